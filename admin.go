@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Handles POST /admin/purge requests, deleting stored receipts that match
+// a filter on purchase date and/or retailer. The credits of purged receipts
+// are taken back from their users.
+func purgeHandler(w http.ResponseWriter, r *http.Request, store Store, clock Clock, logger *slog.Logger) {
+	type PurgeRequest struct {
+		Before   string `json:"before"`   // delete receipts purchased before this date (YYYY-MM-DD)
+		Retailer string `json:"retailer"` // delete receipts from this retailer (case-insensitive)
+	}
+
+	var req PurgeRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		logger.Warn("Failed to decode purge filter", slog.Any("error", err))
+		errorResponse(w, http.StatusBadRequest, invalidFilterMsg, logger)
+		return
+	}
+	if req.Before == "" && req.Retailer == "" {
+		errorResponse(w, http.StatusBadRequest, invalidFilterMsg, logger)
+		return
+	}
+
+	var before time.Time
+	if req.Before != "" {
+		var err error
+		if before, err = time.Parse("2006-01-02", req.Before); err != nil {
+			errorResponse(w, http.StatusBadRequest, invalidFilterMsg, logger)
+			return
+		}
+	}
+
+	var purged []StoredReceipt
+	deleted, err := store.DeleteWhere(func(rec StoredReceipt) bool {
+		if req.Before != "" && !rec.PurchaseDate.Before(before) {
+			return false
+		}
+		if req.Retailer != "" && !strings.EqualFold(rec.Retailer, req.Retailer) {
+			return false
+		}
+		purged = append(purged, rec)
+		return true
+	})
+	if err != nil {
+		logger.Error("Purge failed", slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	now := clock.Now()
+	for _, rec := range purged {
+		if err := adjustCredit(store, rec.Receipt.UserID, rec.ID, 0, now); err != nil {
+			logger.Error("Failed to take back credit of purged receipt", slog.Any("error", err), slog.String("id", rec.ID), slog.String("user_id", rec.Receipt.UserID))
+			errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+			return
+		}
+	}
+
+	logger.Info("Receipts purged", slog.Int("deleted", deleted), slog.String("before", req.Before), slog.String("retailer", req.Retailer))
+
+	type PurgeResponse struct {
+		Deleted int `json:"deleted"`
+	}
+	jsonResponse(w, http.StatusOK, PurgeResponse{Deleted: deleted}, logger)
+}
+
+// Handles POST /admin/migrations requests, starting a background rescore
+// of every stored receipt under the current rules.
+func startMigrationHandler(w http.ResponseWriter, r *http.Request, m *migrator, logger *slog.Logger) {
+	status, started := m.Start()
+	if !started {
+		errorResponse(w, http.StatusConflict, migrationRunningMsg, logger)
+		return
+	}
+	jsonResponse(w, http.StatusAccepted, status, logger)
+}
+
+// Handles GET /admin/migrations requests, reporting the progress of the
+// current or most recent migration.
+func migrationStatusHandler(w http.ResponseWriter, r *http.Request, m *migrator, logger *slog.Logger) {
+	jsonResponse(w, http.StatusOK, m.Status(), logger)
+}
+
+// Handles DELETE /admin/migrations requests, cancelling the running
+// migration after its current batch.
+func cancelMigrationHandler(w http.ResponseWriter, r *http.Request, m *migrator, logger *slog.Logger) {
+	if !m.Cancel() {
+		errorResponse(w, http.StatusConflict, noMigrationMsg, logger)
+		return
+	}
+	logger.Info("Points migration cancellation requested")
+	jsonResponse(w, http.StatusAccepted, m.Status(), logger)
+}
+
+// maxSimulateReceipts bounds the receipts given inline to /admin/simulate.
+const maxSimulateReceipts = 10000
+
+// Handles POST /admin/simulate requests, scoring a set of receipts under the
+// current point rules and under a proposed override, without storing anything.
+// The receipts are given inline or, if none are, sampled from the store.
+func simulateHandler(w http.ResponseWriter, r *http.Request, cfg *Config, store Store, clock Clock, logger *slog.Logger) {
+	type SimulateRequest struct {
+		Points   json.RawMessage   `json:"points"`   // PointsConfig fields to override, e.g. {"OddDayBonus": 10}
+		Receipts []json.RawMessage `json:"receipts"` // receipts to score; when empty, stored receipts are sampled
+		Sample   int               `json:"sample"`   // stored receipts to sample; 0 means all
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+	var req SimulateRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		logger.Warn("Failed to decode simulate request", slog.Any("error", err))
+		bodyErrorResponse(w, cfg, err, logger)
+		return
+	}
+	if req.Sample < 0 {
+		badRequestResponse(w, cfg, "sample must not be negative", logger)
+		return
+	}
+	if len(req.Receipts) > maxSimulateReceipts {
+		badRequestResponse(w, cfg, fmt.Sprintf("at most %d receipts may be given", maxSimulateReceipts), logger)
+		return
+	}
+
+	rules := cfg.pointsFor(contextTenant(r.Context()))
+	proposed, err := overridePoints(rules, req.Points)
+	if err != nil {
+		logger.Warn("Invalid points override", slog.Any("error", err))
+		badRequestResponse(w, cfg, "invalid points override: "+err.Error(), logger)
+		return
+	}
+
+	// Each receipt is parsed once and scored under both configurations
+	var receipts []*ValidatedReceiptData
+	skipped := 0
+	if len(req.Receipts) > 0 {
+		now := clock.Now()
+		for _, raw := range req.Receipts {
+			var receipt Receipt
+			if err := decodeReceipt(bytes.NewReader(raw), cfg.JSONNaming, &receipt); err != nil {
+				skipped++
+				continue
+			}
+			data, err := validateAndParseReceipt(&receipt, cfg.Validation)
+			if err != nil {
+				skipped++
+				continue
+			}
+			data.ProcessedAt = now
+			receipts = append(receipts, data)
+		}
+	} else {
+		recs, err := store.ProcessedBetween(time.Time{}, time.Time{})
+		if err != nil {
+			logger.Error("Failed to list receipts for simulation", slog.Any("error", err))
+			errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+			return
+		}
+		if req.Sample > 0 && req.Sample < len(recs) {
+			rand.Shuffle(len(recs), func(i, j int) { recs[i], recs[j] = recs[j], recs[i] })
+			recs = recs[:req.Sample]
+		}
+		for i := range recs {
+			data, err := storedReceiptData(&recs[i], cfg)
+			if err != nil {
+				skipped++
+				continue
+			}
+			receipts = append(receipts, data)
+		}
+	}
+
+	var current, simulated int64
+	for _, data := range receipts {
+		current += calculatePoints(data, rules)
+		simulated += calculatePoints(data, proposed)
+	}
+
+	logger.Info("Scoring simulation run", slog.Int("receipts", len(receipts)), slog.Int("skipped", skipped), slog.Int64("current_points", current), slog.Int64("proposed_points", simulated))
+
+	type SimulateResponse struct {
+		Receipts       int    `json:"receipts"`
+		Skipped        int    `json:"skipped"`
+		CurrentPoints  int64  `json:"currentPoints"`
+		ProposedPoints int64  `json:"proposedPoints"`
+		Delta          int64  `json:"delta"`
+		CurrentRules   string `json:"currentRuleVersion"`
+		ProposedRules  string `json:"proposedRuleVersion"`
+	}
+	jsonResponse(w, http.StatusOK, SimulateResponse{
+		Receipts:       len(receipts),
+		Skipped:        skipped,
+		CurrentPoints:  current,
+		ProposedPoints: simulated,
+		Delta:          simulated - current,
+		CurrentRules:   ruleVersion(rules),
+		ProposedRules:  ruleVersion(proposed),
+	}, logger)
+}
+
+// overridePoints returns base with the fields present in override (a JSON
+// object of PointsConfig fields) replaced. base itself is not modified.
+func overridePoints(base PointsConfig, override json.RawMessage) (PointsConfig, error) {
+	proposed := base
+	// Decoding into the shared map would change the live configuration
+	proposed.PromotedItems = maps.Clone(base.PromotedItems)
+	if len(override) == 0 {
+		return proposed, nil
+	}
+	// Slices are decoded from scratch: decoding into a copy would both reuse
+	// the live backing array and keep fields of old elements the override
+	// leaves out. Those the override does not set are copied back afterwards.
+	proposed.ItemTiers = nil
+	proposed.DisabledRules = nil
+	proposed.CustomRules = nil
+	proposed.Promotions = nil
+	proposed.RetailerOverrides = nil
+	decoder := json.NewDecoder(bytes.NewReader(override))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&proposed); err != nil {
+		return PointsConfig{}, err
+	}
+	if proposed.ItemTiers == nil {
+		proposed.ItemTiers = slices.Clone(base.ItemTiers)
+	}
+	if proposed.DisabledRules == nil {
+		proposed.DisabledRules = slices.Clone(base.DisabledRules)
+	}
+	if proposed.CustomRules == nil {
+		proposed.CustomRules = slices.Clone(base.CustomRules)
+	}
+	if proposed.Promotions == nil {
+		proposed.Promotions = slices.Clone(base.Promotions)
+	}
+	if proposed.RetailerOverrides == nil {
+		proposed.RetailerOverrides = slices.Clone(base.RetailerOverrides)
+	}
+	proposed.normalize()
+	if err := compileCustomRules(proposed.CustomRules); err != nil {
+		return PointsConfig{}, err
+	}
+	if err := compileBonusScript(&proposed); err != nil {
+		return PointsConfig{}, err
+	}
+	if err := proposed.validate(); err != nil {
+		return PointsConfig{}, err
+	}
+	return proposed, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPurgeHandler(t *testing.T) {
+	seed := []StoredReceipt{
+		{ID: "target-jan", Retailer: "Target", PurchaseDate: time.Date(2022, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{ID: "target-mar", Retailer: "Target", PurchaseDate: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: "walgreens-jan", Retailer: "Walgreens", PurchaseDate: time.Date(2022, 1, 20, 0, 0, 0, 0, time.UTC)},
+		{ID: "walgreens-mar", Retailer: "Walgreens", PurchaseDate: time.Date(2022, 3, 5, 0, 0, 0, 0, time.UTC)},
+	}
+	tests := []struct {
+		name        string
+		token       string
+		filter      string
+		wantStatus  int
+		wantDeleted int
+		wantLeft    []string
+	}{
+		{name: "before a date", token: "secret", filter: `{"before":"2022-02-01"}`, wantStatus: http.StatusOK, wantDeleted: 2, wantLeft: []string{"target-mar", "walgreens-mar"}},
+		{name: "before is exclusive", token: "secret", filter: `{"before":"2022-03-01"}`, wantStatus: http.StatusOK, wantDeleted: 2, wantLeft: []string{"target-mar", "walgreens-mar"}},
+		{name: "by retailer, ignoring case", token: "secret", filter: `{"retailer":"target"}`, wantStatus: http.StatusOK, wantDeleted: 2, wantLeft: []string{"walgreens-jan", "walgreens-mar"}},
+		{name: "date and retailer", token: "secret", filter: `{"before":"2022-02-01","retailer":"Walgreens"}`, wantStatus: http.StatusOK, wantDeleted: 1, wantLeft: []string{"target-jan", "target-mar", "walgreens-mar"}},
+		{name: "nothing matches", token: "secret", filter: `{"retailer":"Costco"}`, wantStatus: http.StatusOK, wantDeleted: 0, wantLeft: []string{"target-jan", "target-mar", "walgreens-jan", "walgreens-mar"}},
+		{name: "empty filter", token: "secret", filter: `{}`, wantStatus: http.StatusBadRequest, wantLeft: []string{"target-jan", "target-mar", "walgreens-jan", "walgreens-mar"}},
+		{name: "malformed date", token: "secret", filter: `{"before":"02/01/2022"}`, wantStatus: http.StatusBadRequest, wantLeft: []string{"target-jan", "target-mar", "walgreens-jan", "walgreens-mar"}},
+		{name: "wrong admin token", token: "guess", filter: `{"retailer":"Target"}`, wantStatus: http.StatusUnauthorized, wantLeft: []string{"target-jan", "target-mar", "walgreens-jan", "walgreens-mar"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore(normalizeRetailer)
+			saveAll(t, store, seed...)
+			srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"ADMIN_TOKEN": "secret"}), Store: store})
+
+			resp, body := send(t, srv, http.MethodPost, "/admin/purge", tt.filter, "Authorization", "Bearer "+tt.token)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var purged struct{ Deleted int }
+				decodeBody(t, body, &purged)
+				if purged.Deleted != tt.wantDeleted {
+					t.Errorf("deleted = %d, want %d", purged.Deleted, tt.wantDeleted)
+				}
+			}
+			if left := storedIDs(t, store, "target-jan", "target-mar", "walgreens-jan", "walgreens-mar"); !slices.Equal(left, tt.wantLeft) {
+				t.Errorf("receipts left = %v, want %v", left, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestSimulateHandler(t *testing.T) {
+	// A fixed sample: the Target example on an odd day (28 points) and on an
+	// even day (22 points, without the odd-day bonus)
+	odd, even := testReceipt(), testReceipt()
+	even.PurchaseDate = "2022-01-02"
+	invalid := testReceipt()
+	invalid.Total = "not a total"
+	sample := func(receipts ...Receipt) string {
+		var raw []string
+		for _, receipt := range receipts {
+			raw = append(raw, mustJSON(t, receipt))
+		}
+		return "[" + strings.Join(raw, ",") + "]"
+	}
+	type simulated struct {
+		Receipts       int
+		Skipped        int
+		CurrentPoints  int64
+		ProposedPoints int64
+		Delta          int64
+	}
+	tests := []struct {
+		name       string
+		token      string
+		body       string
+		wantStatus int
+		want       simulated
+	}{
+		{name: "no change", token: "secret", body: `{"points":{},"receipts":` + sample(odd, even) + `}`, wantStatus: http.StatusOK,
+			want: simulated{Receipts: 2, CurrentPoints: 50, ProposedPoints: 50}},
+		{name: "larger odd-day bonus", token: "secret", body: `{"points":{"OddDayBonus":20},"receipts":` + sample(odd, even) + `}`, wantStatus: http.StatusOK,
+			want: simulated{Receipts: 2, CurrentPoints: 50, ProposedPoints: 64, Delta: 14}},
+		// "Target" has six alphanumeric characters
+		{name: "retailer characters doubled", token: "secret", body: `{"points":{"RetailerCharPoints":2},"receipts":` + sample(odd, even) + `}`, wantStatus: http.StatusOK,
+			want: simulated{Receipts: 2, CurrentPoints: 50, ProposedPoints: 62, Delta: 12}},
+		{name: "invalid receipts skipped", token: "secret", body: `{"points":{"OddDayBonus":0},"receipts":` + sample(odd, invalid) + `}`, wantStatus: http.StatusOK,
+			want: simulated{Receipts: 1, Skipped: 1, CurrentPoints: 28, ProposedPoints: 22, Delta: -6}},
+		{name: "stored receipts", token: "secret", body: `{"points":{"OddDayBonus":20}}`, wantStatus: http.StatusOK,
+			want: simulated{Receipts: 2, CurrentPoints: 50, ProposedPoints: 64, Delta: 14}},
+		{name: "unknown rule", token: "secret", body: `{"points":{"NoSuchBonus":1}}`, wantStatus: http.StatusBadRequest},
+		{name: "wrong admin token", token: "guess", body: `{"points":{}}`, wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"ADMIN_TOKEN": "secret"})})
+			processReceipt(t, srv, odd)
+			id := processReceipt(t, srv, even)
+
+			resp, body := send(t, srv, http.MethodPost, "/admin/simulate", tt.body, "Authorization", "Bearer "+tt.token)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var got simulated
+				decodeBody(t, body, &got)
+				if got != tt.want {
+					t.Errorf("simulation = %+v, want %+v", got, tt.want)
+				}
+			}
+			// Simulating changes neither the rules nor the stored points
+			_, body = send(t, srv, http.MethodGet, "/receipts/"+id+"/points", "")
+			var points struct{ Points int64 }
+			decodeBody(t, body, &points)
+			if points.Points != 22 {
+				t.Errorf("stored points = %d after simulating, want 22", points.Points)
+			}
+			_, body = send(t, srv, http.MethodGet, "/receipts/"+processReceipt(t, srv, odd)+"/points", "")
+			decodeBody(t, body, &points)
+			if points.Points != 28 {
+				t.Errorf("new receipt scored %d after simulating, want 28", points.Points)
+			}
+		})
+	}
+}
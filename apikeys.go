@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// apiKeySecretPrefix starts every managed API key's secret, so leaked keys
+// are easy to recognize in logs and by secret scanners.
+const apiKeySecretPrefix = "rpk_"
+
+// maxAPIKeyNameLength bounds an API key's name.
+const maxAPIKeyNameLength = 100
+
+// apiKeyUsageResolution is how often a key's last-used time is written: a
+// key used more often only has it updated once in this interval, so busy
+// clients do not turn every request into a store write.
+const apiKeyUsageResolution = time.Minute
+
+// errAPIKeyRevoked is returned by rotate for a revoked key.
+var errAPIKeyRevoked = errors.New("API key is revoked")
+
+// hashAPIKey returns the hash under which a managed key's secret is stored.
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeySecret returns a random secret for a managed key.
+func newAPIKeySecret() string {
+	return apiKeySecretPrefix + rand.Text()
+}
+
+// authenticateManagedKey returns the active managed key whose secret is
+// secret, noting that it was used at now.
+func authenticateManagedKey(store Store, secret string, now time.Time, logger *slog.Logger) (APIKey, bool, error) {
+	hash := hashAPIKey(secret)
+	key, found, err := store.APIKeyByHash(hash)
+	if err != nil || !found || !key.RevokedAt.IsZero() {
+		return APIKey{}, false, err
+	}
+	if now.Sub(key.LastUsedAt) >= apiKeyUsageResolution {
+		_, _, err := store.UpdateAPIKey(key.ID, func(k *APIKey) error {
+			// Skip a key rotated since it was read rather than mark the new secret used
+			if k.Hash == hash && now.After(k.LastUsedAt) {
+				k.LastUsedAt = now
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Warn("Failed to record API key use", slog.String("api_key_id", key.ID), slog.Any("error", err))
+		}
+	}
+	return key, true, nil
+}
+
+// APIKeyResponse describes a managed key. Key, the secret, is only set in
+// the responses that create or rotate it.
+type APIKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Tenant     string     `json:"tenant,omitempty"`
+	Key        string     `json:"key,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	RotatedAt  *time.Time `json:"rotatedAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// newAPIKeyResponse describes key, including secret if it is not empty.
+func newAPIKeyResponse(key APIKey, secret string) APIKeyResponse {
+	optional := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	return APIKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Tenant:     key.Tenant,
+		Key:        secret,
+		CreatedAt:  key.CreatedAt,
+		RotatedAt:  optional(key.RotatedAt),
+		LastUsedAt: optional(key.LastUsedAt),
+		RevokedAt:  optional(key.RevokedAt),
+	}
+}
+
+// Handles POST /admin/api-keys requests, creating a managed key. Its secret
+// is returned in the response and cannot be retrieved again.
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request, cfg *Config, store Store, clock Clock, logger *slog.Logger) {
+	type CreateAPIKeyRequest struct {
+		Name   string `json:"name"`   // what the key is for, e.g. the partner team using it
+		Tenant string `json:"tenant"` // the tenant to bind the key to, if any
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+	var req CreateAPIKeyRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		logger.Warn("Failed to decode API key request", slog.Any("error", err))
+		errorResponse(w, http.StatusBadRequest, invalidAPIKeyMsg, logger)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len([]rune(req.Name)) > maxAPIKeyNameLength {
+		errorResponse(w, http.StatusBadRequest, invalidAPIKeyMsg, logger)
+		return
+	}
+	if req.Tenant != "" && !tenantPattern.MatchString(req.Tenant) {
+		errorResponse(w, http.StatusBadRequest, invalidAPIKeyMsg, logger)
+		return
+	}
+
+	secret := newAPIKeySecret()
+	key := APIKey{ID: uuid.NewString(), Name: req.Name, Tenant: req.Tenant, Hash: hashAPIKey(secret), CreatedAt: clock.Now()}
+	if err := store.SaveAPIKey(key); err != nil {
+		logger.Error("Failed to save API key", slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	logger.Info("API key created", slog.String("api_key_id", key.ID), slog.String("name", key.Name), slog.String("tenant", key.Tenant))
+	jsonResponse(w, http.StatusCreated, newAPIKeyResponse(key, secret), logger)
+}
+
+// Handles GET /admin/api-keys requests, listing every managed key without
+// its secret.
+func listAPIKeysHandler(w http.ResponseWriter, store Store, logger *slog.Logger) {
+	keys, err := store.APIKeys()
+	if err != nil {
+		logger.Error("Failed to list API keys", slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	type APIKeysResponse struct {
+		APIKeys []APIKeyResponse `json:"apiKeys"`
+	}
+	resp := APIKeysResponse{APIKeys: make([]APIKeyResponse, len(keys))}
+	for i, key := range keys {
+		resp.APIKeys[i] = newAPIKeyResponse(key, "")
+	}
+	jsonResponse(w, http.StatusOK, resp, logger)
+}
+
+// Handles POST /admin/api-keys/{id}/rotate requests, replacing a key's
+// secret. The old secret stops working at once.
+func rotateAPIKeyHandler(w http.ResponseWriter, r *http.Request, store Store, clock Clock, logger *slog.Logger) {
+	id := r.PathValue("id")
+	secret := newAPIKeySecret()
+	key, found, err := store.UpdateAPIKey(id, func(key *APIKey) error {
+		if !key.RevokedAt.IsZero() {
+			return errAPIKeyRevoked
+		}
+		key.Hash, key.RotatedAt = hashAPIKey(secret), clock.Now()
+		return nil
+	})
+	switch {
+	case errors.Is(err, errAPIKeyRevoked):
+		errorResponse(w, http.StatusConflict, apiKeyRevokedMsg, logger)
+		return
+	case err != nil:
+		logger.Error("Failed to rotate API key", slog.String("api_key_id", id), slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	case !found:
+		errorResponse(w, http.StatusNotFound, apiKeyNotFoundMsg, logger)
+		return
+	}
+	logger.Info("API key rotated", slog.String("api_key_id", id))
+	jsonResponse(w, http.StatusOK, newAPIKeyResponse(key, secret), logger)
+}
+
+// Handles DELETE /admin/api-keys/{id} requests, revoking a key. Revoked keys
+// stay listed, with the time they were revoked; revoking one again changes
+// nothing.
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request, store Store, clock Clock, logger *slog.Logger) {
+	id := r.PathValue("id")
+	key, found, err := store.UpdateAPIKey(id, func(key *APIKey) error {
+		if key.RevokedAt.IsZero() {
+			key.RevokedAt = clock.Now()
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("Failed to revoke API key", slog.String("api_key_id", id), slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	if !found {
+		errorResponse(w, http.StatusNotFound, apiKeyNotFoundMsg, logger)
+		return
+	}
+	logger.Info("API key revoked", slog.String("api_key_id", id))
+	jsonResponse(w, http.StatusOK, newAPIKeyResponse(key, ""), logger)
+}
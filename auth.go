@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// apiKeyHeader carries a client's API key.
+const apiKeyHeader = "X-API-Key"
+
+// apiKeySet holds the SHA-256 digests of the accepted API keys, so a key is
+// found by its digest rather than by comparing it, byte by byte, with each
+// configured key.
+type apiKeySet map[[sha256.Size]byte]struct{}
+
+// newAPIKeySet returns the set of keys.
+func newAPIKeySet(keys []string) apiKeySet {
+	set := make(apiKeySet, len(keys))
+	for _, key := range keys {
+		set[sha256.Sum256([]byte(key))] = struct{}{}
+	}
+	return set
+}
+
+// contains reports whether key is one of the set's keys.
+func (s apiKeySet) contains(key string) bool {
+	_, ok := s[sha256.Sum256([]byte(key))]
+	return ok
+}
+
+// openPath reports whether path is served without credentials: the root and
+// the health probes, so load balancers need no credentials, and the admin
+// and profiling endpoints, which require the admin token instead.
+func openPath(path string) bool {
+	switch path {
+	case "/", "/healthz", "/readyz":
+		return true
+	}
+	return strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/pprof/")
+}
+
+// principal is the caller a request authenticated as.
+type principal struct {
+	Subject   string   // the token's sub; empty for API keys
+	KeyID     string   // the managed API key presented, if any
+	Tenant    string   // the tenant that key is bound to, if any
+	Scopes    []string // scopes granted by a bearer token
+	AllScopes bool     // API keys grant every scope
+}
+
+type principalKey struct{}
+
+// requestPrincipal returns the caller r authenticated as, if any.
+func requestPrincipal(r *http.Request) (principal, bool) {
+	p, ok := r.Context().Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// authMiddleware rejects requests to all but the open paths that present
+// neither an API key in the X-API-Key header, one of keys or an active key
+// managed in store, nor, with a verifier, a valid bearer token, and records
+// the caller for requireScope. Unless required, with no keys and no verifier
+// it returns next unchanged, leaving the API open.
+func authMiddleware(next http.Handler, keys []string, store Store, verifier *jwtVerifier, required bool, clock Clock, logger *slog.Logger) http.Handler {
+	if len(keys) == 0 && verifier == nil && !required {
+		return next
+	}
+	set := newAPIKeySet(keys)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if openPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logger := requestLogger(r, logger)
+		token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		reject := func(reason string) {
+			logger.Warn("Rejected unauthenticated request", slog.String("method", r.Method), slog.String("path", r.URL.Path), slog.String("reason", reason))
+			if verifier != nil {
+				challenge := "Bearer"
+				if bearer {
+					challenge += ` error="invalid_token"`
+				}
+				w.Header().Set("WWW-Authenticate", challenge)
+			}
+			errorResponse(w, http.StatusUnauthorized, unauthorizedMsg, logger)
+		}
+
+		var caller principal
+		switch key := r.Header.Get(apiKeyHeader); {
+		case key != "":
+			if set.contains(key) {
+				caller = principal{AllScopes: true}
+				break
+			}
+			managed, found, err := authenticateManagedKey(store, key, clock.Now(), logger)
+			if err != nil {
+				logger.Error("Failed to look up API key", slog.Any("error", err))
+				errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+				return
+			}
+			if !found {
+				reject("invalid API key")
+				return
+			}
+			caller = principal{KeyID: managed.ID, Tenant: managed.Tenant, AllScopes: true}
+		case bearer && verifier != nil:
+			claims, err := verifier.Verify(r.Context(), token)
+			if err != nil {
+				reject(err.Error())
+				return
+			}
+			caller = principal{Subject: claims.Subject, Scopes: claims.Scopes()}
+		default:
+			reject("no credentials")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, caller)))
+	})
+}
+
+// requireScope rejects requests whose bearer token does not grant scope.
+// API keys grant every scope, and with authentication disabled there is no
+// caller to check.
+func requireScope(next http.Handler, scope string, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if caller, ok := requestPrincipal(r); ok && !caller.AllScopes && !slices.Contains(caller.Scopes, scope) {
+			logger := requestLogger(r, logger)
+			logger.Warn("Rejected request lacking a scope", slog.String("path", r.URL.Path), slog.String("subject", caller.Subject), slog.String("scope", scope))
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+			errorResponse(w, http.StatusForbidden, forbiddenMsg, logger)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bearer token scopes required by the receipt endpoints.
+const (
+	scopeReceiptsRead  = "receipts:read"
+	scopeReceiptsWrite = "receipts:write"
+)
+
+// jwtLeeway tolerates clock skew between the identity provider and this
+// service when checking exp and nbf.
+const jwtLeeway = time.Minute
+
+// jwksFetchTimeout bounds one fetch of the key set.
+const jwksFetchTimeout = 5 * time.Second
+
+// jwksRefreshInterval is how long fetched keys are used before the set is
+// fetched again, and jwksMinRefresh how soon a token signed with an unknown
+// key may cause a refetch, so that rotated keys are picked up without a
+// flood of bad tokens turning into a flood of fetches.
+const (
+	jwksRefreshInterval = time.Hour
+	jwksMinRefresh      = time.Minute
+)
+
+// BearerClaims are the claims of an identity provider's access token that
+// the service checks.
+type BearerClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *int64   `json:"exp"` // Unix seconds
+	NotBefore *int64   `json:"nbf"` // Unix seconds
+	// Scope is the space-separated OAuth 2.0 form; some providers send a
+	// list in scp instead
+	Scope string    `json:"scope"`
+	SCP   scopeList `json:"scp"`
+}
+
+// Scopes returns every scope the token grants.
+func (c BearerClaims) Scopes() []string {
+	return append(strings.Fields(c.Scope), c.SCP...)
+}
+
+// audience is the aud claim, which may be a single string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("aud must be a string or a list of strings")
+	}
+	*a = list
+	return nil
+}
+
+// scopeList is the scp claim, which may be a space-separated string or a
+// list.
+type scopeList []string
+
+func (s *scopeList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = strings.Fields(single)
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("scp must be a string or a list of strings")
+	}
+	*s = list
+	return nil
+}
+
+// jwtVerifier checks bearer tokens against the keys published at a JWKS URL.
+type jwtVerifier struct {
+	jwksURL  string
+	issuer   string // required iss; empty accepts any
+	audience string // required among aud; empty accepts any
+	client   *http.Client
+	clock    Clock
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey // by kid
+	fetchedAt   time.Time
+	attemptedAt time.Time // of the last fetch, successful or not
+}
+
+// newJWTVerifier returns a verifier for tokens signed with the keys at
+// jwksURL. The keys are fetched on first use.
+func newJWTVerifier(jwksURL, issuer, audience string, clock Clock) *jwtVerifier {
+	return &jwtVerifier{
+		jwksURL:  jwksURL,
+		issuer:   issuer,
+		audience: audience,
+		client:   &http.Client{Timeout: jwksFetchTimeout},
+		clock:    clock,
+	}
+}
+
+// Verify checks token's signature, expiry, issuer, and audience, and
+// returns its claims.
+func (v *jwtVerifier) Verify(ctx context.Context, token string) (BearerClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return BearerClaims{}, errors.New("token must have three parts")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return BearerClaims{}, fmt.Errorf("decode header: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return BearerClaims{}, fmt.Errorf("parse header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return BearerClaims{}, fmt.Errorf("decode signature: %w", err)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return BearerClaims{}, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return BearerClaims{}, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return BearerClaims{}, fmt.Errorf("decode payload: %w", err)
+	}
+	var claims BearerClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return BearerClaims{}, fmt.Errorf("parse payload: %w", err)
+	}
+	now := v.clock.Now()
+	switch {
+	case claims.ExpiresAt == nil:
+		return BearerClaims{}, errors.New("token has no exp")
+	case now.After(time.Unix(*claims.ExpiresAt, 0).Add(jwtLeeway)):
+		return BearerClaims{}, errors.New("token has expired")
+	case claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(*claims.NotBefore, 0)):
+		return BearerClaims{}, errors.New("token is not valid yet")
+	case v.issuer != "" && claims.Issuer != v.issuer:
+		return BearerClaims{}, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	case v.audience != "" && !slices.Contains(claims.Audience, v.audience):
+		return BearerClaims{}, errors.New("token is not for this audience")
+	}
+	return claims, nil
+}
+
+// key returns the public key with the given kid, fetching the key set if it
+// is stale or the kid is unknown, but at most once every jwksMinRefresh. A
+// token without a kid is accepted only while the set holds a single key.
+func (v *jwtVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	lookup := func() (crypto.PublicKey, bool) {
+		if kid == "" && len(v.keys) == 1 {
+			for _, key := range v.keys {
+				return key, true
+			}
+		}
+		key, ok := v.keys[kid]
+		return key, ok
+	}
+
+	now := v.clock.Now()
+	key, found := lookup()
+	retried := now.Sub(v.attemptedAt) < jwksMinRefresh
+	switch {
+	case found && (now.Sub(v.fetchedAt) < jwksRefreshInterval || retried):
+		return key, nil
+	case !found && retried:
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	v.attemptedAt = now
+	keys, err := v.fetch(ctx)
+	if err != nil {
+		// Keep using the keys already fetched while the provider is unreachable
+		if found {
+			return key, nil
+		}
+		return nil, fmt.Errorf("fetch signing keys: %w", err)
+	}
+	v.keys, v.fetchedAt = keys, now
+	if key, found = lookup(); !found {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// fetch downloads and parses the key set. Keys of unsupported types, or not
+// meant for signatures, are skipped.
+func (v *jwtVerifier) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", v.jwksURL, resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("parse key set: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch jwk.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("key set has no usable signing keys")
+	}
+	return keys, nil
+}
+
+// verifySignature checks signature over input with key under alg. Only
+// asymmetric algorithms are accepted, and alg must suit the key's type, so
+// a token cannot pick a weaker check than its key was published for.
+func verifySignature(alg string, key crypto.PublicKey, input, signature []byte) error {
+	digest := func(h hash.Hash) []byte {
+		h.Write(input)
+		return h.Sum(nil)
+	}
+	hashes := map[string]func() hash.Hash{"256": sha256.New, "384": sha512.New384, "512": sha512.New}
+	hashIDs := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+
+	family, size := alg[:min(2, len(alg))], alg[min(2, len(alg)):]
+	newHash, ok := hashes[size]
+	if alg == "EdDSA" {
+		family, ok = "EdDSA", true
+	}
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	valid := false
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch family {
+		case "RS":
+			valid = rsa.VerifyPKCS1v15(k, hashIDs[size], digest(newHash()), signature) == nil
+		case "PS":
+			valid = rsa.VerifyPSS(k, hashIDs[size], digest(newHash()), signature, nil) == nil
+		default:
+			return fmt.Errorf("algorithm %q does not match the RSA signing key", alg)
+		}
+	case *ecdsa.PublicKey:
+		byteLen := (k.Curve.Params().BitSize + 7) / 8
+		if family != "ES" || len(signature) != 2*byteLen {
+			return fmt.Errorf("algorithm %q does not match the EC signing key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:byteLen])
+		s := new(big.Int).SetBytes(signature[byteLen:])
+		valid = ecdsa.Verify(k, digest(newHash()), r, s)
+	case ed25519.PublicKey:
+		if family != "EdDSA" {
+			return fmt.Errorf("algorithm %q does not match the Ed25519 signing key", alg)
+		}
+		valid = ed25519.Verify(k, input, signature)
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
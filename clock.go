@@ -0,0 +1,14 @@
+package main
+
+import "time"
+
+// Clock reports the current time. Handlers read time through it so that
+// time-dependent behavior can be exercised deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock backed by the system time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
@@ -0,0 +1,915 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the runtime settings read from the environment at startup.
+type Config struct {
+	VerboseErrors   bool          // include the reason for a rejection in error responses
+	RequestTimeout  time.Duration // per-request processing deadline; 0 disables it
+	AdminToken      string        // bearer token for /admin endpoints; empty disables them
+	APIKeys         []string      // keys accepted in X-API-Key; empty leaves the API open
+	RequireAuth     bool          // require credentials even with no APIKeys or JWT, e.g. for managed keys only
+	RateLimit       float64       // requests per second allowed to each client; 0 disables rate limiting
+	RateLimitBurst  int           // requests a client may make at once before RateLimit applies
+	MultiTenant     bool          // partition receipts by the tenant of each request
+	CORSOrigins     []string      // origins allowed to call the API from a browser; "*" allows any
+	EnablePprof     bool          // expose net/http/pprof under /debug/pprof/ (requires AdminToken)
+	JSONNaming      string        // accepted receipt field naming: "any", "camel", or "snake"
+	PointsTokenSeed []byte        // Ed25519 seed for signing points tokens; nil disables them
+	MaxBodyBytes    int64         // largest accepted request body
+	LenientIDs      bool          // accept any non-blank path id instead of only the generator's format
+	DuplicateWindow time.Duration // treat receipts whose content was accepted this recently as duplicates; 0 disables
+	DuplicatePolicy string        // what happens to a duplicate: "reject", "existing", or "allow"
+	IdempotencyTTL  time.Duration // how long an Idempotency-Key is remembered; 0 ignores the header
+	TraceProtocol   string        // OTLP protocol traces are exported with; empty disables tracing
+
+	DeterministicIDs         bool          // derive receipt ids from their content instead of at random
+	RetailerCanonicalization string        // how retailer names are grouped: "none", "basic", or "aggressive"
+	MigrationBatchSize       int           // receipts rescored between progress reports in a migration
+	PointsExpiryDays         int           // days after the purchase date a receipt's points expire; 0 keeps them forever
+	PointsExpiryInterval     time.Duration // how often expired points are taken off balances
+	JWT                      JWTConfig
+	Sampling                 SamplingConfig
+	Server                   ServerConfig
+	Store                    StoreConfig
+	Log                      LogConfig
+	Validation               ValidationConfig
+
+	RulesFile          string            // YAML point rules file; empty uses the defaults and POINTS_* variables
+	RulesWatchInterval time.Duration     // how often RulesFile is checked for changes; 0 reloads only on SIGHUP
+	ShadowRulesFile    string            // candidate rules scored alongside the live ones but never returned; empty disables
+	RuleSetFiles       map[string]string // rules file of each named rule set, by name
+	TenantRuleSets     map[string]string // named rule set each tenant is scored under, by tenantLabel
+
+	rules  atomic.Pointer[ruleSet]             // the active point rules; read with rulesFor, replaced by reloadRules
+	shadow atomic.Pointer[shadowRuleSet]       // nil unless ShadowRulesFile is set
+	named  atomic.Pointer[map[string]*ruleSet] // the named rule sets, by name; replaced by reloadRules
+}
+
+// setPoints makes p the active point rules, returning the rule set it
+// replaced (nil the first time).
+func (c *Config) setPoints(p PointsConfig, at time.Time) *ruleSet {
+	return c.rules.Swap(&ruleSet{Points: p, Version: ruleVersion(p), LoadedAt: at})
+}
+
+// SamplingConfig controls capture of raw receipt payloads for debugging.
+type SamplingConfig struct {
+	Rate         float64  // fraction of processed receipts captured; 0 disables
+	Output       string   // "stdout", "stderr", or a file path to append to
+	RedactFields []string // JSON keys whose values are masked, at any depth
+}
+
+// JWTConfig holds the settings for accepting bearer tokens issued by an
+// identity provider.
+type JWTConfig struct {
+	JWKSURL  string // where the provider publishes its signing keys; empty disables bearer tokens
+	Issuer   string // required iss claim; empty accepts any issuer
+	Audience string // required aud claim; empty accepts any audience
+}
+
+// ServerConfig holds the HTTP server's connection timeouts.
+type ServerConfig struct {
+	ReadTimeout  time.Duration // time to read a request, including its body
+	WriteTimeout time.Duration // time from the end of the request headers to the end of the response
+	IdleTimeout  time.Duration // how long a keep-alive connection may wait for the next request
+	// ExportWriteTimeout replaces WriteTimeout for the GET /receipts export,
+	// whose response can be far larger than any other; 0 removes the limit.
+	ExportWriteTimeout time.Duration
+	// ShutdownTimeout bounds how long in-flight requests may run after a
+	// shutdown signal before they are cut off.
+	ShutdownTimeout time.Duration
+}
+
+// StoreConfig holds settings for the receipt store.
+type StoreConfig struct {
+	Backend    string   // "memory", "sqlite", "postgres", or "redis"
+	Replicas   []string // backends every write is copied to, reads never served from
+	SQLitePath string   // database file used by the sqlite backend
+
+	PostgresURL             string        // connection string used by the postgres backend
+	PostgresMaxConns        int           // pool size; 0 uses the pgx default
+	PostgresMinConns        int           // connections kept open while idle
+	PostgresMaxConnLifetime time.Duration // connections are recycled after this long; 0 uses the pgx default
+
+	RedisURL   string        // server used by the redis backend
+	ReceiptTTL time.Duration // how long the redis backend keeps a receipt; 0 keeps it forever
+
+	SnapshotPath     string        // file the memory backend is saved to and loaded from; empty disables snapshots
+	SnapshotInterval time.Duration // how often a snapshot is written
+	SnapshotFormat   string        // "json" or "gob"
+
+	WALPath string // append-only log of memory backend changes, replayed at startup; empty disables it
+	WALSync bool   // fsync the log after every write
+
+	Retries      int           // retries of a transiently failing operation; 0 disables retrying
+	RetryDelay   time.Duration // backoff before the first retry, doubled on each subsequent one
+	RetryTimeout time.Duration // overall deadline for an operation including retries
+}
+
+// Supported values for Config.DuplicatePolicy.
+const (
+	duplicateReject   = "reject"   // 409 Conflict
+	duplicateExisting = "existing" // respond with the original receipt instead
+	duplicateAllow    = "allow"    // accept it, with a warning naming the original
+)
+
+// Supported values for StoreConfig.Backend.
+const (
+	storeMemory   = "memory"
+	storeSQLite   = "sqlite"
+	storePostgres = "postgres"
+	storeRedis    = "redis"
+)
+
+// LogConfig selects how and where the service logs.
+type LogConfig struct {
+	Level  slog.Level
+	Format string // "json" or "text"
+	Output string // "stdout", "stderr", or a file path to append to
+}
+
+// Supported values for LogConfig.Format.
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// ValidationConfig holds optional limits applied on top of the API schema.
+type ValidationConfig struct {
+	MaxPriceCents int64 // largest accepted item price; 0 means unbounded
+	MaxTotalCents int64 // largest accepted receipt total; 0 means unbounded
+	MinTotalCents int64 // smallest accepted receipt total; 0 accepts any
+	StrictTotal   bool  // require the total to equal the sum of item prices times quantities
+
+	MaxAveragePriceCents int64 // largest accepted total per purchased item; 0 means unbounded
+
+	MaxRetailerLength int // longest accepted retailer name in characters; 0 means unbounded
+
+	ItemPriceDecimals int  // exact decimal places required in item prices; 0 means 2
+	TotalDecimals     int  // exact decimal places required in the total; 0 means 2
+	LenientAmounts    bool // accept a leading "+" and leading zeros in amounts
+
+	AllowBlankRetailer bool // accept a retailer name made only of whitespace
+	AllowDiscounts     bool // accept negative item prices as discount lines
+	PartialScoring     bool // accept an unusable purchaseTime or customerId with a warning
+	StrictDateTime     bool // require purchaseDate and purchaseTime exactly in their canonical form
+
+	ZeroPriceItems string // items priced 0.00: "allow", "reject", or "exclude" from Rule 4
+
+	EarliestPurchaseDate  time.Time     // oldest accepted purchaseDate; zero accepts any
+	RejectFuturePurchases bool          // reject purchases dated more than MaxFutureSkew after now
+	MaxFutureSkew         time.Duration // allowance for client clocks and time zones ahead of ours
+}
+
+// Supported values for ValidationConfig.ZeroPriceItems.
+const (
+	zeroPriceAllow   = "allow"
+	zeroPriceReject  = "reject"
+	zeroPriceExclude = "exclude"
+)
+
+// formatOnly returns the settings that decide how a receipt is parsed,
+// without the admission limits. Stored receipts are rescored with it, since
+// they were already admitted under the limits in force at the time.
+func (c ValidationConfig) formatOnly() ValidationConfig {
+	return ValidationConfig{
+		ItemPriceDecimals: c.ItemPriceDecimals,
+		TotalDecimals:     c.TotalDecimals,
+		LenientAmounts:    c.LenientAmounts,
+
+		AllowBlankRetailer: true,
+		AllowDiscounts:     c.AllowDiscounts,
+		PartialScoring:     true,
+		StrictDateTime:     c.StrictDateTime,
+		ZeroPriceItems:     c.ZeroPriceItems,
+	}
+}
+
+// PointsConfig holds the tunable parameters of the point rules. The yaml
+// keys are those accepted in RULES_FILE.
+type PointsConfig struct {
+	RetailerCharPoints  int64     `yaml:"retailerCharPoints"`  // Rule 1 points per alphanumeric character in the retailer name
+	RoundDollarBonus    int64     `yaml:"roundDollarBonus"`    // Rule 2 points for a whole-dollar total
+	QuarterBonus        int64     `yaml:"quarterBonus"`        // Rule 3 points for a total that is a multiple of 0.25
+	ItemPairPoints      int64     `yaml:"itemPairPoints"`      // Rule 4 points per two items
+	DescriptionMultiple int       `yaml:"descriptionMultiple"` // Rule 5 trimmed description lengths divisible by this earn points
+	DescriptionRate     float64   `yaml:"descriptionRate"`     // Rule 5 fraction of the item price awarded, rounded up
+	OddDayBonusParity   string    `yaml:"oddDayBonusParity"`   // Rule 6 day parity: "odd", "even", or "off"
+	OddDayBonus         int64     `yaml:"oddDayBonus"`         // Rule 6 points awarded on a matching day
+	AfternoonStart      ClockTime `yaml:"afternoonStart"`      // Rule 7 window start, exclusive
+	AfternoonEnd        ClockTime `yaml:"afternoonEnd"`        // Rule 7 window end, exclusive
+	AfternoonBonus      int64     `yaml:"afternoonBonus"`      // Rule 7 points for a purchase inside the window
+
+	PaperlessBonus  int64 `yaml:"paperlessBonus"`  // points for receipts flagged paperless; 0 disables
+	NoBagBonus      int64 `yaml:"noBagBonus"`      // points for receipts flagged noBag; 0 disables
+	StreakBonus     int64 `yaml:"streakBonus"`     // points when a customer's previous purchase was the day before; 0 disables
+	FirstOfDayBonus int64 `yaml:"firstOfDayBonus"` // points for a retailer's first receipt of each purchase date; 0 disables
+
+	RoundDollarExcludesQuarter bool `yaml:"roundDollarExcludesQuarter"` // skip Rule 3 when Rule 2 already applies
+
+	FreshnessBonus  int64         `yaml:"freshnessBonus"`  // points for receipts submitted within FreshnessWindow of purchase
+	FreshnessWindow time.Duration `yaml:"freshnessWindow"` // 0 disables the freshness bonus
+
+	// PromotedItems maps lowercase description substrings to bonus points
+	// awarded per matching item; see promotedItemBonus for precedence.
+	PromotedItems map[string]int64 `yaml:"promotedItems"`
+
+	ItemTiers           []ItemTier `yaml:"itemTiers"`           // bonuses by purchased item count; empty disables
+	ItemTiersCumulative bool       `yaml:"itemTiersCumulative"` // award every qualifying tier rather than only the highest
+
+	// DisabledRules names rules, as reported in a breakdown, that are not
+	// applied at all and so are left out of breakdowns.
+	DisabledRules []string `yaml:"disabledRules"`
+
+	CustomRules []CustomRule `yaml:"customRules"` // CEL rules applied after the built-in ones
+
+	Promotions []Promotion `yaml:"promotions"` // extra points within date ranges, on top of the rules
+
+	// RetailerOverrides adjust the rules for particular retailers; the first
+	// matching one applies.
+	RetailerOverrides []RetailerOverride `yaml:"retailerOverrides"`
+
+	// BonusScript is Lua source defining bonus(receipt), whose result is
+	// awarded after every other rule; empty disables it.
+	BonusScript string       `yaml:"bonusScript"`
+	script      *bonusScript // compiled BonusScript; set by compileBonusScript
+}
+
+// ItemTier awards Bonus to receipts with at least MinItems purchased items.
+type ItemTier struct {
+	MinItems int   `yaml:"minItems"`
+	Bonus    int64 `yaml:"bonus"`
+}
+
+// Supported values for PointsConfig.OddDayBonusParity.
+const (
+	dayParityOdd  = "odd"
+	dayParityEven = "even"
+	dayParityOff  = "off"
+)
+
+// defaultPointsConfig returns the rules as defined by the challenge.
+func defaultPointsConfig() PointsConfig {
+	return PointsConfig{
+		RetailerCharPoints:  1,
+		RoundDollarBonus:    50,
+		QuarterBonus:        25,
+		ItemPairPoints:      5,
+		DescriptionMultiple: 3,
+		DescriptionRate:     0.2,
+		OddDayBonusParity:   dayParityOdd,
+		OddDayBonus:         6,
+		AfternoonStart:      14 * 60,
+		AfternoonEnd:        16 * 60,
+		AfternoonBonus:      10,
+	}
+}
+
+// loadConfig builds the configuration from environment variables,
+// falling back to the defaults for anything unset.
+func loadConfig() (*Config, error) {
+	cfg := &Config{}
+
+	var err error
+	if err = cfg.Log.Level.UnmarshalText([]byte(envString("LOG_LEVEL", "info"))); err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL must be one of debug, info, warn, error")
+	}
+	cfg.Log.Format = envString("LOG_FORMAT", logFormatJSON)
+	if cfg.Log.Format != logFormatJSON && cfg.Log.Format != logFormatText {
+		return nil, fmt.Errorf("LOG_FORMAT must be one of json, text")
+	}
+	cfg.Log.Output = envString("LOG_OUTPUT", "stdout")
+
+	// Tracing is configured by the standard OpenTelemetry variables and is
+	// on once an OTLP endpoint is given
+	otlpEndpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+	sdkDisabled, err := envBool("OTEL_SDK_DISABLED", false)
+	if err != nil {
+		return nil, err
+	}
+	if otlpEndpoint && !sdkDisabled && envString("OTEL_TRACES_EXPORTER", "otlp") != "none" {
+		cfg.TraceProtocol = envString("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", envString("OTEL_EXPORTER_OTLP_PROTOCOL", otlpHTTP))
+		if cfg.TraceProtocol != otlpHTTP && cfg.TraceProtocol != otlpGRPC {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_PROTOCOL must be one of http/protobuf, grpc")
+		}
+	}
+
+	if cfg.Server.ReadTimeout, err = envDuration("READ_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Server.WriteTimeout, err = envDuration("WRITE_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Server.IdleTimeout, err = envDuration("IDLE_TIMEOUT", 60*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Server.ExportWriteTimeout, err = envDuration("EXPORT_WRITE_TIMEOUT", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.Server.ShutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Server.ShutdownTimeout <= 0 {
+		return nil, fmt.Errorf("SHUTDOWN_TIMEOUT must be positive")
+	}
+
+	cfg.Store.Backend = envString("STORE", storeMemory)
+	switch cfg.Store.Backend {
+	case storeMemory, storeSQLite, storePostgres, storeRedis:
+	default:
+		return nil, fmt.Errorf("STORE must be one of memory, sqlite, postgres, redis")
+	}
+	cfg.Store.Replicas = envList("REPLICA_STORES")
+	for i, replica := range cfg.Store.Replicas {
+		switch replica {
+		case storeMemory, storeSQLite, storePostgres, storeRedis:
+		default:
+			return nil, fmt.Errorf("REPLICA_STORES entries must be memory, sqlite, postgres, or redis")
+		}
+		if replica == cfg.Store.Backend || slices.Contains(cfg.Store.Replicas[:i], replica) {
+			return nil, fmt.Errorf("REPLICA_STORES must not repeat a backend or include STORE")
+		}
+	}
+	cfg.Store.SQLitePath = envString("SQLITE_PATH", "receipts.db")
+	cfg.Store.PostgresURL = os.Getenv("POSTGRES_URL")
+	if (cfg.Store.Backend == storePostgres || slices.Contains(cfg.Store.Replicas, storePostgres)) && cfg.Store.PostgresURL == "" {
+		return nil, fmt.Errorf("POSTGRES_URL is required when STORE or REPLICA_STORES is postgres")
+	}
+	maxConns, err := envInt("POSTGRES_MAX_CONNS", 0)
+	if err != nil {
+		return nil, err
+	}
+	minConns, err := envInt("POSTGRES_MIN_CONNS", 0)
+	if err != nil {
+		return nil, err
+	}
+	if maxConns < 0 || minConns < 0 || (maxConns > 0 && minConns > maxConns) {
+		return nil, fmt.Errorf("POSTGRES_MIN_CONNS and POSTGRES_MAX_CONNS must not be negative, and the minimum must not exceed the maximum")
+	}
+	cfg.Store.PostgresMaxConns, cfg.Store.PostgresMinConns = int(maxConns), int(minConns)
+	if cfg.Store.PostgresMaxConnLifetime, err = envDuration("POSTGRES_MAX_CONN_LIFETIME", 0); err != nil {
+		return nil, err
+	}
+	cfg.Store.RedisURL = envString("REDIS_URL", "redis://localhost:6379/0")
+	if cfg.Store.ReceiptTTL, err = envDuration("RECEIPT_TTL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Store.ReceiptTTL > 0 && cfg.Store.Backend != storeRedis {
+		return nil, fmt.Errorf("RECEIPT_TTL is only supported when STORE is redis")
+	}
+
+	cfg.Store.SnapshotPath = os.Getenv("SNAPSHOT_PATH")
+	if cfg.Store.SnapshotPath != "" && cfg.Store.Backend != storeMemory {
+		return nil, fmt.Errorf("SNAPSHOT_PATH is only supported when STORE is memory")
+	}
+	if cfg.Store.SnapshotInterval, err = envDuration("SNAPSHOT_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.Store.SnapshotInterval <= 0 {
+		return nil, fmt.Errorf("SNAPSHOT_INTERVAL must be positive")
+	}
+	cfg.Store.SnapshotFormat = envString("SNAPSHOT_FORMAT", snapshotJSON)
+	if cfg.Store.SnapshotFormat != snapshotJSON && cfg.Store.SnapshotFormat != snapshotGob {
+		return nil, fmt.Errorf("SNAPSHOT_FORMAT must be json or gob")
+	}
+	cfg.Store.WALPath = os.Getenv("WAL_PATH")
+	if cfg.Store.WALPath != "" && cfg.Store.Backend != storeMemory {
+		return nil, fmt.Errorf("WAL_PATH is only supported when STORE is memory")
+	}
+	if cfg.Store.WALSync, err = envBool("WAL_SYNC", true); err != nil {
+		return nil, err
+	}
+
+	retries, err := envInt("STORE_RETRIES", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Store.Retries = int(retries)
+	if cfg.Store.RetryDelay, err = envDuration("STORE_RETRY_DELAY", 50*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if cfg.Store.RetryTimeout, err = envDuration("STORE_RETRY_TIMEOUT", 2*time.Second); err != nil {
+		return nil, err
+	}
+
+	if cfg.VerboseErrors, err = envBool("VERBOSE_ERRORS", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.EnablePprof, err = envBool("ENABLE_PPROF", false); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("POINTS_TOKEN_KEY"); v != "" {
+		if cfg.PointsTokenSeed, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, fmt.Errorf("POINTS_TOKEN_KEY must be base64")
+		}
+	}
+
+	if cfg.MaxBodyBytes, err = envInt("MAX_BODY_BYTES", 1<<20); err != nil {
+		return nil, err
+	}
+	if cfg.Sampling.Rate, err = envFloat("PAYLOAD_SAMPLE_RATE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Sampling.Rate < 0 || cfg.Sampling.Rate > 1 {
+		return nil, fmt.Errorf("PAYLOAD_SAMPLE_RATE must be between 0 and 1")
+	}
+	cfg.Sampling.Output = envString("PAYLOAD_SAMPLE_OUTPUT", "stderr")
+	cfg.Sampling.RedactFields = envList("PAYLOAD_REDACT_FIELDS")
+
+	if cfg.LenientIDs, err = envBool("LENIENT_IDS", false); err != nil {
+		return nil, err
+	}
+	if cfg.DeterministicIDs, err = envBool("DETERMINISTIC_IDS", false); err != nil {
+		return nil, err
+	}
+	if cfg.DuplicateWindow, err = envDuration("DUPLICATE_WINDOW", 0); err != nil {
+		return nil, err
+	}
+	cfg.DuplicatePolicy = envString("DUPLICATE_POLICY", duplicateReject)
+	switch cfg.DuplicatePolicy {
+	case duplicateReject, duplicateExisting, duplicateAllow:
+	default:
+		return nil, fmt.Errorf("DUPLICATE_POLICY must be one of reject, existing, allow")
+	}
+	if cfg.IdempotencyTTL, err = envDuration("IDEMPOTENCY_TTL", 24*time.Hour); err != nil {
+		return nil, err
+	}
+
+	batchSize, err := envInt("MIGRATION_BATCH_SIZE", 100)
+	if err != nil {
+		return nil, err
+	}
+	if batchSize < 1 {
+		return nil, fmt.Errorf("MIGRATION_BATCH_SIZE must be positive")
+	}
+	cfg.MigrationBatchSize = int(batchSize)
+
+	expiryDays, err := envInt("POINTS_EXPIRY_DAYS", 0)
+	if err != nil {
+		return nil, err
+	}
+	if expiryDays < 0 {
+		return nil, fmt.Errorf("POINTS_EXPIRY_DAYS must not be negative")
+	}
+	cfg.PointsExpiryDays = int(expiryDays)
+	if cfg.PointsExpiryInterval, err = envDuration("POINTS_EXPIRY_INTERVAL", time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.PointsExpiryInterval <= 0 {
+		return nil, fmt.Errorf("POINTS_EXPIRY_INTERVAL must be positive")
+	}
+
+	cfg.RetailerCanonicalization = envString("RETAILER_CANONICALIZATION", canonicalBasic)
+	switch cfg.RetailerCanonicalization {
+	case canonicalNone, canonicalBasic, canonicalAggressive:
+	default:
+		return nil, fmt.Errorf("RETAILER_CANONICALIZATION must be one of none, basic, aggressive")
+	}
+
+	cfg.JSONNaming = envString("JSON_FIELD_NAMING", jsonNamingAny)
+	switch cfg.JSONNaming {
+	case jsonNamingAny, jsonNamingCamel, jsonNamingSnake:
+	default:
+		return nil, fmt.Errorf("JSON_FIELD_NAMING must be one of any, camel, snake")
+	}
+
+	if cfg.RequestTimeout, err = envDuration("REQUEST_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+	cfg.CORSOrigins = envList("CORS_ALLOWED_ORIGINS")
+	cfg.APIKeys = envList("API_KEYS")
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		keys, err := readAPIKeysFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("API_KEYS_FILE: %w", err)
+		}
+		cfg.APIKeys = append(cfg.APIKeys, keys...)
+	}
+	if cfg.RequireAuth, err = envBool("REQUIRE_AUTH", false); err != nil {
+		return nil, err
+	}
+	if cfg.MultiTenant, err = envBool("MULTI_TENANT", false); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimit, err = envFloat("RATE_LIMIT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimit < 0 || math.IsInf(cfg.RateLimit, 0) || math.IsNaN(cfg.RateLimit) {
+		return nil, fmt.Errorf("RATE_LIMIT must be a non-negative number")
+	}
+	burst, err := envInt("RATE_LIMIT_BURST", int64(max(1, math.Ceil(cfg.RateLimit))))
+	if err != nil {
+		return nil, err
+	}
+	if burst < 1 || burst > math.MaxInt32 {
+		return nil, fmt.Errorf("RATE_LIMIT_BURST must be a positive integer")
+	}
+	cfg.RateLimitBurst = int(burst)
+	cfg.JWT = JWTConfig{
+		JWKSURL:  os.Getenv("JWT_JWKS_URL"),
+		Issuer:   os.Getenv("JWT_ISSUER"),
+		Audience: os.Getenv("JWT_AUDIENCE"),
+	}
+	if cfg.JWT.JWKSURL == "" && (cfg.JWT.Issuer != "" || cfg.JWT.Audience != "") {
+		return nil, fmt.Errorf("JWT_ISSUER and JWT_AUDIENCE require JWT_JWKS_URL")
+	}
+
+	if cfg.Validation.MaxPriceCents, err = envCents("MAX_ITEM_PRICE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Validation.MaxTotalCents, err = envCents("MAX_TOTAL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Validation.MaxAveragePriceCents, err = envCents("MAX_AVERAGE_ITEM_PRICE", 0); err != nil {
+		return nil, err
+	}
+	maxRetailer, err := envInt("MAX_RETAILER_LENGTH", 0)
+	if err != nil {
+		return nil, err
+	}
+	if maxRetailer < 0 {
+		return nil, fmt.Errorf("MAX_RETAILER_LENGTH must not be negative")
+	}
+	cfg.Validation.MaxRetailerLength = int(maxRetailer)
+
+	if cfg.Validation.MinTotalCents, err = envCents("MIN_TOTAL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Validation.ItemPriceDecimals, err = envDecimals("ITEM_PRICE_DECIMALS"); err != nil {
+		return nil, err
+	}
+	if cfg.Validation.TotalDecimals, err = envDecimals("TOTAL_DECIMALS"); err != nil {
+		return nil, err
+	}
+	if cfg.Validation.LenientAmounts, err = envBool("LENIENT_AMOUNTS", false); err != nil {
+		return nil, err
+	}
+	if cfg.Validation.AllowBlankRetailer, err = envBool("ALLOW_BLANK_RETAILER", false); err != nil {
+		return nil, err
+	}
+	if cfg.Validation.AllowDiscounts, err = envBool("ALLOW_DISCOUNTS", false); err != nil {
+		return nil, err
+	}
+	if cfg.Validation.StrictDateTime, err = envBool("STRICT_DATETIME", false); err != nil {
+		return nil, err
+	}
+	if cfg.Validation.PartialScoring, err = envBool("PARTIAL_SCORING", false); err != nil {
+		return nil, err
+	}
+	if cfg.Validation.StrictTotal, err = envBool("STRICT_TOTAL", false); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("EARLIEST_PURCHASE_DATE"); v != "" {
+		if cfg.Validation.EarliestPurchaseDate, err = time.Parse("2006-01-02", v); err != nil {
+			return nil, fmt.Errorf("EARLIEST_PURCHASE_DATE must be a date (YYYY-MM-DD)")
+		}
+	}
+	if os.Getenv("MAX_FUTURE_SKEW") != "" {
+		cfg.Validation.RejectFuturePurchases = true
+		if cfg.Validation.MaxFutureSkew, err = envDuration("MAX_FUTURE_SKEW", 0); err != nil {
+			return nil, err
+		}
+	}
+	cfg.Validation.ZeroPriceItems = envString("ZERO_PRICE_ITEMS", zeroPriceAllow)
+	switch cfg.Validation.ZeroPriceItems {
+	case zeroPriceAllow, zeroPriceReject, zeroPriceExclude:
+	default:
+		return nil, fmt.Errorf("ZERO_PRICE_ITEMS must be one of allow, reject, exclude")
+	}
+
+	cfg.RulesFile = os.Getenv("RULES_FILE")
+	cfg.ShadowRulesFile = os.Getenv("SHADOW_RULES_FILE")
+	if cfg.RulesWatchInterval, err = envDuration("RULES_WATCH_INTERVAL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.RuleSetFiles, err = envPairs("RULE_SETS", "name:path"); err != nil {
+		return nil, err
+	}
+	if cfg.TenantRuleSets, err = envPairs("TENANT_RULE_SETS", "tenant:name"); err != nil {
+		return nil, err
+	}
+	if len(cfg.TenantRuleSets) > 0 && !cfg.MultiTenant {
+		return nil, fmt.Errorf("TENANT_RULE_SETS requires MULTI_TENANT")
+	}
+	for tenant, name := range cfg.TenantRuleSets {
+		if tenant != defaultTenantLabel && !tenantPattern.MatchString(tenant) {
+			return nil, fmt.Errorf("TENANT_RULE_SETS: %q is not a valid tenant id", tenant)
+		}
+		if _, ok := cfg.RuleSetFiles[name]; !ok {
+			return nil, fmt.Errorf("TENANT_RULE_SETS: rule set %q of tenant %q is not in RULE_SETS", name, tenant)
+		}
+	}
+	if cfg.RulesWatchInterval > 0 && cfg.RulesFile == "" && cfg.ShadowRulesFile == "" && len(cfg.RuleSetFiles) == 0 {
+		return nil, fmt.Errorf("RULES_WATCH_INTERVAL requires RULES_FILE, SHADOW_RULES_FILE, or RULE_SETS")
+	}
+	points, err := loadPointsConfig(cfg.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.setPoints(points, time.Now())
+	sets, err := loadRuleSets(cfg.RuleSetFiles, points)
+	if err != nil {
+		return nil, err
+	}
+	cfg.setRuleSets(sets, time.Now())
+	if cfg.ShadowRulesFile != "" {
+		shadow, err := loadShadowRules(cfg.ShadowRulesFile, points)
+		if err != nil {
+			return nil, err
+		}
+		cfg.setShadow(shadow, time.Now())
+	}
+
+	return cfg, nil
+}
+
+// loadPointsConfig builds the point rules: the defaults, then the rules file
+// at path if one is given, then the POINTS_* variables. It runs at startup
+// and again whenever the rules are reloaded.
+func loadPointsConfig(path string) (PointsConfig, error) {
+	points := defaultPointsConfig()
+
+	var err error
+	if path != "" {
+		if points, err = loadRulesFile(path, points); err != nil {
+			return PointsConfig{}, fmt.Errorf("RULES_FILE: %w", err)
+		}
+	}
+
+	points.OddDayBonusParity = envString("POINTS_DAY_PARITY", points.OddDayBonusParity)
+	switch points.OddDayBonusParity {
+	case dayParityOdd, dayParityEven, dayParityOff:
+	default:
+		return PointsConfig{}, fmt.Errorf("POINTS_DAY_PARITY must be one of odd, even, off")
+	}
+
+	if points.OddDayBonus, err = envInt("POINTS_DAY_BONUS", points.OddDayBonus); err != nil {
+		return PointsConfig{}, err
+	}
+	if points.PaperlessBonus, err = envInt("POINTS_PAPERLESS_BONUS", points.PaperlessBonus); err != nil {
+		return PointsConfig{}, err
+	}
+	if points.NoBagBonus, err = envInt("POINTS_NO_BAG_BONUS", points.NoBagBonus); err != nil {
+		return PointsConfig{}, err
+	}
+	if points.StreakBonus, err = envInt("POINTS_STREAK_BONUS", points.StreakBonus); err != nil {
+		return PointsConfig{}, err
+	}
+	if points.FirstOfDayBonus, err = envInt("POINTS_FIRST_OF_DAY_BONUS", points.FirstOfDayBonus); err != nil {
+		return PointsConfig{}, err
+	}
+	if points.RoundDollarExcludesQuarter, err = envBool("POINTS_ROUND_EXCLUDES_QUARTER", points.RoundDollarExcludesQuarter); err != nil {
+		return PointsConfig{}, err
+	}
+	promoted, err := envPromotions("POINTS_PROMOTED_ITEMS")
+	if err != nil {
+		return PointsConfig{}, err
+	}
+	if promoted != nil {
+		points.PromotedItems = promoted
+	}
+	tiers, err := envItemTiers("POINTS_ITEM_TIERS")
+	if err != nil {
+		return PointsConfig{}, err
+	}
+	if tiers != nil {
+		points.ItemTiers = tiers
+	}
+	if points.ItemTiersCumulative, err = envBool("POINTS_ITEM_TIERS_CUMULATIVE", points.ItemTiersCumulative); err != nil {
+		return PointsConfig{}, err
+	}
+	if path := os.Getenv("POINTS_BONUS_SCRIPT"); path != "" {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return PointsConfig{}, fmt.Errorf("POINTS_BONUS_SCRIPT: %w", err)
+		}
+		points.BonusScript = string(source)
+		if err := compileBonusScript(&points); err != nil {
+			return PointsConfig{}, fmt.Errorf("POINTS_BONUS_SCRIPT %s: %w", path, err)
+		}
+	}
+	if disabled := envList("POINTS_DISABLED_RULES"); disabled != nil {
+		for _, name := range disabled {
+			if !points.hasRule(name) {
+				return PointsConfig{}, fmt.Errorf("POINTS_DISABLED_RULES: unknown rule %q", name)
+			}
+		}
+		points.DisabledRules = disabled
+	}
+	if points.FreshnessBonus, err = envInt("POINTS_FRESHNESS_BONUS", points.FreshnessBonus); err != nil {
+		return PointsConfig{}, err
+	}
+	if points.FreshnessWindow, err = envDuration("POINTS_FRESHNESS_WINDOW", points.FreshnessWindow); err != nil {
+		return PointsConfig{}, err
+	}
+
+	return points, nil
+}
+
+// readAPIKeysFile reads one API key per line, skipping blank lines and
+// lines starting with "#".
+func readAPIKeysFile(path string) ([]string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s contains no keys", path)
+	}
+	return keys, nil
+}
+
+// envString returns the value of the named variable or def when unset.
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList splits the named comma-separated variable, dropping empty entries.
+func envList(name string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// envPromotions parses the named variable as a comma-separated list of
+// substring:points pairs, e.g. "cola:5,diet cola:10". It returns nil when unset.
+func envPromotions(name string) (map[string]int64, error) {
+	list := envList(name)
+	if len(list) == 0 {
+		return nil, nil
+	}
+	promotions := make(map[string]int64, len(list))
+	for _, entry := range list {
+		i := strings.LastIndex(entry, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("%s: %q is not substring:points", name, entry)
+		}
+		substring := strings.ToLower(strings.TrimSpace(entry[:i]))
+		points, err := strconv.ParseInt(strings.TrimSpace(entry[i+1:]), 10, 64)
+		if substring == "" || err != nil {
+			return nil, fmt.Errorf("%s: %q is not substring:points", name, entry)
+		}
+		promotions[substring] = points
+	}
+	return promotions, nil
+}
+
+// envItemTiers parses the named variable as comma-separated minItems:points
+// pairs, e.g. "5:10,10:25", returning the tiers ordered by item count.
+func envItemTiers(name string) ([]ItemTier, error) {
+	list := envList(name)
+	if len(list) == 0 {
+		return nil, nil
+	}
+	tiers := make([]ItemTier, 0, len(list))
+	for _, entry := range list {
+		count, points, ok := strings.Cut(entry, ":")
+		minItems, err := strconv.Atoi(strings.TrimSpace(count))
+		if !ok || err != nil || minItems < 1 {
+			return nil, fmt.Errorf("%s: %q is not minItems:points", name, entry)
+		}
+		bonus, err := strconv.ParseInt(strings.TrimSpace(points), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not minItems:points", name, entry)
+		}
+		tiers = append(tiers, ItemTier{MinItems: minItems, Bonus: bonus})
+	}
+	slices.SortFunc(tiers, func(a, b ItemTier) int { return a.MinItems - b.MinItems })
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i].MinItems == tiers[i-1].MinItems {
+			return nil, fmt.Errorf("%s: more than one tier for %d items", name, tiers[i].MinItems)
+		}
+	}
+	return tiers, nil
+}
+
+// envPairs parses the named variable as comma-separated key:value pairs, e.g.
+// "acme:premium,globex:basic", described by form in errors. It returns nil
+// when unset.
+func envPairs(name, form string) (map[string]string, error) {
+	list := envList(name)
+	if len(list) == 0 {
+		return nil, nil
+	}
+	pairs := make(map[string]string, len(list))
+	for _, entry := range list {
+		key, value, ok := strings.Cut(entry, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("%s: %q is not %s", name, entry, form)
+		}
+		if _, dup := pairs[key]; dup {
+			return nil, fmt.Errorf("%s: %q is given more than once", name, key)
+		}
+		pairs[key] = value
+	}
+	return pairs, nil
+}
+
+// envInt parses the named variable as an integer, or returns def when unset.
+func envInt(name string, def int64) (int64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer", name)
+	}
+	return n, nil
+}
+
+// envFloat parses the named variable as a float, or returns def when unset.
+func envFloat(name string, def float64) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number", name)
+	}
+	return f, nil
+}
+
+// envBool parses the named variable as a boolean, or returns def when unset.
+func envBool(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean", name)
+	}
+	return b, nil
+}
+
+// envDuration parses the named variable as a duration (e.g. "2s"), or returns def when unset.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative duration", name)
+	}
+	return d, nil
+}
+
+// envDecimals parses the named variable as a number of decimal places
+// between 1 and maxAmountDecimals, or returns 2 when unset.
+func envDecimals(name string) (int, error) {
+	n, err := envInt(name, 2)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 || n > maxAmountDecimals {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, maxAmountDecimals)
+	}
+	return int(n), nil
+}
+
+// envCents parses the named variable as an N.NN amount in cents, or returns def when unset.
+func envCents(name string, def int64) (int64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	if !priceTotalRegex.MatchString(v) {
+		return 0, fmt.Errorf("%s must be an amount in N.NN format", name)
+	}
+	c, err := parseCents(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return c, nil
+}
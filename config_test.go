@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReplicaStoresConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "sqlite", env: map[string]string{"REPLICA_STORES": "sqlite"}, want: []string{storeSQLite}},
+		{name: "two replicas", env: map[string]string{"STORE": storeSQLite, "REPLICA_STORES": "memory, redis"}, want: []string{storeMemory, storeRedis}},
+		{name: "the primary", env: map[string]string{"REPLICA_STORES": "memory"}, wantErr: true},
+		{name: "repeated", env: map[string]string{"REPLICA_STORES": "sqlite,sqlite"}, wantErr: true},
+		{name: "unknown backend", env: map[string]string{"REPLICA_STORES": "mysql"}, wantErr: true},
+		{name: "postgres without a URL", env: map[string]string{"REPLICA_STORES": "postgres"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			cfg, err := loadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadConfig accepted %v", tt.env)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if !slices.Equal(cfg.Store.Replicas, tt.want) {
+				t.Errorf("Replicas = %q, want %q", cfg.Store.Replicas, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenReplicas(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"REPLICA_STORES": "sqlite", "SQLITE_PATH": filepath.Join(t.TempDir(), "replica.db")})
+	replicas, err := openReplicas(cfg, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("openReplicas: %v", err)
+	}
+	defer closeStore(replicas[0])
+	if len(replicas) != 1 {
+		t.Fatalf("opened %d replicas, want 1", len(replicas))
+	}
+	if _, ok := replicas[0].(*sqliteStore); !ok {
+		t.Errorf("replica is %T, want *sqliteStore", replicas[0])
+	}
+}
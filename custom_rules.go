@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+)
+
+// CustomRule is an operator-defined rule: a CEL expression over the receipt
+// that evaluates to the points it awards, e.g. `total > 100.0 ? 20 : 0`.
+type CustomRule struct {
+	Name       string `yaml:"name"`
+	Expression string `yaml:"expression"`
+
+	program cel.Program // set by compileCustomRules
+}
+
+// customRuleCostLimit bounds the work one evaluation may do, so a costly
+// expression over a large receipt cannot stall scoring.
+const customRuleCostLimit = 100000
+
+// celEnv declares the variables custom rule expressions can use.
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("retailer", cel.StringType),
+		cel.Variable("total", cel.DoubleType),
+		cel.Variable("itemCount", cel.IntType), // counted as for Rule 4
+		// Each item is {"description": string, "price": double}
+		cel.Variable("items", cel.ListType(cel.MapType(cel.StringType, cel.DynType))),
+		cel.Variable("purchaseDate", cel.TimestampType),
+		cel.Variable("purchaseTime", cel.StringType), // "HH:MM", or "" when unusable
+		cel.Variable("customerId", cel.StringType),
+		cel.Variable("paperless", cel.BoolType),
+		cel.Variable("noBag", cel.BoolType),
+		cel.Variable("consecutiveDay", cel.BoolType),
+		cel.Variable("firstOfDay", cel.BoolType),
+		ext.Strings(), // lowerAscii, split, and the like
+	)
+})
+
+// compileCustomRules checks rules' names and compiles their expressions in
+// place, so that errors are reported when the rules are loaded rather than
+// while scoring.
+func compileCustomRules(rules []CustomRule) error {
+	env, err := celEnv()
+	if err != nil {
+		return err
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			return fmt.Errorf("customRules: every rule needs a name")
+		}
+		if isBuiltinRule(rule.Name) || rule.Name == ruleBonusScript || slices.ContainsFunc(rules[:i], func(r CustomRule) bool { return r.Name == rule.Name }) {
+			return fmt.Errorf("customRules: more than one rule is named %q", rule.Name)
+		}
+		ast, issues := env.Compile(rule.Expression)
+		if issues.Err() != nil {
+			return fmt.Errorf("customRules %q: %w", rule.Name, issues.Err())
+		}
+		if t := ast.OutputType(); !t.IsExactType(cel.IntType) && !t.IsExactType(cel.DynType) {
+			return fmt.Errorf("customRules %q: expression must evaluate to an int, not %s", rule.Name, t)
+		}
+		if rule.program, err = env.Program(ast, cel.CostLimit(customRuleCostLimit)); err != nil {
+			return fmt.Errorf("customRules %q: %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// celRule applies a compiled CustomRule.
+type celRule struct {
+	name    string
+	program cel.Program
+}
+
+func (r celRule) Name() string { return r.name }
+
+// Apply evaluates the expression. An expression that fails at run time (a
+// missing map key, exceeding the cost limit, a non-int result) awards nothing.
+func (r celRule) Apply(data *ValidatedReceiptData) int64 {
+	if r.program == nil {
+		return 0
+	}
+	items := make([]map[string]any, 0, len(data.Items))
+	for _, item := range data.Items {
+		items = append(items, map[string]any{"description": item.ShortDescription, "price": item.Price})
+	}
+	purchaseTime := ""
+	if !data.NoPurchaseTime {
+		purchaseTime = data.PurchaseTime.Format("15:04")
+	}
+	out, _, err := r.program.Eval(map[string]any{
+		"retailer":       data.Retailer,
+		"total":          data.Total,
+		"itemCount":      data.OriginalItems,
+		"items":          items,
+		"purchaseDate":   data.PurchaseDate,
+		"purchaseTime":   purchaseTime,
+		"customerId":     data.CustomerID,
+		"paperless":      data.Paperless,
+		"noBag":          data.NoBag,
+		"consecutiveDay": data.ConsecutiveDay,
+		"firstOfDay":     data.FirstOfDay,
+	})
+	if err != nil {
+		return 0
+	}
+	points, ok := out.Value().(int64)
+	if !ok {
+		return 0
+	}
+	return points
+}
@@ -0,0 +1,16 @@
+-- Example bonus script for POINTS_BONUS_SCRIPT (or bonusScript in a rules
+-- file). bonus is called once per receipt and returns the points to add.
+function bonus(receipt)
+  local points = 0
+  -- 1 point per item priced over 10.00
+  for _, item in ipairs(receipt.items) do
+    if item.price > 10 then
+      points = points + 1
+    end
+  end
+  -- Double it for receipts with no bag
+  if receipt.noBag then
+    points = points * 2
+  end
+  return points
+end
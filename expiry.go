@@ -0,0 +1,201 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// unspentCredit is what is left of a ledger credit.
+type unspentCredit struct {
+	Credit    LedgerEntry
+	Remaining int64 // points neither redeemed nor expired
+}
+
+// creditExpiry returns when the points of a receipt purchased on
+// purchaseDate expire under cfg, or zero if they never do.
+func creditExpiry(cfg *Config, purchaseDate time.Time) time.Time {
+	if cfg.PointsExpiryDays == 0 {
+		return time.Time{}
+	}
+	return purchaseDate.AddDate(0, 0, cfg.PointsExpiryDays)
+}
+
+// expiryEntryID returns the id of the ledger entry expiring the credit with
+// the given id, so each credit can expire only once.
+func expiryEntryID(creditID string) string {
+	return "expiry-" + creditID
+}
+
+// expiredCreditKey returns the id, as stored, of the credit an expiry entry
+// as stored expires. The entry references the credit by its id within its
+// tenant, so the credit's tenant is the entry's.
+func expiredCreditKey(entry LedgerEntry) string {
+	if tenant, _ := splitTenant(entry.ID); tenant != "" {
+		return tenant + tenantSeparator + entry.Reference
+	}
+	return entry.Reference
+}
+
+// unspentCredits returns the expiring credits in entries that still have
+// points left, soonest to expire first. It replays the ledger in the order
+// its entries were added, so each redemption takes from the credits the
+// user held when it was made: those that expire soonest first, and those
+// that never expire last, so the user loses as few points as possible to
+// expiry. What a redemption took stays taken; a credit added later, even one
+// that expires sooner, does not take its place. A debit no credit covered,
+// such as a removed receipt's points already redeemed, is taken from the
+// credits that follow it.
+func unspentCredits(entries []LedgerEntry) []unspentCredit {
+	var credits []*unspentCredit // soonest to expire first
+	byID := make(map[string]*unspentCredit)
+	expired := make(map[string]bool)
+	var owed int64
+	debit := func(points int64) {
+		for _, c := range credits {
+			spent := min(points, c.Remaining)
+			c.Remaining -= spent
+			points -= spent
+		}
+		owed += points
+	}
+	repay := func(c *unspentCredit) {
+		paid := min(owed, c.Remaining)
+		c.Remaining -= paid
+		owed -= paid
+	}
+	for _, entry := range entries {
+		switch entry.Kind {
+		case ledgerReceipt:
+			c := &unspentCredit{Credit: entry, Remaining: max(entry.Points, 0)}
+			i := slices.IndexFunc(credits, func(other *unspentCredit) bool { return expiresSooner(entry, other.Credit) })
+			if i < 0 {
+				i = len(credits)
+			}
+			credits = slices.Insert(credits, i, c)
+			byID[entry.ID] = c
+			repay(c)
+		case ledgerAdjustment:
+			c := byID[entry.Reference]
+			switch {
+			case c == nil:
+			case entry.Points > 0:
+				c.Remaining += entry.Points
+				repay(c)
+			default:
+				taken := min(-entry.Points, c.Remaining)
+				c.Remaining -= taken
+				debit(-entry.Points - taken)
+			}
+		case ledgerRedemption:
+			debit(-entry.Points)
+		case ledgerExpiry:
+			if c := byID[entry.Reference]; c != nil {
+				c.Remaining = max(c.Remaining+entry.Points, 0)
+				expired[entry.Reference] = true
+			}
+		}
+	}
+
+	var unspent []unspentCredit
+	for _, c := range credits {
+		if !c.Credit.ExpiresAt.IsZero() && !expired[c.Credit.ID] && c.Remaining > 0 {
+			unspent = append(unspent, *c)
+		}
+	}
+	return unspent
+}
+
+// expiresSooner reports whether credit a expires before credit b, taking a
+// credit that never expires to expire last.
+func expiresSooner(a, b LedgerEntry) bool {
+	return !a.ExpiresAt.IsZero() && (b.ExpiresAt.IsZero() || a.ExpiresAt.Before(b.ExpiresAt))
+}
+
+// expirePoints takes the points of the user's credits that expired by now,
+// and are not yet redeemed, off their balance, returning how many it took.
+// Each credit is expired by an entry of its own, whose id is derived from
+// the credit's, so running it again or concurrently expires nothing twice.
+func expirePoints(store Store, userID string, now time.Time) (int64, error) {
+	entries, err := store.Ledger(userID)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, c := range unspentCredits(entries) {
+		if c.Credit.ExpiresAt.After(now) {
+			break
+		}
+		// With the balance checked, a redemption racing this one can at
+		// worst leave the credit to be expired on the next pass
+		_, added, err := store.AddLedgerEntry(LedgerEntry{
+			ID:        expiryEntryID(c.Credit.ID),
+			UserID:    userID,
+			Kind:      ledgerExpiry,
+			Points:    -c.Remaining,
+			Reference: c.Credit.ID,
+			CreatedAt: now,
+		}, true)
+		if err != nil {
+			return total, fmt.Errorf("expiring credit %s: %w", c.Credit.ID, err)
+		}
+		if added {
+			total += c.Remaining
+		}
+	}
+	return total, nil
+}
+
+// expireDuePoints expires the points of every user with a credit that
+// expired by before and was not yet expired. With multi-tenancy each user's
+// ledger is read through their tenant's store, as requests read it. Users
+// that fail are logged and skipped, and the first error is returned.
+func expireDuePoints(store Store, cfg *Config, before time.Time, logger *slog.Logger) error {
+	users, err := store.ExpiringLedgerUsers(before)
+	if err != nil {
+		return fmt.Errorf("listing users with expiring points: %w", err)
+	}
+	retailerKey := retailerCanonicalizer(cfg.RetailerCanonicalization)
+	var firstErr error
+	var expired int64
+	for _, key := range users {
+		view, userID := store, key
+		if cfg.MultiTenant {
+			tenant, local := splitTenant(key)
+			view, userID = newTenantStore(store, tenant, retailerKey), local
+		}
+		points, err := expirePoints(view, userID, before)
+		expired += points
+		if err != nil {
+			logger.Error("Failed to expire points", slog.String("user_id", key), slog.Any("error", err))
+			firstErr = cmp.Or(firstErr, err)
+		}
+	}
+	if expired > 0 {
+		logger.Info("Expired points", slog.Int("users", len(users)), slog.Int64("points", expired))
+	}
+	return firstErr
+}
+
+// runPointsExpiry expires points as their credits reach their expiry,
+// checking every cfg.PointsExpiryInterval until ctx is done. Each pass
+// covers every credit that has expired and has no expiry entry, however
+// long ago it expired, so a credit an earlier pass failed to expire, or
+// lost a race over, is expired by a later one.
+func runPointsExpiry(ctx context.Context, store Store, cfg *Config, clock Clock, logger *slog.Logger) {
+	ticker := time.NewTicker(cfg.PointsExpiryInterval)
+	defer ticker.Stop()
+	for {
+		if err := expireDuePoints(store, cfg, clock.Now(), logger); err != nil {
+			logger.Error("Points expiry pass failed; retrying at the next interval", slog.Any("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestUnspentCredits(t *testing.T) {
+	nov := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+	dec := time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+	credit := func(id string, points int64, expiresAt time.Time) LedgerEntry {
+		return LedgerEntry{ID: id, Kind: ledgerReceipt, Points: points, ExpiresAt: expiresAt}
+	}
+	redeem := func(points int64) LedgerEntry { return LedgerEntry{Kind: ledgerRedemption, Points: -points} }
+	adjust := func(id string, points int64) LedgerEntry {
+		return LedgerEntry{Kind: ledgerAdjustment, Points: points, Reference: id}
+	}
+	type left struct {
+		ID        string
+		Remaining int64
+	}
+	tests := []struct {
+		name    string
+		entries []LedgerEntry
+		want    []left
+	}{
+		{
+			name:    "soonest to expire redeemed first",
+			entries: []LedgerEntry{credit("dec", 100, dec), credit("nov", 100, nov), redeem(50)},
+			want:    []left{{"nov", 50}, {"dec", 100}},
+		},
+		{
+			name:    "later credit leaves an earlier redemption where it was",
+			entries: []LedgerEntry{credit("dec", 100, dec), redeem(50), credit("nov", 100, nov)},
+			want:    []left{{"nov", 100}, {"dec", 50}},
+		},
+		{
+			name:    "never expiring redeemed last and not listed",
+			entries: []LedgerEntry{credit("never", 50, time.Time{}), credit("dec", 100, dec), redeem(60)},
+			want:    []left{{"dec", 40}},
+		},
+		{
+			name:    "expired credit no longer listed",
+			entries: []LedgerEntry{credit("nov", 100, nov), credit("dec", 100, dec), redeem(30), {Kind: ledgerExpiry, Points: -70, Reference: "nov"}},
+			want:    []left{{"dec", 100}},
+		},
+		{
+			name:    "redemption after an expiry takes from what is left",
+			entries: []LedgerEntry{credit("nov", 100, nov), credit("dec", 100, dec), {Kind: ledgerExpiry, Points: -100, Reference: "nov"}, redeem(30)},
+			want:    []left{{"dec", 70}},
+		},
+		{
+			name:    "rescored credit",
+			entries: []LedgerEntry{credit("dec", 100, dec), redeem(30), adjust("dec", 20)},
+			want:    []left{{"dec", 90}},
+		},
+		{
+			name:    "removed credit's redeemed points taken from the next",
+			entries: []LedgerEntry{credit("nov", 100, nov), credit("dec", 100, dec), redeem(80), adjust("nov", -100)},
+			want:    []left{{"dec", 20}},
+		},
+		{
+			name:    "points owed taken from a later credit",
+			entries: []LedgerEntry{credit("nov", 100, nov), redeem(100), adjust("nov", -100), credit("dec", 150, dec)},
+			want:    []left{{"dec", 50}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []left
+			for _, c := range unspentCredits(tt.entries) {
+				got = append(got, left{c.Credit.ID, c.Remaining})
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("unspentCredits = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiringLedgerUsers(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		tenant    string
+		expiresAt time.Time
+		expire    bool // whether the credit's points were expired
+		want      []string
+	}{
+		{name: "expired", expiresAt: now.Add(-time.Hour), want: []string{"alice"}},
+		{name: "expired long ago", expiresAt: now.AddDate(-3, 0, 0), want: []string{"alice"}},
+		{name: "expiring at now", expiresAt: now, want: []string{"alice"}},
+		{name: "not yet expired", expiresAt: now.Add(time.Hour)},
+		{name: "never expires"},
+		{name: "already expired", expiresAt: now.Add(-time.Hour), expire: true},
+		{name: "tenant's", tenant: "acme", expiresAt: now.Add(-time.Hour), want: []string{"acme/alice"}},
+		{name: "tenant's already expired", tenant: "acme", expiresAt: now.Add(-time.Hour), expire: true},
+	}
+	for _, backend := range testBackends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				store := backend.open(t)
+				view := newTenantStore(store, tt.tenant, normalizeRetailer)
+				if _, _, err := view.AddLedgerEntry(LedgerEntry{ID: "r1", UserID: "alice", Kind: ledgerReceipt, Points: 28, CreatedAt: now.AddDate(-4, 0, 0), ExpiresAt: tt.expiresAt}, false); err != nil {
+					t.Fatalf("AddLedgerEntry: %v", err)
+				}
+				if tt.expire {
+					if expired, err := expirePoints(view, "alice", now); err != nil || expired != 28 {
+						t.Fatalf("expirePoints = %d, %v; want 28 expired", expired, err)
+					}
+				}
+				got, err := store.ExpiringLedgerUsers(now)
+				if err != nil {
+					t.Fatalf("ExpiringLedgerUsers: %v", err)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("ExpiringLedgerUsers = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
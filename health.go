@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readyzPingTimeout bounds how long a readiness check waits on the store, so
+// a hung backend is reported rather than stalling the load balancer's probe.
+const readyzPingTimeout = 2 * time.Second
+
+// dependencyCheck reports whether one backend the service depends on is
+// available. Backends added later get a check of their own.
+type dependencyCheck struct {
+	Name  string
+	Check func(context.Context) error
+}
+
+// Handles GET /healthz requests. The process answering is all liveness
+// requires, so no dependency is checked: a store outage should take the
+// service out of rotation, not get it restarted.
+func healthzHandler(w http.ResponseWriter, logger *slog.Logger) {
+	type HealthResponse struct {
+		Status string `json:"status"`
+	}
+	jsonResponse(w, http.StatusOK, HealthResponse{Status: "ok"}, logger)
+}
+
+// Handles GET /readyz requests, running every dependency check at once and
+// reporting ready only if all of them pass.
+func readyzHandler(w http.ResponseWriter, r *http.Request, checks []dependencyCheck, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyzPingTimeout)
+	defer cancel()
+
+	type CheckResult struct {
+		Status    string  `json:"status"`
+		LatencyMs float64 `json:"latencyMs"`
+		Error     string  `json:"error,omitempty"`
+	}
+	type ReadinessResponse struct {
+		Status string                 `json:"status"`
+		Checks map[string]CheckResult `json:"checks"`
+	}
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := check.Check(ctx)
+			results[i] = CheckResult{Status: "ok", LatencyMs: float64(time.Since(start)) / float64(time.Millisecond)}
+			if err != nil {
+				logger.Error("Dependency check failed", slog.String("dependency", check.Name), slog.Any("error", err))
+				results[i].Status, results[i].Error = "unavailable", err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	resp := ReadinessResponse{Status: "ready", Checks: make(map[string]CheckResult, len(checks))}
+	status := http.StatusOK
+	for i, check := range checks {
+		resp.Checks[check.Name] = results[i]
+		if results[i].Error != "" {
+			resp.Status, status = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	jsonResponse(w, status, resp, logger)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// pingStore is a store whose Ping returns err.
+type pingStore struct {
+	Store
+	err error
+}
+
+func (s pingStore) Ping(ctx context.Context) error { return s.err }
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name        string
+		pingErr     error
+		wantStatus  int
+		wantReady   string
+		wantStore   string
+		wantErrText string
+	}{
+		{name: "store reachable", wantStatus: http.StatusOK, wantReady: "ready", wantStore: "ok"},
+		{name: "store unreachable", pingErr: errors.New("dial tcp: connection refused"), wantStatus: http.StatusServiceUnavailable, wantReady: "unavailable", wantStore: "unavailable", wantErrText: "dial tcp: connection refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := pingStore{Store: newMemoryStore(normalizeRetailer), err: tt.pingErr}
+			srv := newTestServer(t, routerDeps{Store: store})
+
+			resp, body := send(t, srv, http.MethodGet, "/readyz", "")
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			var got struct {
+				Status string
+				Checks map[string]struct{ Status, Error string }
+			}
+			decodeBody(t, body, &got)
+			check := got.Checks["store"]
+			if got.Status != tt.wantReady || check.Status != tt.wantStore || check.Error != tt.wantErrText {
+				t.Errorf("readyz = %+v, want %q with store %q (error %q)", got, tt.wantReady, tt.wantStore, tt.wantErrText)
+			}
+
+			// Liveness does not depend on the store
+			if resp, _ := send(t, srv, http.MethodGet, "/healthz", ""); resp.StatusCode != http.StatusOK {
+				t.Errorf("healthz status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+		})
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
+	"strings"
 )
 
 // Helper to write JSON responses
@@ -17,9 +19,42 @@ func jsonResponse(w http.ResponseWriter, status int, data interface{}, logger *s
 
 // Helper to write standard error messages
 func errorResponse(w http.ResponseWriter, status int, message string, logger *slog.Logger) {
+	errorResponseWithDetail(w, status, message, "", logger)
+}
+
+// Helper to write error messages with an optional detail explaining the cause
+func errorResponseWithDetail(w http.ResponseWriter, status int, message, detail string, logger *slog.Logger) {
 	type ErrorMsg struct {
-		Error string `json:"error"`
+		Error  string `json:"error"`
+		Detail string `json:"detail,omitempty"`
+	}
+	logger.Warn("Responding with error", slog.Int("status", status), slog.String("message", message), slog.String("detail", detail))
+	jsonResponse(w, status, ErrorMsg{Error: message, Detail: detail}, logger)
+}
+
+// Helper to reject an invalid receipt, exposing the reason only in verbose mode
+func badRequestResponse(w http.ResponseWriter, cfg *Config, reason string, logger *slog.Logger) {
+	if !cfg.VerboseErrors {
+		reason = ""
+	}
+	errorResponseWithDetail(w, http.StatusBadRequest, badRequestMsg, reason, logger)
+}
+
+// Helper to reject a request body that could not be read or decoded
+func bodyErrorResponse(w http.ResponseWriter, cfg *Config, err error, logger *slog.Logger) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		errorResponse(w, http.StatusRequestEntityTooLarge, bodyTooLargeMsg, logger)
+		return
+	}
+	badRequestResponse(w, cfg, describeDecodeError(err), logger)
+}
+
+// Helper to turn a JSON decoding error into a client-facing reason
+func describeDecodeError(err error) string {
+	// encoding/json has no typed error for DisallowUnknownFields, only this message.
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return "unknown field " + field
 	}
-	logger.Warn("Responding with error", slog.Int("status", status), slog.String("message", message))
-	jsonResponse(w, status, ErrorMsg{Error: message}, logger)
-}
\ No newline at end of file
+	return "malformed JSON body"
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConfig loads the configuration as main does, from the environment
+// with env set over it.
+func testConfig(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return cfg
+}
+
+// writeRulesFile writes a YAML rules file for the test and returns its path.
+func writeRulesFile(t *testing.T, rules string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yml")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatalf("writing rules file: %v", err)
+	}
+	return path
+}
+
+// newTestServer serves newRouter(deps) until the test ends. Dependencies
+// deps leaves unset are filled in as main would: the default configuration,
+// a memory store, random ids, and the system clock.
+func newTestServer(t *testing.T, deps routerDeps) *httptest.Server {
+	t.Helper()
+	if deps.Config == nil {
+		deps.Config = testConfig(t, nil)
+	}
+	if deps.Store == nil {
+		deps.Store = newMemoryStore(retailerCanonicalizer(deps.Config.RetailerCanonicalization))
+	}
+	if deps.Events == nil {
+		deps.Events = newBroker(64)
+	}
+	if deps.IDs == nil {
+		deps.IDs = uuidGenerator{}
+	}
+	if deps.Clock == nil {
+		deps.Clock = systemClock{}
+	}
+	if deps.Logger == nil {
+		deps.Logger = slog.New(slog.DiscardHandler)
+	}
+	srv := httptest.NewServer(newRouter(deps))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testClock is a Clock that stands still until the test moves it.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock(now time.Time) *testClock { return &testClock{now: now} }
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// testBackend is a Store implementation under test.
+type testBackend struct {
+	name string
+	open func(t *testing.T) Store // returns an empty store, closed when the test ends
+}
+
+// testBackends lists the backends that run without an external server:
+// memory, memory with a write-ahead log, and sqlite.
+var testBackends = []testBackend{
+	{name: storeMemory, open: func(t *testing.T) Store { return newMemoryStore(normalizeRetailer) }},
+	{name: "wal", open: func(t *testing.T) Store {
+		store, err := openWAL(newMemoryStore(normalizeRetailer), memorySnapshot{}, filepath.Join(t.TempDir(), "receipts.wal"), false, slog.New(slog.DiscardHandler))
+		if err != nil {
+			t.Fatalf("openWAL: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}},
+	{name: storeSQLite, open: func(t *testing.T) Store {
+		store, err := newSQLiteStore(filepath.Join(t.TempDir(), "receipts.db"), normalizeRetailer)
+		if err != nil {
+			t.Fatalf("newSQLiteStore: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}},
+}
+
+// send makes a request to srv with body, if not empty, and headers given as
+// name, value pairs. It returns the response and its body.
+func send(t *testing.T, srv *httptest.Server, method, path, body string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, srv.URL+path, reader)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading body: %v", method, path, err)
+	}
+	return resp, string(buf)
+}
+
+// processReceipt submits receipt to srv and returns its id.
+func processReceipt(t *testing.T, srv *httptest.Server, receipt Receipt) string {
+	t.Helper()
+	resp, body := send(t, srv, http.MethodPost, "/receipts/process", mustJSON(t, receipt))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /receipts/process: status %d, body %s", resp.StatusCode, body)
+	}
+	var processed struct{ ID string }
+	decodeBody(t, body, &processed)
+	return processed.ID
+}
+
+// decodeBody unmarshals the JSON response body into v.
+func decodeBody(t *testing.T, body string, v any) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		t.Fatalf("decoding %q: %v", body, err)
+	}
+}
+
+// mustJSON marshals v.
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	return string(buf)
+}
+
+// testReceipt returns the challenge's Target example, a valid receipt worth
+// 28 points under the default rules. Each call returns a fresh copy.
+func testReceipt() Receipt {
+	return Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items: []Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+			{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+			{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+			{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+			{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+		},
+		Total: "35.35",
+	}
+}
+
+// benchmarkReceipts returns representative receipts for benchmarks: the
+// challenge's example and a large basket of a hundred lines, some with
+// quantities.
+func benchmarkReceipts() []struct {
+	name    string
+	receipt Receipt
+} {
+	basket := testReceipt()
+	basket.Items = nil
+	var cents int64
+	for i := range 100 {
+		item := Item{ShortDescription: "Item number " + strconv.Itoa(i), Price: formatCents(int64(100 + i*7))}
+		quantity := 1
+		if i%10 == 0 {
+			quantity = 3
+			item.Quantity = &quantity
+		}
+		basket.Items = append(basket.Items, item)
+		cents += int64(quantity * (100 + i*7))
+	}
+	basket.Total = formatCents(cents)
+	return []struct {
+		name    string
+		receipt Receipt
+	}{
+		{name: "example", receipt: testReceipt()},
+		{name: "large basket", receipt: basket},
+	}
+}
+
+// rulePoints returns the points rule contributed to breakdown and whether it
+// is listed at all.
+func rulePoints(breakdown []RuleResult, rule string) (int64, bool) {
+	for _, result := range breakdown {
+		if result.Rule == rule {
+			return result.Points, true
+		}
+	}
+	return 0, false
+}
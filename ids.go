@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// uuidPatternRegex matches the canonical hyphenated form of a UUID.
+var uuidPatternRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// IDGenerator creates receipt ids and recognizes the ids it creates, so that
+// lookups can reject malformed ids before touching the store.
+type IDGenerator interface {
+	// NewID returns the id for a receipt that has just been validated.
+	NewID(data *ValidatedReceiptData) string
+	// Pattern matches every id NewID can return.
+	Pattern() *regexp.Regexp
+}
+
+// uuidGenerator issues random (version 4) UUIDs.
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID(*ValidatedReceiptData) string { return uuid.NewString() }
+func (uuidGenerator) Pattern() *regexp.Regexp            { return uuidPatternRegex }
+
+// contentIDNamespace seeds content-derived ids. Changing it changes every id,
+// so it must stay fixed for ids to agree across environments.
+var contentIDNamespace = uuid.MustParse("3f5d8c2a-7b1e-4c69-9a04-d2e6b8f01c57")
+
+// contentIDGenerator derives each id from a SHA-256 of the receipt's parsed
+// content (see ValidatedReceiptData.Fingerprint), formatted as a version 8
+// UUID, so the same receipt always gets the same id.
+type contentIDGenerator struct{}
+
+func (contentIDGenerator) NewID(data *ValidatedReceiptData) string {
+	return uuid.NewHash(sha256.New(), contentIDNamespace, []byte(data.Fingerprint()), 8).String()
+}
+func (contentIDGenerator) Pattern() *regexp.Regexp { return uuidPatternRegex }
+
+// idPattern returns the pattern that path ids must match: the generator's own
+// pattern, or the lenient idPatternRegex when ids may come from elsewhere
+// (for example, receipts imported under a custom id scheme).
+func idPattern(ids IDGenerator, lenient bool) *regexp.Regexp {
+	if lenient {
+		return idPatternRegex
+	}
+	return ids.Pattern()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+const (
+	testUUID = "7fb1377b-b223-49d9-a31a-5a02701dd310"
+	testULID = "01ARZ3NDEKTSV4RRFFQ69G5FAV"
+)
+
+func TestIDPattern(t *testing.T) {
+	tests := []struct {
+		name        string
+		id          string
+		wantStrict  bool
+		wantLenient bool
+	}{
+		{name: "UUID", id: testUUID, wantStrict: true, wantLenient: true},
+		{name: "upper-case UUID", id: "7FB1377B-B223-49D9-A31A-5A02701DD310", wantStrict: true, wantLenient: true},
+		{name: "ULID", id: testULID, wantLenient: true},
+		{name: "UUID without hyphens", id: "7fb1377bb22349d9a31a5a02701dd310", wantLenient: true},
+		{name: "UUID with a suffix", id: testUUID + "x", wantLenient: true},
+		{name: "garbage", id: "not-an-id!", wantLenient: true},
+		{name: "whitespace", id: "not an id"},
+		{name: "empty", id: ""},
+	}
+	generators := []struct {
+		name string
+		ids  IDGenerator
+	}{
+		{name: "random", ids: uuidGenerator{}},
+		{name: "content", ids: contentIDGenerator{}},
+	}
+	for _, gen := range generators {
+		for _, tt := range tests {
+			t.Run(gen.name+"/"+tt.name, func(t *testing.T) {
+				if got := idPattern(gen.ids, false).MatchString(tt.id); got != tt.wantStrict {
+					t.Errorf("strict match = %v, want %v", got, tt.wantStrict)
+				}
+				if got := idPattern(gen.ids, true).MatchString(tt.id); got != tt.wantLenient {
+					t.Errorf("lenient match = %v, want %v", got, tt.wantLenient)
+				}
+			})
+		}
+	}
+}
+
+func TestGetReceiptIDValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		lenient    bool
+		id         string
+		wantStatus int
+		wantLookup bool // whether the store was asked
+	}{
+		{name: "UUID", id: testUUID, wantStatus: http.StatusOK, wantLookup: true},
+		{name: "ULID", id: testULID, wantStatus: http.StatusNotFound},
+		{name: "garbage", id: "not-an-id!", wantStatus: http.StatusNotFound},
+		{name: "lenient UUID", lenient: true, id: testUUID, wantStatus: http.StatusOK, wantLookup: true},
+		{name: "lenient ULID", lenient: true, id: testULID, wantStatus: http.StatusOK, wantLookup: true},
+		{name: "lenient garbage", lenient: true, id: "not-an-id!", wantStatus: http.StatusNotFound, wantLookup: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFlakyStore(0, nil)
+			saveAll(t, store.Store, StoredReceipt{ID: testUUID, Points: 28}, StoredReceipt{ID: testULID, Points: 28})
+			cfg := testConfig(t, map[string]string{"LENIENT_IDS": strconv.FormatBool(tt.lenient)})
+			srv := newTestServer(t, routerDeps{Config: cfg, Store: store})
+			resp, body := send(t, srv, http.MethodGet, "/receipts/"+url.PathEscape(tt.id)+"/points", "")
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if looked := store.count("Get") > 0; looked != tt.wantLookup {
+				t.Errorf("store looked up = %v, want %v", looked, tt.wantLookup)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PointsClaims are the claims carried by a signed points token.
+type PointsClaims struct {
+	Subject  string `json:"sub"`    // receipt id
+	Points   int64  `json:"points"` // points awarded to the receipt
+	IssuedAt int64  `json:"iat"`    // Unix seconds
+}
+
+// pointsTokenSigner issues EdDSA (Ed25519) JWTs vouching for a receipt's
+// points, so partners can verify them with the published public key.
+type pointsTokenSigner struct {
+	key ed25519.PrivateKey
+	kid string
+}
+
+// newPointsTokenSigner derives the signing key from a 32-byte Ed25519 seed.
+func newPointsTokenSigner(seed []byte) (*pointsTokenSigner, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key seed must be %d bytes", ed25519.SeedSize)
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	return &pointsTokenSigner{key: key, kid: base64.RawURLEncoding.EncodeToString(sum[:8])}, nil
+}
+
+// Sign returns a compact JWT for the given claims.
+func (s *pointsTokenSigner) Sign(claims PointsClaims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "EdDSA", "typ": "JWT", "kid": s.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(s.key, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// PublicKey returns the key that verifies tokens from this signer.
+func (s *pointsTokenSigner) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// JWK is a JSON Web Key for an Ed25519 public key.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// JWKS returns the signer's public key as a JSON Web Key Set.
+func (s *pointsTokenSigner) JWKS() map[string][]JWK {
+	return map[string][]JWK{"keys": {{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(s.PublicKey()),
+		KeyID:     s.kid,
+		Algorithm: "EdDSA",
+		Use:       "sig",
+	}}}
+}
+
+// verifyPointsToken checks a token's signature against pub and returns its claims.
+func verifyPointsToken(token string, pub ed25519.PublicKey) (PointsClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return PointsClaims{}, errors.New("token must have three parts")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return PointsClaims{}, fmt.Errorf("decode header: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return PointsClaims{}, fmt.Errorf("parse header: %w", err)
+	}
+	if header.Alg != "EdDSA" {
+		return PointsClaims{}, fmt.Errorf("unexpected algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return PointsClaims{}, fmt.Errorf("decode signature: %w", err)
+	}
+	if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), signature) {
+		return PointsClaims{}, errors.New("invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return PointsClaims{}, fmt.Errorf("decode payload: %w", err)
+	}
+	var claims PointsClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return PointsClaims{}, fmt.Errorf("parse payload: %w", err)
+	}
+	return claims, nil
+}
+
+// newPointsClaims builds the claims for a receipt's points issued now.
+func newPointsClaims(id string, points int64, now time.Time) PointsClaims {
+	return PointsClaims{Subject: id, Points: points, IssuedAt: now.Unix()}
+}
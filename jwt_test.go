@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPointsToken(t *testing.T) {
+	signer, err := newPointsTokenSigner(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	if err != nil {
+		t.Fatalf("newPointsTokenSigner: %v", err)
+	}
+	other, err := newPointsTokenSigner(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+	if err != nil {
+		t.Fatalf("newPointsTokenSigner: %v", err)
+	}
+	claims := newPointsClaims("receipt-1", 28, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	token, err := signer.Sign(claims)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	parts := strings.Split(token, ".")
+	encode := base64.RawURLEncoding.EncodeToString
+	tests := []struct {
+		name    string
+		token   string
+		key     ed25519.PublicKey
+		wantErr string
+	}{
+		{name: "valid", token: token, key: signer.PublicKey()},
+		{name: "other key", token: token, key: other.PublicKey(), wantErr: "invalid signature"},
+		{name: "altered points", token: parts[0] + "." + encode([]byte(`{"sub":"receipt-1","points":2800,"iat":1714564800}`)) + "." + parts[2], key: signer.PublicKey(), wantErr: "invalid signature"},
+		{name: "unsigned", token: encode([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", key: signer.PublicKey(), wantErr: `unexpected algorithm "none"`},
+		{name: "two parts", token: parts[0] + "." + parts[1], key: signer.PublicKey(), wantErr: "token must have three parts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyPointsToken(tt.token, tt.key)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("verifyPointsToken error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyPointsToken: %v", err)
+			}
+			if got != claims {
+				t.Errorf("claims = %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestNewPointsTokenSigner(t *testing.T) {
+	for _, size := range []int{0, 16, ed25519.SeedSize + 1} {
+		if _, err := newPointsTokenSigner(make([]byte, size)); err == nil {
+			t.Errorf("newPointsTokenSigner accepted a %d-byte seed", size)
+		}
+	}
+}
+
+func TestPointsTokenEndpoint(t *testing.T) {
+	signer, err := newPointsTokenSigner(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	if err != nil {
+		t.Fatalf("newPointsTokenSigner: %v", err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		signer     *pointsTokenSigner
+		wantStatus int
+	}{
+		{name: "signing key configured", signer: signer, wantStatus: http.StatusOK},
+		{name: "no signing key", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{Signer: tt.signer, Clock: newTestClock(now)})
+			id := processReceipt(t, srv, testReceipt())
+			resp, body := send(t, srv, http.MethodGet, "/receipts/"+id+"/points?format=jwt", "")
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			jwksResp, jwksBody := send(t, srv, http.MethodGet, "/jwks", "")
+			if tt.signer == nil {
+				if jwksResp.StatusCode != http.StatusNotFound {
+					t.Errorf("GET /jwks status = %d, want %d", jwksResp.StatusCode, http.StatusNotFound)
+				}
+				return
+			}
+
+			var issued struct {
+				Points int64
+				Token  string
+			}
+			decodeBody(t, body, &issued)
+			// Verified with the key as published, not the signer's own copy
+			var jwks struct{ Keys []JWK }
+			decodeBody(t, jwksBody, &jwks)
+			if len(jwks.Keys) != 1 {
+				t.Fatalf("JWKS = %s, want one key", jwksBody)
+			}
+			key, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+			if err != nil {
+				t.Fatalf("decoding JWK: %v", err)
+			}
+			claims, err := verifyPointsToken(issued.Token, key)
+			if err != nil {
+				t.Fatalf("verifyPointsToken: %v", err)
+			}
+			if want := newPointsClaims(id, 28, now); claims != want || issued.Points != 28 {
+				t.Errorf("claims = %+v, points %d; want %+v, 28", claims, issued.Points, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Leaderboard periods, in UTC. Weeks are ISO weeks, starting on Monday.
+const (
+	periodDay   = "day"
+	periodWeek  = "week"
+	periodMonth = "month"
+	periodYear  = "year"
+	periodAll   = "all"
+)
+
+// leaderboardPeriods lists every leaderboard period.
+var leaderboardPeriods = []string{periodDay, periodWeek, periodMonth, periodYear, periodAll}
+
+// Sizes of a GET /leaderboard response.
+const (
+	defaultLeaderboardSize = 10
+	maxLeaderboardSize     = 100
+)
+
+// LeaderboardEntry is a user's points on a leaderboard.
+type LeaderboardEntry struct {
+	UserID string
+	Points int64
+}
+
+// leaderboardBucket names the leaderboard of the period containing t.
+func leaderboardBucket(period string, t time.Time) string {
+	t = t.UTC()
+	switch period {
+	case periodDay:
+		return "day:" + t.Format("2006-01-02")
+	case periodWeek:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("week:%04d-W%02d", year, week)
+	case periodMonth:
+		return "month:" + t.Format("2006-01")
+	case periodYear:
+		return "year:" + t.Format("2006")
+	}
+	return periodAll
+}
+
+// periodStart returns when the period containing t began, or zero for
+// periodAll.
+func periodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case periodDay:
+		return day
+	case periodWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case periodMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	case periodYear:
+		return day.AddDate(0, 0, 1-day.YearDay())
+	}
+	return time.Time{}
+}
+
+// leaderboardBuckets returns the leaderboards a ledger entry's points count
+// toward: for a receipt's credit, that of every period containing its
+// CreatedAt; for an adjustment, those of the credit it adjusts; and none for
+// other entries. They are prefixed with the tenant of the entry's id, as
+// stored, so each tenant's leaderboards stay apart. Stores add an entry's
+// points to these as they add the entry, so reading a leaderboard never
+// scans the receipts or the ledger.
+func leaderboardBuckets(entry LedgerEntry) []string {
+	at := entry.CreatedAt
+	switch entry.Kind {
+	case ledgerReceipt:
+	case ledgerAdjustment:
+		at = entry.CreditedAt
+	default:
+		return nil
+	}
+	var prefix string
+	if tenant, _ := splitTenant(entry.ID); tenant != "" {
+		prefix = tenant + tenantSeparator
+	}
+	buckets := make([]string, len(leaderboardPeriods))
+	for i, period := range leaderboardPeriods {
+		buckets[i] = prefix + leaderboardBucket(period, at)
+	}
+	return buckets
+}
+
+// rankLeaderboard orders entries most points first, ties by user id, and
+// keeps the first limit of them.
+func rankLeaderboard(entries []LeaderboardEntry, limit int) []LeaderboardEntry {
+	slices.SortFunc(entries, func(a, b LeaderboardEntry) int {
+		return cmp.Or(cmp.Compare(b.Points, a.Points), strings.Compare(a.UserID, b.UserID))
+	})
+	return entries[:min(limit, len(entries))]
+}
+
+// Handles GET /leaderboard requests, listing the users who earned the most
+// points from receipts in the period given by "period" (day, week, month,
+// year, or all; month by default) containing "date" (today by default), at
+// most "limit" of them. Points later redeemed or expired still count; those
+// of receipts since rescored or removed count as adjusted.
+func leaderboardHandler(w http.ResponseWriter, r *http.Request, store Store, clock Clock, logger *slog.Logger) {
+	query := r.URL.Query()
+	period := periodMonth
+	if v := query.Get("period"); v != "" {
+		if !slices.Contains(leaderboardPeriods, v) {
+			logger.Warn("Invalid leaderboard period", slog.String("period", v))
+			errorResponse(w, http.StatusBadRequest, invalidFilterMsg, logger)
+			return
+		}
+		period = v
+	}
+	at := clock.Now()
+	if v := query.Get("date"); v != "" {
+		date, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			logger.Warn("Invalid leaderboard date", slog.String("date", v))
+			errorResponse(w, http.StatusBadRequest, invalidFilterMsg, logger)
+			return
+		}
+		at = date
+	}
+	limit := defaultLeaderboardSize
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLeaderboardSize {
+			logger.Warn("Invalid leaderboard limit", slog.String("limit", v))
+			errorResponse(w, http.StatusBadRequest, invalidFilterMsg, logger)
+			return
+		}
+		limit = n
+	}
+
+	bucket := leaderboardBucket(period, at)
+	entries, err := store.Leaderboard(bucket, limit)
+	if err != nil {
+		logger.Error("Failed to read leaderboard", slog.String("bucket", bucket), slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+
+	type RankedUser struct {
+		Rank   int    `json:"rank"` // users with equal points share a rank
+		UserID string `json:"userId"`
+		Points int64  `json:"points"`
+	}
+	type LeaderboardResponse struct {
+		Period string       `json:"period"`
+		Start  time.Time    `json:"start,omitzero"`
+		Users  []RankedUser `json:"users"`
+	}
+	resp := LeaderboardResponse{Period: period, Start: periodStart(period, at), Users: make([]RankedUser, len(entries))}
+	for i, entry := range entries {
+		rank := i + 1
+		if i > 0 && entry.Points == entries[i-1].Points {
+			rank = resp.Users[i-1].Rank
+		}
+		resp.Users[i] = RankedUser{Rank: rank, UserID: entry.UserID, Points: entry.Points}
+	}
+	jsonResponse(w, http.StatusOK, resp, logger)
+}
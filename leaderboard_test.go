@@ -0,0 +1,81 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLeaderboardBuckets(t *testing.T) {
+	jan := time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)
+	mar := time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)
+	janBuckets := []string{"day:2024-01-15", "week:2024-W03", "month:2024-01", "year:2024", "all"}
+	tests := []struct {
+		name  string
+		entry LedgerEntry
+		want  []string
+	}{
+		{name: "credit", entry: LedgerEntry{ID: "r1", Kind: ledgerReceipt, Points: 28, CreatedAt: jan}, want: janBuckets},
+		{name: "adjustment counts when its credit was added", entry: LedgerEntry{ID: "adjustment-r1-0", Kind: ledgerAdjustment, Points: -28, Reference: "r1", CreatedAt: mar, CreditedAt: jan}, want: janBuckets},
+		{name: "tenant credit", entry: LedgerEntry{ID: "acme/r1", Kind: ledgerReceipt, Points: 28, CreatedAt: jan}, want: []string{"acme/day:2024-01-15", "acme/week:2024-W03", "acme/month:2024-01", "acme/year:2024", "acme/all"}},
+		{name: "redemption", entry: LedgerEntry{ID: "d1", Kind: ledgerRedemption, Points: -10, CreatedAt: jan}},
+		{name: "expiry", entry: LedgerEntry{ID: "expiry-r1", Kind: ledgerExpiry, Points: -18, Reference: "r1", CreatedAt: mar}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := leaderboardBuckets(tt.entry); !slices.Equal(got, tt.want) {
+				t.Errorf("leaderboardBuckets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeaderboardAdjustments(t *testing.T) {
+	jan := time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)
+	mar := time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		points  int64 // alice's receipt's points after the adjustment
+		wantJan []LeaderboardEntry
+	}{
+		{name: "rescored up", points: 40, wantJan: []LeaderboardEntry{{UserID: "alice", Points: 40}, {UserID: "bob", Points: 20}}},
+		{name: "rescored down", points: 10, wantJan: []LeaderboardEntry{{UserID: "bob", Points: 20}, {UserID: "alice", Points: 10}}},
+		{name: "removed", points: 0, wantJan: []LeaderboardEntry{{UserID: "bob", Points: 20}, {UserID: "alice", Points: 0}}},
+	}
+	for _, backend := range testBackends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				store := backend.open(t)
+				for _, credit := range []LedgerEntry{
+					{ID: "r1", UserID: "alice", Kind: ledgerReceipt, Points: 28, CreatedAt: jan},
+					{ID: "r2", UserID: "bob", Kind: ledgerReceipt, Points: 20, CreatedAt: jan},
+				} {
+					if _, _, err := store.AddLedgerEntry(credit, false); err != nil {
+						t.Fatalf("AddLedgerEntry %s: %v", credit.ID, err)
+					}
+				}
+				if err := adjustCredit(store, "alice", "r1", tt.points, mar); err != nil {
+					t.Fatalf("adjustCredit: %v", err)
+				}
+
+				for _, period := range []string{periodMonth, periodAll} {
+					got, err := store.Leaderboard(leaderboardBucket(period, jan), 10)
+					if err != nil {
+						t.Fatalf("Leaderboard: %v", err)
+					}
+					if !slices.Equal(got, tt.wantJan) {
+						t.Errorf("%s leaderboard = %v, want %v", period, got, tt.wantJan)
+					}
+				}
+				// The adjustment belongs to January, not to the month it was made in
+				got, err := store.Leaderboard(leaderboardBucket(periodMonth, mar), 10)
+				if err != nil {
+					t.Fatalf("Leaderboard: %v", err)
+				}
+				if len(got) != 0 {
+					t.Errorf("March leaderboard = %v, want none", got)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantText   bool
+		wantDebug  bool
+		wantOutput string // contained in a line logged to a file
+	}{
+		{name: "defaults", env: nil},
+		{name: "text", env: map[string]string{"LOG_FORMAT": logFormatText}, wantText: true},
+		{name: "debug level", env: map[string]string{"LOG_LEVEL": "debug"}, wantDebug: true},
+		{name: "stderr", env: map[string]string{"LOG_OUTPUT": "stderr", "LOG_FORMAT": logFormatText, "LOG_LEVEL": "warn"}, wantText: true},
+		{name: "JSON to a file", env: map[string]string{"LOG_OUTPUT": "file"}, wantOutput: `"msg":"hello"`},
+		{name: "text to a file", env: map[string]string{"LOG_OUTPUT": "file", "LOG_FORMAT": logFormatText}, wantText: true, wantOutput: "msg=hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "service.log")
+			if tt.env["LOG_OUTPUT"] == "file" {
+				tt.env["LOG_OUTPUT"] = path
+			}
+			cfg := testConfig(t, tt.env)
+			logger, err := newLogger(cfg.Log)
+			if err != nil {
+				t.Fatalf("newLogger: %v", err)
+			}
+			switch logger.Handler().(type) {
+			case *slog.TextHandler:
+				if !tt.wantText {
+					t.Errorf("handler is text, want JSON")
+				}
+			case *slog.JSONHandler:
+				if tt.wantText {
+					t.Errorf("handler is JSON, want text")
+				}
+			default:
+				t.Errorf("handler is %T", logger.Handler())
+			}
+			if enabled := logger.Enabled(t.Context(), slog.LevelDebug); enabled != tt.wantDebug {
+				t.Errorf("debug enabled = %v, want %v", enabled, tt.wantDebug)
+			}
+			if tt.wantOutput == "" {
+				return
+			}
+			logger.Info("hello")
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("reading log file: %v", err)
+			}
+			if !strings.Contains(string(buf), tt.wantOutput) {
+				t.Errorf("log file = %q, want it to contain %q", buf, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestOpenLogOutput(t *testing.T) {
+	if _, err := openLogOutput(filepath.Join(t.TempDir(), "missing", "service.log")); err == nil {
+		t.Error("openLogOutput opened a file in a missing directory")
+	}
+	if out, err := openLogOutput(""); err != nil || out != os.Stdout {
+		t.Errorf("openLogOutput(\"\") = %v, %v; want stdout", out, err)
+	}
+}
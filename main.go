@@ -1,104 +1,1328 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
-
-	"github.com/google/uuid"
 )
 
-// In-memory storage for receipt points.
-var receiptPointsStore = make(map[string]int64)
-var storeMutex = &sync.RWMutex{}
-
 // API error messages.
 const badRequestMsg = "The receipt is invalid."
 const notFoundMsg = "No receipt found for that ID."
+const timeoutMsg = "The request timed out."
+const internalErrorMsg = "An internal error occurred."
+const unauthorizedMsg = "Missing or invalid credentials."
+const forbiddenMsg = "The credentials do not grant access to this resource."
+const invalidAPIKeyMsg = "The API key request is invalid."
+const apiKeyNotFoundMsg = "No API key found for that ID."
+const apiKeyRevokedMsg = "The API key has been revoked."
+const rateLimitedMsg = "Too many requests; retry later."
+const invalidTenantMsg = "The tenant ID is invalid."
+const invalidUserIDMsg = "The user ID is invalid."
+const invalidRedemptionMsg = "The redemption request is invalid."
+const insufficientPointsMsg = "The points balance is too low for this redemption."
+const invalidFilterMsg = "The filter is invalid."
+const unsupportedFormatMsg = "The requested format is not supported."
+const bodyTooLargeMsg = "The request body is too large."
+const duplicateReceiptMsg = "This receipt was already submitted."
+const routeNotFoundMsg = "The requested resource does not exist."
+const methodNotAllowedMsg = "The method is not allowed for this resource."
+const migrationRunningMsg = "A migration is already running."
+const noMigrationMsg = "No migration is running."
+const preconditionFailedMsg = "The receipt has changed since it was read."
+const notAcceptableMsg = "None of the accepted media types are available."
+const staleRulesMsg = "The rules have changed since this receipt was scored; recalculate it first."
+const invalidIdempotencyKeyMsg = "The Idempotency-Key header is invalid."
+const idempotencyMismatchMsg = "The Idempotency-Key was already used for a different request."
+const idempotencyInProgressMsg = "A request with this Idempotency-Key is still being processed."
+
+// Response formats for GET /receipts/{id}/points, selected with ?format=
+// or, for the object format, an Accept header of pointsObjectMediaType.
+const (
+	pointsFormatPlain     = "plain"  // {"points": 95}
+	pointsFormatObject    = "object" // {"points": {"value": 95, "display": "95 points"}}
+	pointsFormatJWT       = "jwt"    // {"points": 95, "token": "<signed JWT>"}
+	pointsObjectMediaType = "application/vnd.receipt-points.object+json"
+)
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
 
-// Handles POST /receipts/process requests.
-func processReceiptHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+// Handles POST /receipts/process requests. With an Idempotency-Key header,
+// a repeat of an earlier request returns that request's response instead of
+// storing the receipt again.
+func processReceiptHandler(w http.ResponseWriter, r *http.Request, cfg *Config, store Store, events *broker, prom *promMetrics, sampler *payloadSampler, idGen IDGenerator, clock Clock, logger *slog.Logger) {
+	idempotencyKey := ""
+	if cfg.IdempotencyTTL > 0 {
+		idempotencyKey = r.Header.Get("Idempotency-Key")
+	}
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		logger.Warn("Idempotency key too long", slog.Int("length", len(idempotencyKey)))
+		errorResponse(w, http.StatusBadRequest, invalidIdempotencyKeyMsg, logger)
+		return
+	}
+
+	body, err := readBody(w, r, cfg, sampler, logger)
+	if err != nil {
+		bodyErrorResponse(w, cfg, err, logger)
+		return
+	}
+	var requestHash string
+	if idempotencyKey != "" {
+		// The body is hashed to tell a retry from a different request reusing the key
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			bodyErrorResponse(w, cfg, err, logger)
+			return
+		}
+		sum := sha256.Sum256(raw)
+		requestHash = hex.EncodeToString(sum[:])
+		body = bytes.NewReader(raw)
+	}
 
 	var receipt Receipt
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields()
+	if err := decodeReceipt(body, cfg.JSONNaming, &receipt); err != nil {
+		logger.Warn("Failed to decode receipt JSON", slog.Any("error", err))
+		bodyErrorResponse(w, cfg, err, logger)
+		return
+	}
+
+	type ProcessResponse struct {
+		ID       string   `json:"id"`
+		Warnings []string `json:"warnings,omitempty"`
+	}
+
+	if idempotencyKey != "" {
+		logger := logger.With(slog.String("idempotency_key", idempotencyKey))
+		reservation, reserved, err := store.ReserveIdempotencyKey(idempotencyKey, requestHash, clock.Now(), cfg.IdempotencyTTL)
+		if err != nil {
+			logger.Error("Failed to reserve idempotency key", slog.Any("error", err))
+			errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+			return
+		}
+		if !reserved {
+			switch {
+			case reservation.RequestHash != requestHash:
+				logger.Warn("Idempotency key reused for a different request")
+				errorResponse(w, http.StatusUnprocessableEntity, idempotencyMismatchMsg, logger)
+			case reservation.ReceiptID == "":
+				logger.Warn("Idempotency key still being processed")
+				errorResponse(w, http.StatusConflict, idempotencyInProgressMsg, logger)
+			default:
+				resp := ProcessResponse{ID: reservation.ReceiptID}
+				// Warnings are only known while the receipt is stored
+				if rec, found, err := store.Get(reservation.ReceiptID); err != nil {
+					logger.Warn("Failed to read replayed receipt", slog.Any("error", err), slog.String("id", reservation.ReceiptID))
+				} else if found {
+					resp.Warnings = rec.Warnings
+				}
+				logger.Info("Replayed idempotent request", slog.String("id", reservation.ReceiptID))
+				w.Header().Set("Idempotent-Replayed", "true")
+				jsonResponse(w, http.StatusOK, resp, logger)
+			}
+			return
+		}
+	}
 
-	if err := decoder.Decode(&receipt); err != nil {
+	rec, err := acceptReceipt(r.Context(), receipt, cfg, store, events, prom, idGen, clock, logger)
+	if idempotencyKey != "" {
+		var settleErr error
+		if err != nil {
+			// Nothing was stored, so a retry should be processed afresh
+			settleErr = store.ReleaseIdempotencyKey(idempotencyKey)
+		} else {
+			settleErr = store.CompleteIdempotencyKey(idempotencyKey, rec.ID)
+		}
+		if settleErr != nil {
+			logger.Error("Failed to settle idempotency key", slog.Any("error", settleErr), slog.String("idempotency_key", idempotencyKey))
+		}
+	}
+	var rejected *receiptRejection
+	switch {
+	case errors.As(err, &rejected) && rejected.status == http.StatusBadRequest:
+		badRequestResponse(w, cfg, rejected.reason, logger)
+		return
+	case errors.As(err, &rejected):
+		errorResponse(w, rejected.status, rejected.message, logger)
+		return
+	case err != nil:
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, ProcessResponse{ID: rec.ID, Warnings: rec.Warnings}, logger)
+}
+
+// Handles POST /receipts/score requests, validating and scoring a receipt
+// without storing it. Bonuses that depend on earlier receipts (streaks,
+// first of day) are not awarded, since nothing is recorded.
+func scoreReceiptHandler(w http.ResponseWriter, r *http.Request, cfg *Config, sampler *payloadSampler, clock Clock, logger *slog.Logger) {
+	body, err := readBody(w, r, cfg, sampler, logger)
+	if err != nil {
+		bodyErrorResponse(w, cfg, err, logger)
+		return
+	}
+
+	var receipt Receipt
+	if err := decodeReceipt(body, cfg.JSONNaming, &receipt); err != nil {
 		logger.Warn("Failed to decode receipt JSON", slog.Any("error", err))
-		errorResponse(w, http.StatusBadRequest, badRequestMsg, logger)
+		bodyErrorResponse(w, cfg, err, logger)
 		return
 	}
 
-	validatedData, err := validateAndParseReceipt(&receipt)
+	_, span := tracer.Start(r.Context(), "receipt.validate")
+	data, err := validateAndParseReceipt(&receipt, cfg.Validation)
+	if err == nil {
+		data.ProcessedAt = clock.Now()
+		err = checkPurchaseDate(data, cfg.Validation, data.ProcessedAt)
+	}
+	endSpan(span, err)
 	if err != nil {
 		logger.Warn("Receipt validation failed", slog.Any("error", err), slog.String("retailer", receipt.Retailer))
-		errorResponse(w, http.StatusBadRequest, badRequestMsg, logger)
+		badRequestResponse(w, cfg, err.Error(), logger)
 		return
 	}
 
-	points := calculatePoints(validatedData)
-	id := uuid.NewString()
+	type ScoreResponse struct {
+		Points      int64        `json:"points"`
+		RuleVersion string       `json:"ruleVersion"`
+		Breakdown   []RuleResult `json:"breakdown"`
+		Warnings    []string     `json:"warnings,omitempty"`
+	}
+	rules := cfg.pointsFor(contextTenant(r.Context()))
+	breakdown, points := tracedScore(r.Context(), data, rules)
+	jsonResponse(w, http.StatusOK, ScoreResponse{
+		Points:      points,
+		RuleVersion: ruleVersion(rules),
+		Breakdown:   breakdown,
+		Warnings:    data.Warnings,
+	}, logger)
+}
 
-	storeMutex.Lock()
-	receiptPointsStore[id] = points
-	storeMutex.Unlock()
+// readBody caps the request body at cfg.MaxBodyBytes and, if the request is
+// sampled, buffers it so it can be both captured and decoded.
+func readBody(w http.ResponseWriter, r *http.Request, cfg *Config, sampler *payloadSampler, logger *slog.Logger) (io.Reader, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+	if !sampler.Sample() {
+		return r.Body, nil
+	}
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Failed to read request body", slog.Any("error", err))
+		return nil, err
+	}
+	if err := sampler.Record(r.URL.Path, raw); err != nil {
+		logger.Error("Failed to record sampled payload", slog.Any("error", err))
+	}
+	return bytes.NewReader(raw), nil
+}
 
-	logger.Info("Receipt processed", slog.String("id", id), slog.Int64("points", points), slog.String("retailer", validatedData.Retailer))
+// receiptRejection is returned by acceptReceipt when the receipt itself is
+// at fault. Any other error is an internal failure.
+type receiptRejection struct {
+	status  int
+	message string // client-facing message
+	reason  string // validation detail, shown only in verbose mode
+}
 
-	type ProcessResponse struct {
-		ID string `json:"id"`
+func (e *receiptRejection) Error() string {
+	if e.reason != "" {
+		return e.message + ": " + e.reason
 	}
-	jsonResponse(w, http.StatusOK, ProcessResponse{ID: id}, logger)
+	return e.message
 }
 
-// Handles GET /receipts/{id}/points requests.
-func getPointsHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+// acceptReceipt validates, scores, and stores a decoded receipt, then
+// announces it to stream subscribers. It is shared by the single and batch
+// process endpoints. A duplicate fingerprint it claims is released again if
+// the receipt is not stored, so the client can resubmit it.
+func acceptReceipt(ctx context.Context, receipt Receipt, cfg *Config, store Store, events *broker, prom *promMetrics, idGen IDGenerator, clock Clock, logger *slog.Logger) (_ StoredReceipt, err error) {
+	_, span := tracer.Start(ctx, "receipt.validate")
+	validatedData, err := validateAndParseReceipt(&receipt, cfg.Validation)
+	if err != nil {
+		endSpan(span, err)
+		logger.Warn("Receipt validation failed", slog.Any("error", err), slog.String("retailer", receipt.Retailer))
+		prom.validationFailed(err)
+		return StoredReceipt{}, &receiptRejection{status: http.StatusBadRequest, message: badRequestMsg, reason: err.Error()}
+	}
+
+	now := clock.Now()
+	if err := checkPurchaseDate(validatedData, cfg.Validation, now); err != nil {
+		endSpan(span, err)
+		logger.Warn("Receipt validation failed", slog.Any("error", err), slog.String("retailer", receipt.Retailer))
+		prom.validationFailed(err)
+		return StoredReceipt{}, &receiptRejection{status: http.StatusBadRequest, message: badRequestMsg, reason: err.Error()}
+	}
+	span.End()
+
+	id := idGen.NewID(validatedData)
+
+	var held string // the fingerprint claimed for id, if any
+	defer func() {
+		if held == "" || err == nil {
+			return
+		}
+		if err := store.ReleaseFingerprint(held, id); err != nil {
+			logger.Error("Failed to release fingerprint of unstored receipt", slog.Any("error", err), slog.String("id", id))
+		}
+	}()
+
+	// Checked before the streak is recorded, so a rescan cannot extend it
+	if cfg.DuplicateWindow > 0 {
+		fingerprint := validatedData.Fingerprint()
+		holder, claimed, err := store.ClaimFingerprint(fingerprint, id, now, cfg.DuplicateWindow)
+		if err != nil {
+			logger.Error("Failed to check for duplicate receipt", slog.Any("error", err))
+			return StoredReceipt{}, err
+		}
+		if claimed {
+			held = fingerprint
+		} else {
+			logger := logger.With(slog.String("fingerprint", fingerprint), slog.String("retailer", validatedData.Retailer), slog.String("original_id", holder))
+			switch cfg.DuplicatePolicy {
+			case duplicateReject:
+				logger.Warn("Duplicate receipt rejected")
+				return StoredReceipt{}, &receiptRejection{status: http.StatusConflict, message: duplicateReceiptMsg}
+			case duplicateExisting:
+				original, found, err := getDuplicateOriginal(store, holder)
+				if err != nil {
+					logger.Error("Failed to read original of duplicate receipt", slog.Any("error", err))
+					return StoredReceipt{}, err
+				}
+				if found {
+					logger.Info("Duplicate receipt answered with the original")
+					return original, nil
+				}
+				// The original is gone, so this receipt takes its place
+				if _, _, err := store.ClaimFingerprint(fingerprint, id, now, 0); err != nil {
+					logger.Error("Failed to check for duplicate receipt", slog.Any("error", err))
+					return StoredReceipt{}, err
+				}
+				held = fingerprint
+			case duplicateAllow:
+				logger.Info("Duplicate receipt accepted")
+				validatedData.Warnings = append(validatedData.Warnings, duplicateWarning(holder))
+			}
+		}
+	}
+
+	// A content-derived id is already taken if the same receipt was stored
+	if cfg.DeterministicIDs {
+		existing, found, err := store.Get(id)
+		if err != nil {
+			logger.Error("Failed to read receipt", slog.Any("error", err), slog.String("id", id))
+			return StoredReceipt{}, err
+		}
+		if found {
+			logger.Info("Receipt already stored under its content id", slog.String("id", id))
+			return existing, nil
+		}
+	}
+
+	rules := cfg.pointsFor(contextTenant(ctx))
+	if rules.StreakBonus != 0 && validatedData.CustomerID != "" {
+		previous, found, err := store.RecordCustomerPurchase(validatedData.CustomerID, validatedData.PurchaseDate)
+		if err != nil {
+			logger.Error("Failed to record customer purchase", slog.Any("error", err))
+			return StoredReceipt{}, err
+		}
+		validatedData.ConsecutiveDay = found && previous.AddDate(0, 0, 1).Equal(validatedData.PurchaseDate)
+	}
+
+	// Claimed atomically in the store, so of two concurrent receipts for
+	// the same retailer and date only one wins the bonus
+	if rules.FirstOfDayBonus != 0 {
+		first, err := store.ClaimRetailerDay(validatedData.Retailer, validatedData.PurchaseDate)
+		if err != nil {
+			logger.Error("Failed to claim first-of-day bonus", slog.Any("error", err))
+			return StoredReceipt{}, err
+		}
+		validatedData.FirstOfDay = first
+	}
+
+	validatedData.ProcessedAt = now
+	breakdown, points := tracedScore(ctx, validatedData, rules)
+	logBreakdown(ctx, logger, id, breakdown)
+
+	rec := StoredReceipt{
+		ID:           id,
+		Retailer:     validatedData.Retailer,
+		PurchaseDate: validatedData.PurchaseDate,
+		Points:       points,
+		TotalCents:   validatedData.TotalCents,
+		ProcessedAt:  now,
+		Receipt:      receipt,
+		RuleVersion:  ruleVersion(rules),
+		ScoredAt:     now,
+
+		ConsecutiveDay: validatedData.ConsecutiveDay,
+		FirstOfDay:     validatedData.FirstOfDay,
+		Warnings:       validatedData.Warnings,
+	}
+	if err := store.Save(rec); err != nil {
+		logger.Error("Failed to store receipt", slog.Any("error", err), slog.String("id", id))
+		return StoredReceipt{}, err
+	}
+	if err := creditReceipt(store, rec, cfg, now); err != nil {
+		// Without its credit the receipt would never count toward the balance
+		logger.Error("Failed to credit receipt to its user", slog.Any("error", err), slog.String("id", id), slog.String("user_id", receipt.UserID))
+		if _, err := store.Delete(id); err != nil {
+			logger.Error("Failed to remove uncredited receipt", slog.Any("error", err), slog.String("id", id))
+		}
+		return StoredReceipt{}, err
+	}
+
+	logger.Info("Receipt processed", slog.String("id", id), slog.Int64("points", points), slog.String("retailer", validatedData.Retailer), slog.String("total", formatCents(validatedData.TotalCents)))
+	events.Publish(ReceiptEvent{ID: id, Points: points, Retailer: validatedData.Retailer, Tenant: contextTenant(ctx)})
+	prom.receiptProcessed(contextTenant(ctx))
+	scoreShadow(cfg, contextTenant(ctx), id, validatedData, points, logger)
+	return rec, nil
+}
+
+// maxClientRefLength bounds the client reference echoed in batch results.
+const maxClientRefLength = 128
+
+// Handles POST /receipts/process/batch requests. The body is a JSON array
+// whose entries are either a receipt or {"clientRef": "...", "receipt": {...}};
+// each entry is processed independently and the results, in input order,
+// echo its clientRef.
+func processBatchHandler(w http.ResponseWriter, r *http.Request, cfg *Config, store Store, events *broker, prom *promMetrics, sampler *payloadSampler, idGen IDGenerator, clock Clock, logger *slog.Logger) {
+	body, err := readBody(w, r, cfg, sampler, logger)
+	if err != nil {
+		bodyErrorResponse(w, cfg, err, logger)
+		return
+	}
+	var entries []json.RawMessage
+	if err := json.NewDecoder(body).Decode(&entries); err != nil {
+		logger.Warn("Failed to decode batch JSON", slog.Any("error", err))
+		bodyErrorResponse(w, cfg, err, logger)
+		return
+	}
+
+	type BatchResult struct {
+		ClientRef string   `json:"clientRef,omitempty"`
+		ID        string   `json:"id,omitempty"`
+		Points    *int64   `json:"points,omitempty"`
+		Warnings  []string `json:"warnings,omitempty"`
+		Error     string   `json:"error,omitempty"`
+		Detail    string   `json:"detail,omitempty"`
+	}
+	results := make([]BatchResult, len(entries))
+	for i, entry := range entries {
+		result := &results[i]
+		fail := func(status int, message, reason string) {
+			result.Error = message
+			if cfg.VerboseErrors && status == http.StatusBadRequest {
+				result.Detail = reason
+			}
+		}
+
+		raw, clientRef, err := unwrapBatchEntry(entry)
+		if err != nil {
+			logger.Warn("Invalid batch entry", slog.Int("index", i), slog.Any("error", err))
+			fail(http.StatusBadRequest, badRequestMsg, err.Error())
+			continue
+		}
+		result.ClientRef = clientRef
+
+		var receipt Receipt
+		if err := decodeReceipt(bytes.NewReader(raw), cfg.JSONNaming, &receipt); err != nil {
+			logger.Warn("Failed to decode batch receipt", slog.Int("index", i), slog.Any("error", err))
+			fail(http.StatusBadRequest, badRequestMsg, describeDecodeError(err))
+			continue
+		}
+		rec, err := acceptReceipt(r.Context(), receipt, cfg, store, events, prom, idGen, clock, logger.With(slog.Int("index", i)))
+		var rejected *receiptRejection
+		switch {
+		case errors.As(err, &rejected):
+			fail(rejected.status, rejected.message, rejected.reason)
+		case err != nil:
+			fail(http.StatusInternalServerError, internalErrorMsg, "")
+		default:
+			result.ID = rec.ID
+			result.Points = &rec.Points
+			result.Warnings = rec.Warnings
+		}
+	}
+
+	jsonResponse(w, http.StatusOK, results, logger)
+}
+
+// unwrapBatchEntry returns the receipt JSON and client reference of a batch
+// entry. An entry with a "receipt" key is a wrapper; anything else is taken
+// to be a bare receipt.
+func unwrapBatchEntry(entry json.RawMessage) (json.RawMessage, string, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(entry, &probe); err != nil {
+		return nil, "", fmt.Errorf("batch entry is not a JSON object")
+	}
+	if _, wrapped := probe["receipt"]; !wrapped {
+		return entry, "", nil
+	}
+
+	var wrapper struct {
+		ClientRef string          `json:"clientRef"`
+		Receipt   json.RawMessage `json:"receipt"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(entry))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&wrapper); err != nil {
+		return nil, "", fmt.Errorf("invalid batch entry: %s", describeDecodeError(err))
+	}
+	if len(wrapper.ClientRef) > maxClientRefLength || !isCleanUTF8(wrapper.ClientRef) {
+		return nil, "", fmt.Errorf("invalid clientRef")
+	}
+	return wrapper.Receipt, wrapper.ClientRef, nil
+}
+
+// getDuplicateOriginal looks up the receipt holding a fingerprint claim.
+// Claims recorded before receipt ids were kept with them have no holder.
+func getDuplicateOriginal(store Store, holder string) (StoredReceipt, bool, error) {
+	if holder == "" {
+		return StoredReceipt{}, false, nil
+	}
+	return store.Get(holder)
+}
+
+// duplicateWarning flags a receipt accepted under duplicateAllow.
+func duplicateWarning(holder string) string {
+	if holder == "" {
+		return "possible duplicate of an earlier receipt"
+	}
+	return "possible duplicate of receipt " + holder
+}
+
+// logBreakdown emits each rule's contribution at debug level, for tracing
+// scoring discrepancies. It does nothing unless debug logging is enabled.
+func logBreakdown(ctx context.Context, logger *slog.Logger, id string, breakdown []RuleResult) {
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	for _, result := range breakdown {
+		logger.LogAttrs(ctx, slog.LevelDebug, "Scoring rule applied", slog.String("id", id), slog.String("rule", result.Rule), slog.Int64("points", result.Points))
+	}
+}
+
+// Handles GET /receipts/{id}/points/breakdown requests, reporting each
+// rule's contribution to the stored points. The breakdown is recomputed, so
+// it is only available while the rules that scored the receipt are in force.
+func getBreakdownHandler(w http.ResponseWriter, r *http.Request, cfg *Config, store Store, ids *regexp.Regexp, logger *slog.Logger) {
 	id := r.PathValue("id")
 
-	if id == "" || !idPatternRegex.MatchString(id) {
+	if id == "" || !ids.MatchString(id) {
 		logger.Warn("Invalid ID format requested", slog.String("requested_id", id))
 		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
 		return
 	}
 
-	storeMutex.RLock()
-	points, found := receiptPointsStore[id]
-	storeMutex.RUnlock()
+	rec, found, err := store.Get(id)
+	if err != nil {
+		logger.Error("Failed to read receipt", slog.Any("error", err), slog.String("id", id))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	if !found {
+		logger.Warn("Receipt ID not found", slog.String("id", id))
+		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
+		return
+	}
+	rules := cfg.pointsFor(contextTenant(r.Context()))
+	if current := ruleVersion(rules); rec.RuleVersion != current {
+		logger.Warn("Breakdown requested under changed rules", slog.String("id", id), slog.String("rule_version", rec.RuleVersion), slog.String("current_rule_version", current))
+		errorResponse(w, http.StatusConflict, staleRulesMsg, logger)
+		return
+	}
+
+	data, err := storedReceiptData(&rec, cfg)
+	if err != nil {
+		logger.Error("Failed to rescore receipt", slog.Any("error", err), slog.String("id", id))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+
+	type BreakdownResponse struct {
+		ID          string       `json:"id"`
+		Points      int64        `json:"points"`
+		RuleVersion string       `json:"ruleVersion"`
+		Breakdown   []RuleResult `json:"breakdown"`
+	}
+	jsonResponse(w, http.StatusOK, BreakdownResponse{
+		ID:          id,
+		Points:      rec.Points,
+		RuleVersion: rec.RuleVersion,
+		Breakdown:   calculatePointsBreakdown(data, rules),
+	}, logger)
+}
+
+// Handles GET /receipts/{id}/points requests.
+func getPointsHandler(w http.ResponseWriter, r *http.Request, cfg *Config, store Store, ids *regexp.Regexp, signer *pointsTokenSigner, clock Clock, logger *slog.Logger) {
+	id := r.PathValue("id")
 
+	var withProvenance bool
+	if v := r.URL.Query().Get("provenance"); v != "" {
+		var err error
+		if withProvenance, err = strconv.ParseBool(v); err != nil {
+			logger.Warn("Invalid provenance parameter", slog.String("provenance", v))
+			errorResponse(w, http.StatusBadRequest, invalidFilterMsg, logger)
+			return
+		}
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = pointsFormatPlain
+		if strings.Contains(r.Header.Get("Accept"), pointsObjectMediaType) {
+			format = pointsFormatObject
+		}
+	}
+	if format != pointsFormatPlain && format != pointsFormatObject && (format != pointsFormatJWT || signer == nil) {
+		errorResponse(w, http.StatusBadRequest, unsupportedFormatMsg, logger)
+		return
+	}
+
+	if id == "" || !ids.MatchString(id) {
+		logger.Warn("Invalid ID format requested", slog.String("requested_id", id))
+		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
+		return
+	}
+
+	rec, found, err := store.Get(id)
+	if err != nil {
+		logger.Error("Failed to read receipt", slog.Any("error", err), slog.String("id", id))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
 	if !found {
 		logger.Warn("Receipt ID not found", slog.String("id", id))
 		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
 		return
 	}
 
-	logger.Info("Points retrieved", slog.String("id", id), slog.Int64("points", points))
+	logger.Info("Points retrieved", slog.String("id", id), slog.Int64("points", rec.Points))
+
+	// PointsProvenance records which rules produced the stored points. The
+	// breakdown is only reproducible while those rules are still in force.
+	type PointsProvenance struct {
+		RuleVersion        string       `json:"ruleVersion"`
+		CurrentRuleVersion string       `json:"currentRuleVersion"`
+		ScoredAt           time.Time    `json:"scoredAt"`
+		Breakdown          []RuleResult `json:"breakdown,omitempty"`
+	}
+	rules := cfg.pointsFor(contextTenant(r.Context()))
+	var provenance *PointsProvenance
+	if withProvenance {
+		provenance = &PointsProvenance{
+			RuleVersion:        rec.RuleVersion,
+			CurrentRuleVersion: ruleVersion(rules),
+			ScoredAt:           rec.ScoredAt,
+		}
+		if provenance.RuleVersion == provenance.CurrentRuleVersion {
+			data, err := storedReceiptData(&rec, cfg)
+			if err != nil {
+				logger.Error("Failed to rescore receipt", slog.Any("error", err), slog.String("id", id))
+				errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+				return
+			}
+			provenance.Breakdown = calculatePointsBreakdown(data, rules)
+		}
+	}
+
+	if format == pointsFormatJWT {
+		token, err := signer.Sign(newPointsClaims(id, rec.Points, clock.Now()))
+		if err != nil {
+			logger.Error("Failed to sign points token", slog.Any("error", err), slog.String("id", id))
+			errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+			return
+		}
+		type PointsTokenResponse struct {
+			Points      int64             `json:"points"`
+			RuleVersion string            `json:"ruleVersion,omitempty"`
+			Token       string            `json:"token"`
+			Provenance  *PointsProvenance `json:"provenance,omitempty"`
+		}
+		jsonResponse(w, http.StatusOK, PointsTokenResponse{Points: rec.Points, RuleVersion: rec.RuleVersion, Token: token, Provenance: provenance}, logger)
+		return
+	}
+
+	if format == pointsFormatObject {
+		type PointsValue struct {
+			Value   int64  `json:"value"`
+			Display string `json:"display"`
+		}
+		type PointsObjectResponse struct {
+			Points      PointsValue       `json:"points"`
+			RuleVersion string            `json:"ruleVersion,omitempty"`
+			Provenance  *PointsProvenance `json:"provenance,omitempty"`
+		}
+		display := fmt.Sprintf("%d points", rec.Points)
+		if rec.Points == 1 {
+			display = "1 point"
+		}
+		jsonResponse(w, http.StatusOK, PointsObjectResponse{Points: PointsValue{Value: rec.Points, Display: display}, RuleVersion: rec.RuleVersion, Provenance: provenance}, logger)
+		return
+	}
 
+	// RuleVersion is the version that computed Points, which stays the same
+	// after a rule change until the receipt is recalculated
 	type PointsResponse struct {
-		Points int64 `json:"points"`
+		Points      int64             `json:"points"`
+		RuleVersion string            `json:"ruleVersion,omitempty"`
+		Provenance  *PointsProvenance `json:"provenance,omitempty"`
+	}
+	offers := []representation{{MediaType: mediaTypeJSON, Value: PointsResponse{Points: rec.Points, RuleVersion: rec.RuleVersion, Provenance: provenance}}}
+	// The provenance record only has a JSON form
+	if provenance == nil {
+		type PointsXML struct {
+			XMLName xml.Name `xml:"points"`
+			Points  int64    `xml:",chardata"`
+		}
+		offers = append(offers,
+			representation{MediaType: mediaTypeText, Value: rec.Points},
+			representation{MediaType: mediaTypeXML, Value: PointsXML{Points: rec.Points}})
+	}
+	negotiatedResponse(w, r, http.StatusOK, offers, logger)
+}
+
+// Handles GET /receipts/stream requests, pushing a Server-Sent Event for
+// every receipt processed while the client is connected.
+func streamReceiptsHandler(w http.ResponseWriter, r *http.Request, events *broker, logger *slog.Logger) {
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's WriteTimeout, so lift it for this response
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		logger.Warn("Could not clear write deadline for stream", slog.Any("error", err))
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.Error("Streaming not supported", slog.Any("error", err))
+		return
+	}
+
+	sub, unsubscribe := events.Subscribe(r.Context(), contextTenant(r.Context()))
+	defer unsubscribe()
+	logger.Info("Stream subscriber connected")
+
+	var reported int64 // drops already announced to this client
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			logger.Info("Stream subscriber disconnected")
+			return
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			// Let the client know it missed events while it was behind
+			if dropped := sub.Dropped(); dropped > reported {
+				logger.Warn("Stream subscriber fell behind", slog.Int64("dropped", dropped-reported))
+				if _, err := fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped-reported); err != nil {
+					return
+				}
+				reported = dropped
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				logger.Error("Failed to encode stream event", slog.Any("error", err))
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: receipt\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Handles GET /receipts/{id} requests, returning the stored receipt and
+// how it was scored.
+func getReceiptHandler(w http.ResponseWriter, r *http.Request, store Store, ids *regexp.Regexp, logger *slog.Logger) {
+	id := r.PathValue("id")
+
+	if id == "" || !ids.MatchString(id) {
+		logger.Warn("Invalid ID format requested", slog.String("requested_id", id))
+		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
+		return
+	}
+
+	rec, found, err := store.Get(id)
+	if err != nil {
+		logger.Error("Failed to read receipt", slog.Any("error", err), slog.String("id", id))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	if !found {
+		logger.Warn("Receipt ID not found", slog.String("id", id))
+		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
+		return
+	}
+
+	w.Header().Set("ETag", receiptETag(rec))
+	jsonResponse(w, http.StatusOK, newReceiptDetail(rec), logger)
+}
+
+// Page sizes for GET /receipts when paginated.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// encodePageCursor returns the cursor for the page following rec.
+func encodePageCursor(rec StoredReceipt) string {
+	return base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, "%d:%s", rec.ProcessedAt.UnixNano(), rec.ID))
+}
+
+// decodePageCursor parses a cursor from encodePageCursor into the position
+// of the last receipt on the previous page.
+func decodePageCursor(cursor string) (processedAt time.Time, id string, ok bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	nanos, id, found := strings.Cut(string(raw), ":")
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if !found || err != nil || id == "" {
+		return time.Time{}, "", false
+	}
+	return time.Unix(0, n).UTC(), id, true
+}
+
+// Handles GET /receipts requests, listing the receipts processed between the
+// optional RFC 3339 "from" (inclusive) and "to" (exclusive) query parameters.
+// With "limit" or "cursor" the list is split into pages, each response
+// carrying the cursor for the next. writeTimeout replaces the server's
+// WriteTimeout for the response.
+func listReceiptsHandler(w http.ResponseWriter, r *http.Request, store Store, writeTimeout time.Duration, logger *slog.Logger) {
+	// A full export can take longer to send than the server's WriteTimeout
+	// allows, which would cut the body off mid-stream
+	var deadline time.Time
+	if writeTimeout > 0 {
+		deadline = time.Now().Add(writeTimeout)
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+		logger.Warn("Could not extend write deadline for export", slog.Any("error", err))
+	}
+
+	parseBound := func(name string) (time.Time, bool) {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			return time.Time{}, true
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			logger.Warn("Invalid time range parameter", slog.String(name, v))
+			return time.Time{}, false
+		}
+		return t, true
+	}
+	from, fromOK := parseBound("from")
+	to, toOK := parseBound("to")
+	if !fromOK || !toOK || (!from.IsZero() && !to.IsZero() && !from.Before(to)) {
+		errorResponse(w, http.StatusBadRequest, invalidFilterMsg, logger)
+		return
+	}
+
+	query := r.URL.Query()
+	paged := query.Has("limit") || query.Has("cursor")
+	limit := defaultPageSize
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			logger.Warn("Invalid page limit", slog.String("limit", v))
+			errorResponse(w, http.StatusBadRequest, invalidFilterMsg, logger)
+			return
+		}
+		limit = n
+	}
+	// Without a cursor a page starts with the receipts processed at from
+	after, afterID := from, ""
+	if v := query.Get("cursor"); v != "" {
+		cursorTime, cursorID, ok := decodePageCursor(v)
+		if !ok {
+			logger.Warn("Invalid page cursor", slog.String("cursor", v))
+			errorResponse(w, http.StatusBadRequest, invalidFilterMsg, logger)
+			return
+		}
+		// A cursor from before from is outside the range
+		if !cursorTime.Before(from) {
+			after, afterID = cursorTime, cursorID
+		}
+	}
+
+	type ListResponse struct {
+		Receipts   []ReceiptDetail `json:"receipts"`
+		NextCursor string          `json:"nextCursor,omitempty"`
+	}
+	var resp ListResponse
+	var recs []StoredReceipt
+	var err error
+	if paged {
+		// One more than the page holds tells whether another follows
+		recs, err = store.ProcessedPage(after, afterID, to, limit+1)
+		if err == nil && len(recs) > limit {
+			recs = recs[:limit]
+			resp.NextCursor = encodePageCursor(recs[limit-1])
+		}
+	} else {
+		recs, err = store.ProcessedBetween(from, to)
+	}
+	if err != nil {
+		logger.Error("Failed to list receipts", slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	resp.Receipts = make([]ReceiptDetail, 0, len(recs))
+	for _, rec := range recs {
+		resp.Receipts = append(resp.Receipts, newReceiptDetail(rec))
+	}
+	jsonResponse(w, http.StatusOK, resp, logger)
+}
+
+// Handles HEAD /receipts/{id} requests, reporting whether the receipt
+// exists without fetching it.
+func headReceiptHandler(w http.ResponseWriter, r *http.Request, store Store, ids *regexp.Regexp, logger *slog.Logger) {
+	id := r.PathValue("id")
+
+	if id == "" || !ids.MatchString(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	found, err := store.Exists(id)
+	if err != nil {
+		logger.Error("Failed to check receipt", slog.Any("error", err), slog.String("id", id))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Handles DELETE /receipts/{id} requests, removing a stored receipt and
+// taking its credit back from its user.
+func deleteReceiptHandler(w http.ResponseWriter, r *http.Request, store Store, ids *regexp.Regexp, clock Clock, logger *slog.Logger) {
+	id := r.PathValue("id")
+
+	if id == "" || !ids.MatchString(id) {
+		logger.Warn("Invalid ID format requested", slog.String("requested_id", id))
+		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
+		return
+	}
+
+	rec, found, err := store.Get(id)
+	if err == nil && found {
+		found, err = store.Delete(id)
+	}
+	if err != nil {
+		logger.Error("Failed to delete receipt", slog.Any("error", err), slog.String("id", id))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	if !found {
+		logger.Warn("Receipt ID not found", slog.String("id", id))
+		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
+		return
+	}
+	if err := adjustCredit(store, rec.Receipt.UserID, id, 0, clock.Now()); err != nil {
+		logger.Error("Failed to take back credit of deleted receipt", slog.Any("error", err), slog.String("id", id), slog.String("user_id", rec.Receipt.UserID))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+
+	logger.Info("Receipt deleted", slog.String("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReceiptDetail is the JSON representation of a stored receipt.
+type ReceiptDetail struct {
+	ID          string    `json:"id"`
+	Points      int64     `json:"points"`
+	Total       string    `json:"total"` // the parsed total as N.NN
+	RuleVersion string    `json:"ruleVersion"`
+	ProcessedAt time.Time `json:"processedAt"`
+	ScoredAt    time.Time `json:"scoredAt"`
+	Receipt     Receipt   `json:"receipt"`
+	Warnings    []string  `json:"warnings,omitempty"`
+}
+
+// newReceiptDetail converts a stored receipt for a response.
+func newReceiptDetail(rec StoredReceipt) ReceiptDetail {
+	return ReceiptDetail{
+		ID:          rec.ID,
+		Points:      rec.Points,
+		Total:       formatCents(rec.TotalCents),
+		RuleVersion: rec.RuleVersion,
+		ProcessedAt: rec.ProcessedAt,
+		ScoredAt:    rec.ScoredAt,
+		Receipt:     rec.Receipt,
+		Warnings:    rec.Warnings,
+	}
+}
+
+// receiptETag returns a strong entity tag for the stored state of a receipt.
+// It covers everything a handler may change, so any update produces a new tag.
+func receiptETag(rec StoredReceipt) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s|%d|%s|%s", rec.ID, rec.Points, rec.RuleVersion, rec.ScoredAt.Format(time.RFC3339Nano)))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatches applies an If-Match header value to the current tag: "*" or a
+// listed tag matches. Comparison is strong, so weak (W/) tags never match.
+func etagMatches(ifMatch, current string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+// errPreconditionFailed aborts an update whose If-Match header no longer
+// matches the stored receipt.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// Handles POST /receipts/{id}/recalculate requests, rescoring a stored
+// receipt under the current rules and adjusting its credit to match. An
+// If-Match header makes the update conditional on the receipt's current ETag.
+func recalculateHandler(w http.ResponseWriter, r *http.Request, cfg *Config, store Store, ids *regexp.Regexp, clock Clock, logger *slog.Logger) {
+	id := r.PathValue("id")
+
+	if id == "" || !ids.MatchString(id) {
+		logger.Warn("Invalid ID format requested", slog.String("requested_id", id))
+		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
+		return
 	}
-	jsonResponse(w, http.StatusOK, PointsResponse{Points: points}, logger)
+
+	rules := cfg.pointsFor(contextTenant(r.Context()))
+	ifMatch := r.Header.Get("If-Match")
+	var previous int64
+	rec, found, err := store.Update(id, func(rec *StoredReceipt) error {
+		// Checked inside Update so no other write can land between the check and ours
+		if ifMatch != "" && !etagMatches(ifMatch, receiptETag(*rec)) {
+			return errPreconditionFailed
+		}
+		points, err := scoreReceipt(rec, cfg, rules)
+		if err != nil {
+			return err
+		}
+		previous = rec.Points
+		rec.Points = points
+		rec.RuleVersion = ruleVersion(rules)
+		rec.ScoredAt = clock.Now()
+		return nil
+	})
+	if errors.Is(err, errPreconditionFailed) {
+		logger.Warn("Recalculate precondition failed", slog.String("id", id), slog.String("if_match", ifMatch))
+		errorResponse(w, http.StatusPreconditionFailed, preconditionFailedMsg, logger)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to recalculate receipt", slog.Any("error", err), slog.String("id", id))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	if !found {
+		logger.Warn("Receipt ID not found", slog.String("id", id))
+		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
+		return
+	}
+	// Adjusted even if the points are unchanged, so a retry repairs a failed adjustment
+	if err := adjustCredit(store, rec.Receipt.UserID, id, rec.Points, clock.Now()); err != nil {
+		logger.Error("Failed to adjust credit of recalculated receipt", slog.Any("error", err), slog.String("id", id), slog.String("user_id", rec.Receipt.UserID))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+
+	logger.Info("Receipt recalculated", slog.String("id", id), slog.Int64("previous_points", previous), slog.Int64("points", rec.Points), slog.String("rule_version", rec.RuleVersion))
+
+	w.Header().Set("ETag", receiptETag(rec))
+	jsonResponse(w, http.StatusOK, newReceiptDetail(rec), logger)
 }
 
+// scoreReceipt recomputes the points of an already-accepted receipt under
+// rules. Only the parsing settings of cfg apply: admission limits (totals, strictness) in force when
+// the receipt was submitted are not re-applied.
+func scoreReceipt(rec *StoredReceipt, cfg *Config, rules PointsConfig) (int64, error) {
+	data, err := storedReceiptData(rec, cfg)
+	if err != nil {
+		return 0, err
+	}
+	return calculatePoints(data, rules), nil
+}
+
+// storedReceiptData re-parses a stored receipt for scoring, restoring the
+// caller-set fields recorded when it was submitted.
+func storedReceiptData(rec *StoredReceipt, cfg *Config) (*ValidatedReceiptData, error) {
+	data, err := validateAndParseReceipt(&rec.Receipt, cfg.Validation.formatOnly())
+	if err != nil {
+		return nil, err
+	}
+	data.ConsecutiveDay = rec.ConsecutiveDay
+	data.FirstOfDay = rec.FirstOfDay
+	data.ProcessedAt = rec.ProcessedAt
+	return data, nil
+}
+
+// Handles GET /receipts/{id}/rank requests.
+func getRankHandler(w http.ResponseWriter, r *http.Request, store Store, ids *regexp.Regexp, logger *slog.Logger) {
+	id := r.PathValue("id")
+
+	if id == "" || !ids.MatchString(id) {
+		logger.Warn("Invalid ID format requested", slog.String("requested_id", id))
+		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
+		return
+	}
+
+	rank, found, err := store.Rank(id)
+	if err != nil {
+		logger.Error("Failed to rank receipt", slog.Any("error", err), slog.String("id", id))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	if !found {
+		logger.Warn("Receipt ID not found", slog.String("id", id))
+		errorResponse(w, http.StatusNotFound, notFoundMsg, logger)
+		return
+	}
+
+	// Percentile: share of stored receipts scoring the same or lower, to one decimal
+	percentile := math.Round(float64(rank.AtOrBelow)/float64(rank.Total)*1000) / 10
+
+	type RankResponse struct {
+		Points     int64   `json:"points"`
+		Rank       int     `json:"rank"`
+		Total      int     `json:"total"`
+		Percentile float64 `json:"percentile"`
+	}
+	jsonResponse(w, http.StatusOK, RankResponse{Points: rank.Points, Rank: rank.Rank, Total: rank.Total, Percentile: percentile}, logger)
+}
+
+// Handles POST /receipts/compare requests, scoring two receipts without
+// storing them and reporting the rules where their points differ. Both are
+// scored as if processed now, as they would be if submitted.
+func compareReceiptsHandler(w http.ResponseWriter, r *http.Request, cfg *Config, clock Clock, logger *slog.Logger) {
+	type CompareRequest struct {
+		First  json.RawMessage `json:"first"`
+		Second json.RawMessage `json:"second"`
+	}
+	type CompareSide struct {
+		Points    *int64       `json:"points,omitempty"`
+		Breakdown []RuleResult `json:"breakdown,omitempty"`
+		Error     string       `json:"error,omitempty"`
+		Detail    string       `json:"detail,omitempty"`
+	}
+	type RuleDiff struct {
+		Rule   string `json:"rule"`
+		First  int64  `json:"first"`
+		Second int64  `json:"second"`
+		Delta  int64  `json:"delta"` // second minus first
+	}
+	type CompareResponse struct {
+		First  CompareSide `json:"first"`
+		Second CompareSide `json:"second"`
+		Delta  *int64      `json:"delta,omitempty"`
+		Diff   []RuleDiff  `json:"diff,omitempty"`
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+
+	var req CompareRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		logger.Warn("Failed to decode compare request", slog.Any("error", err))
+		bodyErrorResponse(w, cfg, err, logger)
+		return
+	}
+
+	rules := cfg.pointsFor(contextTenant(r.Context()))
+	// score validates one side, filling in either its breakdown or its error
+	score := func(raw json.RawMessage, side *CompareSide) bool {
+		var receipt Receipt
+		var reason string
+		if len(raw) == 0 {
+			reason = "receipt missing"
+		} else if err := decodeReceipt(bytes.NewReader(raw), cfg.JSONNaming, &receipt); err != nil {
+			reason = describeDecodeError(err)
+		} else if data, err := validateAndParseReceipt(&receipt, cfg.Validation); err != nil {
+			reason = err.Error()
+		} else {
+			data.ProcessedAt = clock.Now()
+			side.Breakdown = calculatePointsBreakdown(data, rules)
+			points := sumBreakdown(side.Breakdown)
+			side.Points = &points
+			return true
+		}
+		side.Error = badRequestMsg
+		if cfg.VerboseErrors {
+			side.Detail = reason
+		}
+		return false
+	}
+
+	var resp CompareResponse
+	firstOK := score(req.First, &resp.First)
+	secondOK := score(req.Second, &resp.Second)
+	if !firstOK || !secondOK {
+		logger.Warn("Compare request contained an invalid receipt", slog.Bool("first_valid", firstOK), slog.Bool("second_valid", secondOK))
+		jsonResponse(w, http.StatusBadRequest, resp, logger)
+		return
+	}
+
+	// A promotion is only listed for the receipts it covers, so rules are
+	// matched by name, and one missing from a breakdown scored nothing there
+	points := make(map[string][2]int64)
+	var names []string
+	for side, breakdown := range [][]RuleResult{resp.First.Breakdown, resp.Second.Breakdown} {
+		for _, result := range breakdown {
+			sides, seen := points[result.Rule]
+			if !seen {
+				names = append(names, result.Rule)
+			}
+			sides[side] = result.Points
+			points[result.Rule] = sides
+		}
+	}
+	for _, rule := range names {
+		if sides := points[rule]; sides[0] != sides[1] {
+			resp.Diff = append(resp.Diff, RuleDiff{Rule: rule, First: sides[0], Second: sides[1], Delta: sides[1] - sides[0]})
+		}
+	}
+	delta := *resp.Second.Points - *resp.First.Points
+	resp.Delta = &delta
+
+	jsonResponse(w, http.StatusOK, resp, logger)
+}
+
+// traceFlushTimeout bounds how long exiting waits for buffered spans to be
+// exported, after requests have drained.
+const traceFlushTimeout = 5 * time.Second
+
 // main is the application entry point.
 func main() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:], os.Stdout, os.Stderr))
+	}
 
-	mux := http.NewServeMux()
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Invalid configuration", slog.Any("error", err))
+		os.Exit(1)
+	}
 
-	// Register endpoint handlers
-	mux.HandleFunc("POST /receipts/process", func(w http.ResponseWriter, r *http.Request) {
-		processReceiptHandler(w, r, logger)
-	})
-	mux.HandleFunc("GET /receipts/{id}/points", func(w http.ResponseWriter, r *http.Request) {
-		getPointsHandler(w, r, logger)
-	})
-	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Receipt Processor API Ready"))
-	})
+	logger, err := newLogger(cfg.Log)
+	if err != nil {
+		slog.Error("Failed to configure logging", slog.Any("error", err))
+		os.Exit(1)
+	}
+	// Bonus script failures are logged from inside scoring, which has no logger passed in
+	slog.SetDefault(logger)
+
+	store, err := openStore(cfg, logger)
+	if err != nil {
+		logger.Error("Failed to open store", slog.String("backend", cfg.Store.Backend), slog.Any("error", err))
+		os.Exit(1)
+	}
+	backend := store // closed at shutdown, after the decorators are done with it
+	// Snapshots and the write-ahead log are only allowed with the memory
+	// backend, see loadConfig
+	var snapshots snapshotSource
+	var wal *walStore
+	if cfg.Store.SnapshotPath != "" || cfg.Store.WALPath != "" {
+		mem := store.(*memoryStore)
+		var snap memorySnapshot
+		if cfg.Store.SnapshotPath != "" {
+			var found bool
+			if snap, found, err = loadSnapshot(mem, cfg.Store.SnapshotPath, cfg.Store.SnapshotFormat); err != nil {
+				logger.Error("Failed to load snapshot", slog.String("path", cfg.Store.SnapshotPath), slog.Any("error", err))
+				os.Exit(1)
+			}
+			if found {
+				logger.Info("Loaded snapshot",
+					slog.String("path", cfg.Store.SnapshotPath),
+					slog.Int("receipts", len(snap.Receipts)),
+					slog.Time("taken_at", snap.TakenAt))
+			}
+			snapshots = mem
+		}
+		if cfg.Store.WALPath != "" {
+			if wal, err = openWAL(mem, snap, cfg.Store.WALPath, cfg.Store.WALSync, logger); err != nil {
+				logger.Error("Failed to open write-ahead log", slog.String("path", cfg.Store.WALPath), slog.Any("error", err))
+				os.Exit(1)
+			}
+			store = wal
+			if snapshots != nil {
+				snapshots = wal
+			}
+		}
+	}
+	// Replicas receive what reaches the primary, WAL included, and are
+	// retried along with it so a retried write is copied only once it lands
+	replicas, err := openReplicas(cfg, logger)
+	if err != nil {
+		logger.Error("Failed to open replica store", slog.Any("error", err))
+		os.Exit(1)
+	}
+	if len(replicas) > 0 {
+		store = newReplicatingStore(store, replicas, logger)
+		logger.Info("Replicating writes", slog.Any("replicas", cfg.Store.Replicas))
+	}
+	if cfg.Store.Retries > 0 {
+		store = newRetryingStore(store, cfg.Store.Retries, cfg.Store.RetryDelay, cfg.Store.RetryTimeout, logger)
+	}
+	// Outermost, so observed latency includes any retries
+	metrics := newStoreMetrics()
+	store = newObservableStore(store, metrics)
+	prom := newPromMetrics(store, cfg.MultiTenant, logger)
+
+	var sampler *payloadSampler
+	if cfg.Sampling.Rate > 0 {
+		out, err := openLogOutput(cfg.Sampling.Output)
+		if err != nil {
+			logger.Error("Failed to open payload sample output", slog.Any("error", err))
+			os.Exit(1)
+		}
+		sampler = newPayloadSampler(cfg.Sampling.Rate, cfg.Sampling.RedactFields, out)
+	}
+
+	var signer *pointsTokenSigner
+	if cfg.PointsTokenSeed != nil {
+		if signer, err = newPointsTokenSigner(cfg.PointsTokenSeed); err != nil {
+			logger.Error("Invalid points token key", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
 
 	// Determine port or use default
 	port := os.Getenv("PORT")
@@ -106,18 +1330,100 @@ func main() {
 		port = "8080"
 	}
 
+	var ids IDGenerator = uuidGenerator{}
+	if cfg.DeterministicIDs {
+		ids = contentIDGenerator{}
+	}
+
+	events := newBroker(64)
+	handler := newRouter(routerDeps{
+		Config:     cfg,
+		Store:      store,
+		Events:     events,
+		Sampler:    sampler,
+		Signer:     signer,
+		Metrics:    metrics,
+		Prometheus: prom,
+		IDs:        ids,
+		Clock:      systemClock{},
+		Logger:     logger,
+	})
+
 	// Configure and start server
 	server := &http.Server{
 		Addr:         ":" + port,
-		Handler:      mux,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Handler:      handler,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+	}
+	// Shutdown waits for every request, so end event streams rather than
+	// holding it up until the timeout
+	server.RegisterOnShutdown(events.Close)
+
+	if cfg.EnablePprof && cfg.AdminToken == "" {
+		logger.Warn("ENABLE_PPROF is set but ADMIN_TOKEN is not; profiling endpoints are disabled")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.TraceProtocol != "" {
+		if shutdownTracing, err = setupTracing(ctx, cfg.TraceProtocol); err != nil {
+			logger.Error("Failed to set up tracing", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+	if snapshots != nil {
+		go runSnapshots(ctx, snapshots, cfg.Store, logger)
+	}
+	if cfg.RulesFile != "" || cfg.ShadowRulesFile != "" || len(cfg.RuleSetFiles) > 0 {
+		go watchRules(ctx, cfg, systemClock{}, logger)
+	}
+	if cfg.PointsExpiryDays > 0 {
+		go runPointsExpiry(ctx, store, cfg, systemClock{}, logger)
 	}
 
-	logger.Info("Server starting...", slog.String("port", port))
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	logger.Info("Server starting...", slog.String("port", port), slog.String("rule_version", cfg.rules.Load().Version))
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.ListenAndServe() }()
+	select {
+	case err := <-serveErr:
 		logger.Error("Server failed", slog.Any("error", err))
 		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	// Stop listening and let in-flight requests finish, then cut off any
+	// still running, so nothing writes to the store once it is closed
+	logger.Info("Shutting down...", slog.Duration("timeout", cfg.Server.ShutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Requests still running at shutdown were abandoned", slog.Any("error", err))
+		server.Close()
+	}
+	// After Shutdown, so receipts accepted by draining requests are included
+	if snapshots != nil {
+		saveSnapshot(snapshots, cfg.Store, logger)
+	}
+	if wal != nil {
+		if err := wal.Close(); err != nil {
+			logger.Error("Failed to close write-ahead log", slog.Any("error", err))
+		}
+	}
+	if err := closeStore(backend); err != nil {
+		logger.Error("Failed to close store", slog.String("backend", cfg.Store.Backend), slog.Any("error", err))
+	}
+	for i, replica := range replicas {
+		if err := closeStore(replica); err != nil {
+			logger.Error("Failed to close replica store", slog.String("backend", cfg.Store.Replicas[i]), slog.Any("error", err))
+		}
+	}
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), traceFlushTimeout)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		logger.Warn("Failed to flush traces", slog.Any("error", err))
 	}
+	logger.Info("Shutdown complete")
 }
@@ -0,0 +1,1288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProcessUnknownFieldError(t *testing.T) {
+	// The receipt with an extra "tax" field
+	body := strings.Replace(mustJSON(t, testReceipt()), `{`, `{"tax":"2.83",`, 1)
+	tests := []struct {
+		name       string
+		naming     string
+		verbose    string
+		wantDetail string
+	}{
+		{name: "verbose", naming: jsonNamingAny, verbose: "true", wantDetail: `unknown field "tax"`},
+		{name: "verbose, camelCase only", naming: jsonNamingCamel, verbose: "true", wantDetail: `unknown field "tax"`},
+		{name: "terse", naming: jsonNamingAny, verbose: "false", wantDetail: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"VERBOSE_ERRORS": tt.verbose, "JSON_FIELD_NAMING": tt.naming})})
+			resp, got := send(t, srv, http.MethodPost, "/receipts/process", body)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+			var errResp struct{ Error, Detail string }
+			decodeBody(t, got, &errResp)
+			if errResp.Error != badRequestMsg || errResp.Detail != tt.wantDetail {
+				t.Errorf("response = %+v, want error %q with detail %q", errResp, badRequestMsg, tt.wantDetail)
+			}
+		})
+	}
+}
+
+func TestRankHandler(t *testing.T) {
+	store := newMemoryStore(normalizeRetailer)
+	saveAll(t, store,
+		StoredReceipt{ID: "6f1c0f9e-3f5a-4e0e-9d0a-000000000001", Points: 10},
+		StoredReceipt{ID: "6f1c0f9e-3f5a-4e0e-9d0a-000000000002", Points: 28},
+		StoredReceipt{ID: "6f1c0f9e-3f5a-4e0e-9d0a-000000000003", Points: 28},
+		StoredReceipt{ID: "6f1c0f9e-3f5a-4e0e-9d0a-000000000004", Points: 109},
+	)
+	srv := newTestServer(t, routerDeps{Store: store})
+	type rankResponse struct {
+		Points     int64
+		Rank       int
+		Total      int
+		Percentile float64
+	}
+	tests := []struct {
+		name       string
+		id         string
+		wantStatus int
+		want       rankResponse
+	}{
+		{name: "highest", id: "6f1c0f9e-3f5a-4e0e-9d0a-000000000004", wantStatus: http.StatusOK, want: rankResponse{Points: 109, Rank: 1, Total: 4, Percentile: 100}},
+		{name: "tie", id: "6f1c0f9e-3f5a-4e0e-9d0a-000000000002", wantStatus: http.StatusOK, want: rankResponse{Points: 28, Rank: 2, Total: 4, Percentile: 75}},
+		{name: "other side of the tie", id: "6f1c0f9e-3f5a-4e0e-9d0a-000000000003", wantStatus: http.StatusOK, want: rankResponse{Points: 28, Rank: 2, Total: 4, Percentile: 75}},
+		{name: "lowest", id: "6f1c0f9e-3f5a-4e0e-9d0a-000000000001", wantStatus: http.StatusOK, want: rankResponse{Points: 10, Rank: 4, Total: 4, Percentile: 25}},
+		{name: "unknown id", id: "6f1c0f9e-3f5a-4e0e-9d0a-000000000005", wantStatus: http.StatusNotFound},
+		{name: "malformed id", id: "not-a-receipt", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := send(t, srv, http.MethodGet, "/receipts/"+tt.id+"/rank", "")
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got rankResponse
+			decodeBody(t, body, &got)
+			if got != tt.want {
+				t.Errorf("rank = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessInvalidUTF8(t *testing.T) {
+	srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"VERBOSE_ERRORS": "true"})})
+	// encoding/json turns invalid bytes into U+FFFD, which is rejected too
+	tests := []struct {
+		name       string
+		old, new   string
+		wantDetail string
+	}{
+		{name: "retailer", old: `"Target"`, new: "\"Tar\xffget\"", wantDetail: "retailer contains invalid UTF-8"},
+		{name: "item description", old: `"Doritos Nacho Cheese"`, new: "\"Doritos \xffNacho\"", wantDetail: "item 3: shortDescription contains invalid UTF-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.Replace(mustJSON(t, testReceipt()), tt.old, tt.new, 1)
+			resp, got := send(t, srv, http.MethodPost, "/receipts/process", body)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+			var errResp struct{ Error, Detail string }
+			decodeBody(t, got, &errResp)
+			if errResp.Detail != tt.wantDetail {
+				t.Errorf("detail = %q, want %q", errResp.Detail, tt.wantDetail)
+			}
+		})
+	}
+}
+
+func TestPointsFormats(t *testing.T) {
+	srv := newTestServer(t, routerDeps{})
+	id := processReceipt(t, srv, testReceipt())
+	tests := []struct {
+		name       string
+		query      string
+		accept     string
+		wantStatus int
+		want       string
+	}{
+		{name: "plain by default", wantStatus: http.StatusOK, want: `{"points":28,"ruleVersion":"` + ruleVersion(defaultPointsConfig()) + `"}`},
+		{name: "plain by query", query: "?format=plain", wantStatus: http.StatusOK, want: `{"points":28,"ruleVersion":"` + ruleVersion(defaultPointsConfig()) + `"}`},
+		{name: "object by query", query: "?format=object", wantStatus: http.StatusOK, want: `{"points":{"value":28,"display":"28 points"},"ruleVersion":"` + ruleVersion(defaultPointsConfig()) + `"}`},
+		{name: "object by Accept", accept: pointsObjectMediaType, wantStatus: http.StatusOK, want: `{"points":{"value":28,"display":"28 points"},"ruleVersion":"` + ruleVersion(defaultPointsConfig()) + `"}`},
+		{name: "unknown format", query: "?format=xml", wantStatus: http.StatusBadRequest, want: `{"error":"` + unsupportedFormatMsg + `"}`},
+		{name: "jwt without a signing key", query: "?format=jwt", wantStatus: http.StatusBadRequest, want: `{"error":"` + unsupportedFormatMsg + `"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var headers []string
+			if tt.accept != "" {
+				headers = []string{"Accept", tt.accept}
+			}
+			resp, body := send(t, srv, http.MethodGet, "/receipts/"+id+"/points"+tt.query, "", headers...)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := strings.TrimSpace(body); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareReceipts(t *testing.T) {
+	// Double points at Target throughout January 2022
+	rules := writeRulesFile(t, `
+promotions:
+  - name: target_january
+    from: 2022-01-01
+    to: 2022-01-31
+    retailer: "target"
+    multiplier: 2
+`)
+	srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"RULES_FILE": rules})})
+
+	type ruleDiff struct {
+		Rule                 string
+		First, Second, Delta int64
+	}
+	covered := testReceipt()
+	uncovered := testReceipt()
+	uncovered.PurchaseDate = "2022-02-01"
+	tests := []struct {
+		name          string
+		first, second Receipt
+		wantDelta     int64
+		wantDiff      []ruleDiff
+	}{
+		{
+			name:      "promotion covering only the first",
+			first:     covered,
+			second:    uncovered,
+			wantDelta: -28,
+			// February 1 is an odd day too, so only the promotion differs
+			wantDiff: []ruleDiff{{Rule: "promotion:target_january", First: 28, Second: 0, Delta: -28}},
+		},
+		{
+			name:      "promotion covering only the second",
+			first:     uncovered,
+			second:    covered,
+			wantDelta: 28,
+			wantDiff:  []ruleDiff{{Rule: "promotion:target_january", First: 0, Second: 28, Delta: 28}},
+		},
+		{
+			name:   "identical receipts",
+			first:  covered,
+			second: covered,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := send(t, srv, http.MethodPost, "/receipts/compare", `{"first":`+mustJSON(t, tt.first)+`,"second":`+mustJSON(t, tt.second)+`}`)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, http.StatusOK, body)
+			}
+			var got struct {
+				Delta int64
+				Diff  []ruleDiff
+			}
+			decodeBody(t, body, &got)
+			if got.Delta != tt.wantDelta || !slices.Equal(got.Diff, tt.wantDiff) {
+				t.Errorf("delta %d, diff %+v; want delta %d, diff %+v", got.Delta, got.Diff, tt.wantDelta, tt.wantDiff)
+			}
+		})
+	}
+}
+
+func TestComparePurchaseTimes(t *testing.T) {
+	srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"VERBOSE_ERRORS": "true"})})
+	at := func(purchaseTime string) string {
+		receipt := testReceipt()
+		receipt.PurchaseTime = purchaseTime
+		return mustJSON(t, receipt)
+	}
+	type ruleDiff struct {
+		Rule                 string
+		First, Second, Delta int64
+	}
+	afternoon := []ruleDiff{{Rule: rulePurchaseTime, First: 0, Second: 10, Delta: 10}}
+	tests := []struct {
+		name          string
+		first, second string
+		wantStatus    int
+		wantDelta     int64
+		wantDiff      []ruleDiff
+		wantErrors    [2]string // detail of each side
+	}{
+		{name: "morning and afternoon", first: at("09:30"), second: at("14:30"), wantStatus: http.StatusOK, wantDelta: 10, wantDiff: afternoon},
+		{name: "window start is exclusive", first: at("14:00"), second: at("14:01"), wantStatus: http.StatusOK, wantDelta: 10, wantDiff: afternoon},
+		{name: "window end is exclusive", first: at("16:00"), second: at("15:59"), wantStatus: http.StatusOK, wantDelta: 10, wantDiff: afternoon},
+		{name: "both in the window", first: at("14:01"), second: at("15:59"), wantStatus: http.StatusOK},
+		{name: "invalid time", first: at("14:30"), second: at("25:00"), wantStatus: http.StatusBadRequest, wantErrors: [2]string{"", "invalid purchaseTime format (HH:MM)"}},
+		{name: "missing receipt", first: at("14:30"), wantStatus: http.StatusBadRequest, wantErrors: [2]string{"", "receipt missing"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"first":` + tt.first + `}`
+			if tt.second != "" {
+				body = `{"first":` + tt.first + `,"second":` + tt.second + `}`
+			}
+			resp, got := send(t, srv, http.MethodPost, "/receipts/compare", body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, got)
+			}
+			type side struct{ Error, Detail string }
+			var compared struct {
+				First, Second side
+				Delta         int64
+				Diff          []ruleDiff
+			}
+			decodeBody(t, got, &compared)
+			if compared.Delta != tt.wantDelta || !slices.Equal(compared.Diff, tt.wantDiff) {
+				t.Errorf("delta %d, diff %+v; want delta %d, diff %+v", compared.Delta, compared.Diff, tt.wantDelta, tt.wantDiff)
+			}
+			if details := [2]string{compared.First.Detail, compared.Second.Detail}; details != tt.wantErrors {
+				t.Errorf("errors = %q, want %q", details, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestCompareFreshness(t *testing.T) {
+	purchased := time.Date(2022, 1, 1, 13, 1, 0, 0, time.UTC) // testReceipt's
+	stale := testReceipt()
+	stale.PurchaseDate = "2021-12-31"
+	tests := []struct {
+		name      string
+		processed time.Time
+		wantFirst int64 // points of testReceipt; the second is bought a day before
+		wantDelta int64
+	}{
+		{name: "first fresh", processed: purchased.Add(2 * time.Hour), wantFirst: 28 + 5, wantDelta: -5},
+		{name: "neither fresh", processed: purchased.Add(48 * time.Hour), wantFirst: 28},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"POINTS_FRESHNESS_BONUS": "5", "POINTS_FRESHNESS_WINDOW": "24h"})
+			srv := newTestServer(t, routerDeps{Config: cfg, Clock: newTestClock(tt.processed)})
+			body := `{"first":` + mustJSON(t, testReceipt()) + `,"second":` + mustJSON(t, stale) + `}`
+			resp, got := send(t, srv, http.MethodPost, "/receipts/compare", body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, http.StatusOK, got)
+			}
+			var compared struct {
+				First struct{ Points int64 }
+				Delta int64
+			}
+			decodeBody(t, got, &compared)
+			if compared.First.Points != tt.wantFirst || compared.Delta != tt.wantDelta {
+				t.Errorf("first %d points, delta %d; want %d, delta %d", compared.First.Points, compared.Delta, tt.wantFirst, tt.wantDelta)
+			}
+		})
+	}
+}
+
+func TestCompareMalformedRequest(t *testing.T) {
+	srv := newTestServer(t, routerDeps{})
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "invalid JSON", body: `{"first":`},
+		{name: "unknown field", body: `{"first":{},"second":{},"third":{}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp, _ := send(t, srv, http.MethodPost, "/receipts/compare", tt.body); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestRecalculateRuleVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		change      func(p *PointsConfig)
+		wantPoints  int64
+		wantVersion bool // whether the rule version changes
+	}{
+		{name: "rules unchanged", change: func(*PointsConfig) {}, wantPoints: 28},
+		{name: "rules changed", change: func(p *PointsConfig) { p.RetailerCharPoints = 2 }, wantPoints: 34, wantVersion: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			clock := newTestClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+			srv := newTestServer(t, routerDeps{Config: cfg, Clock: clock})
+			id := processReceipt(t, srv, testReceipt())
+			_, body := send(t, srv, http.MethodGet, "/receipts/"+id, "")
+			var before ReceiptDetail
+			decodeBody(t, body, &before)
+
+			rules := cfg.pointsFor("")
+			tt.change(&rules)
+			cfg.setPoints(rules, clock.Now())
+			clock.Advance(time.Hour)
+			resp, body := send(t, srv, http.MethodPost, "/receipts/"+id+"/recalculate", "")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("recalculate: status %d, body %s", resp.StatusCode, body)
+			}
+			_, body = send(t, srv, http.MethodGet, "/receipts/"+id, "")
+			var after ReceiptDetail
+			decodeBody(t, body, &after)
+
+			if after.Points != tt.wantPoints {
+				t.Errorf("points = %d, want %d", after.Points, tt.wantPoints)
+			}
+			if after.RuleVersion != ruleVersion(rules) {
+				t.Errorf("rule version = %q, want the active %q", after.RuleVersion, ruleVersion(rules))
+			}
+			if changed := after.RuleVersion != before.RuleVersion; changed != tt.wantVersion {
+				t.Errorf("rule version changed = %v, want %v (%q to %q)", changed, tt.wantVersion, before.RuleVersion, after.RuleVersion)
+			}
+			if !after.ScoredAt.Equal(clock.Now()) || !after.ProcessedAt.Equal(before.ProcessedAt) {
+				t.Errorf("scored at %v, processed at %v; want scored at %v, processed at %v", after.ScoredAt, after.ProcessedAt, clock.Now(), before.ProcessedAt)
+			}
+		})
+	}
+}
+
+func TestStreamReceipts(t *testing.T) {
+	events := newBroker(64)
+	srv := newTestServer(t, routerDeps{Events: events})
+	ctx, cancel := context.WithCancel(t.Context())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/receipts/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET /receipts/stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", got)
+	}
+	// The handler subscribes after sending the headers
+	for deadline := time.Now().Add(5 * time.Second); events.Subscribers() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("stream never subscribed")
+		}
+	}
+
+	id := processReceipt(t, srv, testReceipt())
+	lines := bufio.NewScanner(resp.Body)
+	var event, data string
+	for data == "" && lines.Scan() {
+		line := lines.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+		} else if payload, ok := strings.CutPrefix(line, "data: "); ok {
+			data = payload
+		}
+	}
+	if event != "receipt" {
+		t.Errorf("event = %q, want receipt", event)
+	}
+	var got ReceiptEvent
+	decodeBody(t, data, &got)
+	if want := (ReceiptEvent{ID: id, Points: 28, Retailer: "Target"}); got != want {
+		t.Errorf("event data = %+v, want %+v", got, want)
+	}
+
+	// Disconnecting removes the subscriber
+	cancel()
+	for deadline := time.Now().Add(5 * time.Second); events.Subscribers() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber outlived its stream")
+		}
+	}
+}
+
+func TestStreakBonus(t *testing.T) {
+	type purchase struct {
+		customer string
+		date     string
+		want     int64 // streak points awarded
+	}
+	tests := []struct {
+		name      string
+		purchases []purchase
+	}{
+		{name: "two-day streak", purchases: []purchase{{"alice", "2022-01-01", 0}, {"alice", "2022-01-02", 15}}},
+		{name: "three-day streak", purchases: []purchase{{"alice", "2022-01-01", 0}, {"alice", "2022-01-02", 15}, {"alice", "2022-01-03", 15}}},
+		{name: "broken streak", purchases: []purchase{{"alice", "2022-01-01", 0}, {"alice", "2022-01-03", 0}, {"alice", "2022-01-04", 15}}},
+		{name: "same day twice", purchases: []purchase{{"alice", "2022-01-01", 0}, {"alice", "2022-01-01", 0}}},
+		{name: "out of order", purchases: []purchase{{"alice", "2022-01-02", 0}, {"alice", "2022-01-01", 0}, {"alice", "2022-01-03", 15}}},
+		{name: "other customer", purchases: []purchase{{"alice", "2022-01-01", 0}, {"bob", "2022-01-02", 0}}},
+		{name: "no customer", purchases: []purchase{{"", "2022-01-01", 0}, {"", "2022-01-02", 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"POINTS_STREAK_BONUS": "15"})})
+			for i, p := range tt.purchases {
+				receipt := testReceipt()
+				receipt.CustomerID, receipt.PurchaseDate = p.customer, p.date
+				id := processReceipt(t, srv, receipt)
+				_, body := send(t, srv, http.MethodGet, "/receipts/"+id+"/points/breakdown", "")
+				var breakdown struct{ Breakdown []RuleResult }
+				decodeBody(t, body, &breakdown)
+				if got, _ := rulePoints(breakdown.Breakdown, ruleStreak); got != p.want {
+					t.Errorf("purchase %d (%s on %s): %s = %d, want %d", i, p.customer, p.date, ruleStreak, got, p.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHeadReceipt(t *testing.T) {
+	srv := newTestServer(t, routerDeps{})
+	id := processReceipt(t, srv, testReceipt())
+	tests := []struct {
+		name       string
+		id         string
+		wantStatus int
+	}{
+		{name: "stored", id: id, wantStatus: http.StatusOK},
+		{name: "unknown", id: "00000000-0000-4000-8000-000000000000", wantStatus: http.StatusNotFound},
+		{name: "malformed", id: "not-an-id", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := send(t, srv, http.MethodHead, "/receipts/"+tt.id, "")
+			if resp.StatusCode != tt.wantStatus || body != "" {
+				t.Errorf("status = %d, body %q; want %d and no body", resp.StatusCode, body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestProcessFreshness(t *testing.T) {
+	purchased := time.Date(2022, 1, 1, 13, 1, 0, 0, time.UTC) // testReceipt's
+	tests := []struct {
+		name      string
+		processed time.Time
+		want      int64
+	}{
+		{name: "fresh", processed: purchased.Add(2 * time.Hour), want: 28 + 5},
+		{name: "stale", processed: purchased.Add(48 * time.Hour), want: 28},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"POINTS_FRESHNESS_BONUS": "5", "POINTS_FRESHNESS_WINDOW": "24h"})
+			srv := newTestServer(t, routerDeps{Config: cfg, Clock: newTestClock(tt.processed)})
+			id := processReceipt(t, srv, testReceipt())
+			_, body := send(t, srv, http.MethodGet, "/receipts/"+id+"/points", "")
+			var got struct{ Points int64 }
+			decodeBody(t, body, &got)
+			if got.Points != tt.want {
+				t.Errorf("points = %d, want %d", got.Points, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecalculateIfMatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		ifMatch    func(current, stale string) string
+		wantStatus int
+	}{
+		{name: "no precondition", ifMatch: func(string, string) string { return "" }, wantStatus: http.StatusOK},
+		{name: "matching", ifMatch: func(current, _ string) string { return current }, wantStatus: http.StatusOK},
+		{name: "any", ifMatch: func(string, string) string { return "*" }, wantStatus: http.StatusOK},
+		{name: "listed with another", ifMatch: func(current, stale string) string { return stale + ", " + current }, wantStatus: http.StatusOK},
+		{name: "stale", ifMatch: func(_, stale string) string { return stale }, wantStatus: http.StatusPreconditionFailed},
+		{name: "weak", ifMatch: func(current, _ string) string { return "W/" + current }, wantStatus: http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newTestClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+			srv := newTestServer(t, routerDeps{Clock: clock})
+			id := processReceipt(t, srv, testReceipt())
+			resp, _ := send(t, srv, http.MethodGet, "/receipts/"+id, "")
+			stale := resp.Header.Get("ETag")
+			// Another client's update moves the receipt on
+			clock.Advance(time.Minute)
+			resp, _ = send(t, srv, http.MethodPost, "/receipts/"+id+"/recalculate", "")
+			current := resp.Header.Get("ETag")
+			if stale == "" || current == stale {
+				t.Fatalf("ETag %q after an update, was %q", current, stale)
+			}
+
+			clock.Advance(time.Minute)
+			var headers []string
+			if ifMatch := tt.ifMatch(current, stale); ifMatch != "" {
+				headers = []string{"If-Match", ifMatch}
+			}
+			resp, body := send(t, srv, http.MethodPost, "/receipts/"+id+"/recalculate", "", headers...)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			// A rejected update leaves the receipt as it was
+			resp, _ = send(t, srv, http.MethodGet, "/receipts/"+id, "")
+			if changed := resp.Header.Get("ETag") != current; changed != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("receipt updated = %v, want %v", changed, tt.wantStatus == http.StatusOK)
+			}
+		})
+	}
+}
+
+// failingUpdateStore fails every Update before finding the receipt, as a
+// backend that cannot be reached does.
+type failingUpdateStore struct {
+	Store
+}
+
+func (failingUpdateStore) Update(string, func(*StoredReceipt) error) (StoredReceipt, bool, error) {
+	return StoredReceipt{}, false, errors.New("connection refused")
+}
+
+func TestRecalculateStoreError(t *testing.T) {
+	srv := newTestServer(t, routerDeps{Store: failingUpdateStore{newMemoryStore(normalizeRetailer)}})
+	id := processReceipt(t, srv, testReceipt())
+	resp, body := send(t, srv, http.MethodPost, "/receipts/"+id+"/recalculate", "")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d (body %s)", resp.StatusCode, http.StatusInternalServerError, body)
+	}
+}
+
+func TestReceiptRoutes(t *testing.T) {
+	srv := newTestServer(t, routerDeps{})
+	id := processReceipt(t, srv, testReceipt())
+	valid := mustJSON(t, testReceipt())
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantError  string // the error message, if the request fails
+		wantPoints int64  // otherwise the points reported, if any
+	}{
+		{name: "process", method: http.MethodPost, path: "/receipts/process", body: valid, wantStatus: http.StatusOK},
+		{name: "points of a processed receipt", method: http.MethodGet, path: "/receipts/" + id + "/points", wantStatus: http.StatusOK, wantPoints: 28},
+		{name: "detail of a processed receipt", method: http.MethodGet, path: "/receipts/" + id, wantStatus: http.StatusOK, wantPoints: 28},
+		{name: "points of a missing id", method: http.MethodGet, path: "/receipts/7fb1377b-b223-49d9-a31a-5a02701dd310/points", wantStatus: http.StatusNotFound, wantError: notFoundMsg},
+		{name: "points of a malformed id", method: http.MethodGet, path: "/receipts/nonsense/points", wantStatus: http.StatusNotFound, wantError: notFoundMsg},
+		{name: "invalid JSON", method: http.MethodPost, path: "/receipts/process", body: `{"retailer": "Target",`, wantStatus: http.StatusBadRequest, wantError: badRequestMsg},
+		{name: "not an object", method: http.MethodPost, path: "/receipts/process", body: `["Target"]`, wantStatus: http.StatusBadRequest, wantError: badRequestMsg},
+		{name: "extra field", method: http.MethodPost, path: "/receipts/process", body: strings.Replace(valid, `{`, `{"tax":"2.83",`, 1), wantStatus: http.StatusBadRequest, wantError: badRequestMsg},
+		{name: "invalid receipt", method: http.MethodPost, path: "/receipts/process", body: strings.Replace(valid, `"35.35"`, `"35.3"`, 1), wantStatus: http.StatusBadRequest, wantError: badRequestMsg},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := send(t, srv, tt.method, tt.path, tt.body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+				t.Errorf("Content-Type = %q, want JSON", got)
+			}
+			var got struct {
+				ID     string
+				Points int64
+				Error  string
+			}
+			decodeBody(t, body, &got)
+			if got.Error != tt.wantError || got.Points != tt.wantPoints {
+				t.Errorf("body = %s, want error %q and points %d", body, tt.wantError, tt.wantPoints)
+			}
+			if tt.path == "/receipts/process" && tt.wantStatus == http.StatusOK && !uuidPatternRegex.MatchString(got.ID) {
+				t.Errorf("id = %q, want a UUID", got.ID)
+			}
+		})
+	}
+}
+
+func TestDuplicateWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		window     string
+		policy     string
+		gap        time.Duration // between the two submissions
+		modify     func(r *Receipt)
+		wantStatus int
+		wantSameID bool
+	}{
+		{name: "within the window", window: "1h", policy: duplicateReject, gap: 59 * time.Minute, wantStatus: http.StatusConflict},
+		{name: "at the window's end", window: "1h", policy: duplicateReject, gap: time.Hour, wantStatus: http.StatusOK},
+		{name: "outside the window", window: "1h", policy: duplicateReject, gap: 2 * time.Hour, wantStatus: http.StatusOK},
+		{name: "detection off", gap: time.Minute, wantStatus: http.StatusOK},
+		{name: "different content", window: "1h", policy: duplicateReject, gap: time.Minute, modify: func(r *Receipt) { r.Total = "35.36" }, wantStatus: http.StatusOK},
+		{name: "only whitespace differs", window: "1h", policy: duplicateReject, gap: time.Minute, modify: func(r *Receipt) { r.Items[0].ShortDescription += " " }, wantStatus: http.StatusConflict},
+		{name: "answered with the original", window: "1h", policy: duplicateExisting, gap: time.Minute, wantStatus: http.StatusOK, wantSameID: true},
+		{name: "accepted anyway", window: "1h", policy: duplicateAllow, gap: time.Minute, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"DUPLICATE_WINDOW": tt.window}
+			if tt.policy != "" {
+				env["DUPLICATE_POLICY"] = tt.policy
+			}
+			clock := newTestClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+			srv := newTestServer(t, routerDeps{Config: testConfig(t, env), Clock: clock})
+			first := processReceipt(t, srv, testReceipt())
+
+			clock.Advance(tt.gap)
+			again := testReceipt()
+			if tt.modify != nil {
+				tt.modify(&again)
+			}
+			resp, body := send(t, srv, http.MethodPost, "/receipts/process", mustJSON(t, again))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			var got struct{ ID, Error string }
+			decodeBody(t, body, &got)
+			if tt.wantStatus == http.StatusConflict && got.Error != duplicateReceiptMsg {
+				t.Errorf("error = %q, want %q", got.Error, duplicateReceiptMsg)
+			}
+			if tt.wantStatus == http.StatusOK && (got.ID == first) != tt.wantSameID {
+				t.Errorf("id %q for the resubmission, original %q; want the same id = %v", got.ID, first, tt.wantSameID)
+			}
+		})
+	}
+}
+
+func TestDuplicateClaimReleased(t *testing.T) {
+	store := newFlakyStore(1, errors.New("disk full"))
+	cfg := testConfig(t, map[string]string{"DUPLICATE_WINDOW": "1h", "DUPLICATE_POLICY": duplicateReject})
+	srv := newTestServer(t, routerDeps{Config: cfg, Store: store})
+
+	resp, body := send(t, srv, http.MethodPost, "/receipts/process", mustJSON(t, testReceipt()))
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("first submission: status %d, want %d (body %s)", resp.StatusCode, http.StatusInternalServerError, body)
+	}
+	// The receipt was never stored, so its resubmission is no duplicate
+	processReceipt(t, srv, testReceipt())
+
+	resp, body = send(t, srv, http.MethodPost, "/receipts/process", mustJSON(t, testReceipt()))
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("duplicate of the stored receipt: status %d, want %d (body %s)", resp.StatusCode, http.StatusConflict, body)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to log to from the server's goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestScoringTraceLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		level     slog.Level
+		wantRules map[string]int64 // rule contributions that must be logged; nil for no logging
+	}{
+		{name: "debug", level: slog.LevelDebug, wantRules: map[string]int64{
+			ruleRetailerName: 6, ruleRoundDollar: 0, ruleQuarterMultiple: 0, ruleItemPairs: 10,
+			ruleDescription: 6, rulePurchaseDay: 6, rulePurchaseTime: 0,
+		}},
+		{name: "info", level: slog.LevelInfo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out syncBuffer
+			logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: tt.level}))
+			srv := newTestServer(t, routerDeps{Logger: logger})
+			id := processReceipt(t, srv, testReceipt())
+
+			got := make(map[string]int64)
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				var record struct {
+					Msg, ID, Rule string
+					Points        int64
+				}
+				decodeBody(t, line, &record)
+				if record.Msg != "Scoring rule applied" {
+					continue
+				}
+				if record.ID != id {
+					t.Errorf("rule logged for id %q, want %q", record.ID, id)
+				}
+				got[record.Rule] = record.Points
+			}
+			if (len(got) > 0) != (tt.wantRules != nil) {
+				t.Fatalf("logged rules %v, want %v", got, tt.wantRules)
+			}
+			// Each rule is logged, the optional bonuses with zero points
+			var total int64
+			for rule, points := range got {
+				total += points
+				if want, ok := tt.wantRules[rule]; ok && points != want {
+					t.Errorf("%s logged %d points, want %d", rule, points, want)
+				}
+			}
+			for rule := range tt.wantRules {
+				if _, ok := got[rule]; !ok {
+					t.Errorf("%s not logged", rule)
+				}
+			}
+			if tt.wantRules != nil && total != 28 {
+				t.Errorf("logged contributions total %d, want the receipt's 28 points", total)
+			}
+		})
+	}
+}
+
+func TestBatchClientRefs(t *testing.T) {
+	valid := mustJSON(t, testReceipt())
+	invalid := strings.Replace(valid, `"35.35"`, `"35.3"`, 1)
+	longRef := strings.Repeat("r", maxClientRefLength+1)
+	body := "[" + strings.Join([]string{
+		`{"clientRef":"order-1","receipt":` + valid + `}`,
+		`{"clientRef":"order-2","receipt":` + invalid + `}`,
+		valid,
+		`{"clientRef":"` + longRef + `","receipt":` + valid + `}`,
+		`{"clientRef":"order-5","receipt":` + valid + `,"note":"x"}`,
+		`{"receipt":` + valid + `}`,
+		`"order-7"`,
+	}, ",") + "]"
+	type result struct {
+		ClientRef string
+		ID        string
+		Points    *int64
+		Error     string
+		Detail    string
+	}
+	want := []struct {
+		ref        string
+		wantPoints bool
+		wantDetail string
+	}{
+		{ref: "order-1", wantPoints: true},
+		{ref: "order-2", wantDetail: "invalid total format (N.NN)"},
+		{wantPoints: true},
+		{wantDetail: "invalid clientRef"},
+		{wantDetail: `invalid batch entry: unknown field "note"`},
+		{wantPoints: true},
+		{wantDetail: "batch entry is not a JSON object"},
+	}
+
+	srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"VERBOSE_ERRORS": "true"})})
+	resp, got := send(t, srv, http.MethodPost, "/receipts/process/batch", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, got)
+	}
+	var results []result
+	decodeBody(t, got, &results)
+	if len(results) != len(want) {
+		t.Fatalf("%d results for %d entries: %s", len(results), len(want), got)
+	}
+	for i, w := range want {
+		res := results[i]
+		if res.ClientRef != w.ref {
+			t.Errorf("result %d: clientRef = %q, want %q", i, res.ClientRef, w.ref)
+		}
+		if w.wantPoints {
+			if res.Points == nil || *res.Points != 28 || res.ID == "" || res.Error != "" {
+				t.Errorf("result %d = %+v, want an id and 28 points", i, res)
+			}
+			continue
+		}
+		if res.Error != badRequestMsg || res.Detail != w.wantDetail || res.ID != "" || res.Points != nil {
+			t.Errorf("result %d = %+v, want error %q with detail %q", i, res, badRequestMsg, w.wantDetail)
+		}
+	}
+}
+
+func TestPartialScoring(t *testing.T) {
+	withTime := func(purchaseTime string) Receipt {
+		receipt := testReceipt()
+		receipt.PurchaseTime = purchaseTime
+		return receipt
+	}
+	badTotal := testReceipt()
+	badTotal.Total = "35.3"
+	tests := []struct {
+		name         string
+		partial      string
+		receipt      Receipt
+		wantStatus   int
+		wantPoints   int64
+		wantWarnings int
+	}{
+		{name: "time scored", partial: "true", receipt: withTime("14:33"), wantStatus: http.StatusOK, wantPoints: 38},
+		// The time rule's 10 points are lost with the time
+		{name: "missing time", partial: "true", receipt: withTime(""), wantStatus: http.StatusOK, wantPoints: 28, wantWarnings: 1},
+		{name: "unparseable time", partial: "true", receipt: withTime("2:33pm"), wantStatus: http.StatusOK, wantPoints: 28, wantWarnings: 1},
+		{name: "missing time, strict", partial: "false", receipt: withTime(""), wantStatus: http.StatusBadRequest},
+		{name: "bad total", partial: "true", receipt: badTotal, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"PARTIAL_SCORING": tt.partial})})
+			resp, body := send(t, srv, http.MethodPost, "/receipts/process", mustJSON(t, tt.receipt))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var processed struct {
+				ID       string
+				Warnings []string
+			}
+			decodeBody(t, body, &processed)
+			if len(processed.Warnings) != tt.wantWarnings {
+				t.Errorf("warnings = %q, want %d", processed.Warnings, tt.wantWarnings)
+			}
+			_, body = send(t, srv, http.MethodGet, "/receipts/"+processed.ID+"/points", "")
+			var points struct{ Points int64 }
+			decodeBody(t, body, &points)
+			if points.Points != tt.wantPoints {
+				t.Errorf("points = %d, want %d", points.Points, tt.wantPoints)
+			}
+		})
+	}
+}
+
+func TestListReceiptsByProcessingTime(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := newTestClock(start)
+	srv := newTestServer(t, routerDeps{Clock: clock})
+	// Receipts processed at 12:00, 13:00, and 14:00
+	var ids []string
+	for range 3 {
+		ids = append(ids, processReceipt(t, srv, testReceipt()))
+		clock.Advance(time.Hour)
+	}
+	at := func(hour int) string { return start.Add(time.Duration(hour-12) * time.Hour).Format(time.RFC3339) }
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantIDs    []string
+	}{
+		{name: "all", query: "", wantStatus: http.StatusOK, wantIDs: ids},
+		{name: "middle", query: "?from=" + at(13) + "&to=" + at(14), wantStatus: http.StatusOK, wantIDs: ids[1:2]},
+		{name: "from only", query: "?from=" + at(13), wantStatus: http.StatusOK, wantIDs: ids[1:]},
+		{name: "to only", query: "?to=" + at(13), wantStatus: http.StatusOK, wantIDs: ids[:1]},
+		{name: "none", query: "?from=" + at(15), wantStatus: http.StatusOK, wantIDs: nil},
+		{name: "not RFC 3339", query: "?from=2024-03-01", wantStatus: http.StatusBadRequest},
+		{name: "empty range", query: "?from=" + at(13) + "&to=" + at(13), wantStatus: http.StatusBadRequest},
+		{name: "reversed", query: "?from=" + at(14) + "&to=" + at(12), wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := send(t, srv, http.MethodGet, "/receipts"+tt.query, "")
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var list struct{ Receipts []struct{ ID string } }
+			decodeBody(t, body, &list)
+			var got []string
+			for _, rec := range list.Receipts {
+				got = append(got, rec.ID)
+			}
+			if !slices.Equal(got, tt.wantIDs) {
+				t.Errorf("receipts = %v, want %v", got, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestFirstOfDayBonus(t *testing.T) {
+	receipt := func(retailer, date string) Receipt {
+		r := testReceipt()
+		r.Retailer, r.PurchaseDate = retailer, date
+		return r
+	}
+	tests := []struct {
+		name     string
+		receipts []Receipt
+		want     []bool // whether each receipt, in turn, earns the bonus
+	}{
+		{name: "same day", receipts: []Receipt{receipt("Target", "2022-01-01"), receipt("Target", "2022-01-01")}, want: []bool{true, false}},
+		{name: "different days", receipts: []Receipt{receipt("Target", "2022-01-01"), receipt("Target", "2022-01-02")}, want: []bool{true, true}},
+		{name: "different retailers", receipts: []Receipt{receipt("Target", "2022-01-01"), receipt("Walgreens", "2022-01-01")}, want: []bool{true, true}},
+		{name: "earlier day after a later one", receipts: []Receipt{receipt("Target", "2022-01-02"), receipt("Target", "2022-01-01")}, want: []bool{true, false}},
+		{name: "canonicalized retailer", receipts: []Receipt{receipt("Target", "2022-01-01"), receipt("TARGET", "2022-01-01")}, want: []bool{true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"POINTS_FIRST_OF_DAY_BONUS": "50"})})
+			for i, r := range tt.receipts {
+				id := processReceipt(t, srv, r)
+				_, body := send(t, srv, http.MethodGet, "/receipts/"+id+"/points/breakdown", "")
+				var breakdown struct{ Breakdown []RuleResult }
+				decodeBody(t, body, &breakdown)
+				points, _ := rulePoints(breakdown.Breakdown, ruleFirstOfDay)
+				if got := points == 50; got != tt.want[i] {
+					t.Errorf("receipt %d earned the bonus = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		store := newMemoryStore(normalizeRetailer)
+		srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"POINTS_FIRST_OF_DAY_BONUS": "50"}), Store: store})
+		var wg sync.WaitGroup
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				send(t, srv, http.MethodPost, "/receipts/process", mustJSON(t, testReceipt()))
+			}()
+		}
+		wg.Wait()
+		recs, err := store.ProcessedBetween(time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatalf("ProcessedBetween: %v", err)
+		}
+		var winners int
+		for _, rec := range recs {
+			if rec.FirstOfDay {
+				winners++
+			}
+		}
+		if len(recs) != 20 || winners != 1 {
+			t.Errorf("%d of %d receipts earned the bonus, want 1 of 20", winners, len(recs))
+		}
+	})
+}
+
+// slowListStore delays listing receipts, as a large export is slow to read.
+type slowListStore struct {
+	Store
+	delay time.Duration
+}
+
+func (s slowListStore) ProcessedBetween(from, to time.Time) ([]StoredReceipt, error) {
+	time.Sleep(s.delay)
+	return s.Store.ProcessedBetween(from, to)
+}
+
+func TestExportWriteTimeout(t *testing.T) {
+	const receipts = 2000
+	store := newMemoryStore(normalizeRetailer)
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := range receipts {
+		saveAll(t, store, StoredReceipt{ID: fmt.Sprintf("receipt-%04d", i), Points: 28, ProcessedAt: start.Add(time.Duration(i) * time.Second), Receipt: testReceipt()})
+	}
+	tests := []struct {
+		name          string
+		exportTimeout string
+		wantComplete  bool
+	}{
+		{name: "default", exportTimeout: "5m", wantComplete: true},
+		{name: "unlimited", exportTimeout: "0", wantComplete: true},
+		// Shorter than the store takes, so the export is cut off as it was
+		// under the server's WriteTimeout
+		{name: "too short", exportTimeout: "10ms", wantComplete: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"EXPORT_WRITE_TIMEOUT": tt.exportTimeout})
+			srv := httptest.NewUnstartedServer(newRouter(routerDeps{
+				Config: cfg,
+				Store:  slowListStore{Store: store, delay: 100 * time.Millisecond},
+				Events: newBroker(64),
+				IDs:    uuidGenerator{},
+				Clock:  systemClock{},
+				Logger: slog.New(slog.DiscardHandler),
+			}))
+			// Far shorter than the export takes
+			srv.Config.WriteTimeout = 20 * time.Millisecond
+			srv.Start()
+			t.Cleanup(srv.Close)
+
+			var list struct{ Receipts []ReceiptDetail }
+			resp, err := srv.Client().Get(srv.URL + "/receipts")
+			if err == nil {
+				defer resp.Body.Close()
+				err = json.NewDecoder(resp.Body).Decode(&list)
+			}
+			complete := err == nil && len(list.Receipts) == receipts
+			if complete != tt.wantComplete {
+				t.Errorf("export complete = %v (%d receipts, error %v), want %v", complete, len(list.Receipts), err, tt.wantComplete)
+			}
+		})
+	}
+}
+
+func TestPointsProvenance(t *testing.T) {
+	scoredAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	changed := defaultPointsConfig()
+	changed.OddDayBonus = 20
+	tests := []struct {
+		name           string
+		query          string
+		changeRules    bool
+		wantStatus     int
+		wantProvenance bool
+		wantBreakdown  bool
+	}{
+		{name: "requested", query: "?provenance=true", wantStatus: http.StatusOK, wantProvenance: true, wantBreakdown: true},
+		// The breakdown can no longer be reproduced, but the versions still say so
+		{name: "rules changed since", query: "?provenance=true", changeRules: true, wantStatus: http.StatusOK, wantProvenance: true},
+		{name: "not requested", query: "", wantStatus: http.StatusOK},
+		{name: "declined", query: "?provenance=false", wantStatus: http.StatusOK},
+		{name: "malformed", query: "?provenance=maybe", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			srv := newTestServer(t, routerDeps{Config: cfg, Clock: newTestClock(scoredAt)})
+			id := processReceipt(t, srv, testReceipt())
+			scoredVersion := ruleVersion(cfg.pointsFor(""))
+			if tt.changeRules {
+				cfg.setPoints(changed, scoredAt)
+			}
+
+			resp, body := send(t, srv, http.MethodGet, "/receipts/"+id+"/points"+tt.query, "")
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got struct {
+				Points     int64
+				Provenance *struct {
+					RuleVersion        string
+					CurrentRuleVersion string
+					ScoredAt           time.Time
+					Breakdown          []RuleResult
+				}
+			}
+			decodeBody(t, body, &got)
+			if got.Points != 28 {
+				t.Errorf("points = %d, want 28", got.Points)
+			}
+			if (got.Provenance != nil) != tt.wantProvenance {
+				t.Fatalf("provenance = %+v, want present %v", got.Provenance, tt.wantProvenance)
+			}
+			if got.Provenance == nil {
+				return
+			}
+			p := got.Provenance
+			if p.RuleVersion != scoredVersion || !p.ScoredAt.Equal(scoredAt) {
+				t.Errorf("scored under %q at %v, want %q at %v", p.RuleVersion, p.ScoredAt, scoredVersion, scoredAt)
+			}
+			if want := ruleVersion(cfg.pointsFor("")); p.CurrentRuleVersion != want {
+				t.Errorf("current rule version = %q, want %q", p.CurrentRuleVersion, want)
+			}
+			if (p.CurrentRuleVersion == p.RuleVersion) == tt.changeRules {
+				t.Errorf("current rule version %q, scored %q; want them to differ only after a rule change", p.CurrentRuleVersion, p.RuleVersion)
+			}
+			if (len(p.Breakdown) > 0) != tt.wantBreakdown {
+				t.Fatalf("breakdown = %v, want present %v", p.Breakdown, tt.wantBreakdown)
+			}
+			if tt.wantBreakdown && sumBreakdown(p.Breakdown) != got.Points {
+				t.Errorf("breakdown sums to %d, want the stored %d", sumBreakdown(p.Breakdown), got.Points)
+			}
+		})
+	}
+}
+
+func TestProcessPurchaseDateBounds(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		date       string
+		wantStatus int
+	}{
+		{date: "1999-12-31", wantStatus: http.StatusBadRequest},
+		{date: "2000-01-01", wantStatus: http.StatusOK},
+		{date: "2024-03-01", wantStatus: http.StatusOK},
+		{date: "2024-03-02", wantStatus: http.StatusBadRequest},
+	}
+	cfg := testConfig(t, map[string]string{"EARLIEST_PURCHASE_DATE": "2000-01-01", "MAX_FUTURE_SKEW": "2h"})
+	srv := newTestServer(t, routerDeps{Config: cfg, Clock: newTestClock(now)})
+	for _, tt := range tests {
+		t.Run(tt.date, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.PurchaseDate = tt.date
+			resp, body := send(t, srv, http.MethodPost, "/receipts/process", mustJSON(t, receipt))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus == http.StatusBadRequest {
+				var errResp struct{ Error string }
+				decodeBody(t, body, &errResp)
+				if errResp.Error != badRequestMsg {
+					t.Errorf("error = %q, want %q", errResp.Error, badRequestMsg)
+				}
+			}
+		})
+	}
+}
+
+func TestPointsRepresentations(t *testing.T) {
+	srv := newTestServer(t, routerDeps{})
+	id := processReceipt(t, srv, testReceipt())
+	tests := []struct {
+		name            string
+		accept          string
+		query           string
+		wantStatus      int
+		wantContentType string
+		want            string
+	}{
+		{name: "JSON", accept: "application/json", wantStatus: http.StatusOK, wantContentType: "application/json", want: `{"points":28,"ruleVersion":"` + ruleVersion(defaultPointsConfig()) + `"}`},
+		{name: "plain text", accept: "text/plain", wantStatus: http.StatusOK, wantContentType: "text/plain; charset=utf-8", want: "28"},
+		{name: "XML", accept: "application/xml", wantStatus: http.StatusOK, wantContentType: "application/xml", want: "<points>28</points>"},
+		{name: "anything", accept: "*/*", wantStatus: http.StatusOK, wantContentType: "application/json", want: `{"points":28,"ruleVersion":"` + ruleVersion(defaultPointsConfig()) + `"}`},
+		{name: "unsupported", accept: "text/html", wantStatus: http.StatusNotAcceptable, wantContentType: "application/json", want: `{"error":"` + notAcceptableMsg + `"}`},
+		// Provenance has no text or XML form
+		{name: "plain text with provenance", accept: "text/plain", query: "?provenance=true", wantStatus: http.StatusNotAcceptable, wantContentType: "application/json", want: `{"error":"` + notAcceptableMsg + `"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := send(t, srv, http.MethodGet, "/receipts/"+id+"/points"+tt.query, "", "Accept", tt.accept)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if got := resp.Header.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if got := resp.Header.Get("Vary"); got != "Accept" {
+				t.Errorf("Vary = %q, want Accept", got)
+			}
+			if got := strings.TrimSpace(body); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetReceiptDetail(t *testing.T) {
+	processedAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	// Two of the first item make six in all, for 33 points rather than 28
+	quantity := 2
+	submitted := testReceipt()
+	submitted.Items[0].Quantity = &quantity
+	submitted.Total = "41.84"
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{Store: backend.open(t), Clock: newTestClock(processedAt)})
+			id := processReceipt(t, srv, submitted)
+
+			resp, body := send(t, srv, http.MethodGet, "/receipts/"+id, "")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+			}
+			var got ReceiptDetail
+			decodeBody(t, body, &got)
+			if got.ID != id || got.Points != 33 || !got.ProcessedAt.Equal(processedAt) {
+				t.Errorf("detail = %+v, want id %s with 33 points processed at %v", got, id, processedAt)
+			}
+			// The payload comes back as submitted, untrimmed descriptions included
+			if !reflect.DeepEqual(got.Receipt, submitted) {
+				t.Errorf("receipt = %+v, want %+v", got.Receipt, submitted)
+			}
+
+			resp, body = send(t, srv, http.MethodGet, "/receipts/"+testUUID, "")
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("missing receipt: status = %d, want %d (body %s)", resp.StatusCode, http.StatusNotFound, body)
+			}
+		})
+	}
+}
+
+func TestBatchProcess(t *testing.T) {
+	cornerMarket := Receipt{
+		Retailer:     "M&M Corner Market",
+		PurchaseDate: "2022-03-20",
+		PurchaseTime: "14:33",
+		Items:        []Item{{ShortDescription: "Gatorade", Price: "2.25"}, {ShortDescription: "Gatorade", Price: "2.25"}, {ShortDescription: "Gatorade", Price: "2.25"}, {ShortDescription: "Gatorade", Price: "2.25"}},
+		Total:        "9.00",
+	}
+	invalid := testReceipt()
+	invalid.Total = "35.3"
+	type result struct {
+		ID     string
+		Points *int64
+		Error  string
+	}
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantPoints []int64 // of each entry, or -1 for an error entry
+	}{
+		{name: "all valid", body: "[" + mustJSON(t, testReceipt()) + "," + mustJSON(t, cornerMarket) + "]", wantStatus: http.StatusOK, wantPoints: []int64{28, 109}},
+		{name: "an invalid entry", body: "[" + mustJSON(t, testReceipt()) + "," + mustJSON(t, invalid) + "," + mustJSON(t, cornerMarket) + "]", wantStatus: http.StatusOK, wantPoints: []int64{28, -1, 109}},
+		{name: "empty", body: "[]", wantStatus: http.StatusOK, wantPoints: []int64{}},
+		{name: "not an array", body: mustJSON(t, testReceipt()), wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{})
+			resp, body := send(t, srv, http.MethodPost, "/receipts/process/batch", tt.body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var results []result
+			decodeBody(t, body, &results)
+			if len(results) != len(tt.wantPoints) {
+				t.Fatalf("%d results for %d entries: %s", len(results), len(tt.wantPoints), body)
+			}
+			for i, want := range tt.wantPoints {
+				res := results[i]
+				if want < 0 {
+					if res.Error != badRequestMsg || res.ID != "" || res.Points != nil {
+						t.Errorf("result %d = %+v, want error %q", i, res, badRequestMsg)
+					}
+					continue
+				}
+				if res.Points == nil || *res.Points != want || res.Error != "" {
+					t.Errorf("result %d = %+v, want %d points", i, res, want)
+					continue
+				}
+				// Each accepted entry is stored like a single submission
+				_, body := send(t, srv, http.MethodGet, "/receipts/"+res.ID+"/points", "")
+				var points struct{ Points int64 }
+				decodeBody(t, body, &points)
+				if points.Points != want {
+					t.Errorf("result %d: stored points = %d, want %d", i, points.Points, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// storeMetrics accumulates per-method store call counts, error counts, and
+// latencies. It is the StoreObserver behind the /metrics endpoint.
+type storeMetrics struct {
+	mu      sync.Mutex
+	methods map[string]*storeMethodMetrics
+}
+
+// storeMethodMetrics are the totals for one Store method.
+type storeMethodMetrics struct {
+	Calls      int64
+	Errors     int64
+	Latency    time.Duration // sum over all calls
+	MaxLatency time.Duration
+}
+
+// newStoreMetrics returns an empty set of store metrics.
+func newStoreMetrics() *storeMetrics {
+	return &storeMetrics{methods: make(map[string]*storeMethodMetrics)}
+}
+
+func (m *storeMetrics) ObserveStoreOp(method string, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mm, ok := m.methods[method]
+	if !ok {
+		mm = &storeMethodMetrics{}
+		m.methods[method] = mm
+	}
+	mm.Calls++
+	if err != nil {
+		mm.Errors++
+	}
+	mm.Latency += latency
+	mm.MaxLatency = max(mm.MaxLatency, latency)
+}
+
+// Snapshot returns a copy of the current totals keyed by method name.
+func (m *storeMetrics) Snapshot() map[string]storeMethodMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshot := make(map[string]storeMethodMetrics, len(m.methods))
+	for method, mm := range m.methods {
+		snapshot[method] = *mm
+	}
+	return snapshot
+}
+
+// Handles GET /metrics requests, reporting store operation, event stream, and
+// shadow scoring metrics as JSON, or, to clients that prefer the Prometheus
+// text or OpenMetrics format (as Prometheus does), the Prometheus metrics.
+// With multi-tenancy the JSON also counts each tenant's receipts.
+func metricsHandler(w http.ResponseWriter, r *http.Request, cfg *Config, store Store, metrics *storeMetrics, prom *promMetrics, events *broker, logger *slog.Logger) {
+	if prom != nil {
+		w.Header().Add("Vary", "Accept")
+		offer, ok := negotiate(r.Header.Get("Accept"), []representation{{MediaType: mediaTypeJSON}, {MediaType: mediaTypeText}, {MediaType: mediaTypeOpenMetrics}})
+		if ok && offer.MediaType != mediaTypeJSON {
+			prom.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	type MethodMetrics struct {
+		Calls        int64   `json:"calls"`
+		Errors       int64   `json:"errors"`
+		AvgLatencyMs float64 `json:"avgLatencyMs"`
+		MaxLatencyMs float64 `json:"maxLatencyMs"`
+	}
+	type StreamMetrics struct {
+		Subscribers int   `json:"subscribers"`
+		Dropped     int64 `json:"dropped"`
+	}
+	type MetricsResponse struct {
+		Store   map[string]MethodMetrics `json:"store"`
+		Stream  StreamMetrics            `json:"stream"`
+		Shadow  *ShadowMetrics           `json:"shadow,omitempty"`
+		Tenants map[string]TenantStats   `json:"tenants,omitempty"`
+	}
+
+	snapshot := metrics.Snapshot()
+	resp := MetricsResponse{
+		Store:  make(map[string]MethodMetrics, len(snapshot)),
+		Stream: StreamMetrics{Subscribers: events.Subscribers(), Dropped: events.Dropped()},
+		Shadow: shadowMetrics(cfg),
+	}
+	if cfg.MultiTenant {
+		tenants, err := tenantStats(store)
+		if err != nil {
+			logger.Error("Failed to count receipts by tenant", slog.Any("error", err))
+			errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+			return
+		}
+		resp.Tenants = tenants
+	}
+	for method, mm := range snapshot {
+		var avg time.Duration
+		if mm.Calls > 0 {
+			avg = mm.Latency / time.Duration(mm.Calls)
+		}
+		resp.Store[method] = MethodMetrics{
+			Calls:        mm.Calls,
+			Errors:       mm.Errors,
+			AvgLatencyMs: float64(avg) / float64(time.Millisecond),
+			MaxLatencyMs: float64(mm.MaxLatency) / float64(time.Millisecond),
+		}
+	}
+	jsonResponse(w, http.StatusOK, resp, logger)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// adminOnly rejects requests that do not present the admin token as an
+// "Authorization: Bearer <token>" header.
+func adminOnly(next http.Handler, token string, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r, logger)
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			logger.Warn("Rejected admin request", slog.String("path", r.URL.Path))
+			errorResponse(w, http.StatusUnauthorized, unauthorizedMsg, logger)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIDHeader carries the id correlating a request's logs on both sides.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds a caller-supplied request id.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDMiddleware gives every request an id: the caller's X-Request-ID,
+// if it is short and printable, or else a new UUID. The id is echoed in the
+// response's X-Request-ID header and added to the request's log lines by
+// requestLogger.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether a caller-supplied id is safe to log and
+// echo: non-empty, at most maxRequestIDLength bytes, and printable ASCII
+// without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogger returns logger with r's request id attached, so every line
+// logged while serving r can be matched with the client's logs.
+func requestLogger(r *http.Request, logger *slog.Logger) *slog.Logger {
+	id, ok := r.Context().Value(requestIDKey{}).(string)
+	if !ok {
+		return logger
+	}
+	return logger.With(slog.String("request_id", id))
+}
+
+// handlerPanic is a panic recovered on another goroutine and raised again,
+// keeping the stack of the goroutine that first panicked.
+type handlerPanic struct {
+	value any
+	stack []byte
+}
+
+// recoveryMiddleware turns a panicking request into a logged 500, with the
+// stack trace, instead of a dropped connection. A panic after the response
+// has started cannot be reported to the client, so that connection is still
+// aborted. Panics with http.ErrAbortHandler are deliberate aborts and are
+// passed on.
+func recoveryMiddleware(next http.Handler, prom *promMetrics, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			value, stack := p, []byte(nil)
+			if hp, ok := p.(handlerPanic); ok {
+				value, stack = hp.value, hp.stack
+			} else {
+				stack = debug.Stack()
+			}
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+			prom.panicked()
+			logger := requestLogger(r, logger)
+			logger.Error("Request handler panicked", slog.String("method", r.Method), slog.String("path", r.URL.Path), slog.Any("panic", value), slog.String("stack", string(stack)))
+			if sw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// statusWriter records the status code of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which
+// the event stream and export need to flush and extend write deadlines.
+func (sw *statusWriter) Unwrap() http.ResponseWriter { return sw.ResponseWriter }
+
+// corsMethods are the methods a preflight response may allow, each listed
+// only if a route serves it for the requested path.
+var corsMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// corsMiddleware adds CORS headers for requests from an allowed origin and
+// answers preflight requests, allowing the methods that methods reports are
+// routed for the path. With no origins configured it returns next
+// unchanged, so no CORS headers are sent.
+func corsMiddleware(next http.Handler, origins []string, methods func(*http.Request) []string) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		allowed[o] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		originAllowed := origin != "" && (allowed["*"] || allowed[origin])
+		if originAllowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+		}
+
+		// Preflight requests are answered here and never reach the router
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allow := methods(r); originAllowed && len(allow) > 0 {
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(allow, ", "))
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+apiKeyHeader+", "+tenantHeader+", "+requestIDHeader)
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// jsonUnmatched serves mux, replacing its plain-text responses for requests
+// that match no route with JSON errors: 404 for an unknown path and 405, with
+// the mux's Allow header, for a known path used with the wrong method.
+func jsonUnmatched(mux *http.ServeMux, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		logger := requestLogger(r, logger)
+
+		// Run the mux's own fallback to learn which error it would send;
+		// redirects (e.g. path cleaning) are passed through unchanged.
+		probe := &discardWriter{header: make(http.Header)}
+		h.ServeHTTP(probe, r)
+		switch probe.status {
+		case http.StatusMethodNotAllowed:
+			logger.Warn("Method not allowed", slog.String("method", r.Method), slog.String("path", r.URL.Path))
+			w.Header().Set("Allow", probe.header.Get("Allow"))
+			errorResponse(w, http.StatusMethodNotAllowed, methodNotAllowedMsg, logger)
+		case http.StatusNotFound:
+			logger.Warn("No route for request", slog.String("method", r.Method), slog.String("path", r.URL.Path))
+			errorResponse(w, http.StatusNotFound, routeNotFoundMsg, logger)
+		default:
+			mux.ServeHTTP(w, r)
+		}
+	})
+}
+
+// discardWriter records a response's header and status and drops its body.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (dw *discardWriter) Header() http.Header { return dw.header }
+
+func (dw *discardWriter) Write(p []byte) (int, error) {
+	if dw.status == 0 {
+		dw.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (dw *discardWriter) WriteHeader(status int) {
+	if dw.status == 0 {
+		dw.status = status
+	}
+}
+
+// timeoutMiddleware bounds the processing time of each request. Unlike
+// http.TimeoutHandler, a request that misses the deadline receives a JSON
+// 503 built by errorResponse. A zero duration returns next unchanged.
+func timeoutMiddleware(next http.Handler, d time.Duration, logger *slog.Logger) http.Handler {
+	if d <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r, logger)
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		panicChan := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicChan <- handlerPanic{value: p, stack: debug.Stack()}
+				}
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicChan:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			for k, v := range tw.header {
+				w.Header()[k] = v
+			}
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			w.WriteHeader(tw.status)
+			w.Write(tw.body.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			logger.Warn("Request exceeded processing deadline", slog.String("method", r.Method), slog.String("path", r.URL.Path), slog.Duration("timeout", d))
+			errorResponse(w, http.StatusServiceUnavailable, timeoutMsg, logger)
+		}
+	})
+}
+
+// timeoutWriter buffers a handler's response so it can be discarded if the
+// deadline passes before the handler finishes.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.body.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = status
+}
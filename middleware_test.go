@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+	// sleeper answers 200 after delay, unless the request is cancelled first
+	sleeper := func(delay time.Duration) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(delay):
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("done"))
+			case <-r.Context().Done():
+			}
+		})
+	}
+	tests := []struct {
+		name            string
+		timeout         time.Duration
+		delay           time.Duration
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{name: "past the deadline", timeout: 20 * time.Millisecond, delay: time.Second, wantStatus: http.StatusServiceUnavailable, wantContentType: "application/json", wantBody: `{"error":"` + timeoutMsg + `"}` + "\n"},
+		{name: "within the deadline", timeout: time.Second, delay: 0, wantStatus: http.StatusOK, wantContentType: "text/plain", wantBody: "done"},
+		{name: "no deadline", timeout: 0, delay: 30 * time.Millisecond, wantStatus: http.StatusOK, wantContentType: "text/plain", wantBody: "done"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			timeoutMiddleware(sleeper(tt.delay), tt.timeout, logger).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	// As routed: receipts can be read, checked, and deleted, and are processed by POST
+	methods := func(r *http.Request) []string {
+		switch r.URL.Path {
+		case "/receipts/process":
+			return []string{http.MethodPost}
+		case "/receipts/" + testUUID:
+			return []string{http.MethodGet, http.MethodHead, http.MethodDelete}
+		}
+		return nil
+	}
+	tests := []struct {
+		name        string
+		origins     []string
+		method      string
+		path        string
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantOrigin  string
+		wantMethods string // Access-Control-Allow-Methods
+	}{
+		{name: "preflight from an allowed origin", origins: []string{"https://dash.example.com"}, method: http.MethodOptions, path: "/receipts/process", origin: "https://dash.example.com", preflight: true, wantStatus: http.StatusNoContent, wantOrigin: "https://dash.example.com", wantMethods: "POST"},
+		{name: "preflight for a receipt", origins: []string{"https://dash.example.com"}, method: http.MethodOptions, path: "/receipts/" + testUUID, origin: "https://dash.example.com", preflight: true, wantStatus: http.StatusNoContent, wantOrigin: "https://dash.example.com", wantMethods: "GET, HEAD, DELETE"},
+		{name: "preflight for an unrouted path", origins: []string{"https://dash.example.com"}, method: http.MethodOptions, path: "/nowhere", origin: "https://dash.example.com", preflight: true, wantStatus: http.StatusNoContent, wantOrigin: "https://dash.example.com"},
+		{name: "preflight from a disallowed origin", origins: []string{"https://dash.example.com"}, method: http.MethodOptions, path: "/receipts/process", origin: "https://evil.example.com", preflight: true, wantStatus: http.StatusNoContent},
+		{name: "request from an allowed origin", origins: []string{"https://dash.example.com"}, method: http.MethodPost, path: "/receipts/process", origin: "https://dash.example.com", wantStatus: http.StatusOK, wantOrigin: "https://dash.example.com"},
+		{name: "request from a disallowed origin", origins: []string{"https://dash.example.com"}, method: http.MethodPost, path: "/receipts/process", origin: "https://evil.example.com", wantStatus: http.StatusOK},
+		{name: "any origin", origins: []string{"*"}, method: http.MethodOptions, path: "/receipts/process", origin: "https://anywhere.example.com", preflight: true, wantStatus: http.StatusNoContent, wantOrigin: "https://anywhere.example.com", wantMethods: "POST"},
+		{name: "unconfigured", method: http.MethodOptions, path: "/receipts/process", origin: "https://dash.example.com", preflight: true, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			rec := httptest.NewRecorder()
+			corsMiddleware(next, tt.origins, methods).ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tt.wantMethods)
+			}
+		})
+	}
+}
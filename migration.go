@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Migration states reported in MigrationStatus.State.
+const (
+	migrationIdle      = "idle"
+	migrationRunning   = "running"
+	migrationCompleted = "completed"
+	migrationCancelled = "cancelled"
+	migrationFailed    = "failed"
+)
+
+// MigrationStatus reports the progress of a points migration.
+type MigrationStatus struct {
+	State      string    `json:"state"`
+	StartedAt  time.Time `json:"startedAt,omitzero"`
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+	Total      int       `json:"total"`       // receipts stored when the migration started
+	Processed  int       `json:"processed"`   // receipts visited so far
+	Changed    int       `json:"changed"`     // receipts whose points changed
+	Skipped    int       `json:"skipped"`     // receipts that could not be rescored, or were deleted meanwhile
+	Delta      int64     `json:"pointsDelta"` // net change in points across all receipts
+	Error      string    `json:"error,omitempty"`
+
+	// RuleVersion is the rule set receipts are rescored under: the one active
+	// when the migration started, even if the rules are reloaded meanwhile.
+	// Tenants assigned a named rule set have their receipts rescored under
+	// that set as it was then, and RuleVersion is the default tenant's.
+	RuleVersion string `json:"ruleVersion,omitempty"`
+}
+
+// migrateReceipts rescores every stored receipt under the rule set rules
+// returns for its tenant, in batches of batchSize, calling progress after
+// each batch. Credited receipts have their credits adjusted to their new
+// points, through their tenant's store as requests credited them.
+// It stops early, returning ctx.Err(), if ctx is cancelled between batches.
+// Receipts that no longer parse are skipped rather than failing the migration.
+func migrateReceipts(ctx context.Context, store Store, cfg *Config, rules func(tenant string) *ruleSet, clock Clock, batchSize int, progress func(MigrationStatus)) (MigrationStatus, error) {
+	status := MigrationStatus{State: migrationRunning, RuleVersion: rules("").Version}
+	recs, err := store.ProcessedBetween(time.Time{}, time.Time{})
+	if err != nil {
+		return status, fmt.Errorf("listing receipts: %w", err)
+	}
+	status.Total = len(recs)
+	retailerKey := retailerCanonicalizer(cfg.RetailerCanonicalization)
+
+	for start := 0; start < len(recs); start += batchSize {
+		if err := ctx.Err(); err != nil {
+			return status, err
+		}
+		for _, listed := range recs[start:min(start+batchSize, len(recs))] {
+			var previous int64
+			var scoreErr error
+			tenant, _ := splitTenant(listed.ID)
+			set := rules(tenant)
+			rec, found, err := store.Update(listed.ID, func(rec *StoredReceipt) error {
+				points, err := scoreReceipt(rec, cfg, set.Points)
+				if err != nil {
+					scoreErr = err
+					return err
+				}
+				previous = rec.Points
+				rec.Points = points
+				rec.RuleVersion = set.Version
+				rec.ScoredAt = clock.Now()
+				return nil
+			})
+			status.Processed++
+			switch {
+			case !found || scoreErr != nil:
+				status.Skipped++
+			case err != nil:
+				return status, fmt.Errorf("updating receipt %s: %w", listed.ID, err)
+			default:
+				if rec.Points != previous {
+					status.Changed++
+					status.Delta += rec.Points - previous
+				}
+				view, id := store, rec.ID
+				if cfg.MultiTenant {
+					_, local := splitTenant(rec.ID)
+					view, id = newTenantStore(store, tenant, retailerKey), local
+				}
+				if err := adjustCredit(view, rec.Receipt.UserID, id, rec.Points, clock.Now()); err != nil {
+					return status, fmt.Errorf("adjusting credit of receipt %s: %w", listed.ID, err)
+				}
+			}
+		}
+		progress(status)
+	}
+	return status, nil
+}
+
+// migrator runs at most one points migration at a time in the background.
+type migrator struct {
+	store     Store
+	cfg       *Config
+	clock     Clock
+	batchSize int
+	logger    *slog.Logger
+
+	mu     sync.Mutex
+	status MigrationStatus
+	cancel context.CancelFunc // non-nil while a migration is running
+}
+
+// newMigrator returns an idle migrator over store.
+func newMigrator(store Store, cfg *Config, clock Clock, batchSize int, logger *slog.Logger) *migrator {
+	return &migrator{
+		store:     store,
+		cfg:       cfg,
+		clock:     clock,
+		batchSize: batchSize,
+		logger:    logger,
+		status:    MigrationStatus{State: migrationIdle},
+	}
+}
+
+// Start launches a migration unless one is already running, and reports
+// whether it did along with the current status.
+func (m *migrator) Start() (MigrationStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		return m.status, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	// One rule set for the whole job, even if the rules are reloaded meanwhile
+	rules := m.cfg.ruleSnapshot()
+	m.status = MigrationStatus{State: migrationRunning, StartedAt: m.clock.Now(), RuleVersion: rules("").Version}
+	go m.run(ctx, rules)
+	return m.status, true
+}
+
+// Cancel asks a running migration to stop after its current batch, and
+// reports whether one was running.
+func (m *migrator) Cancel() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel == nil {
+		return false
+	}
+	m.cancel()
+	return true
+}
+
+// Status returns the progress of the current or most recent migration.
+func (m *migrator) Status() MigrationStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+func (m *migrator) run(ctx context.Context, rules func(tenant string) *ruleSet) {
+	m.logger.Info("Points migration started", slog.String("rule_version", rules("").Version))
+	status, err := migrateReceipts(ctx, m.store, m.cfg, rules, m.clock, m.batchSize, func(progress MigrationStatus) {
+		m.logger.Info("Points migration progress", slog.Int("processed", progress.Processed), slog.Int("total", progress.Total), slog.Int("changed", progress.Changed))
+		m.mu.Lock()
+		progress.StartedAt = m.status.StartedAt
+		m.status = progress
+		m.mu.Unlock()
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status.StartedAt = m.status.StartedAt
+	status.FinishedAt = m.clock.Now()
+	switch {
+	case ctx.Err() != nil:
+		status.State = migrationCancelled
+	case err != nil:
+		status.State = migrationFailed
+		status.Error = err.Error()
+	default:
+		status.State = migrationCompleted
+	}
+	m.status = status
+	m.cancel()
+	m.cancel = nil
+
+	m.logger.Info("Points migration finished", slog.String("state", status.State), slog.Int("processed", status.Processed), slog.Int("changed", status.Changed), slog.Int64("points_delta", status.Delta), slog.Any("error", err))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMigrateReceipts(t *testing.T) {
+	cfg := testConfig(t, nil)
+	rules := cfg.ruleSnapshot()
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	// The Target example scores 28 under the current rules
+	credited := testReceipt()
+	credited.UserID = "alice"
+	stored := []StoredReceipt{
+		{ID: "under-scored", Points: 10, Receipt: credited, ProcessedAt: start},
+		{ID: "over-scored", Points: 40, Receipt: testReceipt(), ProcessedAt: start.Add(time.Minute)},
+		{ID: "current", Points: 28, Receipt: testReceipt(), ProcessedAt: start.Add(2 * time.Minute)},
+		{ID: "unparseable", Points: 5, ProcessedAt: start.Add(3 * time.Minute)},
+	}
+	tests := []struct {
+		name       string
+		cancelled  bool
+		wantErr    error
+		wantStatus MigrationStatus
+		wantPoints map[string]int64
+		wantEarned int64 // alice's, credited 10 for under-scored
+		wantBatch  []int // Processed at each progress report
+	}{
+		{
+			name:       "completed",
+			wantStatus: MigrationStatus{State: migrationRunning, RuleVersion: rules("").Version, Total: 4, Processed: 4, Changed: 2, Skipped: 1, Delta: 18 - 12}, // +18 and -12,
+			wantPoints: map[string]int64{"under-scored": 28, "over-scored": 28, "current": 28, "unparseable": 5},
+			wantEarned: 28,
+			wantBatch:  []int{3, 4},
+		},
+		{
+			name:       "cancelled",
+			cancelled:  true,
+			wantErr:    context.Canceled,
+			wantStatus: MigrationStatus{State: migrationRunning, RuleVersion: rules("").Version, Total: 4},
+			wantPoints: map[string]int64{"under-scored": 10, "over-scored": 40, "current": 28, "unparseable": 5},
+			wantEarned: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore(normalizeRetailer)
+			saveAll(t, store, stored...)
+			if _, _, err := store.AddLedgerEntry(LedgerEntry{ID: "under-scored", UserID: "alice", Kind: ledgerReceipt, Points: 10, CreatedAt: start}, false); err != nil {
+				t.Fatalf("AddLedgerEntry: %v", err)
+			}
+			ctx, cancel := context.WithCancel(t.Context())
+			if tt.cancelled {
+				cancel()
+			}
+			defer cancel()
+			var batches []int
+			status, err := migrateReceipts(ctx, store, cfg, rules, systemClock{}, 3, func(progress MigrationStatus) {
+				batches = append(batches, progress.Processed)
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("migrateReceipts error = %v, want %v", err, tt.wantErr)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %+v, want %+v", status, tt.wantStatus)
+			}
+			if !slices.Equal(batches, tt.wantBatch) {
+				t.Errorf("progress reported at %v, want %v", batches, tt.wantBatch)
+			}
+			for id, want := range tt.wantPoints {
+				rec, _, err := store.Get(id)
+				if err != nil {
+					t.Fatalf("Get %s: %v", id, err)
+				}
+				if rec.Points != want {
+					t.Errorf("%s has %d points, want %d", id, rec.Points, want)
+				}
+			}
+			balance, err := store.UserBalance("alice")
+			if err != nil {
+				t.Fatalf("UserBalance: %v", err)
+			}
+			if balance.Earned != tt.wantEarned || balance.Points != tt.wantEarned {
+				t.Errorf("alice earned %d with a balance of %d, want %d", balance.Earned, balance.Points, tt.wantEarned)
+			}
+		})
+	}
+}
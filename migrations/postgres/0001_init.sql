@@ -0,0 +1,25 @@
+-- Times are Unix nanoseconds, matching the precision of the Go values they
+-- come from; TIMESTAMPTZ would round them to microseconds.
+CREATE TABLE receipts (
+	id           TEXT PRIMARY KEY,
+	points       BIGINT NOT NULL,
+	processed_at BIGINT NOT NULL,
+	record       JSONB NOT NULL -- the StoredReceipt, submitted receipt included
+);
+CREATE INDEX receipts_points ON receipts (points);
+CREATE INDEX receipts_processed_at ON receipts (processed_at);
+
+CREATE TABLE customer_purchases (
+	customer_id TEXT PRIMARY KEY,
+	last_date   DATE NOT NULL
+);
+
+CREATE TABLE retailer_days (
+	retailer  TEXT PRIMARY KEY,
+	last_date DATE NOT NULL
+);
+
+CREATE TABLE fingerprints (
+	fingerprint TEXT PRIMARY KEY,
+	claimed_at  BIGINT NOT NULL
+);
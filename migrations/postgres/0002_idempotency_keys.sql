@@ -0,0 +1,6 @@
+CREATE TABLE idempotency_keys (
+	key          TEXT PRIMARY KEY,
+	request_hash TEXT NOT NULL,
+	receipt_id   TEXT NOT NULL DEFAULT '', -- empty until the request completes
+	expires_at   BIGINT NOT NULL
+);
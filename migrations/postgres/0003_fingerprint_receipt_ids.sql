@@ -0,0 +1,3 @@
+-- The receipt holding each claim, so a duplicate can be answered with it.
+-- Claims made before this migration have no recorded receipt.
+ALTER TABLE fingerprints ADD COLUMN receipt_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+CREATE TABLE api_keys (
+	id           TEXT PRIMARY KEY,
+	name         TEXT NOT NULL,
+	hash         TEXT NOT NULL UNIQUE,
+	created_at   BIGINT NOT NULL,
+	rotated_at   BIGINT NOT NULL DEFAULT 0, -- 0 until first rotated, like the other optional times
+	last_used_at BIGINT NOT NULL DEFAULT 0,
+	revoked_at   BIGINT NOT NULL DEFAULT 0
+);
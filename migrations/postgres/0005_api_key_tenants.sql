@@ -0,0 +1,3 @@
+-- The tenant requests made with each key belong to; '' for keys not bound
+-- to one.
+ALTER TABLE api_keys ADD COLUMN tenant TEXT NOT NULL DEFAULT '';
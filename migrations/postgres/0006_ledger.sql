@@ -0,0 +1,11 @@
+-- Credits and debits of each user's points, in the order they were added.
+CREATE TABLE ledger (
+	seq        BIGSERIAL PRIMARY KEY,
+	id         TEXT NOT NULL UNIQUE,
+	user_id    TEXT NOT NULL,
+	kind       TEXT NOT NULL,
+	points     BIGINT NOT NULL,
+	reference  TEXT NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL
+);
+CREATE INDEX ledger_user ON ledger (user_id, seq);
@@ -0,0 +1,3 @@
+-- When each credit's points expire, 0 if they never do.
+ALTER TABLE ledger ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX ledger_expiry ON ledger (expires_at) WHERE expires_at > 0;
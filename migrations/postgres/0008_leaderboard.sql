@@ -0,0 +1,9 @@
+-- Points earned by each user in each leaderboard period, added to as
+-- receipts are credited.
+CREATE TABLE leaderboard (
+	bucket  TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	points  BIGINT NOT NULL,
+	PRIMARY KEY (bucket, user_id)
+);
+CREATE INDEX leaderboard_points ON leaderboard (bucket, points DESC, user_id);
@@ -0,0 +1,3 @@
+-- For each adjustment, when the credit it adjusts was added, so it counts
+-- toward the same leaderboards; 0 for other entries.
+ALTER TABLE ledger ADD COLUMN credited_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- Pages of receipts are read in processing order, ties broken by id.
+CREATE INDEX receipts_processed_order ON receipts (processed_at, id);
+DROP INDEX receipts_processed_at;
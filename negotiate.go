@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Media types with a registered serializer.
+const (
+	mediaTypeJSON = "application/json"
+	mediaTypeXML  = "application/xml"
+	mediaTypeText = "text/plain"
+)
+
+// serializers encode a response value for each supported media type.
+var serializers = map[string]func(io.Writer, any) error{
+	mediaTypeJSON: func(w io.Writer, v any) error { return json.NewEncoder(w).Encode(v) },
+	mediaTypeXML: func(w io.Writer, v any) error {
+		if err := xml.NewEncoder(w).Encode(v); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	},
+	mediaTypeText: func(w io.Writer, v any) error {
+		_, err := fmt.Fprintln(w, v)
+		return err
+	},
+}
+
+// representation is one form an endpoint can respond with: the value to
+// encode with the serializer registered for MediaType.
+type representation struct {
+	MediaType string
+	Value     any
+}
+
+// Helper to write the representation the request's Accept header prefers,
+// or the first one when it has no preference. Responds 406 when the client
+// accepts none of them.
+func negotiatedResponse(w http.ResponseWriter, r *http.Request, status int, offers []representation, logger *slog.Logger) {
+	w.Header().Add("Vary", "Accept")
+	offer, ok := negotiate(r.Header.Get("Accept"), offers)
+	if !ok {
+		logger.Warn("No acceptable representation", slog.String("accept", r.Header.Get("Accept")))
+		errorResponse(w, http.StatusNotAcceptable, notAcceptableMsg, logger)
+		return
+	}
+	if offer.MediaType == mediaTypeJSON {
+		jsonResponse(w, status, offer.Value, logger)
+		return
+	}
+
+	contentType := offer.MediaType
+	if strings.HasPrefix(contentType, "text/") {
+		contentType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if err := serializers[offer.MediaType](w, offer.Value); err != nil {
+		logger.Error("Failed to encode response", slog.String("media_type", offer.MediaType), slog.Any("error", err))
+	}
+}
+
+// negotiate picks the offer with the highest quality in the Accept header,
+// preferring earlier offers on a tie. Each offer is rated by the most
+// specific range matching it, so "text/*;q=0" can be overridden by an
+// explicit "text/plain". An empty header accepts the first offer.
+func negotiate(accept string, offers []representation) (representation, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+
+	type mediaRange struct {
+		typ, subtype string
+		q            float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		typ, subtype, _ := strings.Cut(mediaType, "/")
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{typ: typ, subtype: subtype, q: q})
+	}
+
+	var best representation
+	bestQ := 0.0
+	for _, offer := range offers {
+		typ, subtype, _ := strings.Cut(offer.MediaType, "/")
+		q, specificity := 0.0, 0
+		for _, mr := range ranges {
+			var s int
+			switch {
+			case mr.typ == typ && mr.subtype == subtype:
+				s = 3
+			case mr.typ == typ && mr.subtype == "*":
+				s = 2
+			case mr.typ == "*" && mr.subtype == "*":
+				s = 1
+			default:
+				continue
+			}
+			if s > specificity {
+				q, specificity = mr.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best, bestQ > 0
+}
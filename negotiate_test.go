@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	offers := []representation{{MediaType: mediaTypeJSON}, {MediaType: mediaTypeText}, {MediaType: mediaTypeXML}}
+	tests := []struct {
+		accept string
+		want   string // the chosen media type; empty for none
+	}{
+		{accept: "", want: mediaTypeJSON},
+		{accept: "*/*", want: mediaTypeJSON},
+		{accept: "text/plain", want: mediaTypeText},
+		{accept: "application/xml", want: mediaTypeXML},
+		{accept: "text/*", want: mediaTypeText},
+		{accept: "application/*", want: mediaTypeJSON},
+		{accept: "text/plain;q=0.5, application/xml", want: mediaTypeXML},
+		{accept: "application/xml;q=0.5, text/plain;q=0.5", want: mediaTypeText}, // ties go to the earlier offer
+		{accept: "*/*;q=0.1, application/xml", want: mediaTypeXML},
+		{accept: "text/*;q=0, text/plain", want: mediaTypeText}, // the more specific range wins
+		{accept: "application/json;q=0, */*", want: mediaTypeText},
+		{accept: "text/html", want: ""},
+		{accept: "*/*;q=0", want: ""},
+		{accept: "not a media type", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			offer, ok := negotiate(tt.accept, offers)
+			if got := offer.MediaType; ok != (tt.want != "") || got != tt.want {
+				t.Errorf("negotiate = %q, %v; want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// postgresMigrationLock is the advisory lock key held while migrating, so
+// pods starting together apply each migration once.
+const postgresMigrationLock = 0x72656370 // "recp"
+
+// postgresLedgerLock is the first key of the advisory lock on a user's
+// ledger, the second being a hash of the user id, so adding an entry waits
+// out any other being added for the same user.
+const postgresLedgerLock = 0x6c656467 // "ledg"
+
+// postgresStore keeps receipts in PostgreSQL, shared by every replica of the
+// service. Every method is a single statement or transaction, so concurrent
+// replicas see the same atomic claims as handlers within one process.
+type postgresStore struct {
+	pool *pgxpool.Pool
+	// retailerKey groups retailer names for RetailerStats and ClaimRetailerDay.
+	retailerKey func(string) string
+}
+
+// newPostgresStore connects to the database described by cfg and applies any
+// pending schema migrations.
+func newPostgresStore(cfg StoreConfig, retailerKey func(string) string, logger *slog.Logger) (*postgresStore, error) {
+	poolCfg, err := pgxpool.ParseConfig(cfg.PostgresURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing POSTGRES_URL: %w", err)
+	}
+	if cfg.PostgresMaxConns > 0 {
+		poolCfg.MaxConns = int32(cfg.PostgresMaxConns)
+	}
+	poolCfg.MinConns = int32(cfg.PostgresMinConns)
+	if cfg.PostgresMaxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = cfg.PostgresMaxConnLifetime
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to postgres: %w", err)
+	}
+	if err := migratePostgres(ctx, pool, logger); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &postgresStore{pool: pool, retailerKey: retailerKey}, nil
+}
+
+// migratePostgres applies, in order, every embedded migration not yet
+// recorded in schema_migrations. Files are named NNNN_description.sql and
+// each runs in its own transaction.
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool, logger *slog.Logger) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("connecting to postgres: %w", err)
+	}
+	defer conn.Release()
+
+	// Session-level, so it must be released on the same connection
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+		return fmt.Errorf("locking for migrations: %w", err)
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, postgresMigrationLock)
+
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+	rows, err := conn.Query(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return fmt.Errorf("reading schema_migrations: %w", err)
+	}
+	applied, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return fmt.Errorf("reading schema_migrations: %w", err)
+	}
+
+	files, err := fs.Glob(postgresMigrations, "migrations/postgres/*.sql")
+	if err != nil {
+		return err
+	}
+	slices.Sort(files)
+	for _, file := range files {
+		name := path.Base(file)
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return fmt.Errorf("migration %s: name must start with a version number", name)
+		}
+		if slices.Contains(applied, version) {
+			continue
+		}
+		sql, err := postgresMigrations.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, string(sql)); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("applying migration %s: %w", name, err)
+		}
+		logger.Info("Applied database migration", slog.String("migration", name))
+	}
+	return nil
+}
+
+// Close closes every connection in the pool.
+func (s *postgresStore) Close() {
+	s.pool.Close()
+}
+
+// putReceipt inserts or replaces rec, inside tx unless it is nil.
+func (s *postgresStore) putReceipt(ctx context.Context, tx pgx.Tx, rec StoredReceipt) error {
+	record, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encoding receipt %s: %w", rec.ID, err)
+	}
+	const upsert = `INSERT INTO receipts (id, points, processed_at, record) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET points = excluded.points, processed_at = excluded.processed_at, record = excluded.record`
+	args := []any{rec.ID, rec.Points, rec.ProcessedAt.UnixNano(), string(record)}
+	if tx != nil {
+		_, err = tx.Exec(ctx, upsert, args...)
+	} else {
+		_, err = s.pool.Exec(ctx, upsert, args...)
+	}
+	return err
+}
+
+// collectReceipts decodes every row of a query selecting the record column.
+func collectReceipts(rows pgx.Rows) ([]StoredReceipt, error) {
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (StoredReceipt, error) {
+		var record string
+		if err := row.Scan(&record); err != nil {
+			return StoredReceipt{}, err
+		}
+		return decodeStoredReceipt(record)
+	})
+}
+
+func (s *postgresStore) Save(rec StoredReceipt) error {
+	return s.putReceipt(context.Background(), nil, rec)
+}
+
+func (s *postgresStore) Get(id string) (StoredReceipt, bool, error) {
+	var record string
+	err := s.pool.QueryRow(context.Background(), `SELECT record FROM receipts WHERE id = $1`, id).Scan(&record)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return StoredReceipt{}, false, nil
+	}
+	if err != nil {
+		return StoredReceipt{}, false, err
+	}
+	rec, err := decodeStoredReceipt(record)
+	return rec, err == nil, err
+}
+
+func (s *postgresStore) Exists(id string) (bool, error) {
+	var found bool
+	err := s.pool.QueryRow(context.Background(), `SELECT EXISTS (SELECT 1 FROM receipts WHERE id = $1)`, id).Scan(&found)
+	return found, err
+}
+
+func (s *postgresStore) Update(id string, fn func(*StoredReceipt) error) (StoredReceipt, bool, error) {
+	ctx := context.Background()
+	var rec StoredReceipt
+	found := false
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		var record string
+		err := tx.QueryRow(ctx, `SELECT record FROM receipts WHERE id = $1 FOR UPDATE`, id).Scan(&record)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		if rec, err = decodeStoredReceipt(record); err != nil {
+			return err
+		}
+		if err := fn(&rec); err != nil {
+			return err
+		}
+		rec.ID = id
+		return s.putReceipt(ctx, tx, rec)
+	})
+	if err != nil || !found {
+		return StoredReceipt{}, found, err
+	}
+	return rec, true, nil
+}
+
+func (s *postgresStore) Delete(id string) (bool, error) {
+	tag, err := s.pool.Exec(context.Background(), `DELETE FROM receipts WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// DeleteWhere evaluates pred in Go, so it locks and reads every receipt
+// inside the transaction before deleting the matches.
+func (s *postgresStore) DeleteWhere(pred func(StoredReceipt) bool) (int, error) {
+	ctx := context.Background()
+	deleted := 0
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT record FROM receipts FOR UPDATE`)
+		if err != nil {
+			return err
+		}
+		recs, err := collectReceipts(rows)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for _, rec := range recs {
+			if pred(rec) {
+				ids = append(ids, rec.ID)
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		tag, err := tx.Exec(ctx, `DELETE FROM receipts WHERE id = ANY($1)`, ids)
+		deleted = int(tag.RowsAffected())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (s *postgresStore) RecordCustomerPurchase(customerID string, date time.Time) (time.Time, bool, error) {
+	ctx := context.Background()
+	var previous time.Time
+	found := false
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		// Inserting first settles a race between two first purchases
+		tag, err := tx.Exec(ctx, `INSERT INTO customer_purchases (customer_id, last_date) VALUES ($1, $2)
+			ON CONFLICT (customer_id) DO NOTHING`, customerID, date)
+		if err != nil || tag.RowsAffected() > 0 {
+			return err
+		}
+		found = true
+		err = tx.QueryRow(ctx, `SELECT last_date FROM customer_purchases WHERE customer_id = $1 FOR UPDATE`, customerID).Scan(&previous)
+		if err != nil {
+			return err
+		}
+		if date.After(previous) {
+			_, err = tx.Exec(ctx, `UPDATE customer_purchases SET last_date = $2 WHERE customer_id = $1`, customerID, date)
+		}
+		return err
+	})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return previous, found, nil
+}
+
+func (s *postgresStore) ClaimRetailerDay(retailer string, date time.Time) (bool, error) {
+	tag, err := s.pool.Exec(context.Background(), `INSERT INTO retailer_days (retailer, last_date) VALUES ($1, $2)
+		ON CONFLICT (retailer) DO UPDATE SET last_date = excluded.last_date
+		WHERE retailer_days.last_date < excluded.last_date`, s.retailerKey(retailer), date)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ClaimFingerprint reads the holder back only when the claim fails. Claims
+// are never deleted, so the row is still there.
+func (s *postgresStore) ClaimFingerprint(fingerprint, id string, at time.Time, window time.Duration) (string, bool, error) {
+	ctx := context.Background()
+	tag, err := s.pool.Exec(ctx, `INSERT INTO fingerprints (fingerprint, claimed_at, receipt_id) VALUES ($1, $2, $4)
+		ON CONFLICT (fingerprint) DO UPDATE SET claimed_at = excluded.claimed_at, receipt_id = excluded.receipt_id
+		WHERE excluded.claimed_at - fingerprints.claimed_at >= $3`, fingerprint, at.UnixNano(), int64(window), id)
+	if err != nil {
+		return "", false, err
+	}
+	if tag.RowsAffected() > 0 {
+		return "", true, nil
+	}
+	var holder string
+	err = s.pool.QueryRow(ctx, `SELECT receipt_id FROM fingerprints WHERE fingerprint = $1`, fingerprint).Scan(&holder)
+	return holder, false, err
+}
+
+func (s *postgresStore) ReleaseFingerprint(fingerprint, id string) error {
+	_, err := s.pool.Exec(context.Background(), `DELETE FROM fingerprints WHERE fingerprint = $1 AND receipt_id = $2`, fingerprint, id)
+	return err
+}
+
+// ReserveIdempotencyKey takes over an expired reservation in the same
+// statement that inserts a new one. If the key is held, the holder is read
+// back; should it be released in between, the reservation is retried.
+func (s *postgresStore) ReserveIdempotencyKey(key, requestHash string, at time.Time, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	ctx := context.Background()
+	rec := IdempotencyRecord{Key: key, RequestHash: requestHash, ExpiresAt: at.Add(ttl)}
+	for attempt := 0; attempt < 3; attempt++ {
+		tag, err := s.pool.Exec(ctx, `INSERT INTO idempotency_keys (key, request_hash, receipt_id, expires_at) VALUES ($1, $2, '', $3)
+			ON CONFLICT (key) DO UPDATE SET request_hash = excluded.request_hash, receipt_id = '', expires_at = excluded.expires_at
+			WHERE idempotency_keys.expires_at <= $4`, key, requestHash, rec.ExpiresAt.UnixNano(), at.UnixNano())
+		if err != nil {
+			return IdempotencyRecord{}, false, err
+		}
+		if tag.RowsAffected() > 0 {
+			return rec, true, nil
+		}
+
+		existing := IdempotencyRecord{Key: key}
+		var expiresAt int64
+		err = s.pool.QueryRow(ctx, `SELECT request_hash, receipt_id, expires_at FROM idempotency_keys WHERE key = $1`, key).
+			Scan(&existing.RequestHash, &existing.ReceiptID, &expiresAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return IdempotencyRecord{}, false, err
+		}
+		existing.ExpiresAt = time.Unix(0, expiresAt)
+		return existing, false, nil
+	}
+	return IdempotencyRecord{}, false, fmt.Errorf("idempotency key %q kept changing while being reserved", key)
+}
+
+func (s *postgresStore) CompleteIdempotencyKey(key, receiptID string) error {
+	_, err := s.pool.Exec(context.Background(), `UPDATE idempotency_keys SET receipt_id = $2 WHERE key = $1`, key, receiptID)
+	return err
+}
+
+func (s *postgresStore) ReleaseIdempotencyKey(key string) error {
+	_, err := s.pool.Exec(context.Background(), `DELETE FROM idempotency_keys WHERE key = $1`, key)
+	return err
+}
+
+func (s *postgresStore) Rank(id string) (ReceiptRank, bool, error) {
+	var rank ReceiptRank
+	err := s.pool.QueryRow(context.Background(), `SELECT r.points, COUNT(*), COUNT(*) FILTER (WHERE all_r.points <= r.points)
+		FROM receipts r CROSS JOIN receipts all_r WHERE r.id = $1 GROUP BY r.points`, id).Scan(&rank.Points, &rank.Total, &rank.AtOrBelow)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ReceiptRank{}, false, nil
+	}
+	if err != nil {
+		return ReceiptRank{}, false, err
+	}
+	rank.Rank = rank.Total - rank.AtOrBelow + 1
+	return rank, true, nil
+}
+
+func (s *postgresStore) ProcessedBetween(from, to time.Time) ([]StoredReceipt, error) {
+	var conds []string
+	var args []any
+	if !from.IsZero() {
+		args = append(args, from.UnixNano())
+		conds = append(conds, fmt.Sprintf(`processed_at >= $%d`, len(args)))
+	}
+	if !to.IsZero() {
+		args = append(args, to.UnixNano())
+		conds = append(conds, fmt.Sprintf(`processed_at < $%d`, len(args)))
+	}
+	query := `SELECT record FROM receipts`
+	if len(conds) > 0 {
+		query += ` WHERE ` + strings.Join(conds, ` AND `)
+	}
+	rows, err := s.pool.Query(context.Background(), query+` ORDER BY processed_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return collectReceipts(rows)
+}
+
+func (s *postgresStore) ProcessedPage(after time.Time, afterID string, to time.Time, limit int) ([]StoredReceipt, error) {
+	var conds []string
+	var args []any
+	switch {
+	case afterID != "":
+		args = append(args, after.UnixNano(), afterID)
+		conds = append(conds, fmt.Sprintf(`(processed_at > $%d OR (processed_at = $%d AND id > $%d))`, len(args)-1, len(args)-1, len(args)))
+	case !after.IsZero():
+		args = append(args, after.UnixNano())
+		conds = append(conds, fmt.Sprintf(`processed_at >= $%d`, len(args)))
+	}
+	if !to.IsZero() {
+		args = append(args, to.UnixNano())
+		conds = append(conds, fmt.Sprintf(`processed_at < $%d`, len(args)))
+	}
+	query := `SELECT record FROM receipts`
+	if len(conds) > 0 {
+		query += ` WHERE ` + strings.Join(conds, ` AND `)
+	}
+	args = append(args, limit)
+	rows, err := s.pool.Query(context.Background(), query+fmt.Sprintf(` ORDER BY processed_at, id LIMIT $%d`, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	return collectReceipts(rows)
+}
+
+// RetailerStats groups in Go rather than SQL, since the grouping key is
+// configurable and may change between deployments.
+func (s *postgresStore) RetailerStats() ([]RetailerStats, error) {
+	recs, err := s.ProcessedBetween(time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return groupRetailerStats(recs, s.retailerKey), nil
+}
+
+func (s *postgresStore) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+// putAPIKey inserts or replaces key, inside tx unless it is nil.
+func (s *postgresStore) putAPIKey(ctx context.Context, tx pgx.Tx, key APIKey) error {
+	const upsert = `INSERT INTO api_keys (` + apiKeyColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, tenant = excluded.tenant, hash = excluded.hash, created_at = excluded.created_at,
+			rotated_at = excluded.rotated_at, last_used_at = excluded.last_used_at, revoked_at = excluded.revoked_at`
+	args := []any{key.ID, key.Name, key.Tenant, key.Hash, key.CreatedAt.UnixNano(), unixNanoOrZero(key.RotatedAt), unixNanoOrZero(key.LastUsedAt), unixNanoOrZero(key.RevokedAt)}
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, upsert, args...)
+	} else {
+		_, err = s.pool.Exec(ctx, upsert, args...)
+	}
+	return err
+}
+
+func (s *postgresStore) SaveAPIKey(key APIKey) error {
+	return s.putAPIKey(context.Background(), nil, key)
+}
+
+func (s *postgresStore) APIKeyByHash(hash string) (APIKey, bool, error) {
+	key, err := scanAPIKey(s.pool.QueryRow(context.Background(), `SELECT `+apiKeyColumns+` FROM api_keys WHERE hash = $1`, hash))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return APIKey{}, false, nil
+	}
+	return key, err == nil, err
+}
+
+func (s *postgresStore) APIKeys() ([]APIKey, error) {
+	rows, err := s.pool.Query(context.Background(), `SELECT `+apiKeyColumns+` FROM api_keys ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (APIKey, error) { return scanAPIKey(row) })
+}
+
+func (s *postgresStore) UpdateAPIKey(id string, fn func(*APIKey) error) (APIKey, bool, error) {
+	ctx := context.Background()
+	var key APIKey
+	found := false
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		var err error
+		key, err = scanAPIKey(tx.QueryRow(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE id = $1 FOR UPDATE`, id))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		if err := fn(&key); err != nil {
+			return err
+		}
+		key.ID = id
+		return s.putAPIKey(ctx, tx, key)
+	})
+	if err != nil || !found {
+		return APIKey{}, found, err
+	}
+	return key, true, nil
+}
+
+func (s *postgresStore) AddLedgerEntry(entry LedgerEntry, checkBalance bool) (int64, bool, error) {
+	ctx := context.Background()
+	var balance int64
+	added := false
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2))`, postgresLedgerLock, entry.UserID); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(ctx, `SELECT COALESCE(SUM(points), 0) FROM ledger WHERE user_id = $1`, entry.UserID).Scan(&balance); err != nil {
+			return err
+		}
+		if checkBalance && entry.Points < 0 && balance+entry.Points < 0 {
+			return nil
+		}
+		tag, err := tx.Exec(ctx, `INSERT INTO ledger (`+ledgerColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (id) DO NOTHING`,
+			entry.ID, entry.UserID, entry.Kind, entry.Points, entry.Reference, entry.CreatedAt.UnixNano(), ledgerTime(entry.ExpiresAt), ledgerTime(entry.CreditedAt))
+		if err != nil {
+			return err
+		}
+		if added = tag.RowsAffected() > 0; !added {
+			return nil
+		}
+		balance += entry.Points
+		for _, bucket := range leaderboardBuckets(entry) {
+			if _, err := tx.Exec(ctx, leaderboardUpsert, bucket, entry.UserID, entry.Points); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return balance, added, nil
+}
+
+func (s *postgresStore) Ledger(userID string) ([]LedgerEntry, error) {
+	rows, err := s.pool.Query(context.Background(), `SELECT `+ledgerColumns+` FROM ledger WHERE user_id = $1 ORDER BY seq`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (LedgerEntry, error) { return scanLedgerEntry(row) })
+}
+
+func (s *postgresStore) UserBalance(userID string) (UserBalance, error) {
+	balance := UserBalance{UserID: userID}
+	err := s.pool.QueryRow(context.Background(), `SELECT `+ledgerBalanceColumns+` FROM ledger WHERE user_id = $1`, userID).
+		Scan(&balance.Points, &balance.Earned, &balance.Redeemed, &balance.Expired, &balance.Receipts)
+	return balance, err
+}
+
+func (s *postgresStore) Leaderboard(bucket string, limit int) ([]LeaderboardEntry, error) {
+	rows, err := s.pool.Query(context.Background(), leaderboardQuery, bucket, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[LeaderboardEntry])
+}
+
+// ExpiringLedgerUsers matches each credit to an expiry entry of the same
+// user referencing the credit's id within its tenant.
+func (s *postgresStore) ExpiringLedgerUsers(before time.Time) ([]string, error) {
+	rows, err := s.pool.Query(context.Background(), `SELECT DISTINCT user_id FROM ledger c
+		WHERE kind = '`+ledgerReceipt+`' AND expires_at > 0 AND expires_at <= $1
+		AND NOT EXISTS (SELECT 1 FROM ledger e WHERE e.user_id = c.user_id AND e.kind = '`+ledgerExpiry+`'
+			AND e.reference = substr(c.id, strpos(c.id, '`+tenantSeparator+`') + 1))`, before.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
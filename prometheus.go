@@ -0,0 +1,192 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// mediaTypeOpenMetrics is the exposition format Prometheus asks for first.
+// It has no serializer; promhttp writes it.
+const mediaTypeOpenMetrics = "application/openmetrics-text"
+
+// metricsNamespace prefixes every metric the service exports.
+const metricsNamespace = "receipt_processor"
+
+// promMetrics holds the service's Prometheus metrics, served by GET /metrics
+// to clients that ask for the Prometheus text format. A nil *promMetrics
+// records nothing.
+type promMetrics struct {
+	handler            http.Handler
+	requests           *prometheus.CounterVec
+	latency            *prometheus.HistogramVec
+	processed          *prometheus.CounterVec
+	multiTenant        bool // label the receipt counts by tenant
+	validationFailures *prometheus.CounterVec
+	panics             prometheus.Counter
+}
+
+// newPromMetrics registers the service's metrics, including the number of
+// stored receipts, which is read from store on every scrape, and the Go
+// runtime and process collectors. With multiTenant the receipt counts are
+// labelled by tenant.
+func newPromMetrics(store Store, multiTenant bool, logger *slog.Logger) *promMetrics {
+	var tenantLabels []string
+	if multiTenant {
+		tenantLabels = []string{"tenant"}
+	}
+	m := &promMetrics{
+		multiTenant: multiTenant,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests served, by route pattern and status code.",
+		}, []string{"route", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time to serve HTTP requests, by route pattern and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "code"}),
+		processed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "receipts_processed_total",
+			Help:      "Receipts scored and stored.",
+		}, tenantLabels),
+		validationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "receipt_validation_failures_total",
+			Help:      "Receipts rejected as invalid, by the field at fault.",
+		}, []string{"reason"}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_handler_panics_total",
+			Help:      "Requests whose handler panicked.",
+		}),
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		m.requests,
+		m.latency,
+		m.processed,
+		m.validationFailures,
+		m.panics,
+		&storeSizeCollector{
+			store:       store,
+			desc:        prometheus.NewDesc(metricsNamespace+"_receipts_stored", "Receipts currently stored.", tenantLabels, nil),
+			multiTenant: multiTenant,
+			logger:      logger,
+		},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	m.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+	return m
+}
+
+// instrument counts and times every request next serves. route names the
+// route pattern a request matches, keeping the route label's values bounded.
+func (m *promMetrics) instrument(next http.Handler, route func(*http.Request) string) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		labels := prometheus.Labels{"route": route(r), "code": strconv.Itoa(sw.status)}
+		m.requests.With(labels).Inc()
+		m.latency.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// receiptProcessed counts a receipt stored by acceptReceipt for tenant.
+func (m *promMetrics) receiptProcessed(tenant string) {
+	if m == nil {
+		return
+	}
+	if m.multiTenant {
+		m.processed.WithLabelValues(tenantLabel(tenant)).Inc()
+		return
+	}
+	m.processed.WithLabelValues().Inc()
+}
+
+// validationFailed counts a receipt rejected for err.
+func (m *promMetrics) validationFailed(err error) {
+	if m == nil {
+		return
+	}
+	m.validationFailures.WithLabelValues(validationReason(err)).Inc()
+}
+
+// panicked counts a request recovered by recoveryMiddleware.
+func (m *promMetrics) panicked() {
+	if m == nil {
+		return
+	}
+	m.panics.Inc()
+}
+
+// validationFields are the receipt fields validation errors name.
+var validationFields = []string{"retailer", "purchaseDate", "purchaseTime", "customerId", "userId", "total", "items", "shortDescription", "price", "quantity"}
+
+// validationReason reduces a validation error to the field it concerns, the
+// one named first in its message, so that item indexes and limits do not
+// become label values.
+func validationReason(err error) string {
+	msg := err.Error()
+	reason, at := "other", len(msg)
+	for _, field := range validationFields {
+		if i := strings.Index(msg, field); i >= 0 && i < at {
+			reason, at = field, i
+		}
+	}
+	return reason
+}
+
+// storeSizeCollector reports the number of stored receipts. The store has no
+// count of its own, so it is summed from the retailer stats, or, by tenant,
+// counted from every receipt.
+type storeSizeCollector struct {
+	store       Store
+	desc        *prometheus.Desc
+	multiTenant bool
+	logger      *slog.Logger
+}
+
+func (c *storeSizeCollector) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+
+func (c *storeSizeCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.multiTenant {
+		stats, err := tenantStats(c.store)
+		if err != nil {
+			c.logger.Error("Failed to count stored receipts", slog.Any("error", err))
+			return
+		}
+		for tenant, s := range stats {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(s.Receipts), tenant)
+		}
+		return
+	}
+	stats, err := c.store.RetailerStats()
+	if err != nil {
+		c.logger.Error("Failed to count stored receipts", slog.Any("error", err))
+		return
+	}
+	var receipts int
+	for _, s := range stats {
+		receipts += s.Receipts
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(receipts))
+}
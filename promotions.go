@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"slices"
+	"time"
+)
+
+// Promotion adds points, on top of the rules, to receipts purchased within a
+// date range at matching retailers, e.g. double points at Target from
+// November 20 to 30.
+type Promotion struct {
+	Name string `yaml:"name"`
+	// From and To bound the purchase date, both inclusive; either may be
+	// left out to leave that end open
+	From Date `yaml:"from"`
+	To   Date `yaml:"to"`
+	// Retailer is a case-insensitive glob over the retailer name, e.g.
+	// "target*"; empty matches every retailer
+	Retailer   string  `yaml:"retailer"`
+	Multiplier float64 `yaml:"multiplier"` // scales the points from the rules, e.g. 2 for double; 0 leaves them alone
+	Bonus      int64   `yaml:"bonus"`      // flat points added
+}
+
+// Date is a calendar date, written as "YYYY-MM-DD" in rules files and JSON.
+// The zero Date is unset.
+type Date struct{ t time.Time }
+
+func (d Date) IsZero() bool { return d.t.IsZero() }
+
+func (d Date) MarshalText() ([]byte, error) {
+	if d.IsZero() {
+		return []byte{}, nil
+	}
+	return []byte(d.t.Format(time.DateOnly)), nil
+}
+
+func (d *Date) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*d = Date{}
+		return nil
+	}
+	t, err := time.Parse(time.DateOnly, string(text))
+	if err != nil {
+		return fmt.Errorf("%q is not a date (YYYY-MM-DD)", text)
+	}
+	*d = Date{t}
+	return nil
+}
+
+// promotionRulePrefix starts the breakdown name of each promotion.
+const promotionRulePrefix = "promotion:"
+
+// applies reports whether p covers data.
+func (p Promotion) applies(data *ValidatedReceiptData) bool {
+	if !p.From.IsZero() && data.PurchaseDate.Before(p.From.t) {
+		return false
+	}
+	if !p.To.IsZero() && data.PurchaseDate.After(p.To.t) {
+		return false
+	}
+	return matchRetailer(p.Retailer, data.Retailer)
+}
+
+// promotionResults returns the contribution of each promotion covering data,
+// given the base points from the rules. Promotions stack additively: each
+// multiplier applies to the base points alone, so two double-points
+// promotions triple them.
+func promotionResults(data *ValidatedReceiptData, promotions []Promotion, base int64) []RuleResult {
+	var results []RuleResult
+	for _, p := range promotions {
+		if !p.applies(data) {
+			continue
+		}
+		points := p.Bonus
+		if p.Multiplier != 0 {
+			points += int64(math.Round(float64(base) * (p.Multiplier - 1)))
+		}
+		results = append(results, RuleResult{Rule: promotionRulePrefix + p.Name, Points: points})
+	}
+	return results
+}
+
+// validatePromotions reports the first promotion that cannot be applied.
+func validatePromotions(promotions []Promotion) error {
+	for i, p := range promotions {
+		if p.Name == "" {
+			return fmt.Errorf("promotions: every promotion needs a name")
+		}
+		if slices.ContainsFunc(promotions[:i], func(q Promotion) bool { return q.Name == p.Name }) {
+			return fmt.Errorf("promotions: more than one promotion is named %q", p.Name)
+		}
+		if !p.From.IsZero() && !p.To.IsZero() && p.To.t.Before(p.From.t) {
+			return fmt.Errorf("promotions %q: to must not be before from", p.Name)
+		}
+		if p.Multiplier < 0 {
+			return fmt.Errorf("promotions %q: multiplier must not be negative", p.Name)
+		}
+		if _, err := path.Match(p.Retailer, ""); err != nil {
+			return fmt.Errorf("promotions %q: retailer %q is not a valid pattern", p.Name, p.Retailer)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPromotionWindow(t *testing.T) {
+	date := func(s string) Date {
+		d, err := time.Parse(time.DateOnly, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Date{d}
+	}
+	november := Promotion{Name: "november", From: date("2024-11-20"), To: date("2024-11-30"), Retailer: "target*", Multiplier: 2}
+	tests := []struct {
+		name      string
+		promotion Promotion
+		retailer  string
+		date      string
+		want      bool
+	}{
+		{name: "day before the window", promotion: november, retailer: "Target", date: "2024-11-19", want: false},
+		{name: "first day", promotion: november, retailer: "Target", date: "2024-11-20", want: true},
+		{name: "inside", promotion: november, retailer: "Target", date: "2024-11-25", want: true},
+		{name: "last day", promotion: november, retailer: "Target", date: "2024-11-30", want: true},
+		{name: "day after the window", promotion: november, retailer: "Target", date: "2024-12-01", want: false},
+		{name: "retailer pattern ignores case", promotion: november, retailer: "TARGET Express", date: "2024-11-25", want: true},
+		{name: "other retailer", promotion: november, retailer: "Walgreens", date: "2024-11-25", want: false},
+		{name: "open start", promotion: Promotion{Name: "until", To: date("2024-11-30")}, retailer: "Walgreens", date: "2000-01-01", want: true},
+		{name: "open end", promotion: Promotion{Name: "since", From: date("2024-11-20")}, retailer: "Walgreens", date: "2099-12-31", want: true},
+		{name: "single day", promotion: Promotion{Name: "new_year", From: date("2025-01-01"), To: date("2025-01-01")}, retailer: "Target", date: "2025-01-01", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.Retailer, receipt.PurchaseDate = tt.retailer, tt.date
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{})
+			if err != nil {
+				t.Fatalf("validateAndParseReceipt: %v", err)
+			}
+			if got := tt.promotion.applies(data); got != tt.want {
+				t.Errorf("applies = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromotionResults(t *testing.T) {
+	double := Promotion{Name: "double", Multiplier: 2}
+	bonus := Promotion{Name: "bonus", Bonus: 10}
+	tests := []struct {
+		name       string
+		promotions []Promotion
+		want       []RuleResult
+	}{
+		{name: "multiplier", promotions: []Promotion{double}, want: []RuleResult{{Rule: "promotion:double", Points: 28}}},
+		{name: "flat bonus", promotions: []Promotion{bonus}, want: []RuleResult{{Rule: "promotion:bonus", Points: 10}}},
+		{name: "stacked on the base alone", promotions: []Promotion{double, {Name: "double_again", Multiplier: 2}}, want: []RuleResult{{Rule: "promotion:double", Points: 28}, {Rule: "promotion:double_again", Points: 28}}},
+		{name: "multiplier and bonus", promotions: []Promotion{{Name: "both", Multiplier: 1.5, Bonus: 5}}, want: []RuleResult{{Rule: "promotion:both", Points: 19}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{})
+			if err != nil {
+				t.Fatalf("validateAndParseReceipt: %v", err)
+			}
+			got := promotionResults(data, tt.promotions, 28)
+			if len(got) != len(tt.want) {
+				t.Fatalf("results = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("results = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
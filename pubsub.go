@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// ReceiptEvent is published each time a receipt is processed.
+type ReceiptEvent struct {
+	ID       string `json:"id"`
+	Points   int64  `json:"points"`
+	Retailer string `json:"retailer"`
+	Tenant   string `json:"-"` // only the tenant's subscribers receive it
+}
+
+// broker fans receipt events out to subscribers. Publishing never blocks:
+// an event that does not fit in a subscriber's buffer is dropped for that
+// subscriber and counted, and the subscriber keeps receiving later events.
+type broker struct {
+	mu      sync.Mutex
+	subs    map[*subscription]struct{}
+	buffer  int
+	dropped atomic.Int64 // events dropped across all subscribers
+	closed  bool         // set by Close; later subscriptions start closed
+}
+
+// subscription is one subscriber's view of a broker.
+type subscription struct {
+	tenant  string
+	ch      chan ReceiptEvent
+	dropped atomic.Int64
+	stop    func() bool // deregisters the context callback
+}
+
+// newBroker returns a broker giving each subscriber a buffer of the given size.
+func newBroker(buffer int) *broker {
+	return &broker{subs: make(map[*subscription]struct{}), buffer: buffer}
+}
+
+// Subscribe registers a new subscriber to tenant's events until ctx is done
+// or the returned function is called, whichever comes first. Either way the
+// subscription's channel is closed once it is unsubscribed, and no goroutine
+// outlives it.
+func (b *broker) Subscribe(ctx context.Context, tenant string) (*subscription, func()) {
+	sub := &subscription{tenant: tenant, ch: make(chan ReceiptEvent, b.buffer)}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		close(sub.ch)
+		return sub, func() {}
+	}
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	sub.stop = context.AfterFunc(ctx, func() { b.remove(sub) })
+	return sub, func() {
+		sub.stop()
+		b.remove(sub)
+	}
+}
+
+// Events returns the channel on which the subscriber receives events.
+func (s *subscription) Events() <-chan ReceiptEvent {
+	return s.ch
+}
+
+// Dropped returns how many events this subscriber missed for falling behind.
+func (s *subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Publish delivers ev to every subscriber to its tenant with room in its
+// buffer.
+func (b *broker) Publish(ev ReceiptEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		if sub.tenant != ev.Tenant {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped.Add(1)
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribers returns the number of current subscribers.
+func (b *broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// Dropped returns how many events have been dropped across all subscribers.
+func (b *broker) Dropped() int64 {
+	return b.dropped.Load()
+}
+
+// Close unsubscribes every subscriber, closing their channels, and refuses
+// new ones. It is called at shutdown so streams end instead of delaying it.
+func (b *broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+func (b *broker) remove(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
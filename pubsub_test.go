@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBrokerPublish(t *testing.T) {
+	tests := []struct {
+		name        string
+		buffer      int
+		tenant      string // the subscriber's
+		publish     []ReceiptEvent
+		wantIDs     []string
+		wantDropped int64
+	}{
+		{name: "delivered", buffer: 4, publish: []ReceiptEvent{{ID: "a"}, {ID: "b"}}, wantIDs: []string{"a", "b"}},
+		{name: "full buffer drops", buffer: 1, publish: []ReceiptEvent{{ID: "a"}, {ID: "b"}, {ID: "c"}}, wantIDs: []string{"a"}, wantDropped: 2},
+		{name: "other tenant's events", buffer: 4, tenant: "acme", publish: []ReceiptEvent{{ID: "a"}, {ID: "b", Tenant: "acme"}, {ID: "c", Tenant: "other"}}, wantIDs: []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBroker(tt.buffer)
+			sub, unsubscribe := b.Subscribe(context.Background(), tt.tenant)
+			for _, ev := range tt.publish {
+				b.Publish(ev) // never blocks, however full the buffer
+			}
+			unsubscribe()
+			var got []string
+			for ev := range sub.Events() {
+				got = append(got, ev.ID)
+			}
+			if len(got) != len(tt.wantIDs) {
+				t.Fatalf("received %v, want %v", got, tt.wantIDs)
+			}
+			for i := range got {
+				if got[i] != tt.wantIDs[i] {
+					t.Fatalf("received %v, want %v", got, tt.wantIDs)
+				}
+			}
+			if sub.Dropped() != tt.wantDropped || b.Dropped() != tt.wantDropped {
+				t.Errorf("dropped %d by the subscriber, %d by the broker; want %d", sub.Dropped(), b.Dropped(), tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestBrokerUnsubscribe(t *testing.T) {
+	tests := []struct {
+		name string
+		end  func(b *broker, cancel context.CancelFunc, unsubscribe func())
+	}{
+		{name: "unsubscribed", end: func(_ *broker, _ context.CancelFunc, unsubscribe func()) { unsubscribe() }},
+		{name: "context done", end: func(_ *broker, cancel context.CancelFunc, _ func()) { cancel() }},
+		{name: "broker closed", end: func(b *broker, _ context.CancelFunc, _ func()) { b.Close() }},
+		{name: "unsubscribed twice", end: func(_ *broker, cancel context.CancelFunc, unsubscribe func()) { unsubscribe(); cancel(); unsubscribe() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBroker(1)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sub, unsubscribe := b.Subscribe(ctx, "")
+			tt.end(b, cancel, unsubscribe)
+			// The channel closes once the subscriber is gone
+			for range sub.Events() {
+			}
+			if n := b.Subscribers(); n != 0 {
+				t.Errorf("subscribers = %d, want 0", n)
+			}
+			b.Publish(ReceiptEvent{ID: "after"})
+		})
+	}
+}
+
+func TestBrokerStress(t *testing.T) {
+	const (
+		publishers = 4
+		events     = 2500 // per publisher
+	)
+	tests := []struct {
+		name        string
+		readers     int // subscribers draining their channel
+		stalled     int // subscribers that never read
+		buffer      int
+		wantNoDrops bool
+	}{
+		{name: "no subscribers", buffer: 8, wantNoDrops: true},
+		{name: "all stalled", stalled: 100, buffer: 8},
+		{name: "mixed", readers: 50, stalled: 50, buffer: 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseline := runtime.NumGoroutine()
+			b := newBroker(tt.buffer)
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+
+			subs := make([]*subscription, tt.readers+tt.stalled)
+			received := make([]int64, len(subs))
+			var readers sync.WaitGroup
+			for i := range subs {
+				subs[i], _ = b.Subscribe(ctx, "")
+				if i < tt.readers {
+					readers.Add(1)
+					go func() {
+						defer readers.Done()
+						for range subs[i].Events() {
+							received[i]++
+						}
+					}()
+				}
+			}
+
+			// However many subscribers stall, publishing never waits on them
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				var wg sync.WaitGroup
+				for p := range publishers {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := range events {
+							b.Publish(ReceiptEvent{ID: fmt.Sprintf("%d-%d", p, i)})
+						}
+					}()
+				}
+				wg.Wait()
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("publishers blocked")
+			}
+
+			// Ending the subscribers' context closes every channel
+			cancel()
+			readers.Wait()
+			for i, sub := range subs {
+				for range sub.Events() {
+					received[i]++
+				}
+				if got := received[i] + sub.Dropped(); got != publishers*events {
+					t.Errorf("subscriber %d received %d and dropped %d, want %d in all", i, received[i], sub.Dropped(), publishers*events)
+				}
+			}
+			if n := b.Subscribers(); n != 0 {
+				t.Errorf("subscribers = %d after cancelling, want 0", n)
+			}
+			if tt.stalled > 0 && b.Dropped() == 0 {
+				t.Error("no events dropped for stalled subscribers")
+			}
+			if tt.wantNoDrops && b.Dropped() != 0 {
+				t.Errorf("dropped %d events, want none", b.Dropped())
+			}
+
+			// Goroutines exit asynchronously, so allow them a moment
+			deadline := time.Now().Add(5 * time.Second)
+			for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := runtime.NumGoroutine(); n > baseline {
+				t.Errorf("%d goroutines after the test, %d before", n, baseline)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often buckets idle long enough to have
+// refilled are dropped. A dropped bucket is recreated full, so dropping it
+// changes nothing for its client.
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket is one client's allowance: it holds up to burst tokens, gains
+// rate of them every second, and each request spends one.
+type tokenBucket struct {
+	tokens float64
+	at     time.Time // when tokens was last brought up to date
+}
+
+// rateLimiter keeps a token bucket per client.
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+	clock Clock
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	sweptAt   time.Time
+	fullAfter time.Duration // how long an empty bucket takes to refill
+}
+
+// newRateLimiter returns a limiter allowing each client rate requests per
+// second, in bursts of up to burst.
+func newRateLimiter(rate float64, burst int, clock Clock) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		clock:     clock,
+		buckets:   make(map[string]*tokenBucket),
+		sweptAt:   clock.Now(),
+		fullAfter: time.Duration(float64(burst) / rate * float64(time.Second)),
+	}
+}
+
+// allow spends one of client's tokens. If none is left it reports how long
+// until one will be.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.sweptAt) >= rateLimitSweepInterval {
+		for key, b := range l.buckets {
+			if now.Sub(b.at) >= l.fullAfter {
+				delete(l.buckets, key)
+			}
+		}
+		l.sweptAt = now
+	}
+
+	b, found := l.buckets[client]
+	if !found {
+		b = &tokenBucket{tokens: l.burst, at: now}
+		l.buckets[client] = b
+	}
+	if elapsed := now.Sub(b.at); elapsed > 0 {
+		b.tokens = min(l.burst, b.tokens+elapsed.Seconds()*l.rate)
+		b.at = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateLimitClient names the bucket r is charged to: the API key or token
+// subject it authenticated with, or else the address it came from. Static
+// API keys are named by a hash, so the key itself is never held in memory
+// longer than the request.
+func rateLimitClient(r *http.Request) string {
+	if caller, ok := requestPrincipal(r); ok {
+		switch {
+		case caller.KeyID != "":
+			return "key:" + caller.KeyID
+		case caller.Subject != "":
+			return "sub:" + caller.Subject
+		}
+		if key := r.Header.Get(apiKeyHeader); key != "" {
+			sum := sha256.Sum256([]byte(key))
+			return "key:" + hex.EncodeToString(sum[:8])
+		}
+	}
+	return rateLimitAddress(r)
+}
+
+// rateLimitAddress names the bucket of the address r came from, whatever
+// credentials it carries.
+func rateLimitAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimitMiddleware rejects requests from clients that have used up their
+// allowance with 429 and a Retry-After header, charging each request to the
+// client that bucket names. The health probes are exempt, so that a busy load
+// balancer never sees an instance as down. Without a limiter it returns next
+// unchanged.
+func rateLimitMiddleware(next http.Handler, limiter *rateLimiter, bucket func(*http.Request) string, logger *slog.Logger) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := bucket(r)
+		if ok, wait := limiter.allow(client); !ok {
+			logger := requestLogger(r, logger)
+			logger.Warn("Rate limited request", slog.String("client", client), slog.String("path", r.URL.Path))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			errorResponse(w, http.StatusTooManyRequests, rateLimitedMsg, logger)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 // Receipt represents the JSON input structure.
@@ -17,14 +23,31 @@ type Receipt struct {
 	PurchaseTime string `json:"purchaseTime"`
 	Items        []Item `json:"items"`
 	Total        string `json:"total"`
+	Paperless    bool   `json:"paperless,omitempty"`  // digital receipt; optional
+	NoBag        bool   `json:"noBag,omitempty"`      // customer declined a bag; optional
+	CustomerID   string `json:"customerId,omitempty"` // identifies the customer for streaks; optional
+	UserID       string `json:"userId,omitempty"`     // the loyalty account credited with the points; optional
 }
 
+// maxCustomerIDLength bounds Receipt.CustomerID and Receipt.UserID.
+const maxCustomerIDLength = 128
+
 // Item represents a single item on the receipt.
 type Item struct {
 	ShortDescription string `json:"shortDescription"`
 	Price            string `json:"price"`
+	Quantity         *int   `json:"quantity,omitempty"` // units at Price each; 1 when absent
 }
 
+// maxItemQuantity bounds Item.Quantity, since each unit is expanded into a
+// separate validated item.
+const maxItemQuantity = 1000
+
+// maxReceiptUnits bounds the units of all a receipt's items together, each
+// line counting its quantity, so that many lines of large quantities cannot
+// expand into millions of validated items.
+const maxReceiptUnits = 1000
+
 // ValidatedReceiptData holds parsed data needed for point calculations.
 type ValidatedReceiptData struct {
 	Retailer      string
@@ -32,13 +55,133 @@ type ValidatedReceiptData struct {
 	PurchaseTime  time.Time
 	Items         []ValidatedItemData
 	Total         float64
-	OriginalItems int
+	TotalCents    int64
+	OriginalItems int // purchased items counted by Rule 4: quantities expanded, discounts (and, if configured, free items) excluded
+	Paperless     bool
+	NoBag         bool
+	CustomerID    string
+	// ConsecutiveDay is set by the caller, not by validation: it reports that
+	// the customer's previous purchase was the day before this one.
+	ConsecutiveDay bool
+	// FirstOfDay is also set by the caller: it reports that this receipt won
+	// its retailer's first-of-day bonus for the purchase date.
+	FirstOfDay bool
+	// ProcessedAt is set by the caller to when the receipt was submitted.
+	ProcessedAt time.Time
+
+	NoPurchaseTime bool     // the purchase time was unusable (PartialScoring only)
+	Warnings       []string // recoverable problems accepted under PartialScoring
+}
+
+// PurchasedAt combines the purchase date and time into one timestamp. Receipts
+// carry no time zone, so it is interpreted as UTC.
+func (d *ValidatedReceiptData) PurchasedAt() time.Time {
+	return d.PurchaseDate.Add(time.Duration(d.PurchaseTime.Hour())*time.Hour + time.Duration(d.PurchaseTime.Minute())*time.Minute)
+}
+
+// Fingerprint identifies the purchase a receipt describes, independent of how
+// the JSON was formatted: amounts are compared as cents and names ignore case
+// and surrounding whitespace. Two scans of the same paper receipt share it.
+func (d *ValidatedReceiptData) Fingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%d\n%s\n", normalizeRetailer(d.Retailer), d.PurchaseDate.Format("2006-01-02"), d.PurchaseTime.Format("15:04"), d.TotalCents, d.CustomerID)
+	for _, item := range d.Items {
+		fmt.Fprintf(h, "%s\t%d\n", strings.ToLower(strings.TrimSpace(item.ShortDescription)), item.PriceCents)
+	}
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 // ValidatedItemData holds parsed item data.
 type ValidatedItemData struct {
 	ShortDescription string
 	Price            float64
+	PriceCents       int64
+}
+
+// Supported values for Config.JSONNaming.
+const (
+	jsonNamingAny   = "any"   // accept camelCase and snake_case
+	jsonNamingCamel = "camel" // accept only the canonical camelCase names
+	jsonNamingSnake = "snake" // accept only snake_case names
+)
+
+// decodeReceipt reads a receipt from body, rejecting unknown fields. Unless
+// naming is jsonNamingCamel, snake_case field names are translated to their
+// camelCase equivalents first.
+func decodeReceipt(body io.Reader, naming string, receipt *Receipt) error {
+	if naming == jsonNamingCamel {
+		decoder := json.NewDecoder(body)
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(receipt)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return err
+	}
+	normalized, err := normalizeFieldNames(raw, naming)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(normalized)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(receipt)
+}
+
+// normalizeFieldNames rewrites the keys of a receipt (and of each entry in
+// its items array) to camelCase.
+func normalizeFieldNames(obj map[string]json.RawMessage, naming string) (map[string]json.RawMessage, error) {
+	out := make(map[string]json.RawMessage, len(obj))
+	for key, value := range obj {
+		if naming == jsonNamingSnake && strings.ToLower(key) != key {
+			// Mirror the DisallowUnknownFields message so describeDecodeError recognizes it
+			return nil, fmt.Errorf("json: unknown field %q", key)
+		}
+		name := snakeToCamel(key)
+		if _, dup := out[name]; dup {
+			return nil, fmt.Errorf("duplicate field %q", name)
+		}
+
+		if name == "items" {
+			var items []json.RawMessage
+			if err := json.Unmarshal(value, &items); err == nil {
+				for i, item := range items {
+					var itemObj map[string]json.RawMessage
+					if json.Unmarshal(item, &itemObj) != nil || itemObj == nil {
+						continue
+					}
+					normalizedItem, err := normalizeFieldNames(itemObj, naming)
+					if err != nil {
+						return nil, err
+					}
+					if items[i], err = json.Marshal(normalizedItem); err != nil {
+						return nil, err
+					}
+				}
+				if value, err = json.Marshal(items); err != nil {
+					return nil, err
+				}
+			}
+		}
+		out[name] = value
+	}
+	return out, nil
+}
+
+// snakeToCamel converts a snake_case name such as "purchase_date" to
+// "purchaseDate". Names without underscores are returned unchanged.
+func snakeToCamel(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
 }
 
 // Validation regular expressions and helpers.
@@ -50,31 +193,190 @@ var (
 	alphanumericCheck = func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
 )
 
+// maxAmountDecimals is the largest configurable number of decimal places
+// for prices and totals.
+const maxAmountDecimals = 6
+
+// amountRegexes holds the amount pattern for each number of decimal places,
+// with the API's N.NN format at index 2.
+var amountRegexes = func() []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, maxAmountDecimals+1)
+	for d := 1; d <= maxAmountDecimals; d++ {
+		patterns[d] = regexp.MustCompile(fmt.Sprintf(`^\d+\.\d{%d}$`, d))
+	}
+	patterns[2] = priceTotalRegex
+	return patterns
+}()
+
+// amountFormat describes the amount format for error messages, e.g. "N.NN".
+func amountFormat(decimals int) string {
+	return "N." + strings.Repeat("N", decimals)
+}
+
+// decimalsOrDefault maps an unset decimal-places setting to the API's 2.
+func decimalsOrDefault(decimals int) int {
+	if decimals == 0 {
+		return 2
+	}
+	return decimals
+}
+
+// normalizeAmount strips a leading plus sign and redundant leading zeros
+// from an amount, so "+35.00" becomes "35.00" and "00.50" becomes "0.50".
+// Anything it does not recognize is returned for the pattern to reject.
+func normalizeAmount(amount string) string {
+	amount = strings.TrimPrefix(amount, "+")
+	whole, frac, ok := strings.Cut(amount, ".")
+	if !ok || whole == "" {
+		return amount
+	}
+	if whole = strings.TrimLeft(whole, "0"); whole == "" {
+		whole = "0"
+	}
+	return whole + "." + frac
+}
+
+// parseFixed splits an amount matching one of amountRegexes into its digits
+// as an integer and its number of decimal places: "1.333" is (1333, 3).
+func parseFixed(amount string) (int64, int, error) {
+	whole, frac, _ := strings.Cut(amount, ".")
+	value, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("amount out of range")
+	}
+	return value, len(frac), nil
+}
+
+// fixedToCents converts quantity units of a fixed-point amount into cents,
+// rounding half up when the amount has more than two decimal places.
+func fixedToCents(value int64, scale int, quantity int64) (int64, error) {
+	if quantity > 1 && value > math.MaxInt64/quantity {
+		return 0, fmt.Errorf("amount out of range")
+	}
+	value *= quantity
+	for ; scale < 2; scale++ {
+		if value > math.MaxInt64/10 {
+			return 0, fmt.Errorf("amount out of range")
+		}
+		value *= 10
+	}
+	if scale == 2 {
+		return value, nil
+	}
+	divisor := int64(math.Pow10(scale - 2))
+	return value/divisor + (value%divisor*2)/divisor, nil
+}
+
+// formatCents renders integer cents as a two-decimal amount, e.g. 5 as
+// "0.05" and -123456 as "-1234.56".
+func formatCents(cents int64) string {
+	sign := ""
+	u := uint64(cents)
+	if cents < 0 {
+		sign = "-"
+		u = -u
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, u/100, u%100)
+}
+
+// parseCents converts an amount matching one of amountRegexes into integer
+// cents, avoiding float rounding.
+func parseCents(amount string) (int64, error) {
+	value, scale, err := parseFixed(amount)
+	if err != nil {
+		return 0, err
+	}
+	return fixedToCents(value, scale, 1)
+}
+
+// isCleanUTF8 reports whether s is valid UTF-8 that did not come from invalid
+// input. encoding/json silently replaces invalid bytes with U+FFFD, so the
+// replacement character is treated as corrupt data too.
+func isCleanUTF8(s string) bool {
+	return utf8.ValidString(s) && !strings.ContainsRune(s, utf8.RuneError)
+}
+
 // validateAndParseReceipt checks the input receipt's format and structure,
 // returning parsed data or an error.
-func validateAndParseReceipt(receipt *Receipt) (*ValidatedReceiptData, error) {
+func validateAndParseReceipt(receipt *Receipt, cfg ValidationConfig) (*ValidatedReceiptData, error) {
+	if !isCleanUTF8(receipt.Retailer) {
+		return nil, fmt.Errorf("retailer contains invalid UTF-8")
+	}
+	if receipt.Retailer == "" {
+		return nil, fmt.Errorf("retailer required")
+	}
+	// \s in retailerRegex lets a whitespace-only name through, which earns no
+	// Rule 1 points and is almost certainly a client bug.
+	if strings.TrimSpace(receipt.Retailer) == "" && !cfg.AllowBlankRetailer {
+		return nil, fmt.Errorf("retailer cannot be only whitespace")
+	}
+	// Measured in runes so multi-byte characters count once; every extra
+	// character could otherwise earn another Rule 1 point.
+	if cfg.MaxRetailerLength > 0 && utf8.RuneCountInString(receipt.Retailer) > cfg.MaxRetailerLength {
+		return nil, fmt.Errorf("retailer exceeds maximum length")
+	}
 	if !retailerRegex.MatchString(receipt.Retailer) {
 		return nil, fmt.Errorf("invalid retailer format")
 	}
-	purchaseDate, err := time.Parse("2006-01-02", receipt.PurchaseDate)
+	purchaseDate, err := parseStrict("2006-01-02", receipt.PurchaseDate, cfg.StrictDateTime)
 	if err != nil {
 		return nil, fmt.Errorf("invalid purchaseDate format (YYYY-MM-DD)")
 	}
-	purchaseTime, err := time.Parse("15:04", receipt.PurchaseTime)
+	// With PartialScoring, fields that only feed optional rules degrade to a
+	// warning and the rules that need them score nothing.
+	var warnings []string
+	purchaseTime, err := parseStrict("15:04", receipt.PurchaseTime, cfg.StrictDateTime)
+	noPurchaseTime := err != nil
+	if noPurchaseTime {
+		if !cfg.PartialScoring {
+			return nil, fmt.Errorf("invalid purchaseTime format (HH:MM)")
+		}
+		warnings = append(warnings, "invalid purchaseTime format (HH:MM); time-based rules skipped")
+	}
+	customerID := receipt.CustomerID
+	if customerID != "" && (len(customerID) > maxCustomerIDLength || !idPatternRegex.MatchString(customerID)) {
+		if !cfg.PartialScoring {
+			return nil, fmt.Errorf("invalid customerId format")
+		}
+		warnings = append(warnings, "invalid customerId format; streak bonus skipped")
+		customerID = ""
+	}
+	if userID := receipt.UserID; userID != "" && !validUserID(userID) {
+		return nil, fmt.Errorf("invalid userId format")
+	}
+	total := receipt.Total
+	if cfg.LenientAmounts {
+		total = normalizeAmount(total)
+	}
+	totalDecimals := decimalsOrDefault(cfg.TotalDecimals)
+	if !amountRegexes[totalDecimals].MatchString(total) {
+		return nil, fmt.Errorf("invalid total format (%s)", amountFormat(totalDecimals))
+	}
+	totalFloat, _ := strconv.ParseFloat(total, 64)
+	totalCents, err := parseCents(total)
 	if err != nil {
-		return nil, fmt.Errorf("invalid purchaseTime format (HH:MM)")
+		return nil, fmt.Errorf("invalid total value")
 	}
-	if !priceTotalRegex.MatchString(receipt.Total) {
-		return nil, fmt.Errorf("invalid total format (N.NN)")
+	if totalCents < cfg.MinTotalCents {
+		return nil, fmt.Errorf("total is below minimum allowed value")
+	}
+	if cfg.MaxTotalCents > 0 && totalCents > cfg.MaxTotalCents {
+		return nil, fmt.Errorf("total exceeds maximum allowed value")
 	}
-	totalFloat, _ := strconv.ParseFloat(receipt.Total, 64)
 
 	if receipt.Items == nil || len(receipt.Items) == 0 {
 		return nil, fmt.Errorf("items array cannot be empty")
 	}
 
+	priceDecimals := decimalsOrDefault(cfg.ItemPriceDecimals)
 	var validatedItems []ValidatedItemData
+	var itemsCents int64 // sum of each line's price times quantity, rounded per line
+	purchasedItems := 0  // item count excluding discount lines
+	freeItems := 0       // zero-price items left out of Rule 4
 	for i, item := range receipt.Items {
+		if !isCleanUTF8(item.ShortDescription) {
+			return nil, fmt.Errorf("item %d: shortDescription contains invalid UTF-8", i)
+		}
 		trimmedDesc := strings.TrimSpace(item.ShortDescription)
 		if trimmedDesc == "" {
 			return nil, fmt.Errorf("item %d: shortDescription required", i)
@@ -83,14 +385,79 @@ func validateAndParseReceipt(receipt *Receipt) (*ValidatedReceiptData, error) {
 			return nil, fmt.Errorf("item %d: invalid shortDescription format", i)
 		}
 
-		if !priceTotalRegex.MatchString(item.Price) {
-			return nil, fmt.Errorf("item %d: invalid price format (N.NN)", i)
+		price := item.Price
+		// A discount line carries a negative price
+		discount := cfg.AllowDiscounts && strings.HasPrefix(price, "-")
+		if discount {
+			price = price[1:]
+		}
+		if cfg.LenientAmounts {
+			price = normalizeAmount(price)
+		}
+		if !amountRegexes[priceDecimals].MatchString(price) {
+			return nil, fmt.Errorf("item %d: invalid price format (%s)", i, amountFormat(priceDecimals))
+		}
+		priceFloat, _ := strconv.ParseFloat(price, 64)
+		priceFixed, priceScale, err := parseFixed(price)
+		if err != nil {
+			return nil, fmt.Errorf("item %d: invalid price value", i)
+		}
+		priceCents, _ := fixedToCents(priceFixed, priceScale, 1)
+		if !discount && cfg.MaxPriceCents > 0 && priceCents > cfg.MaxPriceCents {
+			return nil, fmt.Errorf("item %d: price exceeds maximum allowed value", i)
+		}
+		if priceFixed == 0 && cfg.ZeroPriceItems == zeroPriceReject {
+			return nil, fmt.Errorf("item %d: price must be greater than zero", i)
+		}
+
+		quantity := 1
+		if item.Quantity != nil {
+			quantity = *item.Quantity
+			if quantity < 1 || quantity > maxItemQuantity {
+				return nil, fmt.Errorf("item %d: quantity must be between 1 and %d", i, maxItemQuantity)
+			}
+		}
+		if len(validatedItems)+quantity > maxReceiptUnits {
+			return nil, fmt.Errorf("item %d: items exceed %d units in total", i, maxReceiptUnits)
+		}
+		lineCents, err := fixedToCents(priceFixed, priceScale, int64(quantity))
+		if err != nil || itemsCents > math.MaxInt64-lineCents {
+			return nil, fmt.Errorf("item %d: invalid price value", i)
+		}
+		if discount {
+			itemsCents -= lineCents
+			priceFloat, priceCents = -priceFloat, -priceCents
+		} else {
+			itemsCents += lineCents
+			purchasedItems += quantity
+			if priceFixed == 0 && cfg.ZeroPriceItems == zeroPriceExclude {
+				freeItems += quantity
+			}
+		}
+		// A quantity-N line scores exactly like N separate entries
+		for range quantity {
+			validatedItems = append(validatedItems, ValidatedItemData{
+				ShortDescription: item.ShortDescription,
+				Price:            priceFloat,
+				PriceCents:       priceCents,
+			})
+		}
+	}
+
+	// Catches clients sending a line total or a price in cents where a unit
+	// price was expected. Compared without multiplying, so it cannot overflow.
+	if cfg.MaxAveragePriceCents > 0 && purchasedItems > 0 {
+		items := int64(purchasedItems)
+		average, remainder := totalCents/items, totalCents%items
+		if average > cfg.MaxAveragePriceCents || (average == cfg.MaxAveragePriceCents && remainder > 0) {
+			return nil, fmt.Errorf("average item price exceeds maximum allowed value")
+		}
+	}
+
+	if cfg.StrictTotal {
+		if itemsCents != totalCents {
+			return nil, fmt.Errorf("total does not match the sum of item prices")
 		}
-		priceFloat, _ := strconv.ParseFloat(item.Price, 64)
-		validatedItems = append(validatedItems, ValidatedItemData{
-			ShortDescription: item.ShortDescription,
-			Price:            priceFloat,
-		})
 	}
 
 	return &ValidatedReceiptData{
@@ -99,55 +466,149 @@ func validateAndParseReceipt(receipt *Receipt) (*ValidatedReceiptData, error) {
 		PurchaseTime:  purchaseTime,
 		Items:         validatedItems,
 		Total:         totalFloat,
-		OriginalItems: len(receipt.Items),
+		TotalCents:    totalCents,
+		OriginalItems: purchasedItems - freeItems,
+		Paperless:     receipt.Paperless,
+		NoBag:         receipt.NoBag,
+		CustomerID:    customerID,
+
+		NoPurchaseTime: noPurchaseTime,
+		Warnings:       warnings,
 	}, nil
 }
 
-// calculatePoints computes the points awarded based on the defined rules.
-func calculatePoints(data *ValidatedReceiptData) int64 {
-	var points int64 = 0
-	const floatEpsilon = 0.0000001
-
-	// Rule 1: Alphanumeric characters in retailer name
-	retailerPoints := 0
-	for _, r := range data.Retailer {
-		if alphanumericCheck(r) {
-			retailerPoints++
-		}
+// checkPurchaseDate rejects purchases dated before cfg.EarliestPurchaseDate
+// or, if configured, more than cfg.MaxFutureSkew after now. It is separate
+// from validateAndParseReceipt, which does not depend on the current time, so
+// only new submissions are checked and stored receipts rescore unchanged.
+func checkPurchaseDate(data *ValidatedReceiptData, cfg ValidationConfig, now time.Time) error {
+	if data.PurchaseDate.Before(cfg.EarliestPurchaseDate) {
+		return fmt.Errorf("purchaseDate is before the earliest accepted date")
 	}
-	points += int64(retailerPoints)
-
-	// Rule 2: Round dollar total
-	if math.Abs(data.Total-math.Trunc(data.Total)) < floatEpsilon && data.Total > 0 {
-		points += 50
+	// Without a usable time the purchase is taken to be at midnight
+	purchasedAt := data.PurchaseDate
+	if !data.NoPurchaseTime {
+		purchasedAt = data.PurchasedAt()
+	}
+	if cfg.RejectFuturePurchases && purchasedAt.After(now.Add(cfg.MaxFutureSkew)) {
+		return fmt.Errorf("purchaseDate is in the future")
 	}
+	return nil
+}
 
-	// Rule 3: Total is a multiple of 0.25
-	if math.Abs(math.Mod(data.Total, 0.25)) < floatEpsilon || math.Abs(math.Mod(data.Total, 0.25)-0.25) < floatEpsilon {
-		points += 25
+// parseStrict parses value with time.Parse. When strict, it also requires the
+// result to format back to exactly value, rejecting input that time.Parse
+// accepts loosely, such as a single-digit hour ("9:05" for "15:04").
+func parseStrict(layout, value string, strict bool) (time.Time, error) {
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return t, err
 	}
+	if strict && t.Format(layout) != value {
+		return time.Time{}, fmt.Errorf("%q does not round-trip as %q", value, layout)
+	}
+	return t, nil
+}
 
-	// Rule 4: 5 points per two items
-	points += int64(data.OriginalItems/2) * 5
+// Rule names reported in a points breakdown.
+const (
+	ruleRetailerName    = "retailer_alphanumeric"
+	ruleRoundDollar     = "round_dollar_total"
+	ruleQuarterMultiple = "quarter_multiple_total"
+	ruleItemPairs       = "item_pairs"
+	ruleDescription     = "item_description_length"
+	rulePurchaseDay     = "purchase_day"
+	rulePurchaseTime    = "afternoon_purchase_time"
+	rulePaperless       = "paperless_bonus"
+	ruleNoBag           = "no_bag_bonus"
+	ruleStreak          = "streak_bonus"
+	ruleFreshness       = "freshness_bonus"
+	rulePromoted        = "promoted_items"
+	ruleFirstOfDay      = "first_of_day_bonus"
+	ruleItemTier        = "item_count_tier"
+)
 
-	// Rule 5: Item description length multiple of 3
-	for _, item := range data.Items {
-		trimmedDesc := strings.TrimSpace(item.ShortDescription)
-		if len(trimmedDesc) > 0 && len(trimmedDesc)%3 == 0 {
-			points += int64(math.Ceil(item.Price * 0.2))
-		}
+// rulesRevision is bumped whenever the scoring code itself changes.
+const rulesRevision = "1"
+
+// ruleVersion identifies the rules that score a receipt: the code revision
+// plus a hash of the points configuration, so a config change is visible too.
+func ruleVersion(cfg PointsConfig) string {
+	buf, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(buf)
+	return rulesRevision + "-" + hex.EncodeToString(sum[:4])
+}
+
+// RuleResult is the contribution of a single rule to a receipt's points.
+type RuleResult struct {
+	Rule   string `json:"rule"`
+	Points int64  `json:"points"`
+}
+
+// calculatePoints computes the points awarded based on the defined rules.
+func calculatePoints(data *ValidatedReceiptData, cfg PointsConfig) int64 {
+	return sumBreakdown(calculatePointsBreakdown(data, cfg))
+}
+
+// sumBreakdown totals the contributions of a breakdown.
+func sumBreakdown(breakdown []RuleResult) int64 {
+	var points int64 = 0
+	for _, r := range breakdown {
+		points += r.Points
 	}
+	return points
+}
 
-	// Rule 6: Odd purchase day
-	if data.PurchaseDate.Day()%2 != 0 {
-		points += 6
+// promotedItemBonus returns the bonus for one item description. When several
+// substrings match, only the longest (most specific) applies, so "diet cola"
+// overrides "cola" rather than adding to it; equal lengths take the larger bonus.
+func promotedItemBonus(description string, promotions map[string]int64) int64 {
+	description = strings.ToLower(description)
+	var best string
+	var bonus int64
+	matched := false
+	for substring, points := range promotions {
+		if !strings.Contains(description, substring) {
+			continue
+		}
+		if !matched || len(substring) > len(best) || (len(substring) == len(best) && points > bonus) {
+			best, bonus, matched = substring, points, true
+		}
 	}
+	return bonus
+}
 
-	// Rule 7: Purchase time between 14:00 and 16:00 (exclusive interval)
-	timeInMinutes := data.PurchaseTime.Hour()*60 + data.PurchaseTime.Minute()
-	if timeInMinutes > 840 && timeInMinutes < 960 {
-		points += 10
+// itemTierBonus returns the bonus of the highest tier that items reaches, or
+// when cumulative, the sum of every tier it reaches. Tiers may be in any order.
+func itemTierBonus(items int, tiers []ItemTier, cumulative bool) int64 {
+	var bonus int64
+	best := 0
+	for _, tier := range tiers {
+		if items < tier.MinItems {
+			continue
+		}
+		if cumulative {
+			bonus += tier.Bonus
+		} else if tier.MinItems > best {
+			best, bonus = tier.MinItems, tier.Bonus
+		}
 	}
+	return bonus
+}
 
-	return points
+// calculatePointsBreakdown computes each enabled rule's contribution, as
+// adjusted by any override for the retailer, in rule order, followed by that
+// of each promotion covering the receipt. Every enabled rule is listed,
+// including those that awarded nothing.
+func calculatePointsBreakdown(data *ValidatedReceiptData, cfg PointsConfig) []RuleResult {
+	rules := pointRules(cfg)
+	override := retailerOverride(cfg.RetailerOverrides, data.Retailer)
+	breakdown := make([]RuleResult, 0, len(rules))
+	for _, rule := range rules {
+		breakdown = append(breakdown, RuleResult{Rule: rule.Name(), Points: override.adjust(rule.Name(), rule.Apply(data))})
+	}
+	if len(cfg.Promotions) > 0 {
+		breakdown = append(breakdown, promotionResults(data, cfg.Promotions, sumBreakdown(breakdown))...)
+	}
+	return breakdown
 }
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// singleItemReceipt returns a valid one-item receipt whose item costs price
+// and whose total is total.
+func singleItemReceipt(price, total string) Receipt {
+	receipt := testReceipt()
+	receipt.Items = []Item{{ShortDescription: "Widget", Price: price}}
+	receipt.Total = total
+	return receipt
+}
+
+func TestValidateAmountCaps(t *testing.T) {
+	caps := ValidationConfig{MaxPriceCents: 10000, MaxTotalCents: 50000}
+	tests := []struct {
+		name    string
+		cfg     ValidationConfig
+		price   string
+		total   string
+		wantErr string
+	}{
+		{name: "below the caps", cfg: caps, price: "99.99", total: "499.99"},
+		{name: "price at its cap", cfg: caps, price: "100.00", total: "100.00"},
+		{name: "price above its cap", cfg: caps, price: "100.01", total: "100.01", wantErr: "item 0: price exceeds maximum allowed value"},
+		{name: "total at its cap", cfg: caps, price: "1.00", total: "500.00"},
+		{name: "total above its cap", cfg: caps, price: "1.00", total: "500.01", wantErr: "total exceeds maximum allowed value"},
+		{name: "unbounded by default", price: "999999999.99", total: "999999999.99"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := singleItemReceipt(tt.price, tt.total)
+			_, err := validateAndParseReceipt(&receipt, tt.cfg)
+			checkValidationError(t, err, tt.wantErr)
+		})
+	}
+}
+
+// checkValidationError fails the test unless err has the message want, or
+// is nil when want is empty.
+func checkValidationError(t *testing.T, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Errorf("validateAndParseReceipt: unexpected error %v", err)
+	case want != "" && err == nil:
+		t.Errorf("validateAndParseReceipt accepted the receipt, want error %q", want)
+	case want != "" && err.Error() != want:
+		t.Errorf("validateAndParseReceipt error = %q, want %q", err, want)
+	}
+}
+
+func BenchmarkValidateAndParseReceipt(b *testing.B) {
+	for _, bm := range benchmarkReceipts() {
+		b.Run(bm.name, func(b *testing.B) {
+			for b.Loop() {
+				if _, err := validateAndParseReceipt(&bm.receipt, ValidationConfig{StrictTotal: true}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestItemQuantity(t *testing.T) {
+	quantity := func(n int) *int { return &n }
+	separate := testReceipt()
+	separate.Items = []Item{
+		{ShortDescription: "Gatorade", Price: "2.25"},
+		{ShortDescription: "Gatorade", Price: "2.25"},
+		{ShortDescription: "Gatorade", Price: "2.25"},
+		{ShortDescription: "Dasani", Price: "1.40"},
+	}
+	separate.Total = "8.15"
+	want, err := validateAndParseReceipt(&separate, ValidationConfig{StrictTotal: true})
+	if err != nil {
+		t.Fatalf("validateAndParseReceipt of separate items: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		items   []Item
+		total   string
+		wantErr string
+	}{
+		{name: "quantity 3", items: []Item{{ShortDescription: "Gatorade", Price: "2.25", Quantity: quantity(3)}, {ShortDescription: "Dasani", Price: "1.40"}}, total: "8.15"},
+		{name: "quantity 1 and absent", items: []Item{{ShortDescription: "Gatorade", Price: "2.25", Quantity: quantity(2)}, {ShortDescription: "Gatorade", Price: "2.25", Quantity: quantity(1)}, {ShortDescription: "Dasani", Price: "1.40"}}, total: "8.15"},
+		{name: "total short of the extended price", items: []Item{{ShortDescription: "Gatorade", Price: "2.25", Quantity: quantity(3)}, {ShortDescription: "Dasani", Price: "1.40"}}, total: "3.65", wantErr: "total does not match the sum of item prices"},
+		{name: "zero quantity", items: []Item{{ShortDescription: "Gatorade", Price: "2.25", Quantity: quantity(0)}}, total: "0.00", wantErr: "item 0: quantity must be between 1 and 1000"},
+		{name: "excessive quantity", items: []Item{{ShortDescription: "Gatorade", Price: "2.25", Quantity: quantity(maxItemQuantity + 1)}}, total: "2252.25", wantErr: "item 0: quantity must be between 1 and 1000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.Items, receipt.Total = tt.items, tt.total
+			got, err := validateAndParseReceipt(&receipt, ValidationConfig{StrictTotal: true})
+			checkValidationError(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+			if got.OriginalItems != want.OriginalItems || len(got.Items) != len(want.Items) {
+				t.Errorf("items counted %d (%d expanded), want %d (%d)", got.OriginalItems, len(got.Items), want.OriginalItems, len(want.Items))
+			}
+			gotBreakdown, wantBreakdown := calculatePointsBreakdown(got, defaultPointsConfig()), calculatePointsBreakdown(want, defaultPointsConfig())
+			if !slices.Equal(gotBreakdown, wantBreakdown) {
+				t.Errorf("breakdown = %v, want that of separate items %v", gotBreakdown, wantBreakdown)
+			}
+		})
+	}
+}
+
+func TestReceiptUnits(t *testing.T) {
+	quantity := func(n int) *int { return &n }
+	many := make([]Item, maxReceiptUnits+1)
+	for i := range many {
+		many[i] = Item{ShortDescription: "Dasani", Price: "1.00"}
+	}
+	tests := []struct {
+		name      string
+		items     []Item
+		total     string
+		wantErr   string
+		wantUnits int
+	}{
+		{name: "quantities up to the limit", items: []Item{{ShortDescription: "Gatorade", Price: "1.00", Quantity: quantity(600)}, {ShortDescription: "Dasani", Price: "1.00", Quantity: quantity(399)}, {ShortDescription: "Dasani", Price: "1.00"}}, total: "1000.00", wantUnits: 1000},
+		{name: "quantities over the limit", items: []Item{{ShortDescription: "Gatorade", Price: "1.00", Quantity: quantity(600)}, {ShortDescription: "Dasani", Price: "1.00", Quantity: quantity(400)}, {ShortDescription: "Dasani", Price: "1.00"}}, total: "1001.00", wantErr: "item 2: items exceed 1000 units in total"},
+		{name: "many lines of the largest quantity", items: []Item{{ShortDescription: "Gatorade", Price: "1.00", Quantity: quantity(maxItemQuantity)}, {ShortDescription: "Gatorade", Price: "1.00", Quantity: quantity(maxItemQuantity)}}, total: "2000.00", wantErr: "item 1: items exceed 1000 units in total"},
+		{name: "lines over the limit", items: many, total: "1001.00", wantErr: "item 1000: items exceed 1000 units in total"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.Items, receipt.Total = tt.items, tt.total
+			got, err := validateAndParseReceipt(&receipt, ValidationConfig{})
+			checkValidationError(t, err, tt.wantErr)
+			if err == nil && len(got.Items) != tt.wantUnits {
+				t.Errorf("%d items validated, want %d", len(got.Items), tt.wantUnits)
+			}
+		})
+	}
+}
+
+func TestDecodeReceiptNaming(t *testing.T) {
+	const camel = `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","total":"1.25","customerId":"c1","items":[{"shortDescription":"Pepsi","price":"1.25"}]}`
+	const snake = `{"retailer":"Target","purchase_date":"2022-01-01","purchase_time":"13:01","total":"1.25","customer_id":"c1","items":[{"short_description":"Pepsi","price":"1.25"}]}`
+	const mixed = `{"retailer":"Target","purchase_date":"2022-01-01","purchaseTime":"13:01","total":"1.25","customerId":"c1","items":[{"short_description":"Pepsi","price":"1.25"}]}`
+	const duplicate = `{"retailer":"Target","purchase_date":"2022-01-01","purchaseDate":"2022-01-02","purchaseTime":"13:01","total":"1.25","items":[{"shortDescription":"Pepsi","price":"1.25"}]}`
+	want := Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items:        []Item{{ShortDescription: "Pepsi", Price: "1.25"}},
+		Total:        "1.25",
+		CustomerID:   "c1",
+	}
+	tests := []struct {
+		name    string
+		naming  string
+		body    string
+		wantErr bool
+	}{
+		{name: "camelCase, any naming", naming: jsonNamingAny, body: camel},
+		{name: "snake_case, any naming", naming: jsonNamingAny, body: snake},
+		{name: "mixed, any naming", naming: jsonNamingAny, body: mixed},
+		{name: "camelCase, camel naming", naming: jsonNamingCamel, body: camel},
+		{name: "snake_case, camel naming", naming: jsonNamingCamel, body: snake, wantErr: true},
+		{name: "snake_case, snake naming", naming: jsonNamingSnake, body: snake},
+		{name: "camelCase, snake naming", naming: jsonNamingSnake, body: camel, wantErr: true},
+		{name: "both spellings of a field", naming: jsonNamingAny, body: duplicate, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Receipt
+			err := decodeReceipt(strings.NewReader(tt.body), tt.naming, &got)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decodeReceipt accepted %s", tt.body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeReceipt: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestValidateInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		name        string
+		retailer    string
+		description string
+		wantErr     string
+	}{
+		{name: "invalid byte in retailer", retailer: "Tar\xffget", description: "Pepsi", wantErr: "retailer contains invalid UTF-8"},
+		{name: "replacement character in retailer", retailer: "Tar�get", description: "Pepsi", wantErr: "retailer contains invalid UTF-8"},
+		{name: "truncated sequence in retailer", retailer: "Target\xe2\x82", description: "Pepsi", wantErr: "retailer contains invalid UTF-8"},
+		{name: "invalid byte in description", retailer: "Target", description: "Pep\xffsi", wantErr: "item 0: shortDescription contains invalid UTF-8"},
+		{name: "clean", retailer: "Target", description: "Pepsi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := singleItemReceipt("1.25", "1.25")
+			receipt.Retailer, receipt.Items[0].ShortDescription = tt.retailer, tt.description
+			_, err := validateAndParseReceipt(&receipt, ValidationConfig{})
+			checkValidationError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateMinimumTotal(t *testing.T) {
+	tests := []struct {
+		name    string
+		min     int64
+		total   string
+		wantErr string
+	}{
+		{name: "below the minimum", min: 100, total: "0.99", wantErr: "total is below minimum allowed value"},
+		{name: "at the minimum", min: 100, total: "1.00"},
+		{name: "above the minimum", min: 100, total: "1.01"},
+		{name: "no minimum", min: 0, total: "0.01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := singleItemReceipt(tt.total, tt.total)
+			_, err := validateAndParseReceipt(&receipt, ValidationConfig{MinTotalCents: tt.min})
+			checkValidationError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestItemPriceDecimals(t *testing.T) {
+	three := ValidationConfig{ItemPriceDecimals: 3, StrictTotal: true}
+	tests := []struct {
+		name      string
+		cfg       ValidationConfig
+		price     string
+		quantity  int
+		total     string
+		wantErr   string
+		wantCents int64 // of the item's unit price
+	}{
+		{name: "3 decimals by default", price: "1.333", total: "1.33", wantErr: "item 0: invalid price format (N.NN)"},
+		{name: "3 decimals allowed", cfg: three, price: "1.333", total: "1.33", wantCents: 133},
+		{name: "unit price rounds half up", cfg: three, price: "1.335", total: "1.34", wantCents: 134},
+		{name: "line rounded after the quantity", cfg: three, price: "1.333", quantity: 3, total: "4.00", wantCents: 133},
+		{name: "exactly 3 decimals required", cfg: three, price: "1.33", total: "1.33", wantErr: "item 0: invalid price format (N.NNN)"},
+		{name: "total keeps its own precision", cfg: three, price: "1.333", total: "1.333", wantErr: "invalid total format (N.NN)"},
+		{name: "total precision set alone", cfg: ValidationConfig{TotalDecimals: 3}, price: "1.33", total: "1.330", wantCents: 133},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := singleItemReceipt(tt.price, tt.total)
+			if tt.quantity != 0 {
+				receipt.Items[0].Quantity = &tt.quantity
+			}
+			data, err := validateAndParseReceipt(&receipt, tt.cfg)
+			checkValidationError(t, err, tt.wantErr)
+			if err == nil && data.Items[0].PriceCents != tt.wantCents {
+				t.Errorf("PriceCents = %d, want %d", data.Items[0].PriceCents, tt.wantCents)
+			}
+		})
+	}
+}
+
+func TestLoadAmountDecimals(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantPrice int
+		wantErr   bool
+	}{
+		{value: "", wantPrice: 2},
+		{value: "3", wantPrice: 3},
+		{value: "6", wantPrice: 6},
+		{value: "0", wantErr: true},
+		{value: "7", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("ITEM_PRICE_DECIMALS", tt.value)
+			cfg, err := loadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadConfig accepted ITEM_PRICE_DECIMALS=%q", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if cfg.Validation.ItemPriceDecimals != tt.wantPrice || cfg.Validation.TotalDecimals != 2 {
+				t.Errorf("decimals = %d for prices, %d for the total; want %d and 2", cfg.Validation.ItemPriceDecimals, cfg.Validation.TotalDecimals, tt.wantPrice)
+			}
+		})
+	}
+}
+
+func TestLenientAmounts(t *testing.T) {
+	tests := []struct {
+		amount        string
+		wantNormal    string
+		wantCents     int64
+		wantStrictErr bool // rejected without LenientAmounts; the pattern allows leading zeros
+	}{
+		{amount: "+35.00", wantNormal: "35.00", wantCents: 3500, wantStrictErr: true},
+		{amount: "035.35", wantNormal: "35.35", wantCents: 3535},
+		{amount: "0.50", wantNormal: "0.50", wantCents: 50},
+		{amount: "00.50", wantNormal: "0.50", wantCents: 50},
+		{amount: "+000.00", wantNormal: "0.00", wantCents: 0, wantStrictErr: true},
+		{amount: "35.35", wantNormal: "35.35", wantCents: 3535},
+	}
+	for _, tt := range tests {
+		t.Run(tt.amount, func(t *testing.T) {
+			if got := normalizeAmount(tt.amount); got != tt.wantNormal {
+				t.Errorf("normalizeAmount = %q, want %q", got, tt.wantNormal)
+			}
+			receipt := singleItemReceipt(tt.amount, tt.amount)
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{LenientAmounts: true, StrictTotal: true})
+			if err != nil {
+				t.Fatalf("lenient: validateAndParseReceipt: %v", err)
+			}
+			if data.TotalCents != tt.wantCents || data.Items[0].PriceCents != tt.wantCents {
+				t.Errorf("lenient: total %d cents, price %d cents; want %d", data.TotalCents, data.Items[0].PriceCents, tt.wantCents)
+			}
+			_, err = validateAndParseReceipt(&receipt, ValidationConfig{})
+			if (err != nil) != tt.wantStrictErr {
+				t.Errorf("strict: error = %v, want error %v", err, tt.wantStrictErr)
+			}
+		})
+	}
+}
+
+func TestLenientAmountsStillRejects(t *testing.T) {
+	for _, amount := range []string{"-35.00", "++35.00", "35", ".50", "+.50", "35.5", "3 5.00"} {
+		t.Run(amount, func(t *testing.T) {
+			receipt := singleItemReceipt("35.00", amount)
+			checkValidationError(t, func() error {
+				_, err := validateAndParseReceipt(&receipt, ValidationConfig{LenientAmounts: true})
+				return err
+			}(), "invalid total format (N.NN)")
+		})
+	}
+}
+
+func TestFormatCents(t *testing.T) {
+	tests := []struct {
+		cents int64
+		want  string
+	}{
+		{cents: 0, want: "0.00"},
+		{cents: 5, want: "0.05"},
+		{cents: 50, want: "0.50"},
+		{cents: 100, want: "1.00"},
+		{cents: 123456, want: "1234.56"},
+		{cents: -5, want: "-0.05"},
+		{cents: -123456, want: "-1234.56"},
+		{cents: math.MaxInt64, want: "92233720368547758.07"},
+		{cents: math.MinInt64, want: "-92233720368547758.08"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatCents(tt.cents); got != tt.want {
+				t.Errorf("formatCents(%d) = %q, want %q", tt.cents, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateBlankRetailer(t *testing.T) {
+	tests := []struct {
+		name       string
+		retailer   string
+		allowBlank bool
+		wantErr    string
+		wantPoints int64 // for Rule 1
+	}{
+		{name: "empty", retailer: "", wantErr: "retailer required"},
+		{name: "empty, blank allowed", retailer: "", allowBlank: true, wantErr: "retailer required"},
+		{name: "whitespace", retailer: "   ", wantErr: "retailer cannot be only whitespace"},
+		{name: "whitespace, blank allowed", retailer: "   ", allowBlank: true},
+		{name: "valid name", retailer: "Target", wantPoints: 6},
+		{name: "valid name, blank allowed", retailer: "Target", allowBlank: true, wantPoints: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.Retailer = tt.retailer
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{AllowBlankRetailer: tt.allowBlank})
+			checkValidationError(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+			if got, _ := rulePoints(calculatePointsBreakdown(data, defaultPointsConfig()), ruleRetailerName); got != tt.wantPoints {
+				t.Errorf("%s = %d, want %d", ruleRetailerName, got, tt.wantPoints)
+			}
+		})
+	}
+}
+
+func TestDiscountLines(t *testing.T) {
+	withDiscount := func(price, total string) Receipt {
+		receipt := testReceipt()
+		// "Coupon" is six characters, so a priced line would earn Rule 5 points
+		receipt.Items = append(receipt.Items, Item{ShortDescription: "Coupon", Price: price})
+		receipt.Total = total
+		return receipt
+	}
+	tests := []struct {
+		name       string
+		receipt    Receipt
+		cfg        ValidationConfig
+		wantErr    string
+		wantPoints int64
+	}{
+		{name: "discounts not allowed", receipt: withDiscount("-5.00", "30.35"), wantErr: "item 5: invalid price format (N.NN)"},
+		{name: "reconciled", receipt: withDiscount("-5.00", "30.35"), cfg: ValidationConfig{AllowDiscounts: true, StrictTotal: true}, wantPoints: 28},
+		{name: "total ignores the discount", receipt: withDiscount("-5.00", "35.35"), cfg: ValidationConfig{AllowDiscounts: true, StrictTotal: true}, wantErr: "total does not match the sum of item prices"},
+		{name: "unreconciled", receipt: withDiscount("-5.00", "35.35"), cfg: ValidationConfig{AllowDiscounts: true}, wantPoints: 28},
+		{name: "to a round total", receipt: withDiscount("-0.35", "35.00"), cfg: ValidationConfig{AllowDiscounts: true, StrictTotal: true}, wantPoints: 28 + 50 + 25},
+		{name: "minus sign only", receipt: withDiscount("-", "35.35"), cfg: ValidationConfig{AllowDiscounts: true}, wantErr: "item 5: invalid price format (N.NN)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := validateAndParseReceipt(&tt.receipt, tt.cfg)
+			checkValidationError(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+			// Neither the item count nor the description rule counts the discount line
+			breakdown := calculatePointsBreakdown(data, defaultPointsConfig())
+			if got := sumBreakdown(breakdown); got != tt.wantPoints {
+				t.Errorf("points = %d, want %d (%v)", got, tt.wantPoints, breakdown)
+			}
+			if got, _ := rulePoints(breakdown, ruleItemPairs); got != 10 {
+				t.Errorf("%s = %d, want 10", ruleItemPairs, got)
+			}
+			if got, _ := rulePoints(breakdown, ruleDescription); got != 6 {
+				t.Errorf("%s = %d, want 6", ruleDescription, got)
+			}
+			if discount := data.Items[len(data.Items)-1]; discount.PriceCents >= 0 || discount.Price >= 0 {
+				t.Errorf("discount line parsed as %+v, want a negative price", discount)
+			}
+		})
+	}
+}
+
+func TestValidateRetailerLength(t *testing.T) {
+	// retailerRegex only admits ASCII word characters, so a multi-byte name
+	// that passes the length check is still rejected, but for its format
+	tests := []struct {
+		name     string
+		retailer string
+		max      int
+		wantErr  string
+	}{
+		{name: "unbounded", retailer: strings.Repeat("A", 1000)},
+		{name: "at the limit", retailer: "Target", max: 6},
+		{name: "over the limit", retailer: "Targets", max: 6, wantErr: "retailer exceeds maximum length"},
+		{name: "accented at the limit", retailer: "Cafés", max: 5, wantErr: "invalid retailer format"},
+		{name: "accented over the limit", retailer: "Cafés", max: 4, wantErr: "retailer exceeds maximum length"},
+		{name: "multi-byte at the limit in runes, over it in bytes", retailer: "日本", max: 2, wantErr: "invalid retailer format"},
+		{name: "multi-byte over the limit in runes", retailer: "日本橋", max: 2, wantErr: "retailer exceeds maximum length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.Retailer = tt.retailer
+			_, err := validateAndParseReceipt(&receipt, ValidationConfig{MaxRetailerLength: tt.max})
+			checkValidationError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateAveragePrice(t *testing.T) {
+	capped := ValidationConfig{MaxAveragePriceCents: 1000, AllowDiscounts: true}
+	three := func(total string) Receipt {
+		receipt := testReceipt()
+		receipt.Items = []Item{{ShortDescription: "A", Price: "10.00"}, {ShortDescription: "B", Price: "10.00"}, {ShortDescription: "C", Price: "10.00"}}
+		receipt.Total = total
+		return receipt
+	}
+	quantity := 3
+	bulk := singleItemReceipt("10.00", "30.00")
+	bulk.Items[0].Quantity = &quantity
+	bulkOver := singleItemReceipt("10.01", "30.03")
+	bulkOver.Items[0].Quantity = &quantity
+	discounted := three("30.01")
+	discounted.Items = append(discounted.Items, Item{ShortDescription: "Coupon", Price: "-5.00"})
+	const tooHigh = "average item price exceeds maximum allowed value"
+	tests := []struct {
+		name    string
+		cfg     ValidationConfig
+		receipt Receipt
+		wantErr string
+	}{
+		{name: "below the ceiling", cfg: capped, receipt: three("29.99")},
+		{name: "at the ceiling", cfg: capped, receipt: three("30.00")},
+		// 30.01 over three items averages 10.0033
+		{name: "a cent above", cfg: capped, receipt: three("30.01"), wantErr: tooHigh},
+		{name: "quantities count as items", cfg: capped, receipt: bulk},
+		{name: "quantities above", cfg: capped, receipt: bulkOver, wantErr: tooHigh},
+		{name: "discount lines are not items", cfg: capped, receipt: discounted, wantErr: tooHigh},
+		{name: "off by default", receipt: three("3000.00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateAndParseReceipt(&tt.receipt, tt.cfg)
+			checkValidationError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateStrictDateTime(t *testing.T) {
+	const badTime = "invalid purchaseTime format (HH:MM)"
+	const badDate = "invalid purchaseDate format (YYYY-MM-DD)"
+	tests := []struct {
+		name       string
+		date, time string
+		strict     bool
+		wantErr    string
+		wantHour   int
+		wantMinute int
+	}{
+		{name: "canonical", date: "2022-01-01", time: "09:05", strict: true, wantHour: 9, wantMinute: 5},
+		// time.Parse takes one digit for the "15" hour
+		{name: "single-digit hour, loose", date: "2022-01-01", time: "9:05", wantHour: 9, wantMinute: 5},
+		{name: "single-digit hour, strict", date: "2022-01-01", time: "9:05", strict: true, wantErr: badTime},
+		{name: "single-digit midnight, strict", date: "2022-01-01", time: "0:00", strict: true, wantErr: badTime},
+		{name: "midnight, strict", date: "2022-01-01", time: "00:00", strict: true},
+		// Rejected either way
+		{name: "single-digit minute", date: "2022-01-01", time: "09:5", strict: true, wantErr: badTime},
+		{name: "hour out of range", date: "2022-01-01", time: "24:00", wantErr: badTime},
+		{name: "single-digit month", date: "2022-1-01", time: "09:05", wantErr: badDate},
+		{name: "impossible day", date: "2022-02-29", time: "09:05", strict: true, wantErr: badDate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.PurchaseDate, receipt.PurchaseTime = tt.date, tt.time
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{StrictDateTime: tt.strict})
+			checkValidationError(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+			if h, m := data.PurchaseTime.Hour(), data.PurchaseTime.Minute(); h != tt.wantHour || m != tt.wantMinute {
+				t.Errorf("purchase time = %02d:%02d, want %02d:%02d", h, m, tt.wantHour, tt.wantMinute)
+			}
+		})
+	}
+}
+
+func TestZeroPriceItems(t *testing.T) {
+	// Two paid and two free items
+	receipt := testReceipt()
+	receipt.Items = []Item{
+		{ShortDescription: "Soda", Price: "2.00"},
+		{ShortDescription: "Free sample", Price: "0.00"},
+		{ShortDescription: "Chips", Price: "3.00"},
+		{ShortDescription: "Free bag", Price: "0.00"},
+	}
+	receipt.Total = "5.00"
+	tests := []struct {
+		mode          string
+		wantErr       string
+		wantItems     int
+		wantPairBonus int64
+	}{
+		{mode: "", wantItems: 4, wantPairBonus: 10},
+		{mode: zeroPriceAllow, wantItems: 4, wantPairBonus: 10},
+		{mode: zeroPriceExclude, wantItems: 2, wantPairBonus: 5},
+		{mode: zeroPriceReject, wantErr: "item 1: price must be greater than zero"},
+	}
+	for _, tt := range tests {
+		t.Run(cmp.Or(tt.mode, "unset"), func(t *testing.T) {
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{ZeroPriceItems: tt.mode, StrictTotal: true})
+			checkValidationError(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+			if data.OriginalItems != tt.wantItems {
+				t.Errorf("items counted = %d, want %d", data.OriginalItems, tt.wantItems)
+			}
+			// Excluded items still make up the receipt and its strict total
+			if len(data.Items) != len(receipt.Items) {
+				t.Errorf("%d items validated, want %d", len(data.Items), len(receipt.Items))
+			}
+			points, _ := rulePoints(calculatePointsBreakdown(data, defaultPointsConfig()), ruleItemPairs)
+			if points != tt.wantPairBonus {
+				t.Errorf("item pair points = %d, want %d", points, tt.wantPairBonus)
+			}
+		})
+	}
+}
+
+func TestCheckPurchaseDate(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	bounded := ValidationConfig{
+		EarliestPurchaseDate:  time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		RejectFuturePurchases: true,
+		MaxFutureSkew:         time.Hour,
+	}
+	const tooOld, future = "purchaseDate is before the earliest accepted date", "purchaseDate is in the future"
+	tests := []struct {
+		name       string
+		cfg        ValidationConfig
+		date, time string
+		wantErr    string
+	}{
+		{name: "day before the earliest", cfg: bounded, date: "1999-12-31", time: "23:59", wantErr: tooOld},
+		{name: "earliest date", cfg: bounded, date: "2000-01-01", time: "00:00"},
+		{name: "now", cfg: bounded, date: "2024-03-01", time: "12:00"},
+		{name: "at the skew", cfg: bounded, date: "2024-03-01", time: "13:00"},
+		{name: "a minute past the skew", cfg: bounded, date: "2024-03-01", time: "13:01", wantErr: future},
+		{name: "tomorrow", cfg: bounded, date: "2024-03-02", time: "00:00", wantErr: future},
+		// Without a usable time, the purchase counts from midnight
+		{name: "no time, today", cfg: bounded, date: "2024-03-01", time: ""},
+		{name: "no time, tomorrow", cfg: bounded, date: "2024-03-02", time: "", wantErr: future},
+		{name: "unbounded by default", date: "1900-01-01", time: "12:00"},
+		{name: "future accepted by default", date: "2100-01-01", time: "12:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.PurchaseDate, receipt.PurchaseTime = tt.date, tt.time
+			cfg := tt.cfg
+			cfg.PartialScoring = true
+			data, err := validateAndParseReceipt(&receipt, cfg)
+			if err != nil {
+				t.Fatalf("validateAndParseReceipt: %v", err)
+			}
+			err = checkPurchaseDate(data, cfg, now)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("checkPurchaseDate: unexpected error %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("checkPurchaseDate error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
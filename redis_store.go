@@ -0,0 +1,785 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keys, all under redisKeyPrefix. Each receipt is a JSON string key
+// that may expire; the sorted sets index the receipts that have not.
+const (
+	redisKeyPrefix         = "receipts:"
+	redisReceiptPrefix     = redisKeyPrefix + "receipt:"      // + id: the StoredReceipt as JSON
+	redisPointsIndex       = redisKeyPrefix + "by-points"     // id scored by points
+	redisProcessedIndex    = redisKeyPrefix + "by-processed"  // id scored by processedAt in microseconds
+	redisCustomerPrefix    = redisKeyPrefix + "customer:"     // + customer id: latest purchase date
+	redisRetailerDayPrefix = redisKeyPrefix + "retailer-day:" // + retailer key: latest first-of-day date
+	redisFingerprintPrefix = redisKeyPrefix + "fingerprint:"  // + fingerprint: id of the claiming receipt, present while the window lasts
+	redisIdempotencyPrefix = redisKeyPrefix + "idempotency:"  // + key: hash of the reservation, present until it expires
+	redisAPIKeyPrefix      = redisKeyPrefix + "api-key:"      // + id: the APIKey as JSON
+	redisAPIKeyHashPrefix  = redisKeyPrefix + "api-key-hash:" // + secret hash: id of the API key
+	redisAPIKeyIndex       = redisKeyPrefix + "api-keys"      // API key id scored by createdAt in microseconds
+	redisLedgerPrefix      = redisKeyPrefix + "ledger:"       // + user id: the user's LedgerEntry list as JSON, oldest first
+	redisBalancePrefix     = redisKeyPrefix + "balance:"      // + user id: hash of the user's UserBalance totals
+	redisLedgerEntryPrefix = redisKeyPrefix + "ledger-entry:" // + entry id: user id of the entry, marking the id taken
+	redisLedgerExpiryIndex = redisKeyPrefix + "ledger-expiry" // ids of expiring credits not yet expired, scored by expiresAt in microseconds
+	redisLeaderboardPrefix = redisKeyPrefix + "leaderboard:"  // + bucket: user ids scored by their points on the leaderboard
+)
+
+// redisUpdateAttempts bounds the optimistic retries of Update when the
+// receipt changes between reading and writing it.
+const redisUpdateAttempts = 10
+
+// redisLatestDate atomically replaces the date at KEYS[1] with ARGV[1] if it
+// is later, returning the previous date or false. YYYY-MM-DD dates compare
+// correctly as strings.
+var redisLatestDate = redis.NewScript(`
+local previous = redis.call("GET", KEYS[1])
+if not previous or ARGV[1] > previous then
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+return previous
+`)
+
+// redisReserveKey creates the reservation hash at KEYS[1] with request hash
+// ARGV[1], expiring after ARGV[2] milliseconds at Unix nanosecond ARGV[3],
+// unless it exists. It returns false if it reserved the key, or else the
+// existing hash, receipt id, and expiry.
+var redisReserveKey = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HMGET", KEYS[1], "hash", "receipt", "expires")
+end
+redis.call("HSET", KEYS[1], "hash", ARGV[1], "receipt", "", "expires", ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return false
+`)
+
+// redisCompleteKey sets the receipt id of the reservation at KEYS[1] to
+// ARGV[1], if it still exists. A plain HSET would recreate it without expiry.
+var redisCompleteKey = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("HSET", KEYS[1], "receipt", ARGV[1])
+end
+return 0
+`)
+
+// redisReleaseFingerprint deletes the claim at KEYS[1] if the receipt id
+// ARGV[1] still holds it.
+var redisReleaseFingerprint = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redisAddLedgerEntry appends the JSON entry ARGV[1], of ARGV[2] points and
+// kind ARGV[3], to the ledger list at KEYS[1] and adds it to the balance hash
+// at KEYS[2], unless its id is marked taken at KEYS[3] or, if ARGV[4] is "1",
+// it is a debit the balance does not cover. It marks the id with the user id
+// ARGV[5], indexes it at KEYS[4] under its expiry ARGV[6] unless that is 0,
+// takes the credit ARGV[8] an expiry entry expires out of that index, adds
+// its points to the user on each leaderboard at KEYS[5] onward, and returns
+// whether it added the entry and the balance after.
+var redisAddLedgerEntry = redis.NewScript(`
+local balance = tonumber(redis.call("HGET", KEYS[2], "points") or "0")
+local points = tonumber(ARGV[2])
+if redis.call("EXISTS", KEYS[3]) == 1 or (ARGV[4] == "1" and points < 0 and balance + points < 0) then
+	return {0, balance}
+end
+redis.call("SET", KEYS[3], ARGV[5])
+redis.call("RPUSH", KEYS[1], ARGV[1])
+redis.call("HINCRBY", KEYS[2], "points", points)
+if ARGV[6] ~= "0" then
+	redis.call("ZADD", KEYS[4], ARGV[6], ARGV[7])
+end
+if ARGV[8] ~= "" then
+	redis.call("ZREM", KEYS[4], ARGV[8])
+end
+for i = 5, #KEYS do
+	redis.call("ZINCRBY", KEYS[i], points, ARGV[5])
+end
+if ARGV[3] == "` + ledgerReceipt + `" then
+	redis.call("HINCRBY", KEYS[2], "earned", points)
+	redis.call("HINCRBY", KEYS[2], "receipts", 1)
+elseif ARGV[3] == "` + ledgerAdjustment + `" then
+	redis.call("HINCRBY", KEYS[2], "earned", points)
+elseif ARGV[3] == "` + ledgerRedemption + `" then
+	redis.call("HINCRBY", KEYS[2], "redeemed", -points)
+elseif ARGV[3] == "` + ledgerExpiry + `" then
+	redis.call("HINCRBY", KEYS[2], "expired", -points)
+end
+return {1, balance + points}
+`)
+
+// redisStore keeps receipts in Redis, shared by every replica of the service.
+// With a ttl, receipts expire that long after they were saved; the indexes
+// are pruned lazily, before the queries that read them.
+type redisStore struct {
+	client *redis.Client
+	ttl    time.Duration // 0 keeps receipts forever
+	// retailerKey groups retailer names for RetailerStats and ClaimRetailerDay.
+	retailerKey func(string) string
+}
+
+// newRedisStore connects to the server at url, a redis:// or rediss:// URL.
+func newRedisStore(url string, ttl time.Duration, retailerKey func(string) string) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parsing REDIS_URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connecting to redis: %w", err)
+	}
+	return &redisStore{client: client, ttl: ttl, retailerKey: retailerKey}, nil
+}
+
+// Close closes the connection pool.
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+// putReceipt queues the writes saving rec. keepTTL preserves the expiry of
+// an existing key instead of starting a new one.
+func (s *redisStore) putReceipt(ctx context.Context, pipe redis.Pipeliner, rec StoredReceipt, keepTTL bool) error {
+	record, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encoding receipt %s: %w", rec.ID, err)
+	}
+	expiration := s.ttl
+	if keepTTL {
+		expiration = redis.KeepTTL
+	}
+	pipe.Set(ctx, redisReceiptPrefix+rec.ID, record, expiration)
+	pipe.ZAdd(ctx, redisPointsIndex, redis.Z{Score: float64(rec.Points), Member: rec.ID})
+	pipe.ZAdd(ctx, redisProcessedIndex, redis.Z{Score: float64(rec.ProcessedAt.UnixMicro()), Member: rec.ID})
+	return nil
+}
+
+// unindex queues the removal of ids from both indexes.
+func unindex(ctx context.Context, pipe redis.Pipeliner, ids ...string) {
+	members := make([]any, len(ids))
+	for i, id := range ids {
+		members[i] = id
+	}
+	pipe.ZRem(ctx, redisPointsIndex, members...)
+	pipe.ZRem(ctx, redisProcessedIndex, members...)
+}
+
+// prune drops expired receipts from the indexes. Receipts are saved right
+// after being processed, so anything processed over a ttl ago has expired.
+func (s *redisStore) prune(ctx context.Context) error {
+	if s.ttl == 0 {
+		return nil
+	}
+	cutoff := strconv.FormatInt(time.Now().Add(-s.ttl).UnixMicro(), 10)
+	ids, err := s.client.ZRangeByScore(ctx, redisProcessedIndex, &redis.ZRangeBy{Min: "-inf", Max: "(" + cutoff}).Result()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		unindex(ctx, pipe, ids...)
+		return nil
+	})
+	return err
+}
+
+// loadReceipts fetches the receipts with the given ids, skipping (and
+// unindexing) any that have expired.
+func (s *redisStore) loadReceipts(ctx context.Context, ids []string) ([]StoredReceipt, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = redisReceiptPrefix + id
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]StoredReceipt, 0, len(ids))
+	var expired []string
+	for i, v := range values {
+		record, ok := v.(string)
+		if !ok {
+			expired = append(expired, ids[i])
+			continue
+		}
+		rec, err := decodeStoredReceipt(record)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	if len(expired) > 0 {
+		if _, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			unindex(ctx, pipe, expired...)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+func (s *redisStore) Save(rec StoredReceipt) error {
+	ctx := context.Background()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return s.putReceipt(ctx, pipe, rec, false)
+	})
+	return err
+}
+
+func (s *redisStore) Get(id string) (StoredReceipt, bool, error) {
+	record, err := s.client.Get(context.Background(), redisReceiptPrefix+id).Result()
+	if errors.Is(err, redis.Nil) {
+		return StoredReceipt{}, false, nil
+	}
+	if err != nil {
+		return StoredReceipt{}, false, err
+	}
+	rec, err := decodeStoredReceipt(record)
+	return rec, err == nil, err
+}
+
+func (s *redisStore) Exists(id string) (bool, error) {
+	n, err := s.client.Exists(context.Background(), redisReceiptPrefix+id).Result()
+	return n > 0, err
+}
+
+// Update watches the receipt key and retries if another writer changes it
+// before the transaction commits.
+func (s *redisStore) Update(id string, fn func(*StoredReceipt) error) (StoredReceipt, bool, error) {
+	ctx := context.Background()
+	key := redisReceiptPrefix + id
+	for range redisUpdateAttempts {
+		var rec StoredReceipt
+		found := false
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			record, err := tx.Get(ctx, key).Result()
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			found = true
+			if rec, err = decodeStoredReceipt(record); err != nil {
+				return err
+			}
+			if err := fn(&rec); err != nil {
+				return err
+			}
+			rec.ID = id
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return s.putReceipt(ctx, pipe, rec, true)
+			})
+			return err
+		}, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil || !found {
+			return StoredReceipt{}, found, err
+		}
+		return rec, true, nil
+	}
+	return StoredReceipt{}, true, fmt.Errorf("updating receipt %s: too much contention: %w", id, errTransient)
+}
+
+func (s *redisStore) Delete(id string) (bool, error) {
+	ctx := context.Background()
+	var del *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(ctx, redisReceiptPrefix+id)
+		unindex(ctx, pipe, id)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return del.Val() > 0, nil
+}
+
+// DeleteWhere evaluates pred in Go over every receipt, so unlike the other
+// backends it is not atomic: a receipt saved while it runs may be missed.
+func (s *redisStore) DeleteWhere(pred func(StoredReceipt) bool) (int, error) {
+	recs, err := s.ProcessedBetween(time.Time{}, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, rec := range recs {
+		if !pred(rec) {
+			continue
+		}
+		found, err := s.Delete(rec.ID)
+		if err != nil {
+			return deleted, err
+		}
+		if found {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *redisStore) RecordCustomerPurchase(customerID string, date time.Time) (time.Time, bool, error) {
+	previous, err := redisLatestDate.Run(context.Background(), s.client, []string{redisCustomerPrefix + customerID}, date.Format(time.DateOnly)).Text()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	t, err := time.Parse(time.DateOnly, previous)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("decoding purchase date for customer %s: %w", customerID, err)
+	}
+	return t, true, nil
+}
+
+func (s *redisStore) ClaimRetailerDay(retailer string, date time.Time) (bool, error) {
+	day := date.Format(time.DateOnly)
+	previous, err := redisLatestDate.Run(context.Background(), s.client, []string{redisRetailerDayPrefix + s.retailerKey(retailer)}, day).Text()
+	if errors.Is(err, redis.Nil) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return day > previous, nil
+}
+
+// ClaimFingerprint lets Redis expire the claim when the window ends, so a
+// key that still exists means a duplicate.
+func (s *redisStore) ClaimFingerprint(fingerprint, id string, at time.Time, window time.Duration) (string, bool, error) {
+	ctx := context.Background()
+	key := redisFingerprintPrefix + fingerprint
+	claimed, err := s.client.SetNX(ctx, key, id, window).Result()
+	if err != nil || claimed {
+		return "", claimed, err
+	}
+	// The claim may expire before it is read, leaving no holder to report
+	holder, err := s.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	return holder, false, err
+}
+
+func (s *redisStore) ReleaseFingerprint(fingerprint, id string) error {
+	return redisReleaseFingerprint.Run(context.Background(), s.client, []string{redisFingerprintPrefix + fingerprint}, id).Err()
+}
+
+// ReserveIdempotencyKey lets Redis expire the reservation, so a key that
+// still exists is held.
+func (s *redisStore) ReserveIdempotencyKey(key, requestHash string, at time.Time, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	rec := IdempotencyRecord{Key: key, RequestHash: requestHash, ExpiresAt: at.Add(ttl)}
+	result, err := redisReserveKey.Run(context.Background(), s.client, []string{redisIdempotencyPrefix + key},
+		requestHash, max(ttl.Milliseconds(), 1), rec.ExpiresAt.UnixNano()).Slice()
+	if errors.Is(err, redis.Nil) {
+		return rec, true, nil
+	}
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	fields := make([]string, len(result))
+	for i, v := range result {
+		fields[i], _ = v.(string)
+	}
+	if len(fields) != 3 {
+		return IdempotencyRecord{}, false, fmt.Errorf("unexpected reservation for idempotency key %q", key)
+	}
+	expiresAt, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return IdempotencyRecord{}, false, fmt.Errorf("decoding reservation for idempotency key %q: %w", key, err)
+	}
+	return IdempotencyRecord{Key: key, RequestHash: fields[0], ReceiptID: fields[1], ExpiresAt: time.Unix(0, expiresAt)}, false, nil
+}
+
+func (s *redisStore) CompleteIdempotencyKey(key, receiptID string) error {
+	return redisCompleteKey.Run(context.Background(), s.client, []string{redisIdempotencyPrefix + key}, receiptID).Err()
+}
+
+func (s *redisStore) ReleaseIdempotencyKey(key string) error {
+	return s.client.Del(context.Background(), redisIdempotencyPrefix+key).Err()
+}
+
+func (s *redisStore) Rank(id string) (ReceiptRank, bool, error) {
+	ctx := context.Background()
+	if err := s.prune(ctx); err != nil {
+		return ReceiptRank{}, false, err
+	}
+	rec, found, err := s.Get(id)
+	if err != nil || !found {
+		return ReceiptRank{}, false, err
+	}
+	var total, atOrBelow *redis.IntCmd
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		total = pipe.ZCard(ctx, redisPointsIndex)
+		atOrBelow = pipe.ZCount(ctx, redisPointsIndex, "-inf", strconv.FormatInt(rec.Points, 10))
+		return nil
+	})
+	if err != nil {
+		return ReceiptRank{}, false, err
+	}
+	return ReceiptRank{
+		Points:    rec.Points,
+		Rank:      int(total.Val()-atOrBelow.Val()) + 1,
+		Total:     int(total.Val()),
+		AtOrBelow: int(atOrBelow.Val()),
+	}, true, nil
+}
+
+func (s *redisStore) ProcessedBetween(from, to time.Time) ([]StoredReceipt, error) {
+	ctx := context.Background()
+	if err := s.prune(ctx); err != nil {
+		return nil, err
+	}
+	// The index is in whole microseconds, so widen the range to them and
+	// apply the exact bounds to the loaded receipts
+	by := redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !from.IsZero() {
+		by.Min = strconv.FormatInt(from.UnixMicro(), 10)
+	}
+	if !to.IsZero() {
+		end := to.UnixMicro()
+		if to.Nanosecond()%1000 != 0 {
+			end++
+		}
+		by.Max = strconv.FormatInt(end, 10)
+	}
+	ids, err := s.client.ZRangeByScore(ctx, redisProcessedIndex, &by).Result()
+	if err != nil {
+		return nil, err
+	}
+	recs, err := s.loadReceipts(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	recs = slices.DeleteFunc(recs, func(rec StoredReceipt) bool {
+		return (!from.IsZero() && rec.ProcessedAt.Before(from)) || (!to.IsZero() && !rec.ProcessedAt.Before(to))
+	})
+	slices.SortFunc(recs, func(a, b StoredReceipt) int {
+		if c := a.ProcessedAt.Compare(b.ProcessedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return recs, nil
+}
+
+func (s *redisStore) ProcessedPage(after time.Time, afterID string, to time.Time, limit int) ([]StoredReceipt, error) {
+	ctx := context.Background()
+	if err := s.prune(ctx); err != nil {
+		return nil, err
+	}
+	// The index is in whole microseconds, as in ProcessedBetween. A batch
+	// that stops partway through a microsecond is completed with the rest
+	// of it, so the receipts in it can be put in order by their exact times
+	by := redis.ZRangeBy{Min: "-inf", Max: "+inf", Count: int64(limit)}
+	if !after.IsZero() {
+		by.Min = strconv.FormatInt(after.UnixMicro(), 10)
+	}
+	if !to.IsZero() {
+		end := to.UnixMicro()
+		if to.Nanosecond()%1000 != 0 {
+			end++
+		}
+		by.Max = strconv.FormatInt(end, 10)
+	}
+	cursor := processedKey{at: after, id: afterID}
+	var page []StoredReceipt
+	for len(page) < limit {
+		batch, err := s.client.ZRangeByScoreWithScores(ctx, redisProcessedIndex, &by).Result()
+		if err != nil {
+			return nil, err
+		}
+		full := len(batch) == limit
+		ids := make([]string, 0, len(batch))
+		for _, z := range batch {
+			if id, _ := z.Member.(string); !full || z.Score < batch[len(batch)-1].Score {
+				ids = append(ids, id)
+			}
+		}
+		if full {
+			last := strconv.FormatInt(int64(batch[len(batch)-1].Score), 10)
+			rest, err := s.client.ZRangeByScore(ctx, redisProcessedIndex, &redis.ZRangeBy{Min: last, Max: last}).Result()
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, rest...)
+			by.Min = "(" + last
+		}
+		recs, err := s.loadReceipts(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range recs {
+			if (processedKey{at: rec.ProcessedAt, id: rec.ID}).compare(cursor) > 0 && (to.IsZero() || rec.ProcessedAt.Before(to)) {
+				page = append(page, rec)
+			}
+		}
+		if !full {
+			break
+		}
+	}
+	slices.SortFunc(page, func(a, b StoredReceipt) int {
+		return processedKey{at: a.ProcessedAt, id: a.ID}.compare(processedKey{at: b.ProcessedAt, id: b.ID})
+	})
+	return page[:min(limit, len(page))], nil
+}
+
+func (s *redisStore) RetailerStats() ([]RetailerStats, error) {
+	recs, err := s.ProcessedBetween(time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return groupRetailerStats(recs, s.retailerKey), nil
+}
+
+func (s *redisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// getAPIKey reads the API key with the given id through c, a client or a
+// transaction.
+func getAPIKey(ctx context.Context, c redis.Cmdable, id string) (APIKey, bool, error) {
+	record, err := c.Get(ctx, redisAPIKeyPrefix+id).Result()
+	if errors.Is(err, redis.Nil) {
+		return APIKey{}, false, nil
+	}
+	if err != nil {
+		return APIKey{}, false, err
+	}
+	var key APIKey
+	if err := json.Unmarshal([]byte(record), &key); err != nil {
+		return APIKey{}, true, fmt.Errorf("decoding API key %s: %w", id, err)
+	}
+	return key, true, nil
+}
+
+// changeAPIKey applies change to the API key with the given id and writes
+// the key it returns, unless it returns false. It watches the key and
+// retries if another writer changes it before the transaction commits, so
+// the hash index never points at a replaced secret.
+func (s *redisStore) changeAPIKey(id string, change func(key APIKey, found bool) (APIKey, bool, error)) (APIKey, bool, error) {
+	ctx := context.Background()
+	for range redisUpdateAttempts {
+		var key APIKey
+		found := false
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			old, exists, err := getAPIKey(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+			key, found = old, exists
+			next, write, err := change(old, exists)
+			if err != nil || !write {
+				return err
+			}
+			next.ID = id
+			record, err := json.Marshal(next)
+			if err != nil {
+				return fmt.Errorf("encoding API key %s: %w", id, err)
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if exists && old.Hash != next.Hash {
+					pipe.Del(ctx, redisAPIKeyHashPrefix+old.Hash)
+				}
+				pipe.Set(ctx, redisAPIKeyPrefix+id, record, 0)
+				pipe.Set(ctx, redisAPIKeyHashPrefix+next.Hash, id, 0)
+				pipe.ZAdd(ctx, redisAPIKeyIndex, redis.Z{Score: float64(next.CreatedAt.UnixMicro()), Member: id})
+				return nil
+			})
+			key = next
+			return err
+		}, redisAPIKeyPrefix+id)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return APIKey{}, found, err
+		}
+		return key, found, nil
+	}
+	return APIKey{}, true, fmt.Errorf("updating API key %s: too much contention: %w", id, errTransient)
+}
+
+func (s *redisStore) SaveAPIKey(key APIKey) error {
+	_, _, err := s.changeAPIKey(key.ID, func(APIKey, bool) (APIKey, bool, error) { return key, true, nil })
+	return err
+}
+
+func (s *redisStore) APIKeyByHash(hash string) (APIKey, bool, error) {
+	ctx := context.Background()
+	id, err := s.client.Get(ctx, redisAPIKeyHashPrefix+hash).Result()
+	if errors.Is(err, redis.Nil) {
+		return APIKey{}, false, nil
+	}
+	if err != nil {
+		return APIKey{}, false, err
+	}
+	key, found, err := getAPIKey(ctx, s.client, id)
+	if err != nil || !found || key.Hash != hash {
+		return APIKey{}, false, err
+	}
+	return key, true, nil
+}
+
+func (s *redisStore) APIKeys() ([]APIKey, error) {
+	ctx := context.Background()
+	ids, err := s.client.ZRange(ctx, redisAPIKeyIndex, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]APIKey, 0, len(ids))
+	for _, id := range ids {
+		key, found, err := getAPIKey(ctx, s.client, id)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			keys = append(keys, key)
+		}
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+func (s *redisStore) UpdateAPIKey(id string, fn func(*APIKey) error) (APIKey, bool, error) {
+	return s.changeAPIKey(id, func(key APIKey, found bool) (APIKey, bool, error) {
+		if !found {
+			return key, false, nil
+		}
+		err := fn(&key)
+		return key, err == nil, err
+	})
+}
+
+func (s *redisStore) AddLedgerEntry(entry LedgerEntry, checkBalance bool) (int64, bool, error) {
+	record, err := json.Marshal(entry)
+	if err != nil {
+		return 0, false, fmt.Errorf("encoding ledger entry %s: %w", entry.ID, err)
+	}
+	check := "0"
+	if checkBalance {
+		check = "1"
+	}
+	var expiresAt int64
+	if !entry.ExpiresAt.IsZero() {
+		expiresAt = entry.ExpiresAt.UnixMicro()
+	}
+	var expired string
+	if entry.Kind == ledgerExpiry {
+		expired = expiredCreditKey(entry)
+	}
+	keys := []string{redisLedgerPrefix + entry.UserID, redisBalancePrefix + entry.UserID, redisLedgerEntryPrefix + entry.ID, redisLedgerExpiryIndex}
+	for _, bucket := range leaderboardBuckets(entry) {
+		keys = append(keys, redisLeaderboardPrefix+bucket)
+	}
+	result, err := redisAddLedgerEntry.Run(context.Background(), s.client, keys, record, entry.Points, entry.Kind, check, entry.UserID, expiresAt, entry.ID, expired).Int64Slice()
+	if err != nil {
+		return 0, false, err
+	}
+	if len(result) != 2 {
+		return 0, false, fmt.Errorf("adding ledger entry %s: unexpected reply %v", entry.ID, result)
+	}
+	return result[1], result[0] == 1, nil
+}
+
+func (s *redisStore) Ledger(userID string) ([]LedgerEntry, error) {
+	records, err := s.client.LRange(context.Background(), redisLedgerPrefix+userID, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LedgerEntry, len(records))
+	for i, record := range records {
+		if err := json.Unmarshal([]byte(record), &entries[i]); err != nil {
+			return nil, fmt.Errorf("decoding ledger of %s: %w", userID, err)
+		}
+	}
+	return entries, nil
+}
+
+func (s *redisStore) UserBalance(userID string) (UserBalance, error) {
+	totals, err := s.client.HGetAll(context.Background(), redisBalancePrefix+userID).Result()
+	if err != nil {
+		return UserBalance{}, err
+	}
+	balance := UserBalance{UserID: userID}
+	for field, total := range map[string]*int64{"points": &balance.Points, "earned": &balance.Earned, "redeemed": &balance.Redeemed, "expired": &balance.Expired} {
+		if v, ok := totals[field]; ok {
+			if *total, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return UserBalance{}, fmt.Errorf("decoding balance of %s: %w", userID, err)
+			}
+		}
+	}
+	if v, ok := totals["receipts"]; ok {
+		if balance.Receipts, err = strconv.Atoi(v); err != nil {
+			return UserBalance{}, fmt.Errorf("decoding balance of %s: %w", userID, err)
+		}
+	}
+	return balance, nil
+}
+
+// Leaderboard reads the bucket's sorted set. Users with equal points are
+// ordered by user id, though which of them make the cut at limit is up to
+// Redis.
+func (s *redisStore) Leaderboard(bucket string, limit int) ([]LeaderboardEntry, error) {
+	scored, err := s.client.ZRevRangeWithScores(context.Background(), redisLeaderboardPrefix+bucket, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LeaderboardEntry, len(scored))
+	for i, z := range scored {
+		userID, _ := z.Member.(string)
+		entries[i] = LeaderboardEntry{UserID: userID, Points: int64(z.Score)}
+	}
+	return rankLeaderboard(entries, limit), nil
+}
+
+// ExpiringLedgerUsers reads the expiry index, which holds only the credits
+// not yet expired: adding an expiry entry takes its credit out.
+func (s *redisStore) ExpiringLedgerUsers(before time.Time) ([]string, error) {
+	ctx := context.Background()
+	ids, err := s.client.ZRangeByScore(ctx, redisLedgerExpiryIndex, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(before.UnixMicro(), 10),
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = redisLedgerEntryPrefix + id
+	}
+	owners, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(owners))
+	var users []string
+	for _, owner := range owners {
+		if userID, ok := owner.(string); ok {
+			if _, dup := seen[userID]; !dup {
+				seen[userID] = struct{}{}
+				users = append(users, userID)
+			}
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayResult is the outcome of posting one receipt.
+type replayResult struct {
+	status  int // HTTP status, or 0 when the request itself failed
+	latency time.Duration
+}
+
+// runReplay implements the replay subcommand: it posts every receipt in a
+// newline-delimited JSON file to a running server and prints a summary of
+// the outcomes and latencies. It returns the process exit code.
+func runReplay(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	baseURL := fs.String("url", "http://localhost:8080", "base URL of the receipt processor")
+	concurrency := fs.Int("concurrency", 1, "number of receipts in flight at once")
+	timeout := fs.Duration("timeout", 10*time.Second, "per-request timeout")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: receipt-processor replay [flags] receipts.ndjson")
+		fs.PrintDefaults()
+	}
+
+	// Accept flags on either side of the file name
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	path := fs.Arg(0)
+	if fs.NArg() > 1 {
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return 2
+		}
+		if fs.NArg() > 0 {
+			fs.Usage()
+			return 2
+		}
+	}
+	if path == "" || *concurrency < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(stderr, "replay:", err)
+		return 1
+	}
+	defer f.Close()
+
+	endpoint := strings.TrimRight(*baseURL, "/") + "/receipts/process"
+	client := &http.Client{Timeout: *timeout}
+
+	bodies := make(chan []byte)
+	results := make(chan replayResult)
+	var wg sync.WaitGroup
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for body := range bodies {
+				results <- postReceipt(client, endpoint, body)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Lines are parsed into Receipt so malformed input is reported here
+	// rather than counted as a server rejection.
+	var skipped int
+	var readErr error
+	go func() {
+		defer close(bodies)
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		line := 0
+		for scanner.Scan() {
+			line++
+			raw := bytes.TrimSpace(scanner.Bytes())
+			if len(raw) == 0 {
+				continue
+			}
+			var receipt Receipt
+			if err := json.Unmarshal(raw, &receipt); err != nil {
+				fmt.Fprintf(stderr, "replay: line %d: %v\n", line, err)
+				skipped++
+				continue
+			}
+			body, err := json.Marshal(receipt)
+			if err != nil {
+				fmt.Fprintf(stderr, "replay: line %d: %v\n", line, err)
+				skipped++
+				continue
+			}
+			bodies <- body
+		}
+		readErr = scanner.Err()
+	}()
+
+	start := time.Now()
+	var latencies []time.Duration
+	statuses := make(map[int]int)
+	for res := range results {
+		latencies = append(latencies, res.latency)
+		statuses[res.status]++
+	}
+	elapsed := time.Since(start)
+
+	if readErr != nil {
+		fmt.Fprintln(stderr, "replay:", readErr)
+	}
+	printReplaySummary(stdout, latencies, statuses, skipped, elapsed)
+	if readErr != nil || statuses[http.StatusOK] != len(latencies) {
+		return 1
+	}
+	return 0
+}
+
+// postReceipt sends one receipt body and times the round trip.
+func postReceipt(client *http.Client, endpoint string, body []byte) replayResult {
+	start := time.Now()
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return replayResult{latency: time.Since(start)}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return replayResult{status: resp.StatusCode, latency: time.Since(start)}
+}
+
+// printReplaySummary writes the counts by outcome and latency percentiles.
+func printReplaySummary(w io.Writer, latencies []time.Duration, statuses map[int]int, skipped int, elapsed time.Duration) {
+	sent := len(latencies)
+	fmt.Fprintf(w, "sent %d receipts in %s (%d skipped)\n", sent, elapsed.Round(time.Millisecond), skipped)
+	fmt.Fprintf(w, "succeeded: %d\n", statuses[http.StatusOK])
+	fmt.Fprintf(w, "failed:    %d\n", sent-statuses[http.StatusOK])
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		if code != http.StatusOK {
+			codes = append(codes, code)
+		}
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		label := http.StatusText(code)
+		if code == 0 {
+			label = "request error"
+		}
+		fmt.Fprintf(w, "  %d %s: %d\n", code, label, statuses[code])
+	}
+
+	if sent == 0 {
+		return
+	}
+	slices.Sort(latencies)
+	fmt.Fprintf(w, "latency p50=%s p90=%s p99=%s max=%s\n",
+		percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[sent-1])
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
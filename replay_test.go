@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunReplay(t *testing.T) {
+	srv := newTestServer(t, routerDeps{})
+	valid := mustJSON(t, testReceipt())
+	rejected := strings.Replace(valid, `"35.35"`, `"35.3"`, 1)
+	tests := []struct {
+		name       string
+		lines      []string
+		flags      []string // before the file name
+		after      []string // after it
+		wantCode   int
+		wantOut    []string
+		wantErrOut string
+	}{
+		{name: "all accepted", lines: []string{valid, valid, valid}, wantCode: 0, wantOut: []string{"sent 3 receipts", "(0 skipped)", "succeeded: 3", "failed:    0", "latency p50="}},
+		{name: "concurrently", lines: []string{valid, valid, valid, valid}, flags: []string{"-concurrency", "3"}, wantCode: 0, wantOut: []string{"sent 4 receipts", "succeeded: 4"}},
+		{name: "flags after the file", lines: []string{valid}, after: []string{"-concurrency", "2"}, wantCode: 0, wantOut: []string{"succeeded: 1"}},
+		{name: "rejected", lines: []string{valid, rejected}, wantCode: 1, wantOut: []string{"succeeded: 1", "failed:    1", "400 Bad Request: 1"}},
+		{name: "malformed and blank lines", lines: []string{valid, "", `{"retailer":`, valid}, wantCode: 0, wantOut: []string{"sent 2 receipts", "(1 skipped)", "succeeded: 2"}, wantErrOut: "line 3"},
+		{name: "empty file", lines: nil, wantCode: 0, wantOut: []string{"sent 0 receipts"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(append([]string{"-url", srv.URL + "/"}, tt.flags...), writeReplayFile(t, tt.lines...))
+			args = append(args, tt.after...)
+			var stdout, stderr bytes.Buffer
+			if code := runReplay(args, &stdout, &stderr); code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d (stderr %s)", code, tt.wantCode, stderr.String())
+			}
+			for _, want := range tt.wantOut {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("summary missing %q:\n%s", want, stdout.String())
+				}
+			}
+			if !strings.Contains(stderr.String(), tt.wantErrOut) {
+				t.Errorf("stderr = %q, want it to contain %q", stderr.String(), tt.wantErrOut)
+			}
+		})
+	}
+}
+
+func TestRunReplayUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+	}{
+		{name: "no file", args: nil, wantCode: 2},
+		{name: "two files", args: []string{"a.ndjson", "b.ndjson"}, wantCode: 2},
+		{name: "no concurrency", args: []string{"-concurrency", "0", "a.ndjson"}, wantCode: 2},
+		{name: "unknown flag", args: []string{"-rate", "5", "a.ndjson"}, wantCode: 2},
+		{name: "missing file", args: []string{filepath.Join(t.TempDir(), "missing.ndjson")}, wantCode: 1},
+		{name: "server down", args: []string{"-url", "http://127.0.0.1:1", writeReplayFile(t, mustJSON(t, testReceipt()))}, wantCode: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runReplay(tt.args, &stdout, &stderr); code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d (stderr %s)", code, tt.wantCode, stderr.String())
+			}
+		})
+	}
+}
+
+// writeReplayFile writes lines to a file to replay and returns its path.
+func writeReplayFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "receipts.ndjson")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatalf("writing replay file: %v", err)
+	}
+	return path
+}
+
+func TestPercentile(t *testing.T) {
+	ms := func(ns ...int) []time.Duration {
+		var d []time.Duration
+		for _, n := range ns {
+			d = append(d, time.Duration(n)*time.Millisecond)
+		}
+		return d
+	}
+	hundred := make([]int, 100)
+	for i := range hundred {
+		hundred[i] = i + 1
+	}
+	tests := []struct {
+		name   string
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{name: "single", sorted: ms(7), p: 50, want: 7 * time.Millisecond},
+		{name: "single p99", sorted: ms(7), p: 99, want: 7 * time.Millisecond},
+		{name: "median of four", sorted: ms(1, 2, 3, 4), p: 50, want: 2 * time.Millisecond},
+		{name: "p90 of a hundred", sorted: ms(hundred...), p: 90, want: 90 * time.Millisecond},
+		{name: "p99 of a hundred", sorted: ms(hundred...), p: 99, want: 99 * time.Millisecond},
+		{name: "p0", sorted: ms(1, 2), p: 0, want: time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentile(tt.sorted, tt.p); got != tt.want {
+				t.Errorf("percentile(%d) = %v, want %v", tt.p, got, tt.want)
+			}
+		})
+	}
+}
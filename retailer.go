@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Supported values for Config.RetailerCanonicalization, from least to most
+// aggressive.
+const (
+	canonicalNone       = "none"       // group only identical names
+	canonicalBasic      = "basic"      // ignore case and whitespace differences
+	canonicalAggressive = "aggressive" // also ignore punctuation and corporate suffixes
+)
+
+// corporateSuffixes are trailing words dropped by aggressive canonicalization,
+// so "Target Inc" groups with "Target".
+var corporateSuffixes = []string{"inc", "llc", "ltd", "co", "corp", "corporation", "company"}
+
+// retailerCanonicalizer returns the function that maps a retailer name to its
+// grouping key at the given level. Unknown levels fall back to basic.
+func retailerCanonicalizer(level string) func(string) string {
+	switch level {
+	case canonicalNone:
+		return func(name string) string { return name }
+	case canonicalAggressive:
+		return aggressiveRetailerKey
+	default:
+		return normalizeRetailer
+	}
+}
+
+// normalizeRetailer ignores case and surrounding whitespace, and collapses
+// inner runs of whitespace.
+func normalizeRetailer(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// aggressiveRetailerKey additionally removes punctuation and a trailing
+// corporate suffix. A name that is nothing but a suffix is left alone.
+func aggressiveRetailerKey(name string) string {
+	stripped := strings.Map(func(r rune) rune {
+		if unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return -1
+		}
+		return r
+	}, name)
+	words := strings.Fields(strings.ToLower(stripped))
+	if len(words) > 1 {
+		for _, suffix := range corporateSuffixes {
+			if words[len(words)-1] == suffix {
+				words = words[:len(words)-1]
+				break
+			}
+		}
+	}
+	return strings.Join(words, " ")
+}
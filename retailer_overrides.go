@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strings"
+)
+
+// RetailerOverride scales the points individual rules award to receipts from
+// matching retailers, e.g. double item-pair points at Target.
+type RetailerOverride struct {
+	// Retailer is a case-insensitive glob over the retailer name, e.g.
+	// "target*"
+	Retailer string `yaml:"retailer"`
+	// Multipliers maps rule names, as reported in a breakdown, to the factor
+	// their points are scaled by; 0 cancels a rule for the retailer
+	Multipliers map[string]float64 `yaml:"multipliers"`
+}
+
+// matchRetailer reports whether the glob pattern matches retailer, ignoring
+// case and surrounding spaces. An empty pattern matches every retailer.
+func matchRetailer(pattern, retailer string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(strings.TrimSpace(retailer)))
+	return matched
+}
+
+// retailerOverride returns the first override matching retailer, or nil when
+// none does. Overrides do not combine, so more specific patterns go first.
+func retailerOverride(overrides []RetailerOverride, retailer string) *RetailerOverride {
+	for i := range overrides {
+		if matchRetailer(overrides[i].Retailer, retailer) {
+			return &overrides[i]
+		}
+	}
+	return nil
+}
+
+// adjust returns the points rule awards under o.
+func (o *RetailerOverride) adjust(rule string, points int64) int64 {
+	if o == nil {
+		return points
+	}
+	multiplier, ok := o.Multipliers[rule]
+	if !ok {
+		return points
+	}
+	return int64(math.Round(float64(points) * multiplier))
+}
+
+// validateRetailerOverrides reports the first override that cannot be
+// applied under p.
+func validateRetailerOverrides(p PointsConfig) error {
+	for _, o := range p.RetailerOverrides {
+		if o.Retailer == "" {
+			return fmt.Errorf("retailerOverrides: every override needs a retailer pattern")
+		}
+		if _, err := path.Match(o.Retailer, ""); err != nil {
+			return fmt.Errorf("retailerOverrides: retailer %q is not a valid pattern", o.Retailer)
+		}
+		for rule, multiplier := range o.Multipliers {
+			if !p.hasRule(rule) {
+				return fmt.Errorf("retailerOverrides %q: unknown rule %q", o.Retailer, rule)
+			}
+			if multiplier < 0 {
+				return fmt.Errorf("retailerOverrides %q: multiplier for %q must not be negative", o.Retailer, rule)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRetailerCanonicalizer(t *testing.T) {
+	variants := []string{"Target", "TARGET", "  target ", "Target Inc.", "Target, Inc", "Tar-get"}
+	tests := []struct {
+		level string
+		want  []string // the key of each variant
+	}{
+		{level: canonicalNone, want: variants},
+		{level: canonicalBasic, want: []string{"target", "target", "target", "target inc.", "target, inc", "tar-get"}},
+		{level: canonicalAggressive, want: []string{"target", "target", "target", "target", "target", "target"}},
+		{level: "unknown", want: []string{"target", "target", "target", "target inc.", "target, inc", "tar-get"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			key := retailerCanonicalizer(tt.level)
+			var got []string
+			for _, name := range variants {
+				got = append(got, key(name))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("keys = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggressiveRetailerKeyKeepsDistinctRetailers(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{a: "Walgreens Co", b: "walgreens", same: true},
+		{a: "Target", b: "Walgreens", same: false},
+		{a: "Co-op Market", b: "Coop Market", same: true},
+		// Only a trailing suffix is removed, and never the whole name
+		{a: "Company", b: "", same: false},
+		{a: "Target Corporation Store", b: "Target Store", same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			if same := aggressiveRetailerKey(tt.a) == aggressiveRetailerKey(tt.b); same != tt.same {
+				t.Errorf("%q and %q grouped together = %v, want %v", tt.a, tt.b, same, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+)
+
+// routerDeps holds everything the HTTP handlers depend on.
+type routerDeps struct {
+	Config     *Config
+	Store      Store
+	Events     *broker
+	Sampler    *payloadSampler    // nil disables payload sampling
+	Signer     *pointsTokenSigner // nil disables points tokens and /jwks
+	Metrics    *storeMetrics      // nil disables /metrics
+	Prometheus *promMetrics       // nil disables the Prometheus metrics
+	IDs        IDGenerator
+	Clock      Clock
+	Logger     *slog.Logger
+}
+
+// newRouter builds the service's HTTP handler: every route plus the
+// timeout, rate limiting, tenant, authentication, CORS, panic recovery, request ID, request metrics, and tracing
+// middleware.
+func newRouter(deps routerDeps) http.Handler {
+	cfg, store, logger := deps.Config, deps.Store, deps.Logger
+	ids := idPattern(deps.IDs, cfg.LenientIDs)
+	tracing := cfg.TraceProtocol != ""
+	// Handlers get the store instrumented to trace their calls and, with
+	// multi-tenancy, confined to the request's tenant
+	retailerKey := retailerCanonicalizer(cfg.RetailerCanonicalization)
+	storeFor := func(r *http.Request) Store {
+		s := tracedStore(store, tracing, r)
+		if cfg.MultiTenant {
+			return newTenantStore(s, contextTenant(r.Context()), retailerKey)
+		}
+		return s
+	}
+	var verifier *jwtVerifier
+	if cfg.JWT.JWKSURL != "" {
+		verifier = newJWTVerifier(cfg.JWT.JWKSURL, cfg.JWT.Issuer, cfg.JWT.Audience, deps.Clock)
+	}
+	// Requests are limited by address before they are authenticated, so
+	// that guessing credentials is limited too, and then by the credentials
+	// they authenticated with
+	var addressLimiter, limiter *rateLimiter
+	if cfg.RateLimit > 0 {
+		addressLimiter = newRateLimiter(cfg.RateLimit, cfg.RateLimitBurst, deps.Clock)
+		limiter = newRateLimiter(cfg.RateLimit, cfg.RateLimitBurst, deps.Clock)
+	}
+	// Receipt routes require a bearer token to grant the scope for their
+	// access
+	read := func(handler http.HandlerFunc) http.Handler { return requireScope(handler, scopeReceiptsRead, logger) }
+	write := func(handler http.HandlerFunc) http.Handler { return requireScope(handler, scopeReceiptsWrite, logger) }
+
+	mux := http.NewServeMux()
+
+	// Register endpoint handlers
+	mux.Handle("POST /receipts/process", write(func(w http.ResponseWriter, r *http.Request) {
+		processReceiptHandler(w, r, cfg, storeFor(r), deps.Events, deps.Prometheus, deps.Sampler, deps.IDs, deps.Clock, requestLogger(r, logger))
+	}))
+	mux.Handle("POST /receipts/process/batch", write(func(w http.ResponseWriter, r *http.Request) {
+		processBatchHandler(w, r, cfg, storeFor(r), deps.Events, deps.Prometheus, deps.Sampler, deps.IDs, deps.Clock, requestLogger(r, logger))
+	}))
+	mux.Handle("POST /receipts/score", read(func(w http.ResponseWriter, r *http.Request) {
+		scoreReceiptHandler(w, r, cfg, deps.Sampler, deps.Clock, requestLogger(r, logger))
+	}))
+	mux.Handle("POST /receipts/compare", read(func(w http.ResponseWriter, r *http.Request) {
+		compareReceiptsHandler(w, r, cfg, deps.Clock, requestLogger(r, logger))
+	}))
+	mux.Handle("GET /receipts/{id}", read(func(w http.ResponseWriter, r *http.Request) {
+		getReceiptHandler(w, r, storeFor(r), ids, requestLogger(r, logger))
+	}))
+	mux.Handle("HEAD /receipts/{id}", read(func(w http.ResponseWriter, r *http.Request) {
+		headReceiptHandler(w, r, storeFor(r), ids, requestLogger(r, logger))
+	}))
+	mux.Handle("DELETE /receipts/{id}", write(func(w http.ResponseWriter, r *http.Request) {
+		deleteReceiptHandler(w, r, storeFor(r), ids, deps.Clock, requestLogger(r, logger))
+	}))
+	mux.Handle("POST /receipts/{id}/recalculate", write(func(w http.ResponseWriter, r *http.Request) {
+		recalculateHandler(w, r, cfg, storeFor(r), ids, deps.Clock, requestLogger(r, logger))
+	}))
+	mux.Handle("GET /receipts/{id}/points", read(func(w http.ResponseWriter, r *http.Request) {
+		getPointsHandler(w, r, cfg, storeFor(r), ids, deps.Signer, deps.Clock, requestLogger(r, logger))
+	}))
+	mux.Handle("GET /receipts/{id}/points/breakdown", read(func(w http.ResponseWriter, r *http.Request) {
+		getBreakdownHandler(w, r, cfg, storeFor(r), ids, requestLogger(r, logger))
+	}))
+	mux.Handle("GET /receipts/{id}/rank", read(func(w http.ResponseWriter, r *http.Request) {
+		getRankHandler(w, r, storeFor(r), ids, requestLogger(r, logger))
+	}))
+	mux.Handle("GET /users/{id}/points", read(func(w http.ResponseWriter, r *http.Request) {
+		getUserPointsHandler(w, r, storeFor(r), requestLogger(r, logger))
+	}))
+	mux.Handle("GET /users/{id}/ledger", read(func(w http.ResponseWriter, r *http.Request) {
+		getUserLedgerHandler(w, r, storeFor(r), requestLogger(r, logger))
+	}))
+	mux.Handle("GET /leaderboard", read(func(w http.ResponseWriter, r *http.Request) {
+		leaderboardHandler(w, r, storeFor(r), deps.Clock, requestLogger(r, logger))
+	}))
+	mux.Handle("GET /users/{id}/expirations", read(func(w http.ResponseWriter, r *http.Request) {
+		getUserExpirationsHandler(w, r, storeFor(r), deps.Clock, requestLogger(r, logger))
+	}))
+	mux.Handle("POST /users/{id}/redeem", write(func(w http.ResponseWriter, r *http.Request) {
+		redeemPointsHandler(w, r, cfg, storeFor(r), deps.Clock, requestLogger(r, logger))
+	}))
+	mux.Handle("GET /rules", read(func(w http.ResponseWriter, r *http.Request) {
+		rulesHandler(w, r, cfg, requestLogger(r, logger))
+	}))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		healthzHandler(w, requestLogger(r, logger))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		readyzHandler(w, r, []dependencyCheck{{Name: "store", Check: storeFor(r).Ping}}, requestLogger(r, logger))
+	})
+	mux.Handle("GET /stats/retailers", read(func(w http.ResponseWriter, r *http.Request) {
+		retailerStatsHandler(w, r, storeFor(r), requestLogger(r, logger))
+	}))
+	if deps.Metrics != nil {
+		mux.Handle("GET /metrics", read(func(w http.ResponseWriter, r *http.Request) {
+			metricsHandler(w, r, cfg, store, deps.Metrics, deps.Prometheus, deps.Events, requestLogger(r, logger))
+		}))
+	}
+	if deps.Signer != nil {
+		mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+			jsonResponse(w, http.StatusOK, deps.Signer.JWKS(), requestLogger(r, logger))
+		})
+	}
+
+	// Admin endpoints are only exposed when an admin token is configured
+	if cfg.AdminToken != "" {
+		mux.Handle("POST /admin/purge", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			purgeHandler(w, r, storeFor(r), deps.Clock, requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+
+		mux.Handle("POST /admin/simulate", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			simulateHandler(w, r, cfg, storeFor(r), deps.Clock, requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+
+		mux.Handle("POST /admin/api-keys", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			createAPIKeyHandler(w, r, cfg, storeFor(r), deps.Clock, requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+		mux.Handle("GET /admin/api-keys", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			listAPIKeysHandler(w, storeFor(r), requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+		mux.Handle("POST /admin/api-keys/{id}/rotate", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rotateAPIKeyHandler(w, r, storeFor(r), deps.Clock, requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+		mux.Handle("DELETE /admin/api-keys/{id}", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			revokeAPIKeyHandler(w, r, storeFor(r), deps.Clock, requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+
+		migrations := newMigrator(store, cfg, deps.Clock, cfg.MigrationBatchSize, logger)
+		mux.Handle("POST /admin/migrations", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			startMigrationHandler(w, r, migrations, requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+		mux.Handle("GET /admin/migrations", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			migrationStatusHandler(w, r, migrations, requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+		mux.Handle("DELETE /admin/migrations", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cancelMigrationHandler(w, r, migrations, requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+		// /admin/recompute names the same job for use after a rule change
+		mux.Handle("POST /admin/recompute", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			startMigrationHandler(w, r, migrations, requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+		mux.Handle("GET /admin/recompute", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			migrationStatusHandler(w, r, migrations, requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+		mux.Handle("DELETE /admin/recompute", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cancelMigrationHandler(w, r, migrations, requestLogger(r, logger))
+		}), cfg.AdminToken, logger))
+
+		// Profiling endpoints are opt-in on top of the admin token
+		if cfg.EnablePprof {
+			mux.Handle("GET /debug/pprof/", adminOnly(http.HandlerFunc(pprof.Index), cfg.AdminToken, logger))
+			mux.Handle("GET /debug/pprof/cmdline", adminOnly(http.HandlerFunc(pprof.Cmdline), cfg.AdminToken, logger))
+			mux.Handle("GET /debug/pprof/profile", adminOnly(http.HandlerFunc(pprof.Profile), cfg.AdminToken, logger))
+			mux.Handle("GET /debug/pprof/symbol", adminOnly(http.HandlerFunc(pprof.Symbol), cfg.AdminToken, logger))
+			mux.Handle("POST /debug/pprof/symbol", adminOnly(http.HandlerFunc(pprof.Symbol), cfg.AdminToken, logger))
+			mux.Handle("GET /debug/pprof/trace", adminOnly(http.HandlerFunc(pprof.Trace), cfg.AdminToken, logger))
+		}
+	}
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Receipt Processor API Ready"))
+	})
+
+	// The event stream is long-lived and the export can be large, so both
+	// bypass the request timeout (whose buffering would also defeat their
+	// write deadline changes)
+	root := http.NewServeMux()
+	root.Handle("/", timeoutMiddleware(jsonUnmatched(mux, logger), cfg.RequestTimeout, logger))
+	root.Handle("GET /receipts/stream", read(func(w http.ResponseWriter, r *http.Request) {
+		streamReceiptsHandler(w, r, deps.Events, requestLogger(r, logger))
+	}))
+	root.Handle("GET /receipts", read(func(w http.ResponseWriter, r *http.Request) {
+		listReceiptsHandler(w, r, storeFor(r), cfg.Server.ExportWriteTimeout, requestLogger(r, logger))
+	}))
+
+	// Requests are labelled by the route pattern they match, whichever mux
+	// serves it
+	route := func(r *http.Request) string {
+		if _, pattern := root.Handler(r); pattern != "/" {
+			return pattern
+		}
+		if _, pattern := mux.Handler(r); pattern != "" {
+			return pattern
+		}
+		return "unmatched"
+	}
+	// Preflight responses allow the methods routed for the requested path
+	methods := func(r *http.Request) []string {
+		var allowed []string
+		for _, method := range corsMethods {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			if _, pattern := root.Handler(probe); pattern != "/" && pattern != "" {
+				allowed = append(allowed, method)
+			} else if _, pattern := mux.Handler(probe); pattern != "" {
+				allowed = append(allowed, method)
+			}
+		}
+		return allowed
+	}
+	return tracingMiddleware(deps.Prometheus.instrument(requestIDMiddleware(recoveryMiddleware(corsMiddleware(rateLimitMiddleware(authMiddleware(tenantMiddleware(rateLimitMiddleware(root, limiter, rateLimitClient, logger), cfg.MultiTenant, logger), cfg.APIKeys, store, verifier, cfg.RequireAuth, deps.Clock, logger), addressLimiter, rateLimitAddress, logger), cfg.CORSOrigins, methods), deps.Prometheus, logger)), route), tracing, route)
+}
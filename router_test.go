@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPprofEndpoints(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		token      string
+		wantStatus int
+	}{
+		{name: "off by default", env: map[string]string{"ADMIN_TOKEN": "secret"}, token: "secret", wantStatus: http.StatusNotFound},
+		{name: "enabled without an admin token", env: map[string]string{"ENABLE_PPROF": "true"}, wantStatus: http.StatusNotFound},
+		{name: "enabled, no token presented", env: map[string]string{"ENABLE_PPROF": "true", "ADMIN_TOKEN": "secret"}, wantStatus: http.StatusUnauthorized},
+		{name: "enabled, admin token presented", env: map[string]string{"ENABLE_PPROF": "true", "ADMIN_TOKEN": "secret"}, token: "secret", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{Config: testConfig(t, tt.env)})
+			resp, _ := send(t, srv, http.MethodGet, "/debug/pprof/", "", "Authorization", "Bearer "+tt.token)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestUnmatchedRoutes(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantError  string
+		wantAllow  []string // methods listed in Allow, in any order
+	}{
+		{name: "unknown path", method: http.MethodGet, path: "/nowhere", wantStatus: http.StatusNotFound, wantError: routeNotFoundMsg},
+		{name: "unknown receipt subresource", method: http.MethodGet, path: "/receipts/7fb1377b-b223-49d9-a31a-5a02701dd310/nowhere", wantStatus: http.StatusNotFound, wantError: routeNotFoundMsg},
+		// GET would match GET /receipts/{id} and be answered as an unknown receipt
+		{name: "wrong method on process", method: http.MethodPut, path: "/receipts/process", wantStatus: http.StatusMethodNotAllowed, wantError: methodNotAllowedMsg, wantAllow: []string{http.MethodDelete, http.MethodGet, http.MethodHead, http.MethodPost}},
+		{name: "wrong method on batch", method: http.MethodGet, path: "/receipts/process/batch", wantStatus: http.StatusMethodNotAllowed, wantError: methodNotAllowedMsg, wantAllow: []string{http.MethodPost}},
+		{name: "wrong method on points", method: http.MethodPost, path: "/receipts/7fb1377b-b223-49d9-a31a-5a02701dd310/points", wantStatus: http.StatusMethodNotAllowed, wantError: methodNotAllowedMsg, wantAllow: []string{http.MethodGet, http.MethodHead}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{})
+			resp, body := send(t, srv, tt.method, tt.path, "")
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+				t.Errorf("Content-Type = %q, want JSON", got)
+			}
+			var errResp struct{ Error string }
+			decodeBody(t, body, &errResp)
+			if errResp.Error != tt.wantError {
+				t.Errorf("error = %q, want %q", errResp.Error, tt.wantError)
+			}
+			var allow []string
+			for _, method := range strings.Split(resp.Header.Get("Allow"), ",") {
+				if method = strings.TrimSpace(method); method != "" {
+					allow = append(allow, method)
+				}
+			}
+			slices.Sort(allow)
+			if !slices.Equal(allow, tt.wantAllow) {
+				t.Errorf("Allow = %q, want %q", allow, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestCORSPreflightMethods(t *testing.T) {
+	const origin = "https://dash.example.com"
+	srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"CORS_ALLOWED_ORIGINS": origin})})
+	tests := []struct {
+		path        string
+		wantMethods string
+	}{
+		{path: "/receipts/" + testUUID, wantMethods: "GET, HEAD, DELETE"},
+		// As in its Allow header, /receipts/{id} matches too
+		{path: "/receipts/process", wantMethods: "GET, HEAD, POST, DELETE"},
+		{path: "/receipts/" + testUUID + "/recalculate", wantMethods: "POST"},
+		// Served by the outer mux, outside the request timeout
+		{path: "/receipts", wantMethods: "GET, HEAD"},
+		{path: "/nowhere", wantMethods: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, _ := send(t, srv, http.MethodOptions, tt.path, "", "Origin", origin, "Access-Control-Request-Method", http.MethodDelete)
+			if resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tt.wantMethods)
+			}
+		})
+	}
+}
+
+func TestRateLimitBeforeAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+	}{
+		{name: "wrong API key", headers: []string{"X-API-Key", "guess"}},
+		{name: "a new wrong API key each time"},
+		{name: "no credentials", headers: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"API_KEYS": "secret", "RATE_LIMIT": "1", "RATE_LIMIT_BURST": "3"}
+			clock := newTestClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+			srv := newTestServer(t, routerDeps{Config: testConfig(t, env), Clock: clock})
+			for i := range 4 {
+				headers := tt.headers
+				if headers == nil {
+					headers = []string{"X-API-Key", "guess-" + strconv.Itoa(i)}
+				}
+				resp, body := send(t, srv, http.MethodGet, "/receipts/"+testUUID+"/points", "", headers...)
+				if i < 3 {
+					if resp.StatusCode != http.StatusUnauthorized {
+						t.Fatalf("request %d: status = %d, want %d (body %s)", i+1, resp.StatusCode, http.StatusUnauthorized, body)
+					}
+					continue
+				}
+				if resp.StatusCode != http.StatusTooManyRequests {
+					t.Fatalf("request %d: status = %d, want %d (body %s)", i+1, resp.StatusCode, http.StatusTooManyRequests, body)
+				}
+				if got := resp.Header.Get("Retry-After"); got != "1" {
+					t.Errorf("Retry-After = %q, want %q", got, "1")
+				}
+			}
+		})
+	}
+}
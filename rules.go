@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ClockTime is a time of day as minutes after midnight. It is written as
+// "HH:MM" in rules files and JSON.
+type ClockTime int
+
+func (t ClockTime) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%02d:%02d", int(t)/60, int(t)%60)), nil
+}
+
+func (t *ClockTime) UnmarshalText(text []byte) error {
+	parsed, err := time.Parse("15:04", string(text))
+	if err != nil {
+		return fmt.Errorf("%q is not a time of day (HH:MM)", text)
+	}
+	*t = ClockTime(parsed.Hour()*60 + parsed.Minute())
+	return nil
+}
+
+// loadRulesFile reads the YAML rules file at path over base, so keys the
+// file leaves out keep their base values. Unknown keys are rejected, since a
+// misspelt rule would otherwise be silently ignored.
+func loadRulesFile(path string, base PointsConfig) (PointsConfig, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return PointsConfig{}, err
+	}
+	cfg := base
+	// Decoding into the shared map or slice would modify base
+	cfg.PromotedItems = nil
+	cfg.ItemTiers = nil
+	cfg.CustomRules = nil
+	cfg.Promotions = nil
+	cfg.RetailerOverrides = nil
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return PointsConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.PromotedItems == nil {
+		cfg.PromotedItems = base.PromotedItems
+	}
+	if cfg.ItemTiers == nil {
+		cfg.ItemTiers = base.ItemTiers
+	}
+	if cfg.Promotions == nil {
+		cfg.Promotions = base.Promotions
+	}
+	if cfg.RetailerOverrides == nil {
+		cfg.RetailerOverrides = base.RetailerOverrides
+	}
+	if cfg.CustomRules == nil {
+		cfg.CustomRules = base.CustomRules
+	} else if err := compileCustomRules(cfg.CustomRules); err != nil {
+		return PointsConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := compileBonusScript(&cfg); err != nil {
+		return PointsConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.normalize()
+	if err := cfg.validate(); err != nil {
+		return PointsConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ruleSet is one generation of point rules, as swapped in by reloadRules.
+type ruleSet struct {
+	Name     string // of a named rule set; empty for the active point rules
+	Points   PointsConfig
+	Version  string // ruleVersion(Points)
+	LoadedAt time.Time
+}
+
+// reloadRules rebuilds the point rules from cfg.RulesFile and the POINTS_*
+// variables and makes them active, then rebuilds the named and shadow rules
+// over them. Receipts being scored meanwhile finish under the rules they
+// started with. If any set fails to load, the active one is kept.
+func reloadRules(cfg *Config, clock Clock, logger *slog.Logger) {
+	points, err := loadPointsConfig(cfg.RulesFile)
+	if err != nil {
+		logger.Error("Failed to reload point rules; keeping the active rules",
+			slog.String("rule_version", cfg.rules.Load().Version), slog.Any("error", err))
+		return
+	}
+	previous := cfg.setPoints(points, clock.Now())
+	logger.Info("Point rules reloaded",
+		slog.String("path", cfg.RulesFile),
+		slog.String("previous_rule_version", previous.Version),
+		slog.String("rule_version", cfg.rules.Load().Version))
+
+	if len(cfg.RuleSetFiles) > 0 {
+		sets, err := loadRuleSets(cfg.RuleSetFiles, points)
+		if err != nil {
+			logger.Error("Failed to reload named rule sets; keeping the active rule sets", slog.Any("error", err))
+		} else {
+			cfg.setRuleSets(sets, clock.Now())
+			logger.Info("Named rule sets reloaded", slog.Int("rule_sets", len(sets)))
+		}
+	}
+
+	if cfg.ShadowRulesFile == "" {
+		return
+	}
+	shadow, err := loadShadowRules(cfg.ShadowRulesFile, points)
+	if err != nil {
+		logger.Error("Failed to reload shadow rules; keeping the active shadow rules",
+			slog.String("shadow_rule_version", cfg.shadow.Load().Version), slog.Any("error", err))
+		return
+	}
+	cfg.setShadow(shadow, clock.Now())
+	logger.Info("Shadow rules reloaded",
+		slog.String("path", cfg.ShadowRulesFile),
+		slog.String("shadow_rule_version", cfg.shadow.Load().Version))
+}
+
+// watchRules reloads the point rules on SIGHUP and, if cfg.RulesWatchInterval
+// is set, whenever a rules file's, or a named rule set's file's, size or modification time changes. It
+// returns when ctx is done.
+func watchRules(ctx context.Context, cfg *Config, clock Clock, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if cfg.RulesWatchInterval > 0 {
+		ticker := time.NewTicker(cfg.RulesWatchInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last := rulesFileStamp(cfg.rulesFiles()...)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("Received SIGHUP; reloading point rules")
+			last = rulesFileStamp(cfg.rulesFiles()...)
+			reloadRules(cfg, clock, logger)
+		case <-tick:
+			// A file being rewritten may be seen half-written; the next change reloads it again
+			if stamp := rulesFileStamp(cfg.rulesFiles()...); stamp != last {
+				last = stamp
+				reloadRules(cfg, clock, logger)
+			}
+		}
+	}
+}
+
+// rulesFileStamp identifies a version of the files at paths by their sizes
+// and modification times. Files that are unset or cannot be read count as
+// empty.
+func rulesFileStamp(paths ...string) string {
+	var stamp strings.Builder
+	for _, path := range paths {
+		if info, err := os.Stat(path); path != "" && err == nil {
+			fmt.Fprintf(&stamp, "%d:%d;", info.Size(), info.ModTime().UnixNano())
+		} else {
+			stamp.WriteString("-;")
+		}
+	}
+	return stamp.String()
+}
+
+// Handles GET /rules requests, reporting which point rules are active for the
+// request's tenant.
+func rulesHandler(w http.ResponseWriter, r *http.Request, cfg *Config, logger *slog.Logger) {
+	active := cfg.rulesFor(contextTenant(r.Context()))
+	type RulesResponse struct {
+		RuleSet     string    `json:"ruleSet,omitempty"`
+		RuleVersion string    `json:"ruleVersion"`
+		LoadedAt    time.Time `json:"loadedAt"`
+		Rules       []string  `json:"rules"`
+	}
+	resp := RulesResponse{RuleSet: active.Name, RuleVersion: active.Version, LoadedAt: active.LoadedAt, Rules: []string{}}
+	for _, rule := range pointRules(active.Points) {
+		resp.Rules = append(resp.Rules, rule.Name())
+	}
+	jsonResponse(w, http.StatusOK, resp, logger)
+}
+
+// normalize puts the promoted items and item tiers in the form the scoring
+// code expects: lowercase substrings and tiers ordered by item count.
+func (p *PointsConfig) normalize() {
+	if len(p.PromotedItems) > 0 {
+		promoted := make(map[string]int64, len(p.PromotedItems))
+		for substring, points := range p.PromotedItems {
+			promoted[strings.ToLower(strings.TrimSpace(substring))] = points
+		}
+		p.PromotedItems = promoted
+	}
+	p.ItemTiers = slices.Clone(p.ItemTiers)
+	slices.SortFunc(p.ItemTiers, func(a, b ItemTier) int { return a.MinItems - b.MinItems })
+}
+
+// validate reports the first setting that cannot be scored with.
+func (p PointsConfig) validate() error {
+	switch p.OddDayBonusParity {
+	case dayParityOdd, dayParityEven, dayParityOff:
+	default:
+		return fmt.Errorf("oddDayBonusParity must be one of odd, even, off")
+	}
+	if p.DescriptionMultiple < 1 {
+		return fmt.Errorf("descriptionMultiple must be at least 1")
+	}
+	if p.DescriptionRate < 0 {
+		return fmt.Errorf("descriptionRate must not be negative")
+	}
+	if p.AfternoonStart < 0 || p.AfternoonEnd > 24*60 || p.AfternoonStart >= p.AfternoonEnd {
+		return fmt.Errorf("afternoonStart must be before afternoonEnd")
+	}
+	if p.FreshnessWindow < 0 {
+		return fmt.Errorf("freshnessWindow must not be negative")
+	}
+	for _, name := range p.DisabledRules {
+		if !p.hasRule(name) {
+			return fmt.Errorf("disabledRules: unknown rule %q", name)
+		}
+	}
+	if err := validatePromotions(p.Promotions); err != nil {
+		return err
+	}
+	if err := validateRetailerOverrides(p); err != nil {
+		return err
+	}
+	for substring := range p.PromotedItems {
+		if substring == "" {
+			return fmt.Errorf("promotedItems must not contain an empty description")
+		}
+	}
+	for i, tier := range p.ItemTiers {
+		if tier.MinItems < 1 {
+			return fmt.Errorf("itemTiers minItems must be at least 1")
+		}
+		if i > 0 && tier.MinItems == p.ItemTiers[i-1].MinItems {
+			return fmt.Errorf("itemTiers has more than one tier for %d items", tier.MinItems)
+		}
+	}
+	return nil
+}
+
+// Rule is one named contribution to a receipt's points.
+type Rule interface {
+	Name() string
+	Apply(data *ValidatedReceiptData) int64
+}
+
+// floatEpsilon absorbs float rounding when testing totals for whole dollars
+// and quarters.
+const floatEpsilon = 0.0000001
+
+// allPointRules returns every rule configured by cfg, in rule order,
+// whether enabled or not. Custom rules follow the built-in ones, and the
+// bonus script comes last.
+func allPointRules(cfg PointsConfig) []Rule {
+	rules := []Rule{
+		retailerNameRule{points: cfg.RetailerCharPoints},
+		roundDollarRule{bonus: cfg.RoundDollarBonus},
+		quarterMultipleRule{
+			bonus: cfg.QuarterBonus,
+			// Only when Rule 2 can award anything
+			excludeRound: cfg.RoundDollarExcludesQuarter && cfg.RoundDollarBonus > 0 && !slices.Contains(cfg.DisabledRules, ruleRoundDollar),
+		},
+		itemPairsRule{points: cfg.ItemPairPoints},
+		descriptionRule{multiple: cfg.DescriptionMultiple, rate: cfg.DescriptionRate},
+		purchaseDayRule{parity: cfg.OddDayBonusParity, bonus: cfg.OddDayBonus},
+		purchaseTimeRule{start: cfg.AfternoonStart, end: cfg.AfternoonEnd, bonus: cfg.AfternoonBonus},
+		flagRule{name: rulePaperless, bonus: cfg.PaperlessBonus, flag: func(d *ValidatedReceiptData) bool { return d.Paperless }},
+		flagRule{name: ruleNoBag, bonus: cfg.NoBagBonus, flag: func(d *ValidatedReceiptData) bool { return d.NoBag }},
+		flagRule{name: ruleStreak, bonus: cfg.StreakBonus, flag: func(d *ValidatedReceiptData) bool { return d.ConsecutiveDay }},
+		freshnessRule{bonus: cfg.FreshnessBonus, window: cfg.FreshnessWindow},
+		promotedItemsRule{promotions: cfg.PromotedItems},
+		flagRule{name: ruleFirstOfDay, bonus: cfg.FirstOfDayBonus, flag: func(d *ValidatedReceiptData) bool { return d.FirstOfDay }},
+		itemTierRule{tiers: cfg.ItemTiers, cumulative: cfg.ItemTiersCumulative},
+	}
+	for _, custom := range cfg.CustomRules {
+		rules = append(rules, celRule{name: custom.Name, program: custom.program})
+	}
+	if cfg.script != nil {
+		rules = append(rules, scriptRule{script: cfg.script})
+	}
+	return rules
+}
+
+// pointRules returns the rules cfg enables, in rule order.
+func pointRules(cfg PointsConfig) []Rule {
+	rules := allPointRules(cfg)
+	if len(cfg.DisabledRules) == 0 {
+		return rules
+	}
+	return slices.DeleteFunc(rules, func(r Rule) bool { return slices.Contains(cfg.DisabledRules, r.Name()) })
+}
+
+// isBuiltinRule reports whether name is the name of a built-in rule.
+func isBuiltinRule(name string) bool {
+	return defaultPointsConfig().hasRule(name)
+}
+
+// hasRule reports whether name is the name of a built-in rule or one of p's
+// custom rules.
+func (p PointsConfig) hasRule(name string) bool {
+	return slices.ContainsFunc(allPointRules(p), func(r Rule) bool { return r.Name() == name })
+}
+
+// Rule 1: Alphanumeric characters in retailer name
+type retailerNameRule struct{ points int64 }
+
+func (retailerNameRule) Name() string { return ruleRetailerName }
+
+func (r retailerNameRule) Apply(data *ValidatedReceiptData) int64 {
+	var count int64
+	for _, c := range data.Retailer {
+		if alphanumericCheck(c) {
+			count++
+		}
+	}
+	return count * r.points
+}
+
+// Rule 2: Round dollar total
+type roundDollarRule struct{ bonus int64 }
+
+func (roundDollarRule) Name() string { return ruleRoundDollar }
+
+func (r roundDollarRule) Apply(data *ValidatedReceiptData) int64 {
+	if isRoundDollar(data.Total) {
+		return r.bonus
+	}
+	return 0
+}
+
+func isRoundDollar(total float64) bool {
+	return math.Abs(total-math.Trunc(total)) < floatEpsilon && total > 0
+}
+
+// Rule 3: Total is a multiple of 0.25, optionally skipped when Rule 2 applies
+type quarterMultipleRule struct {
+	bonus        int64
+	excludeRound bool
+}
+
+func (quarterMultipleRule) Name() string { return ruleQuarterMultiple }
+
+func (r quarterMultipleRule) Apply(data *ValidatedReceiptData) int64 {
+	if r.excludeRound && isRoundDollar(data.Total) {
+		return 0
+	}
+	if math.Abs(math.Mod(data.Total, 0.25)) < floatEpsilon || math.Abs(math.Mod(data.Total, 0.25)-0.25) < floatEpsilon {
+		return r.bonus
+	}
+	return 0
+}
+
+// Rule 4: Points per two items
+type itemPairsRule struct{ points int64 }
+
+func (itemPairsRule) Name() string { return ruleItemPairs }
+
+func (r itemPairsRule) Apply(data *ValidatedReceiptData) int64 {
+	return int64(data.OriginalItems/2) * r.points
+}
+
+// Rule 5: Item description length a multiple of multiple
+type descriptionRule struct {
+	multiple int
+	rate     float64
+}
+
+func (descriptionRule) Name() string { return ruleDescription }
+
+func (r descriptionRule) Apply(data *ValidatedReceiptData) int64 {
+	var points int64
+	for _, item := range data.Items {
+		trimmedDesc := strings.TrimSpace(item.ShortDescription)
+		// Discount lines (negative prices) neither earn nor cost points here
+		if item.PriceCents > 0 && len(trimmedDesc) > 0 && len(trimmedDesc)%r.multiple == 0 {
+			points += int64(math.Ceil(item.Price * r.rate))
+		}
+	}
+	return points
+}
+
+// Rule 6: Odd (or, if configured, even) purchase day
+type purchaseDayRule struct {
+	parity string
+	bonus  int64
+}
+
+func (purchaseDayRule) Name() string { return rulePurchaseDay }
+
+func (r purchaseDayRule) Apply(data *ValidatedReceiptData) int64 {
+	oddDay := data.PurchaseDate.Day()%2 != 0
+	if (r.parity == dayParityOdd && oddDay) || (r.parity == dayParityEven && !oddDay) {
+		return r.bonus
+	}
+	return 0
+}
+
+// Rule 7: Purchase time inside the afternoon window (exclusive interval)
+type purchaseTimeRule struct {
+	start, end ClockTime
+	bonus      int64
+}
+
+func (purchaseTimeRule) Name() string { return rulePurchaseTime }
+
+func (r purchaseTimeRule) Apply(data *ValidatedReceiptData) int64 {
+	// Scores nothing when the time was unusable under PARTIAL_SCORING
+	if data.NoPurchaseTime {
+		return 0
+	}
+	minutes := ClockTime(data.PurchaseTime.Hour()*60 + data.PurchaseTime.Minute())
+	if minutes > r.start && minutes < r.end {
+		return r.bonus
+	}
+	return 0
+}
+
+// flagRule awards bonus to receipts for which flag holds: the green
+// bonuses, the customer streak, and the retailer's first receipt of the day.
+type flagRule struct {
+	name  string
+	bonus int64
+	flag  func(*ValidatedReceiptData) bool
+}
+
+func (r flagRule) Name() string { return r.name }
+
+func (r flagRule) Apply(data *ValidatedReceiptData) int64 {
+	if r.flag(data) {
+		return r.bonus
+	}
+	return 0
+}
+
+// Freshness bonus for receipts submitted soon after the purchase
+type freshnessRule struct {
+	bonus  int64
+	window time.Duration
+}
+
+func (freshnessRule) Name() string { return ruleFreshness }
+
+func (r freshnessRule) Apply(data *ValidatedReceiptData) int64 {
+	if r.window <= 0 || data.ProcessedAt.IsZero() || data.NoPurchaseTime {
+		return 0
+	}
+	age := data.ProcessedAt.Sub(data.PurchasedAt())
+	if age >= 0 && age <= r.window {
+		return r.bonus
+	}
+	return 0
+}
+
+// Bonus per item matching a promoted description
+type promotedItemsRule struct{ promotions map[string]int64 }
+
+func (promotedItemsRule) Name() string { return rulePromoted }
+
+func (r promotedItemsRule) Apply(data *ValidatedReceiptData) int64 {
+	var points int64
+	if len(r.promotions) > 0 {
+		for _, item := range data.Items {
+			points += promotedItemBonus(item.ShortDescription, r.promotions)
+		}
+	}
+	return points
+}
+
+// Escalating bonus for larger baskets, counted like Rule 4
+type itemTierRule struct {
+	tiers      []ItemTier
+	cumulative bool
+}
+
+func (itemTierRule) Name() string { return ruleItemTier }
+
+func (r itemTierRule) Apply(data *ValidatedReceiptData) int64 {
+	return itemTierBonus(data.OriginalItems, r.tiers, r.cumulative)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalculatePointsExamples(t *testing.T) {
+	cornerMarket := Receipt{
+		Retailer:     "M&M Corner Market",
+		PurchaseDate: "2022-03-20",
+		PurchaseTime: "14:33",
+		Items: []Item{
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+		},
+		Total: "9.00",
+	}
+	tests := []struct {
+		name    string
+		receipt Receipt
+		want    int64
+	}{
+		{name: "Target", receipt: testReceipt(), want: 28},
+		{name: "M&M Corner Market", receipt: cornerMarket, want: 109},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := validateAndParseReceipt(&tt.receipt, ValidationConfig{})
+			if err != nil {
+				t.Fatalf("validateAndParseReceipt: %v", err)
+			}
+			if got := calculatePoints(data, defaultPointsConfig()); got != tt.want {
+				t.Errorf("calculatePoints = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurchaseDayParity(t *testing.T) {
+	tests := []struct {
+		name   string
+		parity string
+		bonus  int64
+		date   string
+		want   int64
+	}{
+		{name: "odd day, odd parity", parity: dayParityOdd, bonus: 6, date: "2022-01-01", want: 6},
+		{name: "even day, odd parity", parity: dayParityOdd, bonus: 6, date: "2022-01-02", want: 0},
+		{name: "odd day, even parity", parity: dayParityEven, bonus: 6, date: "2022-01-01", want: 0},
+		{name: "even day, even parity", parity: dayParityEven, bonus: 6, date: "2022-01-02", want: 6},
+		{name: "configured bonus", parity: dayParityEven, bonus: 15, date: "2022-01-02", want: 15},
+		{name: "odd day, off", parity: dayParityOff, bonus: 6, date: "2022-01-01", want: 0},
+		{name: "even day, off", parity: dayParityOff, bonus: 6, date: "2022-01-02", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.PurchaseDate = tt.date
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{})
+			if err != nil {
+				t.Fatalf("validateAndParseReceipt: %v", err)
+			}
+			points := defaultPointsConfig()
+			points.OddDayBonusParity, points.OddDayBonus = tt.parity, tt.bonus
+			if got, _ := rulePoints(calculatePointsBreakdown(data, points), rulePurchaseDay); got != tt.want {
+				t.Errorf("%s = %d, want %d", rulePurchaseDay, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPointsConfigDayParity(t *testing.T) {
+	tests := []struct {
+		parity  string
+		want    string
+		wantErr bool
+	}{
+		{parity: "", want: dayParityOdd},
+		{parity: "even", want: dayParityEven},
+		{parity: "off", want: dayParityOff},
+		{parity: "weekdays", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.parity, func(t *testing.T) {
+			t.Setenv("POINTS_DAY_PARITY", tt.parity)
+			points, err := loadPointsConfig("")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadPointsConfig accepted POINTS_DAY_PARITY=%q", tt.parity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadPointsConfig: %v", err)
+			}
+			if points.OddDayBonusParity != tt.want {
+				t.Errorf("OddDayBonusParity = %q, want %q", points.OddDayBonusParity, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkCalculatePoints(b *testing.B) {
+	promoted := defaultPointsConfig()
+	promoted.PromotedItems = map[string]int64{"item": 1, "number 1": 5}
+	promoted.ItemTiers = []ItemTier{{MinItems: 10, Bonus: 10}, {MinItems: 50, Bonus: 25}}
+	rules := []struct {
+		name   string
+		points PointsConfig
+	}{
+		{name: "default rules", points: defaultPointsConfig()},
+		{name: "promotions and tiers", points: promoted},
+	}
+	for _, bm := range benchmarkReceipts() {
+		data, err := validateAndParseReceipt(&bm.receipt, ValidationConfig{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, r := range rules {
+			b.Run(bm.name+"/"+r.name, func(b *testing.B) {
+				for b.Loop() {
+					calculatePoints(data, r.points)
+				}
+			})
+		}
+	}
+}
+
+func TestGreenBonuses(t *testing.T) {
+	tests := []struct {
+		name           string
+		paperless      bool
+		noBag          bool
+		paperlessBonus int64
+		noBagBonus     int64
+		wantPaperless  int64
+		wantNoBag      int64
+	}{
+		{name: "flags unset", paperlessBonus: 5, noBagBonus: 3},
+		{name: "paperless set", paperless: true, paperlessBonus: 5, noBagBonus: 3, wantPaperless: 5},
+		{name: "noBag set", noBag: true, paperlessBonus: 5, noBagBonus: 3, wantNoBag: 3},
+		{name: "both set", paperless: true, noBag: true, paperlessBonus: 5, noBagBonus: 3, wantPaperless: 5, wantNoBag: 3},
+		{name: "set but off by default", paperless: true, noBag: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.Paperless, receipt.NoBag = tt.paperless, tt.noBag
+			// The flags are not items, so the strict total is unaffected
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{StrictTotal: true})
+			if err != nil {
+				t.Fatalf("validateAndParseReceipt: %v", err)
+			}
+			points := defaultPointsConfig()
+			points.PaperlessBonus, points.NoBagBonus = tt.paperlessBonus, tt.noBagBonus
+			breakdown := calculatePointsBreakdown(data, points)
+			if got, _ := rulePoints(breakdown, rulePaperless); got != tt.wantPaperless {
+				t.Errorf("%s = %d, want %d", rulePaperless, got, tt.wantPaperless)
+			}
+			if got, _ := rulePoints(breakdown, ruleNoBag); got != tt.wantNoBag {
+				t.Errorf("%s = %d, want %d", ruleNoBag, got, tt.wantNoBag)
+			}
+			if got, want := sumBreakdown(breakdown), 28+tt.wantPaperless+tt.wantNoBag; got != want {
+				t.Errorf("points = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestFreshnessBonus(t *testing.T) {
+	purchased := time.Date(2022, 1, 1, 13, 1, 0, 0, time.UTC) // testReceipt's
+	tests := []struct {
+		name      string
+		processed time.Time
+		window    time.Duration
+		noTime    bool // the purchase time was missing, as lenient validation allows
+		want      int64
+	}{
+		{name: "fresh", processed: purchased.Add(time.Hour), window: 24 * time.Hour, want: 5},
+		{name: "at the window's end", processed: purchased.Add(24 * time.Hour), window: 24 * time.Hour, want: 5},
+		{name: "stale", processed: purchased.Add(24*time.Hour + time.Minute), window: 24 * time.Hour},
+		{name: "purchase time counts", processed: time.Date(2022, 1, 2, 13, 0, 0, 0, time.UTC), window: 24 * time.Hour, want: 5},
+		{name: "processed before the purchase", processed: purchased.Add(-time.Minute), window: 24 * time.Hour},
+		{name: "disabled", processed: purchased.Add(time.Hour)},
+		{name: "no purchase time", processed: purchased.Add(time.Hour), window: 24 * time.Hour, noTime: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{})
+			if err != nil {
+				t.Fatalf("validateAndParseReceipt: %v", err)
+			}
+			data.ProcessedAt, data.NoPurchaseTime = tt.processed, tt.noTime
+			points := defaultPointsConfig()
+			points.FreshnessBonus, points.FreshnessWindow = 5, tt.window
+			if got, _ := rulePoints(calculatePointsBreakdown(data, points), ruleFreshness); got != tt.want {
+				t.Errorf("%s = %d, want %d", ruleFreshness, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromotedItems(t *testing.T) {
+	tests := []struct {
+		name       string
+		promotions string // as POINTS_PROMOTED_ITEMS
+		items      []string
+		want       int64
+	}{
+		{name: "disabled", items: []string{"Diet Cola"}},
+		{name: "matching item", promotions: "cola:5", items: []string{"Cherry Cola 12PK"}, want: 5},
+		{name: "ignores case", promotions: "COLA:5", items: []string{"cherry cola"}, want: 5},
+		{name: "non-matching item", promotions: "cola:5", items: []string{"Doritos"}},
+		{name: "each matching item", promotions: "cola:5", items: []string{"Cola", "Doritos", "Diet Cola"}, want: 10},
+		{name: "longest pattern wins", promotions: "cola:5,diet cola:10", items: []string{"Diet Cola"}, want: 10},
+		{name: "longest pattern wins over a larger bonus", promotions: "cola:50,diet cola:10", items: []string{"Diet Cola"}, want: 10},
+		{name: "equal lengths take the larger bonus", promotions: "diet:3,cola:7", items: []string{"Diet Cola"}, want: 7},
+		{name: "shorter pattern elsewhere", promotions: "cola:5,diet cola:10", items: []string{"Diet Cola", "Cola"}, want: 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("POINTS_PROMOTED_ITEMS", tt.promotions)
+			points, err := loadPointsConfig("")
+			if err != nil {
+				t.Fatalf("loadPointsConfig: %v", err)
+			}
+			receipt := testReceipt()
+			receipt.Items = nil
+			for _, description := range tt.items {
+				receipt.Items = append(receipt.Items, Item{ShortDescription: description, Price: "1.00"})
+			}
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{})
+			if err != nil {
+				t.Fatalf("validateAndParseReceipt: %v", err)
+			}
+			if got, _ := rulePoints(calculatePointsBreakdown(data, points), rulePromoted); got != tt.want {
+				t.Errorf("%s = %d, want %d", rulePromoted, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundDollarExcludesQuarter(t *testing.T) {
+	tests := []struct {
+		name        string
+		total       string
+		excludes    bool
+		roundOff    bool // no round-dollar bonus configured
+		wantRound   int64
+		wantQuarter int64
+	}{
+		{name: "$5.00, both bonuses", total: "5.00", wantRound: 50, wantQuarter: 25},
+		{name: "$5.00, exclusive", total: "5.00", excludes: true, wantRound: 50},
+		{name: "$5.25, both bonuses", total: "5.25", wantQuarter: 25},
+		{name: "$5.25, exclusive", total: "5.25", excludes: true, wantQuarter: 25},
+		{name: "$5.10, exclusive", total: "5.10", excludes: true},
+		// With no round-dollar bonus to award, the quarter bonus stays
+		{name: "$5.00, exclusive, round-dollar bonus off", total: "5.00", excludes: true, roundOff: true, wantQuarter: 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := Receipt{Retailer: "Target", PurchaseDate: "2022-01-02", PurchaseTime: "10:00", Items: []Item{{ShortDescription: "Widget", Price: tt.total}}, Total: tt.total}
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{})
+			if err != nil {
+				t.Fatalf("validateAndParseReceipt: %v", err)
+			}
+			points := defaultPointsConfig()
+			points.RoundDollarExcludesQuarter = tt.excludes
+			if tt.roundOff {
+				points.RoundDollarBonus = 0
+			}
+			breakdown := calculatePointsBreakdown(data, points)
+			if got, _ := rulePoints(breakdown, ruleRoundDollar); got != tt.wantRound {
+				t.Errorf("%s = %d, want %d", ruleRoundDollar, got, tt.wantRound)
+			}
+			if got, _ := rulePoints(breakdown, ruleQuarterMultiple); got != tt.wantQuarter {
+				t.Errorf("%s = %d, want %d", ruleQuarterMultiple, got, tt.wantQuarter)
+			}
+		})
+	}
+}
+
+func TestItemTiers(t *testing.T) {
+	const tiers = "5:10,10:25"
+	tests := []struct {
+		name       string
+		tiers      string // as POINTS_ITEM_TIERS
+		cumulative string
+		items      int
+		want       int64
+	}{
+		{name: "disabled", items: 10},
+		{name: "below the first tier", tiers: tiers, items: 4},
+		{name: "at the first tier", tiers: tiers, items: 5, want: 10},
+		{name: "just below the second tier", tiers: tiers, items: 9, want: 10},
+		{name: "at the second tier", tiers: tiers, items: 10, want: 25},
+		{name: "above the last tier", tiers: tiers, items: 11, want: 25},
+		{name: "listed out of order", tiers: "10:25,5:10", items: 9, want: 10},
+		{name: "cumulative, below the first tier", tiers: tiers, cumulative: "true", items: 4},
+		{name: "cumulative, at the first tier", tiers: tiers, cumulative: "true", items: 5, want: 10},
+		{name: "cumulative, just below the second tier", tiers: tiers, cumulative: "true", items: 9, want: 10},
+		{name: "cumulative, at the second tier", tiers: tiers, cumulative: "true", items: 10, want: 35},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("POINTS_ITEM_TIERS", tt.tiers)
+			t.Setenv("POINTS_ITEM_TIERS_CUMULATIVE", tt.cumulative)
+			points, err := loadPointsConfig("")
+			if err != nil {
+				t.Fatalf("loadPointsConfig: %v", err)
+			}
+			// One line per item but the last, which takes a quantity for the rest
+			receipt := testReceipt()
+			receipt.Items = []Item{{ShortDescription: "Soda", Price: "1.00"}}
+			if rest := tt.items - 1; rest > 0 {
+				receipt.Items = append(receipt.Items, Item{ShortDescription: "Chips", Price: "1.00", Quantity: &rest})
+			}
+			data, err := validateAndParseReceipt(&receipt, ValidationConfig{})
+			if err != nil {
+				t.Fatalf("validateAndParseReceipt: %v", err)
+			}
+			if got, _ := rulePoints(calculatePointsBreakdown(data, points), ruleItemTier); got != tt.want {
+				t.Errorf("%s = %d, want %d", ruleItemTier, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadItemTiersInvalid(t *testing.T) {
+	for _, tiers := range []string{"5", "five:10", "0:10", "5:ten", "5:10,5:20"} {
+		t.Run(tiers, func(t *testing.T) {
+			t.Setenv("POINTS_ITEM_TIERS", tiers)
+			if _, err := loadPointsConfig(""); err == nil {
+				t.Errorf("loadPointsConfig accepted POINTS_ITEM_TIERS=%q", tiers)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// loadRuleSets reads each named rule set's file over live, so a file only
+// needs the settings in which its partner program differs.
+func loadRuleSets(files map[string]string, live PointsConfig) (map[string]PointsConfig, error) {
+	sets := make(map[string]PointsConfig, len(files))
+	for name, path := range files {
+		points, err := loadRulesFile(path, live)
+		if err != nil {
+			return nil, fmt.Errorf("RULE_SETS: rule set %q: %w", name, err)
+		}
+		sets[name] = points
+	}
+	return sets, nil
+}
+
+// setRuleSets makes sets the named rule sets.
+func (c *Config) setRuleSets(sets map[string]PointsConfig, at time.Time) {
+	named := make(map[string]*ruleSet, len(sets))
+	for name, p := range sets {
+		named[name] = &ruleSet{Name: name, Points: p, Version: ruleVersion(p), LoadedAt: at}
+	}
+	c.named.Store(&named)
+}
+
+// rulesFiles returns the paths of every rules file watchRules reloads: the
+// point and shadow rules files, then the named rule sets' files.
+func (c *Config) rulesFiles() []string {
+	return append([]string{c.RulesFile, c.ShadowRulesFile}, slices.Sorted(maps.Values(c.RuleSetFiles))...)
+}
+
+// rulesFor returns the rule set tenant's receipts are scored under: the
+// named rule set it is assigned, or else the active point rules.
+func (c *Config) rulesFor(tenant string) *ruleSet {
+	return c.ruleSnapshot()(tenant)
+}
+
+// pointsFor returns the point rules of rulesFor(tenant).
+func (c *Config) pointsFor(tenant string) PointsConfig {
+	return c.rulesFor(tenant).Points
+}
+
+// ruleSnapshot returns a lookup of each tenant's rule set, as rulesFor, that
+// keeps using the rule sets active now even if they are reloaded meanwhile.
+func (c *Config) ruleSnapshot() func(tenant string) *ruleSet {
+	live := c.rules.Load()
+	var named map[string]*ruleSet
+	if p := c.named.Load(); p != nil {
+		named = *p
+	}
+	return func(tenant string) *ruleSet {
+		if set, ok := named[c.TenantRuleSets[tenantLabel(tenant)]]; ok {
+			return set
+		}
+		return live
+	}
+}
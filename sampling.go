@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// payloadSampler captures the raw bodies of a random fraction of processed
+// receipts for debugging. Unlike the structured request logs it keeps the
+// payload exactly as sent, minus the configured redacted fields.
+type payloadSampler struct {
+	rate   float64         // fraction of requests to capture, 0 to 1
+	redact map[string]bool // JSON keys whose values are replaced, at any depth
+	random func() float64  // source of the sampling decision
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// redactedValue replaces the value of every redacted field.
+const redactedValue = "[REDACTED]"
+
+// newPayloadSampler returns a sampler writing JSON lines to out.
+func newPayloadSampler(rate float64, redactFields []string, out io.Writer) *payloadSampler {
+	redact := make(map[string]bool, len(redactFields))
+	for _, f := range redactFields {
+		redact[f] = true
+	}
+	return &payloadSampler{rate: rate, redact: redact, random: rand.Float64, out: out}
+}
+
+// Sample decides whether the current request should be captured.
+func (p *payloadSampler) Sample() bool {
+	return p != nil && p.rate > 0 && p.random() < p.rate
+}
+
+// Record writes a redacted copy of body to the sink. Bodies that are not
+// valid JSON cannot be redacted reliably, so only their size is kept.
+func (p *payloadSampler) Record(path string, body []byte) error {
+	type SampledPayload struct {
+		Time        time.Time `json:"time"`
+		Path        string    `json:"path"`
+		Size        int       `json:"size"`
+		Body        any       `json:"body,omitempty"`
+		Unparseable bool      `json:"unparseable,omitempty"`
+	}
+
+	entry := SampledPayload{Time: time.Now().UTC(), Path: path, Size: len(body)}
+	var parsed any
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		entry.Unparseable = true
+	} else {
+		entry.Body = p.redactValue(parsed)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err = p.out.Write(append(line, '\n'))
+	return err
+}
+
+// redactValue walks a decoded JSON value, replacing redacted fields.
+func (p *payloadSampler) redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if p.redact[k] {
+				v[k] = redactedValue
+			} else {
+				v[k] = p.redactValue(child)
+			}
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = p.redactValue(child)
+		}
+	}
+	return v
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPayloadSamplerGate(t *testing.T) {
+	tests := []struct {
+		name   string
+		rate   float64
+		random float64 // the draw
+		want   bool
+	}{
+		{name: "disabled", rate: 0, random: 0, want: false},
+		{name: "draw below the rate", rate: 0.001, random: 0.0005, want: true},
+		{name: "draw at the rate", rate: 0.001, random: 0.001, want: false},
+		{name: "draw above the rate", rate: 0.001, random: 0.5, want: false},
+		{name: "every request", rate: 1, random: 0.999, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sampler := newPayloadSampler(tt.rate, nil, &bytes.Buffer{})
+			sampler.random = func() float64 { return tt.random }
+			if got := sampler.Sample(); got != tt.want {
+				t.Errorf("Sample = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	var none *payloadSampler
+	if none.Sample() {
+		t.Error("a nil sampler sampled a request")
+	}
+}
+
+func TestPayloadSamplerRedaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		redact    []string
+		body      string
+		wantBody  string // as re-encoded, keys sorted
+		wantParse bool   // whether the body could be parsed
+	}{
+		{name: "nothing redacted", body: `{"retailer":"Target","total":"35.35"}`, wantBody: `{"retailer":"Target","total":"35.35"}`, wantParse: true},
+		{name: "top-level field", redact: []string{"customerId"}, body: `{"customerId":"alice","total":"35.35"}`, wantBody: `{"customerId":"[REDACTED]","total":"35.35"}`, wantParse: true},
+		{name: "in every item", redact: []string{"shortDescription"}, body: `{"items":[{"price":"1.00","shortDescription":"Pills"},{"price":"2.00","shortDescription":"Gum"}]}`, wantBody: `{"items":[{"price":"1.00","shortDescription":"[REDACTED]"},{"price":"2.00","shortDescription":"[REDACTED]"}]}`, wantParse: true},
+		{name: "whole object", redact: []string{"items"}, body: `{"items":[{"price":"1.00"}],"total":"1.00"}`, wantBody: `{"items":"[REDACTED]","total":"1.00"}`, wantParse: true},
+		{name: "invalid JSON kept out", redact: []string{"customerId"}, body: `{"customerId":"alice"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			sampler := newPayloadSampler(1, tt.redact, &out)
+			if err := sampler.Record("/receipts/process", []byte(tt.body)); err != nil {
+				t.Fatalf("Record: %v", err)
+			}
+			var entry struct {
+				Path        string
+				Size        int
+				Body        json.RawMessage
+				Unparseable bool
+			}
+			decodeBody(t, out.String(), &entry)
+			if entry.Path != "/receipts/process" || entry.Size != len(tt.body) {
+				t.Errorf("path %q, size %d; want /receipts/process, %d", entry.Path, entry.Size, len(tt.body))
+			}
+			if entry.Unparseable == tt.wantParse {
+				t.Errorf("unparseable = %v, want %v", entry.Unparseable, !tt.wantParse)
+			}
+			if string(entry.Body) != tt.wantBody {
+				t.Errorf("body = %s, want %s", entry.Body, tt.wantBody)
+			}
+			if !tt.wantParse && strings.Contains(out.String(), "alice") {
+				t.Errorf("unparseable body leaked into the sample: %s", out.String())
+			}
+		})
+	}
+}
+
+func TestProcessSampled(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate        float64
+		body        func(t *testing.T) string
+		wantStatus  int
+		wantSamples int
+	}{
+		{name: "sampled", rate: 1, body: func(t *testing.T) string { return mustJSON(t, testReceipt()) }, wantStatus: http.StatusOK, wantSamples: 1},
+		{name: "not sampled", rate: 0, body: func(t *testing.T) string { return mustJSON(t, testReceipt()) }, wantStatus: http.StatusOK},
+		// Buffering for the sample still honors MAX_BODY_BYTES
+		{name: "sampled but too large", rate: 1, body: func(*testing.T) string { return `{"retailer":"` + strings.Repeat("a", 2048) + `"}` }, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			sampler := newPayloadSampler(tt.rate, []string{"retailer"}, &out)
+			cfg := testConfig(t, map[string]string{"MAX_BODY_BYTES": "1024"})
+			srv := newTestServer(t, routerDeps{Config: cfg, Sampler: sampler})
+			resp, body := send(t, srv, http.MethodPost, "/receipts/process", tt.body(t))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if samples := strings.Count(out.String(), "\n"); samples != tt.wantSamples {
+				t.Fatalf("%d samples recorded, want %d: %s", samples, tt.wantSamples, out.String())
+			}
+			if tt.wantSamples > 0 && (strings.Contains(out.String(), "Target") || !strings.Contains(out.String(), redactedValue)) {
+				t.Errorf("retailer not redacted: %s", out.String())
+			}
+		})
+	}
+}
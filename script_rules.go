@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// ruleBonusScript names the rule that runs PointsConfig.BonusScript.
+const ruleBonusScript = "bonus_script"
+
+// bonusScriptTimeout bounds one call of the script's bonus function.
+const bonusScriptTimeout = 100 * time.Millisecond
+
+// bonusScript is a compiled Lua bonus script. Lua states are not safe for
+// concurrent use, so each call borrows one from a pool; globals a script sets
+// may therefore persist between some calls but not others.
+type bonusScript struct {
+	source string
+	proto  *lua.FunctionProto
+	states sync.Pool // of *lua.LState with the script loaded
+}
+
+// compileBonusScript compiles p.BonusScript, if it is set and has changed,
+// and checks that it defines a bonus function.
+func compileBonusScript(p *PointsConfig) error {
+	if p.BonusScript == "" {
+		p.script = nil
+		return nil
+	}
+	if p.script != nil && p.script.source == p.BonusScript {
+		return nil
+	}
+	chunk, err := parse.Parse(strings.NewReader(p.BonusScript), ruleBonusScript)
+	if err != nil {
+		return fmt.Errorf("bonusScript: %w", err)
+	}
+	proto, err := lua.Compile(chunk, ruleBonusScript)
+	if err != nil {
+		return fmt.Errorf("bonusScript: %w", err)
+	}
+	script := &bonusScript{source: p.BonusScript, proto: proto}
+	L, err := script.newState()
+	if err != nil {
+		return fmt.Errorf("bonusScript: %w", err)
+	}
+	script.states.Put(L)
+	p.script = script
+	return nil
+}
+
+// newState returns a sandboxed Lua state, without file, OS, or module
+// access, in which the script has been run.
+func (s *bonusScript) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bonusScriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	if L.GetGlobal("bonus").Type() != lua.LTFunction {
+		L.Close()
+		return nil, errors.New("script must define a function bonus(receipt)")
+	}
+	return L, nil
+}
+
+// call runs the script's bonus function for data. Lua errors, Go panics,
+// timeouts, and results that are not integers are all returned as errors.
+func (s *bonusScript) call(data *ValidatedReceiptData) (points int64, err error) {
+	L, _ := s.states.Get().(*lua.LState)
+	if L == nil {
+		if L, err = s.newState(); err != nil {
+			return 0, err
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			// The state may be left inconsistent, so it is not reused
+			L.Close()
+			points, err = 0, fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), bonusScriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.Push(L.GetGlobal("bonus"))
+	L.Push(receiptTable(L, data))
+	callErr := L.PCall(1, 1, nil)
+	L.RemoveContext()
+	if callErr != nil {
+		L.SetTop(0)
+		s.states.Put(L)
+		return 0, callErr
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+	s.states.Put(L)
+
+	n, ok := result.(lua.LNumber)
+	if !ok || float64(n) != math.Trunc(float64(n)) || math.Abs(float64(n)) > math.MaxInt64 {
+		return 0, fmt.Errorf("bonus returned %s %s, not an integer", result.Type(), result.String())
+	}
+	return int64(n), nil
+}
+
+// receiptTable exposes data to the script, with the same fields custom rule
+// expressions see.
+func receiptTable(L *lua.LState, data *ValidatedReceiptData) *lua.LTable {
+	items := L.CreateTable(len(data.Items), 0)
+	for _, item := range data.Items {
+		t := L.CreateTable(0, 2)
+		t.RawSetString("description", lua.LString(item.ShortDescription))
+		t.RawSetString("price", lua.LNumber(item.Price))
+		items.Append(t)
+	}
+	purchaseTime := ""
+	if !data.NoPurchaseTime {
+		purchaseTime = data.PurchaseTime.Format("15:04")
+	}
+	t := L.CreateTable(0, 11)
+	t.RawSetString("retailer", lua.LString(data.Retailer))
+	t.RawSetString("total", lua.LNumber(data.Total))
+	t.RawSetString("itemCount", lua.LNumber(data.OriginalItems))
+	t.RawSetString("items", items)
+	t.RawSetString("purchaseDate", lua.LString(data.PurchaseDate.Format("2006-01-02")))
+	t.RawSetString("purchaseTime", lua.LString(purchaseTime))
+	t.RawSetString("customerId", lua.LString(data.CustomerID))
+	t.RawSetString("paperless", lua.LBool(data.Paperless))
+	t.RawSetString("noBag", lua.LBool(data.NoBag))
+	t.RawSetString("consecutiveDay", lua.LBool(data.ConsecutiveDay))
+	t.RawSetString("firstOfDay", lua.LBool(data.FirstOfDay))
+	return t
+}
+
+// scriptRule awards what the bonus script returns.
+type scriptRule struct{ script *bonusScript }
+
+func (scriptRule) Name() string { return ruleBonusScript }
+
+// Apply runs the script. A failing script awards nothing and is logged, so it
+// cannot fail the receipt or the other rules. Scoring has no logger of its
+// own, so the default logger is used.
+func (r scriptRule) Apply(data *ValidatedReceiptData) int64 {
+	points, err := r.script.call(data)
+	if err != nil {
+		slog.Default().Warn("Bonus script failed; awarding no bonus", slog.String("retailer", data.Retailer), slog.Any("error", err))
+		return 0
+	}
+	return points
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// shadowRuleSet is a candidate rule set scored alongside the live rules, with
+// running totals of how its points compare. The totals start over whenever the
+// shadow rules are reloaded.
+type shadowRuleSet struct {
+	ruleSet
+	receipts     atomic.Int64 // receipts scored under both rule sets
+	changed      atomic.Int64 // receipts the two scored differently
+	livePoints   atomic.Int64
+	shadowPoints atomic.Int64
+}
+
+// loadShadowRules reads the shadow rules file at path over live, so the file
+// only needs the settings it changes.
+func loadShadowRules(path string, live PointsConfig) (PointsConfig, error) {
+	shadow, err := loadRulesFile(path, live)
+	if err != nil {
+		return PointsConfig{}, fmt.Errorf("SHADOW_RULES_FILE: %w", err)
+	}
+	return shadow, nil
+}
+
+// setShadow makes p the shadow rules, discarding the previous totals.
+func (c *Config) setShadow(p PointsConfig, at time.Time) {
+	c.shadow.Store(&shadowRuleSet{ruleSet: ruleSet{Points: p, Version: ruleVersion(p), LoadedAt: at}})
+}
+
+// scoreShadow scores data under the shadow rules, if any, and records how the
+// result compares with livePoints. It runs in its own goroutine, so a slow
+// shadow rule set never delays the response. data must not be modified
+// afterwards. The shadow rules are candidates for the active point rules, so
+// receipts of tenants scored under a named rule set are not compared.
+func scoreShadow(cfg *Config, tenant, id string, data *ValidatedReceiptData, livePoints int64, logger *slog.Logger) {
+	shadow := cfg.shadow.Load()
+	if shadow == nil || cfg.rulesFor(tenant).Name != "" {
+		return
+	}
+	go func() {
+		points := calculatePoints(data, shadow.Points)
+		shadow.receipts.Add(1)
+		shadow.livePoints.Add(livePoints)
+		shadow.shadowPoints.Add(points)
+		level := slog.LevelDebug
+		if points != livePoints {
+			shadow.changed.Add(1)
+			level = slog.LevelInfo
+		}
+		logger.Log(context.Background(), level, "Shadow score",
+			slog.String("id", id),
+			slog.Int64("points", livePoints),
+			slog.Int64("shadow_points", points),
+			slog.Int64("delta", points-livePoints),
+			slog.String("shadow_rule_version", shadow.Version))
+	}()
+}
+
+// ShadowMetrics summarizes the shadow rules' results since they were loaded.
+type ShadowMetrics struct {
+	RuleVersion  string    `json:"ruleVersion"`
+	LoadedAt     time.Time `json:"loadedAt"`
+	Receipts     int64     `json:"receipts"`
+	Changed      int64     `json:"changed"`
+	LivePoints   int64     `json:"livePoints"`
+	ShadowPoints int64     `json:"shadowPoints"`
+	Delta        int64     `json:"pointsDelta"` // ShadowPoints minus LivePoints
+}
+
+// shadowMetrics returns the shadow rules' totals, or nil if there are none.
+func shadowMetrics(cfg *Config) *ShadowMetrics {
+	shadow := cfg.shadow.Load()
+	if shadow == nil {
+		return nil
+	}
+	live, points := shadow.livePoints.Load(), shadow.shadowPoints.Load()
+	return &ShadowMetrics{
+		RuleVersion:  shadow.Version,
+		LoadedAt:     shadow.LoadedAt,
+		Receipts:     shadow.receipts.Load(),
+		Changed:      shadow.changed.Load(),
+		LivePoints:   live,
+		ShadowPoints: points,
+		Delta:        points - live,
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Supported values for StoreConfig.SnapshotFormat.
+const (
+	snapshotJSON = "json"
+	snapshotGob  = "gob"
+)
+
+// memorySnapshot is the on-disk form of a memoryStore. sortedPoints and
+// processed are not saved; they are rebuilt from Receipts on load.
+type memorySnapshot struct {
+	Receipts     []StoredReceipt
+	LastPurchase map[string]time.Time
+	LastAwarded  map[string]time.Time
+	Fingerprints map[string]FingerprintClaim
+	// IdempotencyKeys may hold expired reservations too
+	IdempotencyKeys map[string]IdempotencyRecord
+	APIKeys         []APIKey
+	Ledger          map[string][]LedgerEntry // by user id, oldest first
+	TakenAt         time.Time
+	WALSeq          uint64 // last write-ahead log entry included, if a log is kept
+}
+
+// snapshotSource is a store that can be snapshotted: a memoryStore, or a
+// walStore wrapping one.
+type snapshotSource interface {
+	snapshot() memorySnapshot
+	// snapshotWritten is called once snap is safely on disk.
+	snapshotWritten(snap memorySnapshot) error
+}
+
+// snapshot copies the store's contents under the read lock.
+func (s *memoryStore) snapshot() memorySnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snap := memorySnapshot{
+		Receipts:     make([]StoredReceipt, 0, len(s.receipts)),
+		LastPurchase: make(map[string]time.Time, len(s.lastPurchase)),
+		LastAwarded:  make(map[string]time.Time, len(s.lastAwarded)),
+		Fingerprints: make(map[string]FingerprintClaim, len(s.fingerprints)),
+
+		IdempotencyKeys: make(map[string]IdempotencyRecord, len(s.idempotencyKeys)),
+		APIKeys:         slices.Collect(maps.Values(s.apiKeys)),
+		Ledger:          make(map[string][]LedgerEntry, len(s.ledger)),
+		TakenAt:         time.Now(),
+	}
+	for _, rec := range s.receipts {
+		snap.Receipts = append(snap.Receipts, rec)
+	}
+	for k, v := range s.lastPurchase {
+		snap.LastPurchase[k] = v
+	}
+	for k, v := range s.lastAwarded {
+		snap.LastAwarded[k] = v
+	}
+	for k, v := range s.fingerprints {
+		snap.Fingerprints[k] = v
+	}
+	for k, v := range s.idempotencyKeys {
+		snap.IdempotencyKeys[k] = v
+	}
+	for k, v := range s.ledger {
+		snap.Ledger[k] = slices.Clone(v)
+	}
+	return snap
+}
+
+// restore replaces the store's contents with snap.
+func (s *memoryStore) restore(snap memorySnapshot) {
+	receipts := make(map[string]StoredReceipt, len(snap.Receipts))
+	for _, rec := range snap.Receipts {
+		receipts[rec.ID] = rec
+	}
+	points := make([]int64, 0, len(receipts))
+	processed := make([]processedKey, 0, len(receipts))
+	for _, rec := range receipts {
+		points = append(points, rec.Points)
+		processed = append(processed, processedKey{at: rec.ProcessedAt, id: rec.ID})
+	}
+	slices.Sort(points)
+	slices.SortFunc(processed, processedKey.compare)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receipts = receipts
+	s.sortedPoints = points
+	s.processed = processed
+	s.lastPurchase = nonNilMap(snap.LastPurchase)
+	s.lastAwarded = nonNilMap(snap.LastAwarded)
+	s.fingerprints = nonNilMap(snap.Fingerprints)
+	s.idempotencyKeys = nonNilMap(snap.IdempotencyKeys)
+	s.apiKeys = make(map[string]APIKey, len(snap.APIKeys))
+	s.apiKeyHashes = make(map[string]string, len(snap.APIKeys))
+	for _, key := range snap.APIKeys {
+		s.putAPIKey(key)
+	}
+	s.ledger = make(map[string][]LedgerEntry, len(snap.Ledger))
+	s.ledgerIDs = make(map[string]struct{})
+	s.leaderboards = make(map[string]map[string]int64)
+	for _, entries := range snap.Ledger {
+		for _, entry := range entries {
+			s.putLedgerEntry(entry)
+		}
+	}
+}
+
+func (s *memoryStore) snapshotWritten(memorySnapshot) error { return nil }
+
+// nonNilMap returns m, or an empty map if m is nil. Gob decodes an empty
+// map as nil, and snapshots from older versions lack newer maps.
+func nonNilMap[V any](m map[string]V) map[string]V {
+	if m == nil {
+		return make(map[string]V)
+	}
+	return m
+}
+
+// writeSnapshot saves the store to path in format. It writes a temporary
+// file beside path and renames it into place, so a crash mid-write leaves
+// the previous snapshot intact.
+func writeSnapshot(s snapshotSource, path, format string) (memorySnapshot, error) {
+	snap := s.snapshot()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return snap, fmt.Errorf("creating snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if err := encodeSnapshot(tmp, format, snap); err != nil {
+		tmp.Close()
+		return snap, fmt.Errorf("encoding snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return snap, fmt.Errorf("syncing snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return snap, fmt.Errorf("closing snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return snap, fmt.Errorf("replacing snapshot: %w", err)
+	}
+	if err := s.snapshotWritten(snap); err != nil {
+		return snap, fmt.Errorf("after writing snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// loadSnapshot restores the store from the snapshot at path. A missing file
+// is not an error: the store is left empty and found is false.
+func loadSnapshot(s *memoryStore, path, format string) (snap memorySnapshot, found bool, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return memorySnapshot{}, false, nil
+	}
+	if err != nil {
+		return memorySnapshot{}, false, fmt.Errorf("opening snapshot: %w", err)
+	}
+	defer f.Close()
+	if format == snapshotGob {
+		err = gob.NewDecoder(f).Decode(&snap)
+	} else {
+		err = json.NewDecoder(f).Decode(&snap)
+	}
+	if err != nil {
+		return memorySnapshot{}, true, fmt.Errorf("decoding snapshot %s: %w", path, err)
+	}
+	s.restore(snap)
+	return snap, true, nil
+}
+
+func encodeSnapshot(w io.Writer, format string, snap memorySnapshot) error {
+	if format == snapshotGob {
+		return gob.NewEncoder(w).Encode(snap)
+	}
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// runSnapshots writes a snapshot every interval until ctx is done. Failures
+// are logged and retried at the next tick.
+func runSnapshots(ctx context.Context, s snapshotSource, cfg StoreConfig, logger *slog.Logger) {
+	ticker := time.NewTicker(cfg.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			saveSnapshot(s, cfg, logger)
+		}
+	}
+}
+
+// saveSnapshot writes one snapshot and logs the outcome.
+func saveSnapshot(s snapshotSource, cfg StoreConfig, logger *slog.Logger) {
+	start := time.Now()
+	snap, err := writeSnapshot(s, cfg.SnapshotPath, cfg.SnapshotFormat)
+	if err != nil {
+		logger.Error("Failed to write snapshot", slog.String("path", cfg.SnapshotPath), slog.Any("error", err))
+		return
+	}
+	logger.Debug("Wrote snapshot",
+		slog.String("path", cfg.SnapshotPath),
+		slog.Int("receipts", len(snap.Receipts)),
+		slog.Duration("took", time.Since(start)))
+}
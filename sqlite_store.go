@@ -0,0 +1,711 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema is applied on every start; each statement is idempotent.
+// Times are stored as Unix nanoseconds so they sort numerically, and dates
+// as YYYY-MM-DD text, which sorts the same way.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS receipts (
+	id           TEXT PRIMARY KEY,
+	points       INTEGER NOT NULL,
+	processed_at INTEGER NOT NULL,
+	record       TEXT NOT NULL -- the StoredReceipt as JSON, submitted receipt included
+);
+CREATE INDEX IF NOT EXISTS receipts_points ON receipts (points);
+DROP INDEX IF EXISTS receipts_processed_at;
+CREATE INDEX IF NOT EXISTS receipts_processed_order ON receipts (processed_at, id);
+CREATE TABLE IF NOT EXISTS customer_purchases (
+	customer_id TEXT PRIMARY KEY,
+	last_date   TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS retailer_days (
+	retailer  TEXT PRIMARY KEY,
+	last_date TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS fingerprints (
+	fingerprint TEXT PRIMARY KEY,
+	claimed_at  INTEGER NOT NULL,
+	receipt_id  TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key          TEXT PRIMARY KEY,
+	request_hash TEXT NOT NULL,
+	receipt_id   TEXT NOT NULL DEFAULT '', -- empty until the request completes
+	expires_at   INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS api_keys (
+	id           TEXT PRIMARY KEY,
+	name         TEXT NOT NULL,
+	tenant       TEXT NOT NULL DEFAULT '', -- '' for keys not bound to a tenant
+	hash         TEXT NOT NULL UNIQUE,
+	created_at   INTEGER NOT NULL,
+	rotated_at   INTEGER NOT NULL DEFAULT 0, -- 0 until first rotated, like the other optional times
+	last_used_at INTEGER NOT NULL DEFAULT 0,
+	revoked_at   INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS ledger (
+	seq         INTEGER PRIMARY KEY AUTOINCREMENT, -- the order entries were added in
+	id          TEXT NOT NULL UNIQUE,
+	user_id     TEXT NOT NULL,
+	kind        TEXT NOT NULL,
+	points      INTEGER NOT NULL,
+	reference   TEXT NOT NULL DEFAULT '',
+	created_at  INTEGER NOT NULL,
+	expires_at  INTEGER NOT NULL DEFAULT 0, -- 0 if the points never expire
+	credited_at INTEGER NOT NULL DEFAULT 0 -- an adjustment's credit's created_at; 0 for other entries
+);
+CREATE INDEX IF NOT EXISTS ledger_user ON ledger (user_id, seq);
+CREATE TABLE IF NOT EXISTS leaderboard (
+	bucket  TEXT NOT NULL, -- see leaderboardBuckets
+	user_id TEXT NOT NULL,
+	points  INTEGER NOT NULL,
+	PRIMARY KEY (bucket, user_id)
+);
+CREATE INDEX IF NOT EXISTS leaderboard_points ON leaderboard (bucket, points DESC, user_id);
+`
+
+// sqliteDateLayout is how purchase dates are stored.
+const sqliteDateLayout = "2006-01-02"
+
+// sqliteStore keeps receipts in a SQLite database file, so they survive
+// restarts. It uses a single connection: SQLite serializes writers anyway,
+// and this way a transaction never waits on a lock held by another of ours.
+type sqliteStore struct {
+	db *sql.DB
+	// retailerKey groups retailer names for RetailerStats and ClaimRetailerDay.
+	retailerKey func(string) string
+}
+
+// newSQLiteStore opens (creating if needed) the database at path and applies
+// the schema.
+func newSQLiteStore(path string, retailerKey func(string) string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating schema in %s: %w", path, err)
+	}
+	for _, c := range sqliteAddedColumns {
+		if err := addSQLiteColumn(db, c.table, c.column, c.definition); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("upgrading schema in %s: %w", path, err)
+		}
+	}
+	return &sqliteStore{db: db, retailerKey: retailerKey}, nil
+}
+
+// sqliteAddedColumns lists the columns added to sqliteSchema after its
+// tables were first created, which older database files lack.
+var sqliteAddedColumns = []struct{ table, column, definition string }{
+	{"fingerprints", "receipt_id", "TEXT NOT NULL DEFAULT ''"},
+	{"api_keys", "tenant", "TEXT NOT NULL DEFAULT ''"},
+	{"ledger", "expires_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"ledger", "credited_at", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// addSQLiteColumn adds column to table unless it is already there.
+func addSQLiteColumn(db *sql.DB, table, column, definition string) error {
+	var present bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)`, table, column).Scan(&present)
+	if err != nil || present {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
+
+// Close closes the database.
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// execer is the subset of *sql.DB and *sql.Tx used to write receipts.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// putReceipt inserts or replaces rec.
+func putReceipt(db execer, rec StoredReceipt) error {
+	record, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encoding receipt %s: %w", rec.ID, err)
+	}
+	_, err = db.Exec(`INSERT INTO receipts (id, points, processed_at, record) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET points = excluded.points, processed_at = excluded.processed_at, record = excluded.record`,
+		rec.ID, rec.Points, rec.ProcessedAt.UnixNano(), string(record))
+	return err
+}
+
+// decodeStoredReceipt parses a record column.
+func decodeStoredReceipt(record string) (StoredReceipt, error) {
+	var rec StoredReceipt
+	if err := json.Unmarshal([]byte(record), &rec); err != nil {
+		return StoredReceipt{}, fmt.Errorf("decoding stored receipt: %w", err)
+	}
+	return rec, nil
+}
+
+// scanReceipts decodes every row of a query selecting the record column.
+func scanReceipts(rows *sql.Rows) ([]StoredReceipt, error) {
+	defer rows.Close()
+	var recs []StoredReceipt
+	for rows.Next() {
+		var record string
+		if err := rows.Scan(&record); err != nil {
+			return nil, err
+		}
+		rec, err := decodeStoredReceipt(record)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+func (s *sqliteStore) Save(rec StoredReceipt) error {
+	return putReceipt(s.db, rec)
+}
+
+func (s *sqliteStore) Get(id string) (StoredReceipt, bool, error) {
+	var record string
+	err := s.db.QueryRow(`SELECT record FROM receipts WHERE id = ?`, id).Scan(&record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredReceipt{}, false, nil
+	}
+	if err != nil {
+		return StoredReceipt{}, false, err
+	}
+	rec, err := decodeStoredReceipt(record)
+	return rec, err == nil, err
+}
+
+func (s *sqliteStore) Exists(id string) (bool, error) {
+	var found bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM receipts WHERE id = ?)`, id).Scan(&found)
+	return found, err
+}
+
+func (s *sqliteStore) Update(id string, fn func(*StoredReceipt) error) (StoredReceipt, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return StoredReceipt{}, false, err
+	}
+	defer tx.Rollback()
+
+	var record string
+	err = tx.QueryRow(`SELECT record FROM receipts WHERE id = ?`, id).Scan(&record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredReceipt{}, false, nil
+	}
+	if err != nil {
+		return StoredReceipt{}, false, err
+	}
+	rec, err := decodeStoredReceipt(record)
+	if err != nil {
+		return StoredReceipt{}, true, err
+	}
+	if err := fn(&rec); err != nil {
+		return StoredReceipt{}, true, err
+	}
+	rec.ID = id
+	if err := putReceipt(tx, rec); err != nil {
+		return StoredReceipt{}, true, err
+	}
+	return rec, true, tx.Commit()
+}
+
+func (s *sqliteStore) Delete(id string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM receipts WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteWhere evaluates pred in Go, so it reads every receipt inside the
+// transaction before deleting the matches.
+func (s *sqliteStore) DeleteWhere(pred func(StoredReceipt) bool) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT record FROM receipts`)
+	if err != nil {
+		return 0, err
+	}
+	recs, err := scanReceipts(rows)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, rec := range recs {
+		if !pred(rec) {
+			continue
+		}
+		if _, err := tx.Exec(`DELETE FROM receipts WHERE id = ?`, rec.ID); err != nil {
+			return 0, err
+		}
+		deleted++
+	}
+	return deleted, tx.Commit()
+}
+
+// claimDate reads the date stored under key in table and replaces it with
+// date when replace approves. It returns the previous date, if any.
+func (s *sqliteStore) claimDate(table, column, key string, date time.Time, replace func(previous time.Time, found bool) bool) (time.Time, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer tx.Rollback()
+
+	var previous time.Time
+	var stored string
+	err = tx.QueryRow(`SELECT last_date FROM `+table+` WHERE `+column+` = ?`, key).Scan(&stored)
+	found := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, err
+	}
+	if found {
+		if previous, err = time.Parse(sqliteDateLayout, stored); err != nil {
+			return time.Time{}, false, fmt.Errorf("decoding %s date: %w", table, err)
+		}
+	}
+	if replace(previous, found) {
+		_, err = tx.Exec(`INSERT INTO `+table+` (`+column+`, last_date) VALUES (?, ?)
+			ON CONFLICT (`+column+`) DO UPDATE SET last_date = excluded.last_date`,
+			key, date.Format(sqliteDateLayout))
+		if err != nil {
+			return time.Time{}, false, err
+		}
+	}
+	return previous, found, tx.Commit()
+}
+
+func (s *sqliteStore) RecordCustomerPurchase(customerID string, date time.Time) (time.Time, bool, error) {
+	return s.claimDate("customer_purchases", "customer_id", customerID, date, func(previous time.Time, found bool) bool {
+		return !found || date.After(previous)
+	})
+}
+
+func (s *sqliteStore) ClaimRetailerDay(retailer string, date time.Time) (bool, error) {
+	claimed := false
+	_, _, err := s.claimDate("retailer_days", "retailer", s.retailerKey(retailer), date, func(previous time.Time, found bool) bool {
+		claimed = !found || date.After(previous)
+		return claimed
+	})
+	if err != nil {
+		return false, err
+	}
+	return claimed, nil
+}
+
+func (s *sqliteStore) ClaimFingerprint(fingerprint, id string, at time.Time, window time.Duration) (string, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	var claimedAt int64
+	var holder string
+	err = tx.QueryRow(`SELECT claimed_at, receipt_id FROM fingerprints WHERE fingerprint = ?`, fingerprint).Scan(&claimedAt, &holder)
+	switch {
+	case err == nil:
+		if at.Sub(time.Unix(0, claimedAt)) < window {
+			return holder, false, nil
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return "", false, err
+	}
+	_, err = tx.Exec(`INSERT INTO fingerprints (fingerprint, claimed_at, receipt_id) VALUES (?, ?, ?)
+		ON CONFLICT (fingerprint) DO UPDATE SET claimed_at = excluded.claimed_at, receipt_id = excluded.receipt_id`,
+		fingerprint, at.UnixNano(), id)
+	if err != nil {
+		return "", false, err
+	}
+	return "", true, tx.Commit()
+}
+
+func (s *sqliteStore) ReleaseFingerprint(fingerprint, id string) error {
+	_, err := s.db.Exec(`DELETE FROM fingerprints WHERE fingerprint = ? AND receipt_id = ?`, fingerprint, id)
+	return err
+}
+
+func (s *sqliteStore) ReserveIdempotencyKey(key, requestHash string, at time.Time, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	defer tx.Rollback()
+
+	existing := IdempotencyRecord{Key: key}
+	var expiresAt int64
+	err = tx.QueryRow(`SELECT request_hash, receipt_id, expires_at FROM idempotency_keys WHERE key = ?`, key).
+		Scan(&existing.RequestHash, &existing.ReceiptID, &expiresAt)
+	switch {
+	case err == nil:
+		existing.ExpiresAt = time.Unix(0, expiresAt)
+		if at.Before(existing.ExpiresAt) {
+			return existing, false, nil
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return IdempotencyRecord{}, false, err
+	}
+	rec := IdempotencyRecord{Key: key, RequestHash: requestHash, ExpiresAt: at.Add(ttl)}
+	_, err = tx.Exec(`INSERT INTO idempotency_keys (key, request_hash, receipt_id, expires_at) VALUES (?, ?, '', ?)
+		ON CONFLICT (key) DO UPDATE SET request_hash = excluded.request_hash, receipt_id = '', expires_at = excluded.expires_at`,
+		key, requestHash, rec.ExpiresAt.UnixNano())
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	return rec, true, tx.Commit()
+}
+
+func (s *sqliteStore) CompleteIdempotencyKey(key, receiptID string) error {
+	_, err := s.db.Exec(`UPDATE idempotency_keys SET receipt_id = ? WHERE key = ?`, receiptID, key)
+	return err
+}
+
+func (s *sqliteStore) ReleaseIdempotencyKey(key string) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE key = ?`, key)
+	return err
+}
+
+func (s *sqliteStore) Rank(id string) (ReceiptRank, bool, error) {
+	var points int64
+	err := s.db.QueryRow(`SELECT points FROM receipts WHERE id = ?`, id).Scan(&points)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReceiptRank{}, false, nil
+	}
+	if err != nil {
+		return ReceiptRank{}, false, err
+	}
+	var total, atOrBelow int
+	err = s.db.QueryRow(`SELECT COUNT(*), COUNT(CASE WHEN points <= ? THEN 1 END) FROM receipts`, points).Scan(&total, &atOrBelow)
+	if err != nil {
+		return ReceiptRank{}, false, err
+	}
+	return ReceiptRank{
+		Points:    points,
+		Rank:      total - atOrBelow + 1,
+		Total:     total,
+		AtOrBelow: atOrBelow,
+	}, true, nil
+}
+
+func (s *sqliteStore) ProcessedBetween(from, to time.Time) ([]StoredReceipt, error) {
+	query := `SELECT record FROM receipts`
+	var conds []string
+	var args []any
+	if !from.IsZero() {
+		conds = append(conds, `processed_at >= ?`)
+		args = append(args, from.UnixNano())
+	}
+	if !to.IsZero() {
+		conds = append(conds, `processed_at < ?`)
+		args = append(args, to.UnixNano())
+	}
+	if len(conds) > 0 {
+		query += ` WHERE ` + strings.Join(conds, ` AND `)
+	}
+	rows, err := s.db.Query(query+` ORDER BY processed_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanReceipts(rows)
+}
+
+func (s *sqliteStore) ProcessedPage(after time.Time, afterID string, to time.Time, limit int) ([]StoredReceipt, error) {
+	query := `SELECT record FROM receipts`
+	var conds []string
+	var args []any
+	switch {
+	case afterID != "":
+		conds = append(conds, `(processed_at > ? OR (processed_at = ? AND id > ?))`)
+		args = append(args, after.UnixNano(), after.UnixNano(), afterID)
+	case !after.IsZero():
+		conds = append(conds, `processed_at >= ?`)
+		args = append(args, after.UnixNano())
+	}
+	if !to.IsZero() {
+		conds = append(conds, `processed_at < ?`)
+		args = append(args, to.UnixNano())
+	}
+	if len(conds) > 0 {
+		query += ` WHERE ` + strings.Join(conds, ` AND `)
+	}
+	rows, err := s.db.Query(query+` ORDER BY processed_at, id LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	return scanReceipts(rows)
+}
+
+// RetailerStats groups in Go rather than SQL, since the grouping key is
+// configurable and may change between runs.
+func (s *sqliteStore) RetailerStats() ([]RetailerStats, error) {
+	recs, err := s.ProcessedBetween(time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return groupRetailerStats(recs, s.retailerKey), nil
+}
+
+func (s *sqliteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// apiKeyColumns are the api_keys columns scanAPIKey reads, in order, in
+// both the SQLite and PostgreSQL schemas.
+const apiKeyColumns = `id, name, tenant, hash, created_at, rotated_at, last_used_at, revoked_at`
+
+// unixNanoOrZero returns t in Unix nanoseconds, or 0 for the zero time.
+func unixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// timeOrZero is the inverse of unixNanoOrZero.
+func timeOrZero(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// scanAPIKey reads one row of apiKeyColumns.
+func scanAPIKey(row interface{ Scan(...any) error }) (APIKey, error) {
+	var key APIKey
+	var createdAt, rotatedAt, lastUsedAt, revokedAt int64
+	if err := row.Scan(&key.ID, &key.Name, &key.Tenant, &key.Hash, &createdAt, &rotatedAt, &lastUsedAt, &revokedAt); err != nil {
+		return APIKey{}, err
+	}
+	key.CreatedAt = time.Unix(0, createdAt)
+	key.RotatedAt, key.LastUsedAt, key.RevokedAt = timeOrZero(rotatedAt), timeOrZero(lastUsedAt), timeOrZero(revokedAt)
+	return key, nil
+}
+
+// putAPIKey inserts or replaces key.
+func putAPIKey(db execer, key APIKey) error {
+	_, err := db.Exec(`INSERT INTO api_keys (`+apiKeyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, tenant = excluded.tenant, hash = excluded.hash, created_at = excluded.created_at,
+			rotated_at = excluded.rotated_at, last_used_at = excluded.last_used_at, revoked_at = excluded.revoked_at`,
+		key.ID, key.Name, key.Tenant, key.Hash, key.CreatedAt.UnixNano(), unixNanoOrZero(key.RotatedAt), unixNanoOrZero(key.LastUsedAt), unixNanoOrZero(key.RevokedAt))
+	return err
+}
+
+func (s *sqliteStore) SaveAPIKey(key APIKey) error {
+	return putAPIKey(s.db, key)
+}
+
+func (s *sqliteStore) APIKeyByHash(hash string) (APIKey, bool, error) {
+	key, err := scanAPIKey(s.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE hash = ?`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, false, nil
+	}
+	return key, err == nil, err
+}
+
+func (s *sqliteStore) APIKeys() ([]APIKey, error) {
+	rows, err := s.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqliteStore) UpdateAPIKey(id string, fn func(*APIKey) error) (APIKey, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return APIKey{}, false, err
+	}
+	defer tx.Rollback()
+
+	key, err := scanAPIKey(tx.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, false, nil
+	}
+	if err != nil {
+		return APIKey{}, false, err
+	}
+	if err := fn(&key); err != nil {
+		return APIKey{}, true, err
+	}
+	key.ID = id
+	if err := putAPIKey(tx, key); err != nil {
+		return APIKey{}, true, err
+	}
+	return key, true, tx.Commit()
+}
+
+// ledgerColumns are the ledger columns scanLedgerEntry reads, in order, in
+// both the SQLite and PostgreSQL schemas.
+const ledgerColumns = `id, user_id, kind, points, reference, created_at, expires_at, credited_at`
+
+// ledgerBalanceColumns total a user's ledger rows into a UserBalance's
+// Points, Earned, Redeemed, Expired, and Receipts.
+const ledgerBalanceColumns = `COALESCE(SUM(points), 0),
+	COALESCE(SUM(CASE WHEN kind IN ('` + ledgerReceipt + `', '` + ledgerAdjustment + `') THEN points END), 0),
+	COALESCE(SUM(CASE WHEN kind = '` + ledgerRedemption + `' THEN -points END), 0),
+	COALESCE(SUM(CASE WHEN kind = '` + ledgerExpiry + `' THEN -points END), 0),
+	COUNT(CASE WHEN kind = '` + ledgerReceipt + `' THEN 1 END)`
+
+// ledgerTime returns an optional time of a ledger entry as stored, 0 if it
+// is zero.
+func ledgerTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// leaderboardUpsert adds a user's points to a leaderboard bucket, in both
+// the SQLite and PostgreSQL schemas.
+const leaderboardUpsert = `INSERT INTO leaderboard (bucket, user_id, points) VALUES ($1, $2, $3)
+	ON CONFLICT (bucket, user_id) DO UPDATE SET points = leaderboard.points + excluded.points`
+
+// leaderboardQuery lists a leaderboard bucket's top users, in both the
+// SQLite and PostgreSQL schemas.
+const leaderboardQuery = `SELECT user_id, points FROM leaderboard WHERE bucket = $1 ORDER BY points DESC, user_id LIMIT $2`
+
+// scanLedgerEntry reads one row of ledgerColumns.
+func scanLedgerEntry(row interface{ Scan(...any) error }) (LedgerEntry, error) {
+	var entry LedgerEntry
+	var createdAt, expiresAt, creditedAt int64
+	if err := row.Scan(&entry.ID, &entry.UserID, &entry.Kind, &entry.Points, &entry.Reference, &createdAt, &expiresAt, &creditedAt); err != nil {
+		return LedgerEntry{}, err
+	}
+	entry.CreatedAt = time.Unix(0, createdAt)
+	if expiresAt != 0 {
+		entry.ExpiresAt = time.Unix(0, expiresAt)
+	}
+	if creditedAt != 0 {
+		entry.CreditedAt = time.Unix(0, creditedAt)
+	}
+	return entry, nil
+}
+
+// AddLedgerEntry checks and appends in one transaction. The store's single
+// connection keeps other writers out until it commits.
+func (s *sqliteStore) AddLedgerEntry(entry LedgerEntry, checkBalance bool) (int64, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var balance int64
+	if err := tx.QueryRow(`SELECT COALESCE(SUM(points), 0) FROM ledger WHERE user_id = ?`, entry.UserID).Scan(&balance); err != nil {
+		return 0, false, err
+	}
+	if checkBalance && entry.Points < 0 && balance+entry.Points < 0 {
+		return balance, false, nil
+	}
+	res, err := tx.Exec(`INSERT INTO ledger (`+ledgerColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+		entry.ID, entry.UserID, entry.Kind, entry.Points, entry.Reference, entry.CreatedAt.UnixNano(), ledgerTime(entry.ExpiresAt), ledgerTime(entry.CreditedAt))
+	if err != nil {
+		return 0, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return balance, false, err
+	}
+	for _, bucket := range leaderboardBuckets(entry) {
+		if _, err := tx.Exec(leaderboardUpsert, bucket, entry.UserID, entry.Points); err != nil {
+			return 0, false, err
+		}
+	}
+	return balance + entry.Points, true, tx.Commit()
+}
+
+func (s *sqliteStore) Ledger(userID string) ([]LedgerEntry, error) {
+	rows, err := s.db.Query(`SELECT `+ledgerColumns+` FROM ledger WHERE user_id = ? ORDER BY seq`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []LedgerEntry
+	for rows.Next() {
+		entry, err := scanLedgerEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqliteStore) UserBalance(userID string) (UserBalance, error) {
+	balance := UserBalance{UserID: userID}
+	err := s.db.QueryRow(`SELECT `+ledgerBalanceColumns+` FROM ledger WHERE user_id = ?`, userID).
+		Scan(&balance.Points, &balance.Earned, &balance.Redeemed, &balance.Expired, &balance.Receipts)
+	return balance, err
+}
+
+func (s *sqliteStore) Leaderboard(bucket string, limit int) ([]LeaderboardEntry, error) {
+	rows, err := s.db.Query(leaderboardQuery, bucket, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []LeaderboardEntry
+	for rows.Next() {
+		var entry LeaderboardEntry
+		if err := rows.Scan(&entry.UserID, &entry.Points); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// ExpiringLedgerUsers matches each credit to an expiry entry of the same
+// user referencing the credit's id within its tenant.
+func (s *sqliteStore) ExpiringLedgerUsers(before time.Time) ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT user_id FROM ledger c
+		WHERE kind = '`+ledgerReceipt+`' AND expires_at > 0 AND expires_at <= ?
+		AND NOT EXISTS (SELECT 1 FROM ledger e WHERE e.user_id = c.user_id AND e.kind = '`+ledgerExpiry+`'
+			AND e.reference = substr(c.id, instr(c.id, '`+tenantSeparator+`') + 1))`, before.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Handles GET /stats/retailers requests, listing each distinct retailer with
+// its receipt count and total points.
+func retailerStatsHandler(w http.ResponseWriter, r *http.Request, store Store, logger *slog.Logger) {
+	stats, err := store.RetailerStats()
+	if err != nil {
+		logger.Error("Failed to compute retailer stats", slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+
+	type RetailerEntry struct {
+		Retailer    string `json:"retailer"`
+		DisplayName string `json:"displayName"`
+		Receipts    int    `json:"receipts"`
+		Points      int64  `json:"points"`
+	}
+	type RetailerStatsResponse struct {
+		Retailers []RetailerEntry `json:"retailers"`
+	}
+	resp := RetailerStatsResponse{Retailers: make([]RetailerEntry, 0, len(stats))}
+	for _, s := range stats {
+		resp.Retailers = append(resp.Retailers, RetailerEntry{Retailer: s.Retailer, DisplayName: s.DisplayName, Receipts: s.Receipts, Points: s.Points})
+	}
+	jsonResponse(w, http.StatusOK, resp, logger)
+}
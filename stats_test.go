@@ -0,0 +1,115 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestRetailerStats(t *testing.T) {
+	type entry struct {
+		Retailer    string
+		DisplayName string
+		Receipts    int
+		Points      int64
+	}
+	tests := []struct {
+		name      string
+		retailers []string // of the receipts processed, in order
+		want      []entry
+	}{
+		{name: "no receipts", want: []entry{}},
+		{name: "two retailers", retailers: []string{"Target", "Walgreens", "Target"}, want: []entry{
+			{Retailer: "target", DisplayName: "Target", Receipts: 2, Points: 56},
+			{Retailer: "walgreens", DisplayName: "Walgreens", Receipts: 1, Points: 31},
+		}},
+		{name: "grouped ignoring case", retailers: []string{"TARGET", "target", "Target"}, want: []entry{
+			{Retailer: "target", DisplayName: "TARGET", Receipts: 3, Points: 84},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{})
+			for _, retailer := range tt.retailers {
+				receipt := testReceipt()
+				receipt.Retailer = retailer
+				processReceipt(t, srv, receipt)
+			}
+			resp, body := send(t, srv, http.MethodGet, "/stats/retailers", "")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+			}
+			var got struct{ Retailers []entry }
+			decodeBody(t, body, &got)
+			if !slices.Equal(got.Retailers, tt.want) {
+				t.Errorf("retailers = %+v, want %+v", got.Retailers, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetailerStatsAfterDelete(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			saveAll(t, store,
+				StoredReceipt{ID: "a", Retailer: "Target", Points: 10},
+				StoredReceipt{ID: "b", Retailer: "target", Points: 20},
+				StoredReceipt{ID: "c", Retailer: "Walgreens", Points: 30},
+			)
+			if _, err := store.Delete("a"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := store.Delete("c"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			stats, err := store.RetailerStats()
+			if err != nil {
+				t.Fatalf("RetailerStats: %v", err)
+			}
+			want := []RetailerStats{{Retailer: "target", DisplayName: "target", Receipts: 1, Points: 20}}
+			if !slices.Equal(stats, want) {
+				t.Errorf("RetailerStats = %+v, want %+v", stats, want)
+			}
+		})
+	}
+}
+
+func TestRetailerStatsCanonicalization(t *testing.T) {
+	// Retailer names may only hold word characters, spaces, "-" and "&"
+	retailers := []string{"Target", "TARGET", "Target Inc", "Tar-get"}
+	tests := []struct {
+		level string
+		want  map[string]int // receipts by display name
+	}{
+		{level: canonicalNone, want: map[string]int{"Target": 1, "TARGET": 1, "Target Inc": 1, "Tar-get": 1}},
+		{level: canonicalBasic, want: map[string]int{"Target": 2, "Target Inc": 1, "Tar-get": 1}},
+		{level: canonicalAggressive, want: map[string]int{"Target": 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"RETAILER_CANONICALIZATION": tt.level})})
+			for _, retailer := range retailers {
+				receipt := testReceipt()
+				receipt.Retailer = retailer
+				processReceipt(t, srv, receipt)
+			}
+			_, body := send(t, srv, http.MethodGet, "/stats/retailers", "")
+			var got struct {
+				Retailers []struct {
+					DisplayName string
+					Receipts    int
+				}
+			}
+			decodeBody(t, body, &got)
+			receipts := make(map[string]int)
+			for _, entry := range got.Retailers {
+				receipts[entry.DisplayName] = entry.Receipts
+			}
+			if !maps.Equal(receipts, tt.want) {
+				t.Errorf("receipts by display name = %v, want %v", receipts, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,1296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StoredReceipt is the record kept for each processed receipt.
+type StoredReceipt struct {
+	ID           string
+	Retailer     string
+	PurchaseDate time.Time
+	Points       int64
+	TotalCents   int64 // the parsed total
+	ProcessedAt  time.Time
+	Receipt      Receipt   // the submitted payload, kept so the receipt can be rescored
+	RuleVersion  string    // version of the rules that produced Points
+	ScoredAt     time.Time // when Points was last computed
+	// ConsecutiveDay records whether the customer's streak bonus applied
+	// when the receipt was submitted, since that depends on earlier receipts.
+	ConsecutiveDay bool
+	FirstOfDay     bool     // whether the retailer's first-of-day bonus was awarded to this receipt
+	Warnings       []string // validation problems tolerated under PartialScoring
+}
+
+// Store persists processed receipts. Implementations must be safe for
+// concurrent use by multiple handlers.
+type Store interface {
+	// Save inserts or replaces the receipt with rec.ID.
+	Save(rec StoredReceipt) error
+	// Get returns the receipt with the given id and whether it was found.
+	Get(id string) (StoredReceipt, bool, error)
+	// Exists reports whether a receipt with the given id is stored, without
+	// fetching it.
+	Exists(id string) (bool, error)
+	// Update atomically applies fn to the receipt with the given id and saves
+	// the result, unless fn returns an error. It reports whether the id was found.
+	Update(id string, fn func(*StoredReceipt) error) (StoredReceipt, bool, error)
+	// Delete removes the receipt with the given id and reports whether it was found.
+	Delete(id string) (bool, error)
+	// DeleteWhere removes every receipt matching pred and returns how many were removed.
+	DeleteWhere(pred func(StoredReceipt) bool) (int, error)
+	// RecordCustomerPurchase notes a purchase date for a customer and returns
+	// the latest date recorded before this call, if any. The stored date only
+	// moves forward, so out-of-order submissions do not reset a streak.
+	RecordCustomerPurchase(customerID string, date time.Time) (time.Time, bool, error)
+	// ClaimRetailerDay records that a retailer's first-of-day bonus was
+	// awarded for date and reports whether it was still available: it is
+	// only if no receipt for that retailer on date or later has claimed it.
+	ClaimRetailerDay(retailer string, date time.Time) (bool, error)
+	// ClaimFingerprint records that the receipt id with the given content
+	// fingerprint was accepted at the given time, unless one was already
+	// accepted within window before it. It reports whether the claim
+	// succeeded and, if not, the id of the receipt holding it.
+	ClaimFingerprint(fingerprint, id string, at time.Time, window time.Duration) (string, bool, error)
+	// ReleaseFingerprint removes the claim on fingerprint if the receipt id
+	// still holds it, so a receipt that failed to be stored does not block
+	// its resubmission.
+	ReleaseFingerprint(fingerprint, id string) error
+	// ReserveIdempotencyKey records that a request with the given key and
+	// body hash is being processed, unless an unexpired reservation exists,
+	// in which case that one is returned with false. The reservation expires
+	// ttl after at.
+	ReserveIdempotencyKey(key, requestHash string, at time.Time, ttl time.Duration) (IdempotencyRecord, bool, error)
+	// CompleteIdempotencyKey records the receipt created by the request
+	// holding the reservation for key.
+	CompleteIdempotencyKey(key, receiptID string) error
+	// ReleaseIdempotencyKey removes the reservation for key, so a failed
+	// request can be retried.
+	ReleaseIdempotencyKey(key string) error
+	// Rank reports where the receipt's points place it among all stored receipts.
+	Rank(id string) (ReceiptRank, bool, error)
+	// ProcessedBetween returns the receipts processed in [from, to), oldest
+	// first. A zero from or to leaves that end of the range open.
+	ProcessedBetween(from, to time.Time) ([]StoredReceipt, error)
+	// ProcessedPage returns, in the same order, up to limit of the receipts
+	// processed before to that sort after the receipt afterID processed at
+	// after. With an empty afterID it starts with those processed at after.
+	// A zero after or to leaves that end of the range open.
+	ProcessedPage(after time.Time, afterID string, to time.Time, limit int) ([]StoredReceipt, error)
+	// RetailerStats returns receipt counts and point totals grouped by
+	// normalized retailer name, ordered by name.
+	RetailerStats() ([]RetailerStats, error)
+	// Ping reports whether the backend is reachable and able to serve requests.
+	Ping(ctx context.Context) error
+	// SaveAPIKey inserts or replaces the API key with key.ID.
+	SaveAPIKey(key APIKey) error
+	// APIKeyByHash returns the API key whose secret hashes to hash and
+	// whether it was found.
+	APIKeyByHash(hash string) (APIKey, bool, error)
+	// APIKeys returns every API key, revoked ones included, oldest first.
+	APIKeys() ([]APIKey, error)
+	// UpdateAPIKey atomically applies fn to the API key with the given id and
+	// saves the result, unless fn returns an error. It reports whether the id
+	// was found.
+	UpdateAPIKey(id string, fn func(*APIKey) error) (APIKey, bool, error)
+	// AddLedgerEntry appends entry to its user's ledger, unless an entry with
+	// its ID was already added or, with checkBalance, it is a debit the
+	// user's balance does not cover. Checking and appending are one atomic
+	// step, so concurrent debits cannot overdraw the balance. It reports the
+	// user's balance afterwards and whether the entry was added.
+	AddLedgerEntry(entry LedgerEntry, checkBalance bool) (int64, bool, error)
+	// Ledger returns the user's ledger entries, oldest first.
+	Ledger(userID string) ([]LedgerEntry, error)
+	// UserBalance totals the user's ledger entries.
+	UserBalance(userID string) (UserBalance, error)
+	// ExpiringLedgerUsers returns the users with a credit whose ExpiresAt is
+	// no later than before and that has no expiry entry yet, in no
+	// particular order.
+	ExpiringLedgerUsers(before time.Time) ([]string, error)
+	// Leaderboard returns the users with the most points on the leaderboard
+	// bucket, most first, at most limit of them. Credits are added to the
+	// buckets leaderboardBuckets names when they are added to the ledger.
+	Leaderboard(bucket string, limit int) ([]LeaderboardEntry, error)
+}
+
+// Kinds of ledger entry.
+const (
+	ledgerReceipt    = "receipt"    // a credit of a receipt's points
+	ledgerRedemption = "redemption" // a debit of redeemed points
+	ledgerExpiry     = "expiry"     // a debit of a credit's points left unredeemed when it expired
+	ledgerAdjustment = "adjustment" // a change to a credit after its receipt was rescored or removed
+)
+
+// LedgerEntry is one change to a user's points balance: a credit for a
+// receipt, a debit for a redemption or an expiry, or an adjustment to a
+// credit.
+type LedgerEntry struct {
+	ID        string // the receipt's id for a credit; unique among all entries
+	UserID    string
+	Kind      string // ledgerReceipt, ledgerRedemption, ledgerExpiry, or ledgerAdjustment
+	Points    int64  // positive for a credit, negative for a debit
+	Reference string // the caller's reference for a redemption, e.g. an order number, or the expired or adjusted credit's id
+	CreatedAt time.Time
+	ExpiresAt time.Time // when a credit's points expire; zero if they never do
+	// CreditedAt is, for an adjustment, the CreatedAt of the credit it
+	// adjusts, so that it counts toward the same leaderboards.
+	CreditedAt time.Time
+}
+
+// UserBalance totals a user's ledger.
+type UserBalance struct {
+	UserID   string
+	Points   int64 // the balance: Earned less Redeemed and Expired
+	Earned   int64 // credits, as adjusted
+	Redeemed int64
+	Expired  int64
+	Receipts int // receipts credited
+}
+
+// add counts entry in the balance.
+func (b *UserBalance) add(entry LedgerEntry) {
+	b.Points += entry.Points
+	switch entry.Kind {
+	case ledgerReceipt:
+		b.Earned += entry.Points
+		b.Receipts++
+	case ledgerAdjustment:
+		b.Earned += entry.Points
+	case ledgerRedemption:
+		b.Redeemed -= entry.Points
+	case ledgerExpiry:
+		b.Expired -= entry.Points
+	}
+}
+
+// APIKey is a managed API key. Only a hash of its secret is stored; the
+// secret itself is shown once, when the key is created or rotated.
+type APIKey struct {
+	ID         string
+	Name       string
+	Tenant     string // the tenant requests made with the key belong to; empty leaves it to X-Tenant-ID
+	Hash       string // SHA-256 of the secret, hex encoded
+	CreatedAt  time.Time
+	RotatedAt  time.Time // zero until the secret is first replaced
+	LastUsedAt time.Time // zero until the key is first used
+	RevokedAt  time.Time // zero while the key is active
+}
+
+// sortAPIKeys orders keys oldest first.
+func sortAPIKeys(keys []APIKey) {
+	slices.SortFunc(keys, func(a, b APIKey) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+}
+
+// IdempotencyRecord is the reservation of an Idempotency-Key.
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string // SHA-256 of the request body, hex encoded
+	ReceiptID   string // empty until the request completes
+	ExpiresAt   time.Time
+}
+
+// FingerprintClaim records which receipt claimed a content fingerprint, and when.
+type FingerprintClaim struct {
+	ID string
+	At time.Time
+}
+
+// RetailerStats aggregates the receipts stored for one retailer.
+type RetailerStats struct {
+	Retailer    string // grouping key, see retailerCanonicalizer
+	DisplayName string // the retailer as written on the group's earliest receipt
+	Receipts    int
+	Points      int64
+}
+
+// groupRetailerStats aggregates recs, which must be ordered oldest first, by
+// retailerKey. Each group is named after its earliest receipt.
+func groupRetailerStats(recs []StoredReceipt, retailerKey func(string) string) []RetailerStats {
+	groups := make(map[string]*RetailerStats)
+	for _, rec := range recs {
+		key := retailerKey(rec.Retailer)
+		g, found := groups[key]
+		if !found {
+			g = &RetailerStats{Retailer: key, DisplayName: strings.TrimSpace(rec.Retailer)}
+			groups[key] = g
+		}
+		g.Receipts++
+		g.Points += rec.Points
+	}
+
+	result := make([]RetailerStats, 0, len(groups))
+	for _, g := range groups {
+		result = append(result, *g)
+	}
+	slices.SortFunc(result, func(a, b RetailerStats) int { return strings.Compare(a.Retailer, b.Retailer) })
+	return result
+}
+
+// ReceiptRank describes a receipt's standing among all stored receipts.
+// Receipts with equal points share the same Rank.
+type ReceiptRank struct {
+	Points    int64
+	Rank      int // 1 + number of receipts with strictly more points
+	Total     int // number of stored receipts
+	AtOrBelow int // number of receipts with the same or fewer points, including this one
+}
+
+// openStore returns the backend selected by cfg.Store.Backend, undecorated.
+func openStore(cfg *Config, logger *slog.Logger) (Store, error) {
+	return openBackend(cfg, cfg.Store.Backend, logger)
+}
+
+// openReplicas opens the backends of cfg.Store.Replicas, undecorated, in
+// order. If one fails, those already opened are closed.
+func openReplicas(cfg *Config, logger *slog.Logger) ([]Store, error) {
+	var replicas []Store
+	for _, backend := range cfg.Store.Replicas {
+		replica, err := openBackend(cfg, backend, logger)
+		if err != nil {
+			for _, opened := range replicas {
+				closeStore(opened)
+			}
+			return nil, fmt.Errorf("opening %s replica: %w", backend, err)
+		}
+		replicas = append(replicas, replica)
+	}
+	return replicas, nil
+}
+
+// openBackend returns the named backend configured by cfg.Store.
+func openBackend(cfg *Config, backend string, logger *slog.Logger) (Store, error) {
+	retailerKey := retailerCanonicalizer(cfg.RetailerCanonicalization)
+	switch backend {
+	case storeSQLite:
+		return newSQLiteStore(cfg.Store.SQLitePath, retailerKey)
+	case storePostgres:
+		return newPostgresStore(cfg.Store, retailerKey, logger)
+	case storeRedis:
+		return newRedisStore(cfg.Store.RedisURL, cfg.Store.ReceiptTTL, retailerKey)
+	default:
+		return newMemoryStore(retailerKey), nil
+	}
+}
+
+// closeStore releases the connections or files held by a store returned by
+// openStore. The memory store holds none.
+func closeStore(store Store) error {
+	switch s := store.(type) {
+	case interface{ Close() error }:
+		return s.Close()
+	case interface{ Close() }:
+		s.Close()
+	}
+	return nil
+}
+
+// memoryStore keeps receipts in a map. Data is lost on restart.
+type memoryStore struct {
+	mu           sync.RWMutex
+	receipts     map[string]StoredReceipt
+	lastPurchase map[string]time.Time // latest purchase date per customer id
+	lastAwarded  map[string]time.Time // latest first-of-day bonus date per normalized retailer
+	// fingerprints maps a receipt content fingerprint to its latest claim.
+	// Expired entries are only replaced, never swept.
+	fingerprints map[string]FingerprintClaim
+	// idempotencyKeys maps an Idempotency-Key to its reservation. Expired
+	// entries are only replaced, never swept.
+	idempotencyKeys map[string]IdempotencyRecord
+	apiKeys         map[string]APIKey        // by id
+	apiKeyHashes    map[string]string        // id of the API key with each secret hash
+	ledger          map[string][]LedgerEntry // by user id, oldest first
+	ledgerIDs       map[string]struct{}      // ids of every ledger entry
+	// leaderboards holds the points on each leaderboard bucket, by user id.
+	leaderboards map[string]map[string]int64
+	// retailerKey groups retailer names for RetailerStats and ClaimRetailerDay.
+	retailerKey func(string) string
+	// sortedPoints holds every stored receipt's points in ascending order so a
+	// rank is two binary searches. Inserts pay an O(n) copy instead.
+	sortedPoints []int64
+	// processed holds every stored receipt in processing order, so a page of
+	// them is a binary search away. Inserts pay an O(n) copy here too.
+	processed []processedKey
+}
+
+// processedKey places a receipt in processing order: by when it was
+// processed, then by id.
+type processedKey struct {
+	at time.Time
+	id string
+}
+
+func (k processedKey) compare(other processedKey) int {
+	if c := k.at.Compare(other.at); c != 0 {
+		return c
+	}
+	return strings.Compare(k.id, other.id)
+}
+
+// newMemoryStore returns an empty in-memory store that groups retailers by
+// retailerKey.
+func newMemoryStore(retailerKey func(string) string) *memoryStore {
+	return &memoryStore{
+		retailerKey:  retailerKey,
+		receipts:     make(map[string]StoredReceipt),
+		lastPurchase: make(map[string]time.Time),
+		lastAwarded:  make(map[string]time.Time),
+		fingerprints: make(map[string]FingerprintClaim),
+
+		idempotencyKeys: make(map[string]IdempotencyRecord),
+		apiKeys:         make(map[string]APIKey),
+		apiKeyHashes:    make(map[string]string),
+		ledger:          make(map[string][]LedgerEntry),
+		ledgerIDs:       make(map[string]struct{}),
+		leaderboards:    make(map[string]map[string]int64),
+	}
+}
+
+func (s *memoryStore) Save(rec StoredReceipt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, found := s.receipts[rec.ID]; found {
+		s.unindex(old)
+	}
+	s.receipts[rec.ID] = rec
+	s.index(rec)
+	return nil
+}
+
+func (s *memoryStore) Exists(id string) (bool, error) {
+	s.mu.RLock()
+	_, found := s.receipts[id]
+	s.mu.RUnlock()
+	return found, nil
+}
+
+func (s *memoryStore) Update(id string, fn func(*StoredReceipt) error) (StoredReceipt, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, found := s.receipts[id]
+	if !found {
+		return StoredReceipt{}, false, nil
+	}
+	old := rec
+	if err := fn(&rec); err != nil {
+		return StoredReceipt{}, true, err
+	}
+	rec.ID = id
+	s.receipts[id] = rec
+	if rec.Points != old.Points || !rec.ProcessedAt.Equal(old.ProcessedAt) {
+		s.unindex(old)
+		s.index(rec)
+	}
+	return rec, true, nil
+}
+
+// index adds rec to sortedPoints and processed. Callers must hold the write
+// lock.
+func (s *memoryStore) index(rec StoredReceipt) {
+	i, _ := slices.BinarySearch(s.sortedPoints, rec.Points)
+	s.sortedPoints = slices.Insert(s.sortedPoints, i, rec.Points)
+	key := processedKey{at: rec.ProcessedAt, id: rec.ID}
+	i, _ = slices.BinarySearchFunc(s.processed, key, processedKey.compare)
+	s.processed = slices.Insert(s.processed, i, key)
+}
+
+// unindex drops rec from sortedPoints and processed. Callers must hold the
+// write lock.
+func (s *memoryStore) unindex(rec StoredReceipt) {
+	if i, found := slices.BinarySearch(s.sortedPoints, rec.Points); found {
+		s.sortedPoints = slices.Delete(s.sortedPoints, i, i+1)
+	}
+	if i, found := slices.BinarySearchFunc(s.processed, processedKey{at: rec.ProcessedAt, id: rec.ID}, processedKey.compare); found {
+		s.processed = slices.Delete(s.processed, i, i+1)
+	}
+}
+
+func (s *memoryStore) Get(id string) (StoredReceipt, bool, error) {
+	s.mu.RLock()
+	rec, found := s.receipts[id]
+	s.mu.RUnlock()
+	return rec, found, nil
+}
+
+func (s *memoryStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, found := s.receipts[id]
+	if found {
+		delete(s.receipts, id)
+		s.unindex(rec)
+	}
+	return found, nil
+}
+
+func (s *memoryStore) DeleteWhere(pred func(StoredReceipt) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := 0
+	for id, rec := range s.receipts {
+		if pred(rec) {
+			delete(s.receipts, id)
+			s.unindex(rec)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memoryStore) RecordCustomerPurchase(customerID string, date time.Time) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, found := s.lastPurchase[customerID]
+	if !found || date.After(previous) {
+		s.lastPurchase[customerID] = date
+	}
+	return previous, found, nil
+}
+
+func (s *memoryStore) ClaimRetailerDay(retailer string, date time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.retailerKey(retailer)
+	if last, found := s.lastAwarded[key]; found && !date.After(last) {
+		return false, nil
+	}
+	s.lastAwarded[key] = date
+	return true, nil
+}
+
+func (s *memoryStore) ClaimFingerprint(fingerprint, id string, at time.Time, window time.Duration) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if claim, found := s.fingerprints[fingerprint]; found && at.Sub(claim.At) < window {
+		return claim.ID, false, nil
+	}
+	s.fingerprints[fingerprint] = FingerprintClaim{ID: id, At: at}
+	return "", true, nil
+}
+
+func (s *memoryStore) ReleaseFingerprint(fingerprint, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if claim, found := s.fingerprints[fingerprint]; found && claim.ID == id {
+		delete(s.fingerprints, fingerprint)
+	}
+	return nil
+}
+
+func (s *memoryStore) ReserveIdempotencyKey(key, requestHash string, at time.Time, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, found := s.idempotencyKeys[key]; found && at.Before(existing.ExpiresAt) {
+		return existing, false, nil
+	}
+	rec := IdempotencyRecord{Key: key, RequestHash: requestHash, ExpiresAt: at.Add(ttl)}
+	s.idempotencyKeys[key] = rec
+	return rec, true, nil
+}
+
+func (s *memoryStore) CompleteIdempotencyKey(key, receiptID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, found := s.idempotencyKeys[key]; found {
+		rec.ReceiptID = receiptID
+		s.idempotencyKeys[key] = rec
+	}
+	return nil
+}
+
+func (s *memoryStore) ReleaseIdempotencyKey(key string) error {
+	s.mu.Lock()
+	delete(s.idempotencyKeys, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Rank(id string) (ReceiptRank, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, found := s.receipts[id]
+	if !found {
+		return ReceiptRank{}, false, nil
+	}
+	// Index of the first entry with more points than rec
+	above, _ := slices.BinarySearch(s.sortedPoints, rec.Points+1)
+	return ReceiptRank{
+		Points:    rec.Points,
+		Rank:      len(s.sortedPoints) - above + 1,
+		Total:     len(s.sortedPoints),
+		AtOrBelow: above,
+	}, true, nil
+}
+
+func (s *memoryStore) ProcessedBetween(from, to time.Time) ([]StoredReceipt, error) {
+	return s.ProcessedPage(from, "", to, math.MaxInt)
+}
+
+func (s *memoryStore) ProcessedPage(after time.Time, afterID string, to time.Time, limit int) ([]StoredReceipt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	start, found := slices.BinarySearchFunc(s.processed, processedKey{at: after, id: afterID}, processedKey.compare)
+	if found {
+		start++
+	}
+	var page []StoredReceipt
+	for _, key := range s.processed[start:] {
+		if len(page) == limit || (!to.IsZero() && !key.at.Before(to)) {
+			break
+		}
+		page = append(page, s.receipts[key.id])
+	}
+	return page, nil
+}
+
+// RetailerStats scans every receipt under the read lock. Keeping running
+// aggregates would make reads O(1), but every Save, Update, and DeleteWhere
+// would then have to adjust them; statistics are read rarely, so the scan is
+// the cheaper place to pay.
+func (s *memoryStore) RetailerStats() ([]RetailerStats, error) {
+	type group struct {
+		stats RetailerStats
+		first StoredReceipt // earliest receipt, which names the group
+	}
+	s.mu.RLock()
+	groups := make(map[string]*group)
+	for _, rec := range s.receipts {
+		key := s.retailerKey(rec.Retailer)
+		g, found := groups[key]
+		if !found {
+			g = &group{stats: RetailerStats{Retailer: key}, first: rec}
+			groups[key] = g
+		} else if rec.ProcessedAt.Before(g.first.ProcessedAt) || (rec.ProcessedAt.Equal(g.first.ProcessedAt) && rec.ID < g.first.ID) {
+			g.first = rec
+		}
+		g.stats.Receipts++
+		g.stats.Points += rec.Points
+	}
+	s.mu.RUnlock()
+
+	result := make([]RetailerStats, 0, len(groups))
+	for _, g := range groups {
+		g.stats.DisplayName = strings.TrimSpace(g.first.Retailer)
+		result = append(result, g.stats)
+	}
+	slices.SortFunc(result, func(a, b RetailerStats) int { return strings.Compare(a.Retailer, b.Retailer) })
+	return result, nil
+}
+
+// Ping always succeeds: the map is reachable for as long as the process is.
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) SaveAPIKey(key APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putAPIKey(key)
+	return nil
+}
+
+// putAPIKey stores key and indexes its hash. Callers must hold the write
+// lock.
+func (s *memoryStore) putAPIKey(key APIKey) {
+	if old, found := s.apiKeys[key.ID]; found {
+		delete(s.apiKeyHashes, old.Hash)
+	}
+	s.apiKeys[key.ID] = key
+	s.apiKeyHashes[key.Hash] = key.ID
+}
+
+func (s *memoryStore) APIKeyByHash(hash string) (APIKey, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, found := s.apiKeyHashes[hash]
+	if !found {
+		return APIKey{}, false, nil
+	}
+	return s.apiKeys[id], true, nil
+}
+
+func (s *memoryStore) APIKeys() ([]APIKey, error) {
+	s.mu.RLock()
+	keys := slices.Collect(maps.Values(s.apiKeys))
+	s.mu.RUnlock()
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+func (s *memoryStore) UpdateAPIKey(id string, fn func(*APIKey) error) (APIKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, found := s.apiKeys[id]
+	if !found {
+		return APIKey{}, false, nil
+	}
+	if err := fn(&key); err != nil {
+		return APIKey{}, true, err
+	}
+	key.ID = id
+	s.putAPIKey(key)
+	return key, true, nil
+}
+
+func (s *memoryStore) AddLedgerEntry(entry LedgerEntry, checkBalance bool) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var balance int64
+	for _, e := range s.ledger[entry.UserID] {
+		balance += e.Points
+	}
+	if _, found := s.ledgerIDs[entry.ID]; found || checkBalance && entry.Points < 0 && balance+entry.Points < 0 {
+		return balance, false, nil
+	}
+	s.putLedgerEntry(entry)
+	return balance + entry.Points, true, nil
+}
+
+// putLedgerEntry appends entry to its user's ledger and adds it to its
+// leaderboards. Callers must hold the write lock.
+func (s *memoryStore) putLedgerEntry(entry LedgerEntry) {
+	s.ledger[entry.UserID] = append(s.ledger[entry.UserID], entry)
+	s.ledgerIDs[entry.ID] = struct{}{}
+	for _, bucket := range leaderboardBuckets(entry) {
+		if s.leaderboards[bucket] == nil {
+			s.leaderboards[bucket] = make(map[string]int64)
+		}
+		s.leaderboards[bucket][entry.UserID] += entry.Points
+	}
+}
+
+func (s *memoryStore) Ledger(userID string) ([]LedgerEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.ledger[userID]), nil
+}
+
+func (s *memoryStore) UserBalance(userID string) (UserBalance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	balance := UserBalance{UserID: userID}
+	for _, entry := range s.ledger[userID] {
+		balance.add(entry)
+	}
+	return balance, nil
+}
+
+func (s *memoryStore) ExpiringLedgerUsers(before time.Time) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var users []string
+	for userID, entries := range s.ledger {
+		if awaitsExpiry(entries, before) {
+			users = append(users, userID)
+		}
+	}
+	return users, nil
+}
+
+func (s *memoryStore) Leaderboard(bucket string, limit int) ([]LeaderboardEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := make([]LeaderboardEntry, 0, len(s.leaderboards[bucket]))
+	for userID, points := range s.leaderboards[bucket] {
+		entries = append(entries, LeaderboardEntry{UserID: userID, Points: points})
+	}
+	return rankLeaderboard(entries, limit), nil
+}
+
+// awaitsExpiry reports whether entries, one user's ledger as stored, hold a
+// credit that expired by before and has no expiry entry yet.
+func awaitsExpiry(entries []LedgerEntry, before time.Time) bool {
+	expired := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Kind == ledgerExpiry {
+			expired[expiredCreditKey(entry)] = true
+		}
+	}
+	return slices.ContainsFunc(entries, func(e LedgerEntry) bool {
+		return e.Kind == ledgerReceipt && !e.ExpiresAt.IsZero() && !e.ExpiresAt.After(before) && !expired[e.ID]
+	})
+}
+
+// errTransient marks store errors worth retrying, such as a dropped
+// connection. Backends wrap it (fmt.Errorf("...: %w", errTransient)) or
+// return errors with a Temporary() bool method.
+var errTransient = errors.New("transient store error")
+
+// isTransient reports whether err is a temporary failure.
+func isTransient(err error) bool {
+	if errors.Is(err, errTransient) {
+		return true
+	}
+	var temp interface{ Temporary() bool }
+	return errors.As(err, &temp) && temp.Temporary()
+}
+
+// retryingStore decorates a Store, retrying Save, Get, Exists, Rank,
+// ProcessedBetween, ProcessedPage, RetailerStats, SaveAPIKey, APIKeyByHash,
+// APIKeys, Ledger, UserBalance, ExpiringLedgerUsers, and Leaderboard on
+// transient errors with exponential backoff. Other errors, and a receipt
+// simply not being found, are returned immediately. Methods that are not safe
+// to repeat pass straight through to the wrapped store.
+type retryingStore struct {
+	Store
+	retries   int           // attempts after the first
+	baseDelay time.Duration // wait before the first retry; doubled each time
+	timeout   time.Duration // overall deadline across all attempts
+	logger    *slog.Logger
+}
+
+// newRetryingStore wraps store with the given retry policy.
+func newRetryingStore(store Store, retries int, baseDelay, timeout time.Duration, logger *slog.Logger) *retryingStore {
+	return &retryingStore{Store: store, retries: retries, baseDelay: baseDelay, timeout: timeout, logger: logger}
+}
+
+// do runs op until it succeeds, fails permanently, or runs out of retries
+// or time.
+func (s *retryingStore) do(method string, op func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	delay := s.baseDelay
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || !isTransient(err) || attempt >= s.retries {
+			return err
+		}
+		s.logger.Warn("Retrying store operation", slog.String("method", method), slog.Int("attempt", attempt+1), slog.Any("error", err))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%s: %w (after %d attempts: %v)", method, ctx.Err(), attempt+1, err)
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+func (s *retryingStore) Save(rec StoredReceipt) error {
+	return s.do("Save", func() error { return s.Store.Save(rec) })
+}
+
+func (s *retryingStore) Get(id string) (StoredReceipt, bool, error) {
+	var rec StoredReceipt
+	var found bool
+	err := s.do("Get", func() error {
+		var err error
+		rec, found, err = s.Store.Get(id)
+		return err
+	})
+	return rec, found, err
+}
+
+func (s *retryingStore) Exists(id string) (bool, error) {
+	var found bool
+	err := s.do("Exists", func() error {
+		var err error
+		found, err = s.Store.Exists(id)
+		return err
+	})
+	return found, err
+}
+
+func (s *retryingStore) Rank(id string) (ReceiptRank, bool, error) {
+	var rank ReceiptRank
+	var found bool
+	err := s.do("Rank", func() error {
+		var err error
+		rank, found, err = s.Store.Rank(id)
+		return err
+	})
+	return rank, found, err
+}
+
+func (s *retryingStore) ProcessedBetween(from, to time.Time) ([]StoredReceipt, error) {
+	var recs []StoredReceipt
+	err := s.do("ProcessedBetween", func() error {
+		var err error
+		recs, err = s.Store.ProcessedBetween(from, to)
+		return err
+	})
+	return recs, err
+}
+
+func (s *retryingStore) ProcessedPage(after time.Time, afterID string, to time.Time, limit int) ([]StoredReceipt, error) {
+	var recs []StoredReceipt
+	err := s.do("ProcessedPage", func() error {
+		var err error
+		recs, err = s.Store.ProcessedPage(after, afterID, to, limit)
+		return err
+	})
+	return recs, err
+}
+
+func (s *retryingStore) RetailerStats() ([]RetailerStats, error) {
+	var stats []RetailerStats
+	err := s.do("RetailerStats", func() error {
+		var err error
+		stats, err = s.Store.RetailerStats()
+		return err
+	})
+	return stats, err
+}
+
+func (s *retryingStore) SaveAPIKey(key APIKey) error {
+	return s.do("SaveAPIKey", func() error { return s.Store.SaveAPIKey(key) })
+}
+
+func (s *retryingStore) APIKeyByHash(hash string) (APIKey, bool, error) {
+	var key APIKey
+	var found bool
+	err := s.do("APIKeyByHash", func() error {
+		var err error
+		key, found, err = s.Store.APIKeyByHash(hash)
+		return err
+	})
+	return key, found, err
+}
+
+func (s *retryingStore) APIKeys() ([]APIKey, error) {
+	var keys []APIKey
+	err := s.do("APIKeys", func() error {
+		var err error
+		keys, err = s.Store.APIKeys()
+		return err
+	})
+	return keys, err
+}
+
+func (s *retryingStore) Ledger(userID string) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+	err := s.do("Ledger", func() error {
+		var err error
+		entries, err = s.Store.Ledger(userID)
+		return err
+	})
+	return entries, err
+}
+
+func (s *retryingStore) UserBalance(userID string) (UserBalance, error) {
+	var balance UserBalance
+	err := s.do("UserBalance", func() error {
+		var err error
+		balance, err = s.Store.UserBalance(userID)
+		return err
+	})
+	return balance, err
+}
+
+func (s *retryingStore) Leaderboard(bucket string, limit int) ([]LeaderboardEntry, error) {
+	var entries []LeaderboardEntry
+	err := s.do("Leaderboard", func() error {
+		var err error
+		entries, err = s.Store.Leaderboard(bucket, limit)
+		return err
+	})
+	return entries, err
+}
+
+func (s *retryingStore) ExpiringLedgerUsers(before time.Time) ([]string, error) {
+	var users []string
+	err := s.do("ExpiringLedgerUsers", func() error {
+		var err error
+		users, err = s.Store.ExpiringLedgerUsers(before)
+		return err
+	})
+	return users, err
+}
+
+// replicatingStore writes to a primary Store and any number of secondaries,
+// reading only from the primary. It supports migrating between backends:
+// run with the new backend as a secondary until it is backfilled, then swap.
+// Only primary failures are returned; secondary failures are logged.
+type replicatingStore struct {
+	Store       // the primary; unwrapped methods read from it
+	secondaries []Store
+	logger      *slog.Logger
+}
+
+// newReplicatingStore returns a store replicating writes from primary to secondaries.
+func newReplicatingStore(primary Store, secondaries []Store, logger *slog.Logger) *replicatingStore {
+	return &replicatingStore{Store: primary, secondaries: secondaries, logger: logger}
+}
+
+// replicate applies op to each secondary, logging failures.
+func (s *replicatingStore) replicate(method string, op func(Store) error) {
+	for i, secondary := range s.secondaries {
+		if err := op(secondary); err != nil {
+			s.logger.Error("Secondary store write failed", slog.String("method", method), slog.Int("secondary", i), slog.Any("error", err))
+		}
+	}
+}
+
+func (s *replicatingStore) Save(rec StoredReceipt) error {
+	if err := s.Store.Save(rec); err != nil {
+		return err
+	}
+	s.replicate("Save", func(secondary Store) error { return secondary.Save(rec) })
+	return nil
+}
+
+func (s *replicatingStore) Update(id string, fn func(*StoredReceipt) error) (StoredReceipt, bool, error) {
+	rec, found, err := s.Store.Update(id, fn)
+	if err != nil || !found {
+		return rec, found, err
+	}
+	// Copy the primary's result rather than re-running fn against state that may differ
+	s.replicate("Update", func(secondary Store) error { return secondary.Save(rec) })
+	return rec, found, nil
+}
+
+func (s *replicatingStore) Delete(id string) (bool, error) {
+	found, err := s.Store.Delete(id)
+	if err != nil {
+		return found, err
+	}
+	s.replicate("Delete", func(secondary Store) error {
+		_, err := secondary.Delete(id)
+		return err
+	})
+	return found, nil
+}
+
+func (s *replicatingStore) DeleteWhere(pred func(StoredReceipt) bool) (int, error) {
+	deleted, err := s.Store.DeleteWhere(pred)
+	if err != nil {
+		return deleted, err
+	}
+	s.replicate("DeleteWhere", func(secondary Store) error {
+		_, err := secondary.DeleteWhere(pred)
+		return err
+	})
+	return deleted, nil
+}
+
+func (s *replicatingStore) RecordCustomerPurchase(customerID string, date time.Time) (time.Time, bool, error) {
+	previous, found, err := s.Store.RecordCustomerPurchase(customerID, date)
+	if err != nil {
+		return previous, found, err
+	}
+	s.replicate("RecordCustomerPurchase", func(secondary Store) error {
+		_, _, err := secondary.RecordCustomerPurchase(customerID, date)
+		return err
+	})
+	return previous, found, nil
+}
+
+func (s *replicatingStore) ClaimRetailerDay(retailer string, date time.Time) (bool, error) {
+	claimed, err := s.Store.ClaimRetailerDay(retailer, date)
+	if err != nil || !claimed {
+		return claimed, err
+	}
+	s.replicate("ClaimRetailerDay", func(secondary Store) error {
+		_, err := secondary.ClaimRetailerDay(retailer, date)
+		return err
+	})
+	return true, nil
+}
+
+func (s *replicatingStore) ClaimFingerprint(fingerprint, id string, at time.Time, window time.Duration) (string, bool, error) {
+	holder, claimed, err := s.Store.ClaimFingerprint(fingerprint, id, at, window)
+	if err != nil || !claimed {
+		return holder, claimed, err
+	}
+	// A zero window makes the secondary record the claim unconditionally
+	s.replicate("ClaimFingerprint", func(secondary Store) error {
+		_, _, err := secondary.ClaimFingerprint(fingerprint, id, at, 0)
+		return err
+	})
+	return "", true, nil
+}
+
+func (s *replicatingStore) ReleaseFingerprint(fingerprint, id string) error {
+	if err := s.Store.ReleaseFingerprint(fingerprint, id); err != nil {
+		return err
+	}
+	s.replicate("ReleaseFingerprint", func(secondary Store) error { return secondary.ReleaseFingerprint(fingerprint, id) })
+	return nil
+}
+
+func (s *replicatingStore) ReserveIdempotencyKey(key, requestHash string, at time.Time, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	rec, reserved, err := s.Store.ReserveIdempotencyKey(key, requestHash, at, ttl)
+	if err != nil || !reserved {
+		return rec, reserved, err
+	}
+	s.replicate("ReserveIdempotencyKey", func(secondary Store) error {
+		_, _, err := secondary.ReserveIdempotencyKey(key, requestHash, at, ttl)
+		return err
+	})
+	return rec, true, nil
+}
+
+func (s *replicatingStore) CompleteIdempotencyKey(key, receiptID string) error {
+	if err := s.Store.CompleteIdempotencyKey(key, receiptID); err != nil {
+		return err
+	}
+	s.replicate("CompleteIdempotencyKey", func(secondary Store) error { return secondary.CompleteIdempotencyKey(key, receiptID) })
+	return nil
+}
+
+func (s *replicatingStore) ReleaseIdempotencyKey(key string) error {
+	if err := s.Store.ReleaseIdempotencyKey(key); err != nil {
+		return err
+	}
+	s.replicate("ReleaseIdempotencyKey", func(secondary Store) error { return secondary.ReleaseIdempotencyKey(key) })
+	return nil
+}
+
+func (s *replicatingStore) SaveAPIKey(key APIKey) error {
+	if err := s.Store.SaveAPIKey(key); err != nil {
+		return err
+	}
+	s.replicate("SaveAPIKey", func(secondary Store) error { return secondary.SaveAPIKey(key) })
+	return nil
+}
+
+func (s *replicatingStore) UpdateAPIKey(id string, fn func(*APIKey) error) (APIKey, bool, error) {
+	key, found, err := s.Store.UpdateAPIKey(id, fn)
+	if err != nil || !found {
+		return key, found, err
+	}
+	s.replicate("UpdateAPIKey", func(secondary Store) error { return secondary.SaveAPIKey(key) })
+	return key, true, nil
+}
+
+func (s *replicatingStore) AddLedgerEntry(entry LedgerEntry, checkBalance bool) (int64, bool, error) {
+	balance, added, err := s.Store.AddLedgerEntry(entry, checkBalance)
+	if err != nil || !added {
+		return balance, added, err
+	}
+	// The primary checked the balance; a secondary still being backfilled
+	// may not hold enough to cover the debit
+	s.replicate("AddLedgerEntry", func(secondary Store) error {
+		_, _, err := secondary.AddLedgerEntry(entry, false)
+		return err
+	})
+	return balance, true, nil
+}
+
+// StoreObserver receives the outcome of every store operation.
+type StoreObserver interface {
+	ObserveStoreOp(method string, latency time.Duration, err error)
+}
+
+// observableStore decorates a Store, reporting the latency and error of
+// each call to an observer, so every backend is instrumented the same way.
+// A receipt not being found is not an error.
+type observableStore struct {
+	store    Store
+	observer StoreObserver
+}
+
+// newObservableStore wraps store so that every call is reported to observer.
+func newObservableStore(store Store, observer StoreObserver) *observableStore {
+	return &observableStore{store: store, observer: observer}
+}
+
+// observe reports one call that started at start and returned err.
+func (s *observableStore) observe(method string, start time.Time, err error) {
+	s.observer.ObserveStoreOp(method, time.Since(start), err)
+}
+
+func (s *observableStore) Save(rec StoredReceipt) error {
+	start := time.Now()
+	err := s.store.Save(rec)
+	s.observe("Save", start, err)
+	return err
+}
+
+func (s *observableStore) Get(id string) (StoredReceipt, bool, error) {
+	start := time.Now()
+	rec, found, err := s.store.Get(id)
+	s.observe("Get", start, err)
+	return rec, found, err
+}
+
+func (s *observableStore) Exists(id string) (bool, error) {
+	start := time.Now()
+	found, err := s.store.Exists(id)
+	s.observe("Exists", start, err)
+	return found, err
+}
+
+func (s *observableStore) Update(id string, fn func(*StoredReceipt) error) (StoredReceipt, bool, error) {
+	start := time.Now()
+	rec, found, err := s.store.Update(id, fn)
+	s.observe("Update", start, err)
+	return rec, found, err
+}
+
+func (s *observableStore) Delete(id string) (bool, error) {
+	start := time.Now()
+	found, err := s.store.Delete(id)
+	s.observe("Delete", start, err)
+	return found, err
+}
+
+func (s *observableStore) DeleteWhere(pred func(StoredReceipt) bool) (int, error) {
+	start := time.Now()
+	deleted, err := s.store.DeleteWhere(pred)
+	s.observe("DeleteWhere", start, err)
+	return deleted, err
+}
+
+func (s *observableStore) RecordCustomerPurchase(customerID string, date time.Time) (time.Time, bool, error) {
+	start := time.Now()
+	previous, found, err := s.store.RecordCustomerPurchase(customerID, date)
+	s.observe("RecordCustomerPurchase", start, err)
+	return previous, found, err
+}
+
+func (s *observableStore) ClaimRetailerDay(retailer string, date time.Time) (bool, error) {
+	start := time.Now()
+	claimed, err := s.store.ClaimRetailerDay(retailer, date)
+	s.observe("ClaimRetailerDay", start, err)
+	return claimed, err
+}
+
+func (s *observableStore) ClaimFingerprint(fingerprint, id string, at time.Time, window time.Duration) (string, bool, error) {
+	start := time.Now()
+	holder, claimed, err := s.store.ClaimFingerprint(fingerprint, id, at, window)
+	s.observe("ClaimFingerprint", start, err)
+	return holder, claimed, err
+}
+
+func (s *observableStore) ReleaseFingerprint(fingerprint, id string) error {
+	start := time.Now()
+	err := s.store.ReleaseFingerprint(fingerprint, id)
+	s.observe("ReleaseFingerprint", start, err)
+	return err
+}
+
+func (s *observableStore) ReserveIdempotencyKey(key, requestHash string, at time.Time, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	start := time.Now()
+	rec, reserved, err := s.store.ReserveIdempotencyKey(key, requestHash, at, ttl)
+	s.observe("ReserveIdempotencyKey", start, err)
+	return rec, reserved, err
+}
+
+func (s *observableStore) CompleteIdempotencyKey(key, receiptID string) error {
+	start := time.Now()
+	err := s.store.CompleteIdempotencyKey(key, receiptID)
+	s.observe("CompleteIdempotencyKey", start, err)
+	return err
+}
+
+func (s *observableStore) ReleaseIdempotencyKey(key string) error {
+	start := time.Now()
+	err := s.store.ReleaseIdempotencyKey(key)
+	s.observe("ReleaseIdempotencyKey", start, err)
+	return err
+}
+
+func (s *observableStore) Rank(id string) (ReceiptRank, bool, error) {
+	start := time.Now()
+	rank, found, err := s.store.Rank(id)
+	s.observe("Rank", start, err)
+	return rank, found, err
+}
+
+func (s *observableStore) ProcessedBetween(from, to time.Time) ([]StoredReceipt, error) {
+	start := time.Now()
+	recs, err := s.store.ProcessedBetween(from, to)
+	s.observe("ProcessedBetween", start, err)
+	return recs, err
+}
+
+func (s *observableStore) ProcessedPage(after time.Time, afterID string, to time.Time, limit int) ([]StoredReceipt, error) {
+	start := time.Now()
+	recs, err := s.store.ProcessedPage(after, afterID, to, limit)
+	s.observe("ProcessedPage", start, err)
+	return recs, err
+}
+
+func (s *observableStore) RetailerStats() ([]RetailerStats, error) {
+	start := time.Now()
+	stats, err := s.store.RetailerStats()
+	s.observe("RetailerStats", start, err)
+	return stats, err
+}
+
+func (s *observableStore) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.store.Ping(ctx)
+	s.observe("Ping", start, err)
+	return err
+}
+
+func (s *observableStore) SaveAPIKey(key APIKey) error {
+	start := time.Now()
+	err := s.store.SaveAPIKey(key)
+	s.observe("SaveAPIKey", start, err)
+	return err
+}
+
+func (s *observableStore) APIKeyByHash(hash string) (APIKey, bool, error) {
+	start := time.Now()
+	key, found, err := s.store.APIKeyByHash(hash)
+	s.observe("APIKeyByHash", start, err)
+	return key, found, err
+}
+
+func (s *observableStore) APIKeys() ([]APIKey, error) {
+	start := time.Now()
+	keys, err := s.store.APIKeys()
+	s.observe("APIKeys", start, err)
+	return keys, err
+}
+
+func (s *observableStore) UpdateAPIKey(id string, fn func(*APIKey) error) (APIKey, bool, error) {
+	start := time.Now()
+	key, found, err := s.store.UpdateAPIKey(id, fn)
+	s.observe("UpdateAPIKey", start, err)
+	return key, found, err
+}
+
+func (s *observableStore) AddLedgerEntry(entry LedgerEntry, checkBalance bool) (int64, bool, error) {
+	start := time.Now()
+	balance, added, err := s.store.AddLedgerEntry(entry, checkBalance)
+	s.observe("AddLedgerEntry", start, err)
+	return balance, added, err
+}
+
+func (s *observableStore) Ledger(userID string) ([]LedgerEntry, error) {
+	start := time.Now()
+	entries, err := s.store.Ledger(userID)
+	s.observe("Ledger", start, err)
+	return entries, err
+}
+
+func (s *observableStore) UserBalance(userID string) (UserBalance, error) {
+	start := time.Now()
+	balance, err := s.store.UserBalance(userID)
+	s.observe("UserBalance", start, err)
+	return balance, err
+}
+
+func (s *observableStore) Leaderboard(bucket string, limit int) ([]LeaderboardEntry, error) {
+	start := time.Now()
+	entries, err := s.store.Leaderboard(bucket, limit)
+	s.observe("Leaderboard", start, err)
+	return entries, err
+}
+
+func (s *observableStore) ExpiringLedgerUsers(before time.Time) ([]string, error) {
+	start := time.Now()
+	users, err := s.store.ExpiringLedgerUsers(before)
+	s.observe("ExpiringLedgerUsers", start, err)
+	return users, err
+}
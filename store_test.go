@@ -0,0 +1,537 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// saveAll saves recs to store.
+func saveAll(t *testing.T, store Store, recs ...StoredReceipt) {
+	t.Helper()
+	for _, rec := range recs {
+		if err := store.Save(rec); err != nil {
+			t.Fatalf("Save %s: %v", rec.ID, err)
+		}
+	}
+}
+
+// storedIDs returns the ids among ids that store holds.
+func storedIDs(t *testing.T, store Store, ids ...string) []string {
+	t.Helper()
+	var found []string
+	for _, id := range ids {
+		ok, err := store.Exists(id)
+		if err != nil {
+			t.Fatalf("Exists %s: %v", id, err)
+		}
+		if ok {
+			found = append(found, id)
+		}
+	}
+	return found
+}
+
+func TestDeleteWhere(t *testing.T) {
+	seed := []StoredReceipt{
+		{ID: "a", Retailer: "Target", PurchaseDate: time.Date(2022, 1, 15, 0, 0, 0, 0, time.UTC), Points: 10},
+		{ID: "b", Retailer: "Target", PurchaseDate: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), Points: 20},
+		{ID: "c", Retailer: "Walgreens", PurchaseDate: time.Date(2022, 1, 20, 0, 0, 0, 0, time.UTC), Points: 30},
+	}
+	cutoff := time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		pred        func(StoredReceipt) bool
+		wantDeleted int
+		wantLeft    []string
+	}{
+		{name: "by date", pred: func(rec StoredReceipt) bool { return rec.PurchaseDate.Before(cutoff) }, wantDeleted: 2, wantLeft: []string{"b"}},
+		{name: "by retailer", pred: func(rec StoredReceipt) bool { return strings.EqualFold(rec.Retailer, "target") }, wantDeleted: 2, wantLeft: []string{"c"}},
+		{name: "none", pred: func(StoredReceipt) bool { return false }, wantDeleted: 0, wantLeft: []string{"a", "b", "c"}},
+	}
+	for _, backend := range testBackends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				store := backend.open(t)
+				saveAll(t, store, seed...)
+				deleted, err := store.DeleteWhere(tt.pred)
+				if err != nil {
+					t.Fatalf("DeleteWhere: %v", err)
+				}
+				if deleted != tt.wantDeleted {
+					t.Errorf("deleted = %d, want %d", deleted, tt.wantDeleted)
+				}
+				if left := storedIDs(t, store, "a", "b", "c"); !slices.Equal(left, tt.wantLeft) {
+					t.Errorf("receipts left = %v, want %v", left, tt.wantLeft)
+				}
+				// The rank index must forget the deleted receipts too
+				for _, id := range tt.wantLeft {
+					rank, _, err := store.Rank(id)
+					if err != nil {
+						t.Fatalf("Rank %s: %v", id, err)
+					}
+					if rank.Total != len(tt.wantLeft) {
+						t.Errorf("Rank(%s).Total = %d, want %d", id, rank.Total, len(tt.wantLeft))
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	seed := []StoredReceipt{
+		{ID: "low", Points: 10},
+		{ID: "tied-1", Points: 28},
+		{ID: "tied-2", Points: 28},
+		{ID: "high", Points: 109},
+	}
+	tests := []struct {
+		id        string
+		want      ReceiptRank
+		wantFound bool
+	}{
+		{id: "high", want: ReceiptRank{Points: 109, Rank: 1, Total: 4, AtOrBelow: 4}, wantFound: true},
+		{id: "tied-1", want: ReceiptRank{Points: 28, Rank: 2, Total: 4, AtOrBelow: 3}, wantFound: true},
+		{id: "tied-2", want: ReceiptRank{Points: 28, Rank: 2, Total: 4, AtOrBelow: 3}, wantFound: true},
+		{id: "low", want: ReceiptRank{Points: 10, Rank: 4, Total: 4, AtOrBelow: 1}, wantFound: true},
+		{id: "missing"},
+	}
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			saveAll(t, store, seed...)
+			for _, tt := range tests {
+				rank, found, err := store.Rank(tt.id)
+				if err != nil {
+					t.Fatalf("Rank %s: %v", tt.id, err)
+				}
+				if found != tt.wantFound || rank != tt.want {
+					t.Errorf("Rank(%s) = %+v, %v, want %+v, %v", tt.id, rank, found, tt.want, tt.wantFound)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordCustomerPurchase(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2022, 1, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name      string
+		dates     []time.Time // recorded before date
+		date      time.Time
+		wantFound bool
+		want      time.Time
+	}{
+		{name: "first purchase", date: day(1)},
+		{name: "previous day", dates: []time.Time{day(1)}, date: day(2), wantFound: true, want: day(1)},
+		{name: "latest of several", dates: []time.Time{day(1), day(3)}, date: day(4), wantFound: true, want: day(3)},
+		{name: "earlier date does not move it back", dates: []time.Time{day(5), day(2)}, date: day(6), wantFound: true, want: day(5)},
+	}
+	for _, backend := range testBackends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				store := backend.open(t)
+				for _, d := range tt.dates {
+					if _, _, err := store.RecordCustomerPurchase("alice", d); err != nil {
+						t.Fatalf("RecordCustomerPurchase: %v", err)
+					}
+				}
+				// Another customer's purchases are kept apart
+				if _, _, err := store.RecordCustomerPurchase("bob", day(28)); err != nil {
+					t.Fatalf("RecordCustomerPurchase: %v", err)
+				}
+				got, found, err := store.RecordCustomerPurchase("alice", tt.date)
+				if err != nil {
+					t.Fatalf("RecordCustomerPurchase: %v", err)
+				}
+				if found != tt.wantFound || !got.Equal(tt.want) {
+					t.Errorf("RecordCustomerPurchase = %v, %v; want %v, %v", got, found, tt.want, tt.wantFound)
+				}
+			})
+		}
+	}
+}
+
+// flakyStore is a memory store whose Save, Get, and Delete fail with err
+// the first failures times each is called. It counts every call.
+type flakyStore struct {
+	Store
+	failures int
+	err      error
+
+	mu    sync.Mutex // handlers call it from the server's goroutines
+	calls map[string]int
+}
+
+func newFlakyStore(failures int, err error) *flakyStore {
+	return &flakyStore{Store: newMemoryStore(normalizeRetailer), failures: failures, err: err, calls: make(map[string]int)}
+}
+
+// fail counts a call to method and reports whether it should fail.
+func (s *flakyStore) fail(method string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[method]++
+	return s.calls[method] <= s.failures
+}
+
+// count returns how many times method was called.
+func (s *flakyStore) count(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+func (s *flakyStore) Save(rec StoredReceipt) error {
+	if s.fail("Save") {
+		return s.err
+	}
+	return s.Store.Save(rec)
+}
+
+func (s *flakyStore) Get(id string) (StoredReceipt, bool, error) {
+	if s.fail("Get") {
+		return StoredReceipt{}, false, s.err
+	}
+	return s.Store.Get(id)
+}
+
+func (s *flakyStore) Delete(id string) (bool, error) {
+	if s.fail("Delete") {
+		return false, s.err
+	}
+	return s.Store.Delete(id)
+}
+
+// temporaryError is a transient error recognized by its Temporary method.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "connection reset" }
+func (temporaryError) Temporary() bool { return true }
+
+func TestRetryingStore(t *testing.T) {
+	transient := fmt.Errorf("dial: %w", errTransient)
+	permanent := errors.New("constraint violated")
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		retries   int
+		timeout   time.Duration
+		wantErr   error // nil for success
+		wantCalls int   // of Save and of Get each
+	}{
+		{name: "no failures", retries: 3, wantCalls: 1},
+		{name: "succeeds on the second attempt", failures: 1, err: transient, retries: 3, wantCalls: 2},
+		{name: "succeeds on the last attempt", failures: 3, err: transient, retries: 3, wantCalls: 4},
+		{name: "Temporary method", failures: 2, err: temporaryError{}, retries: 3, wantCalls: 3},
+		{name: "out of retries", failures: 5, err: transient, retries: 2, wantErr: transient, wantCalls: 3},
+		{name: "permanent error not retried", failures: 1, err: permanent, retries: 3, wantErr: permanent, wantCalls: 1},
+		{name: "no retries configured", failures: 1, err: transient, wantErr: transient, wantCalls: 1},
+		{name: "deadline", failures: 5, err: transient, retries: 100, timeout: 5 * time.Millisecond, wantErr: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flaky := newFlakyStore(tt.failures, tt.err)
+			timeout := cmp.Or(tt.timeout, time.Minute)
+			store := newRetryingStore(flaky, tt.retries, time.Millisecond, timeout, slog.New(slog.DiscardHandler))
+			saveErr := store.Save(StoredReceipt{ID: "a", Points: 28})
+			_, found, getErr := store.Get("a")
+			for method, err := range map[string]error{"Save": saveErr, "Get": getErr} {
+				if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+					t.Errorf("%s error = %v, want %v", method, err, tt.wantErr)
+				}
+				if tt.wantCalls != 0 && flaky.count(method) != tt.wantCalls {
+					t.Errorf("%s called %d times, want %d", method, flaky.count(method), tt.wantCalls)
+				}
+			}
+			if tt.timeout != 0 && flaky.count("Save") > tt.retries/2 {
+				t.Errorf("Save called %d times; the deadline should have stopped the retries", flaky.count("Save"))
+			}
+			if tt.wantErr == nil && !found {
+				t.Error("Get did not find the saved receipt")
+			}
+		})
+	}
+}
+
+func TestRetryingStorePassesThrough(t *testing.T) {
+	// Delete is not safe to repeat, so even a transient failure is returned
+	flaky := newFlakyStore(1, errTransient)
+	store := newRetryingStore(flaky, 3, time.Millisecond, time.Minute, slog.New(slog.DiscardHandler))
+	if _, err := store.Delete("a"); !errors.Is(err, errTransient) {
+		t.Errorf("Delete error = %v, want %v", err, errTransient)
+	}
+	if calls := flaky.count("Delete"); calls != 1 {
+		t.Errorf("Delete called %d times, want 1", calls)
+	}
+}
+
+func TestExistsMatchesGet(t *testing.T) {
+	tests := []struct {
+		name   string
+		saved  []string
+		delete []string
+		id     string
+	}{
+		{name: "saved", saved: []string{"a", "b"}, id: "a"},
+		{name: "never saved", saved: []string{"a"}, id: "z"},
+		{name: "empty store", id: "a"},
+		{name: "deleted", saved: []string{"a", "b"}, delete: []string{"a"}, id: "a"},
+		{name: "other deleted", saved: []string{"a", "b"}, delete: []string{"b"}, id: "a"},
+	}
+	for _, backend := range testBackends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				store := backend.open(t)
+				for _, id := range tt.saved {
+					saveAll(t, store, StoredReceipt{ID: id, Retailer: "Target", Points: 28})
+				}
+				for _, id := range tt.delete {
+					if _, err := store.Delete(id); err != nil {
+						t.Fatalf("Delete %s: %v", id, err)
+					}
+				}
+				_, found, err := store.Get(tt.id)
+				if err != nil {
+					t.Fatalf("Get: %v", err)
+				}
+				exists, err := store.Exists(tt.id)
+				if err != nil {
+					t.Fatalf("Exists: %v", err)
+				}
+				if exists != found {
+					t.Errorf("Exists = %v, Get found = %v", exists, found)
+				}
+			})
+		}
+	}
+}
+
+func TestReplicatingStore(t *testing.T) {
+	failing := errors.New("disk full")
+	rec := StoredReceipt{ID: "a", Retailer: "Target", Points: 28}
+	tests := []struct {
+		name           string
+		primaryFails   bool
+		replicaFails   []bool // one entry per secondary
+		wantErr        error
+		wantReplicated []bool // whether each secondary holds the receipt
+	}{
+		{name: "one secondary", replicaFails: []bool{false}, wantReplicated: []bool{true}},
+		{name: "two secondaries", replicaFails: []bool{false, false}, wantReplicated: []bool{true, true}},
+		{name: "failing secondary", replicaFails: []bool{true, false}, wantReplicated: []bool{false, true}},
+		{name: "failing primary", primaryFails: true, replicaFails: []bool{false}, wantErr: failing, wantReplicated: []bool{false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newFlakyStore(0, nil)
+			if tt.primaryFails {
+				primary = newFlakyStore(math.MaxInt, failing)
+			}
+			var secondaries []Store
+			for _, fails := range tt.replicaFails {
+				secondary := newFlakyStore(0, nil)
+				if fails {
+					secondary = newFlakyStore(math.MaxInt, failing)
+				}
+				secondaries = append(secondaries, secondary)
+			}
+			store := newReplicatingStore(primary, secondaries, slog.New(slog.DiscardHandler))
+			if err := store.Save(rec); !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("Save error = %v, want %v", err, tt.wantErr)
+			}
+			for i, secondary := range secondaries {
+				// Read past the fake, which would fail the read as it did the write
+				_, found, _ := secondary.(*flakyStore).Store.Get(rec.ID)
+				if found != tt.wantReplicated[i] {
+					t.Errorf("secondary %d holds the receipt = %v, want %v", i, found, tt.wantReplicated[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReplicatingStoreReads(t *testing.T) {
+	primary, secondary := newMemoryStore(normalizeRetailer), newFlakyStore(0, nil)
+	store := newReplicatingStore(primary, []Store{secondary}, slog.New(slog.DiscardHandler))
+	// Each store holds a receipt the other lacks, as while a secondary is backfilled
+	saveAll(t, primary, StoredReceipt{ID: "primary-only", Points: 10})
+	saveAll(t, secondary.Store, StoredReceipt{ID: "secondary-only", Points: 20})
+	tests := []struct {
+		id        string
+		wantFound bool
+	}{
+		{id: "primary-only", wantFound: true},
+		{id: "secondary-only", wantFound: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			_, found, err := store.Get(tt.id)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			exists, err := store.Exists(tt.id)
+			if err != nil {
+				t.Fatalf("Exists: %v", err)
+			}
+			if found != tt.wantFound || exists != tt.wantFound {
+				t.Errorf("Get found = %v, Exists = %v; want %v", found, exists, tt.wantFound)
+			}
+		})
+	}
+	if calls := secondary.count("Get"); calls != 0 {
+		t.Errorf("secondary read %d times, want never", calls)
+	}
+
+	// Removal is replicated too
+	saveAll(t, store, StoredReceipt{ID: "both", Points: 30})
+	if _, err := store.Delete("both"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if found := storedIDs(t, secondary.Store, "both"); len(found) != 0 {
+		t.Errorf("secondary still holds %v after Delete", found)
+	}
+}
+
+func TestObservableStore(t *testing.T) {
+	// The fake fails the first call of each method and counts every call
+	fake := newFlakyStore(1, errors.New("disk full"))
+	metrics := newStoreMetrics()
+	store := newObservableStore(fake, metrics)
+	rec := StoredReceipt{ID: "observed", Points: 10}
+	for range 2 {
+		store.Save(rec)
+	}
+	for _, id := range []string{"observed", "observed", "missing"} {
+		store.Get(id)
+	}
+	store.Delete("observed")
+
+	snapshot := metrics.Snapshot()
+	tests := []struct {
+		method     string
+		wantCalls  int64
+		wantErrors int64
+	}{
+		{method: "Save", wantCalls: 2, wantErrors: 1},
+		// A receipt not found is an answer, not an error
+		{method: "Get", wantCalls: 3, wantErrors: 1},
+		{method: "Delete", wantCalls: 1, wantErrors: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			got := snapshot[tt.method]
+			if got.Calls != tt.wantCalls || got.Errors != tt.wantErrors {
+				t.Errorf("recorded %d calls, %d errors; want %d, %d", got.Calls, got.Errors, tt.wantCalls, tt.wantErrors)
+			}
+			if calls := int64(fake.count(tt.method)); got.Calls != calls {
+				t.Errorf("recorded %d calls, store received %d", got.Calls, calls)
+			}
+			if got.MaxLatency > got.Latency {
+				t.Errorf("max latency %v exceeds total %v", got.MaxLatency, got.Latency)
+			}
+		})
+	}
+	if _, ok := snapshot["Exists"]; ok {
+		t.Error("recorded Exists, which was never called")
+	}
+}
+
+func TestProcessedBetween(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	hour := func(n int) time.Time { return start.Add(time.Duration(n) * time.Hour) }
+	tests := []struct {
+		name     string
+		from, to time.Time
+		wantIDs  []string
+	}{
+		{name: "unbounded", wantIDs: []string{"first", "second", "third"}},
+		{name: "from inclusive, to exclusive", from: hour(1), to: hour(2), wantIDs: []string{"second"}},
+		{name: "from only", from: hour(1), wantIDs: []string{"second", "third"}},
+		{name: "to only", to: hour(1), wantIDs: []string{"first"}},
+		{name: "after all", from: hour(3), wantIDs: nil},
+	}
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			// Saved out of order, listed oldest first
+			saveAll(t, store,
+				StoredReceipt{ID: "third", Points: 3, ProcessedAt: hour(2)},
+				StoredReceipt{ID: "first", Points: 1, ProcessedAt: hour(0)},
+				StoredReceipt{ID: "second", Points: 2, ProcessedAt: hour(1)},
+			)
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					recs, err := store.ProcessedBetween(tt.from, tt.to)
+					if err != nil {
+						t.Fatalf("ProcessedBetween: %v", err)
+					}
+					var got []string
+					for _, rec := range recs {
+						got = append(got, rec.ID)
+					}
+					if !slices.Equal(got, tt.wantIDs) {
+						t.Errorf("receipts = %v, want %v", got, tt.wantIDs)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestProcessedPage(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	hour := func(n int) time.Time { return start.Add(time.Duration(n) * time.Hour) }
+	tests := []struct {
+		name    string
+		after   time.Time
+		afterID string
+		to      time.Time
+		limit   int
+		wantIDs []string
+	}{
+		{name: "first page", limit: 2, wantIDs: []string{"first", "second-a"}},
+		{name: "after a cursor", after: hour(1), afterID: "second-a", limit: 2, wantIDs: []string{"second-b", "third"}},
+		{name: "after the last", after: hour(2), afterID: "third", limit: 2, wantIDs: nil},
+		{name: "from an instant, inclusive", after: hour(1), limit: 1, wantIDs: []string{"second-a"}},
+		{name: "to exclusive", to: hour(2), limit: 10, wantIDs: []string{"first", "second-a", "second-b"}},
+		{name: "cursor and to", after: hour(0), afterID: "first", to: hour(2), limit: 10, wantIDs: []string{"second-a", "second-b"}},
+	}
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			// Ties in processing time are ordered by id
+			saveAll(t, store,
+				StoredReceipt{ID: "third", Points: 3, ProcessedAt: hour(2)},
+				StoredReceipt{ID: "second-b", Points: 2, ProcessedAt: hour(1)},
+				StoredReceipt{ID: "first", Points: 1, ProcessedAt: hour(0)},
+				StoredReceipt{ID: "second-a", Points: 2, ProcessedAt: hour(1)},
+			)
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					recs, err := store.ProcessedPage(tt.after, tt.afterID, tt.to, tt.limit)
+					if err != nil {
+						t.Fatalf("ProcessedPage: %v", err)
+					}
+					var got []string
+					for _, rec := range recs {
+						got = append(got, rec.ID)
+					}
+					if !slices.Equal(got, tt.wantIDs) {
+						t.Errorf("receipts = %v, want %v", got, tt.wantIDs)
+					}
+				})
+			}
+		})
+	}
+}
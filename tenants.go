@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// tenantHeader selects the tenant of a request made with credentials that
+// are not bound to one.
+const tenantHeader = "X-Tenant-ID"
+
+// tenantPattern matches a valid tenant id. It cannot contain the separator
+// of namespaced keys, nor start like defaultTenantLabel.
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,62}$`)
+
+// defaultTenantLabel names the default tenant, that of requests without
+// one, in metrics.
+const defaultTenantLabel = "_default"
+
+// tenantSeparator joins a tenant id to the receipt ids, customer ids, and
+// other keys it namespaces.
+const tenantSeparator = "/"
+
+type tenantKey struct{}
+
+// contextTenant returns the tenant of the request ctx belongs to, or "" for
+// the default tenant.
+func contextTenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantLabel returns tenant, naming the default tenant defaultTenantLabel.
+func tenantLabel(tenant string) string {
+	if tenant == "" {
+		return defaultTenantLabel
+	}
+	return tenant
+}
+
+// splitTenant splits a stored receipt id into its tenant and the id that
+// tenant knows it by.
+func splitTenant(id string) (tenant, local string) {
+	if tenant, local, ok := strings.Cut(id, tenantSeparator); ok {
+		return tenant, local
+	}
+	return "", id
+}
+
+// tenantMiddleware records the tenant of each request: the one its API key
+// is bound to or, for credentials bound to none, the X-Tenant-ID header.
+// Requests naming a tenant other than their key's get 403, and malformed
+// tenant ids get 400. Without multi-tenancy it returns next unchanged.
+func tenantMiddleware(next http.Handler, enabled bool, logger *slog.Logger) http.Handler {
+	if !enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get(tenantHeader)
+		if caller, ok := requestPrincipal(r); ok && caller.Tenant != "" {
+			if tenant != "" && tenant != caller.Tenant {
+				logger := requestLogger(r, logger)
+				logger.Warn("Rejected request for another tenant", slog.String("tenant", tenant), slog.String("api_key_id", caller.KeyID))
+				errorResponse(w, http.StatusForbidden, forbiddenMsg, logger)
+				return
+			}
+			tenant = caller.Tenant
+		}
+		if tenant != "" && !tenantPattern.MatchString(tenant) {
+			logger := requestLogger(r, logger)
+			logger.Warn("Invalid tenant id", slog.String("tenant", tenant))
+			errorResponse(w, http.StatusBadRequest, invalidTenantMsg, logger)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+	})
+}
+
+// tenantStore decorates a Store, confining it to one tenant's receipts. Each
+// tenant's receipt ids, and the customer, retailer, fingerprint, idempotency,
+// user, and ledger entry keys recorded for them, are stored prefixed with the
+// tenant id and separator, so tenants cannot collide or see each other's
+// data; the default tenant's are stored unprefixed, as they were before
+// tenants. API keys are not partitioned.
+//
+// Queries over many receipts (Rank, ProcessedBetween, ProcessedPage, and
+// RetailerStats) scan every tenant's receipts and keep this tenant's.
+type tenantStore struct {
+	Store
+	tenant string
+	prefix string
+	// retailerKey groups retailer names for RetailerStats.
+	retailerKey func(string) string
+}
+
+// newTenantStore returns store confined to tenant's receipts.
+func newTenantStore(store Store, tenant string, retailerKey func(string) string) *tenantStore {
+	s := &tenantStore{Store: store, tenant: tenant, retailerKey: retailerKey}
+	if tenant != "" {
+		s.prefix = tenant + tenantSeparator
+	}
+	return s
+}
+
+// key returns the stored form of one of the tenant's receipt ids. An id
+// containing the separator could name another tenant's receipt, so it is
+// reported as not valid.
+func (s *tenantStore) key(id string) (string, bool) {
+	if strings.Contains(id, tenantSeparator) {
+		return "", false
+	}
+	return s.prefix + id, true
+}
+
+// scoped returns the stored form of one of the tenant's customer, retailer,
+// fingerprint, or idempotency keys. The default tenant's are unprefixed, so
+// one containing the separator gets a leading separator instead, which no
+// other tenant's key has.
+func (s *tenantStore) scoped(key string) string {
+	if s.tenant == "" && strings.Contains(key, tenantSeparator) {
+		return tenantSeparator + key
+	}
+	return s.prefix + key
+}
+
+// local strips the tenant prefix from rec's id.
+func (s *tenantStore) local(rec StoredReceipt) StoredReceipt {
+	rec.ID = strings.TrimPrefix(rec.ID, s.prefix)
+	return rec
+}
+
+// owns reports whether the stored receipt id belongs to the tenant.
+func (s *tenantStore) owns(id string) bool {
+	tenant, _ := splitTenant(id)
+	return tenant == s.tenant
+}
+
+func (s *tenantStore) Save(rec StoredReceipt) error {
+	key, ok := s.key(rec.ID)
+	if !ok {
+		return fmt.Errorf("receipt id %q contains %q", rec.ID, tenantSeparator)
+	}
+	rec.ID = key
+	return s.Store.Save(rec)
+}
+
+func (s *tenantStore) Get(id string) (StoredReceipt, bool, error) {
+	key, ok := s.key(id)
+	if !ok {
+		return StoredReceipt{}, false, nil
+	}
+	rec, found, err := s.Store.Get(key)
+	return s.local(rec), found, err
+}
+
+func (s *tenantStore) Exists(id string) (bool, error) {
+	key, ok := s.key(id)
+	if !ok {
+		return false, nil
+	}
+	return s.Store.Exists(key)
+}
+
+func (s *tenantStore) Update(id string, fn func(*StoredReceipt) error) (StoredReceipt, bool, error) {
+	key, ok := s.key(id)
+	if !ok {
+		return StoredReceipt{}, false, nil
+	}
+	rec, found, err := s.Store.Update(key, func(rec *StoredReceipt) error {
+		rec.ID = id
+		return fn(rec)
+	})
+	return s.local(rec), found, err
+}
+
+func (s *tenantStore) Delete(id string) (bool, error) {
+	key, ok := s.key(id)
+	if !ok {
+		return false, nil
+	}
+	return s.Store.Delete(key)
+}
+
+func (s *tenantStore) DeleteWhere(pred func(StoredReceipt) bool) (int, error) {
+	return s.Store.DeleteWhere(func(rec StoredReceipt) bool {
+		return s.owns(rec.ID) && pred(s.local(rec))
+	})
+}
+
+func (s *tenantStore) RecordCustomerPurchase(customerID string, date time.Time) (time.Time, bool, error) {
+	return s.Store.RecordCustomerPurchase(s.scoped(customerID), date)
+}
+
+func (s *tenantStore) ClaimRetailerDay(retailer string, date time.Time) (bool, error) {
+	return s.Store.ClaimRetailerDay(s.scoped(retailer), date)
+}
+
+func (s *tenantStore) ClaimFingerprint(fingerprint, id string, at time.Time, window time.Duration) (string, bool, error) {
+	holder, claimed, err := s.Store.ClaimFingerprint(s.scoped(fingerprint), s.prefix+id, at, window)
+	return strings.TrimPrefix(holder, s.prefix), claimed, err
+}
+
+func (s *tenantStore) ReleaseFingerprint(fingerprint, id string) error {
+	return s.Store.ReleaseFingerprint(s.scoped(fingerprint), s.prefix+id)
+}
+
+func (s *tenantStore) ReserveIdempotencyKey(key, requestHash string, at time.Time, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	rec, reserved, err := s.Store.ReserveIdempotencyKey(s.scoped(key), requestHash, at, ttl)
+	rec.Key, rec.ReceiptID = key, strings.TrimPrefix(rec.ReceiptID, s.prefix)
+	return rec, reserved, err
+}
+
+func (s *tenantStore) CompleteIdempotencyKey(key, receiptID string) error {
+	return s.Store.CompleteIdempotencyKey(s.scoped(key), s.prefix+receiptID)
+}
+
+func (s *tenantStore) ReleaseIdempotencyKey(key string) error {
+	return s.Store.ReleaseIdempotencyKey(s.scoped(key))
+}
+
+func (s *tenantStore) Rank(id string) (ReceiptRank, bool, error) {
+	if strings.Contains(id, tenantSeparator) {
+		return ReceiptRank{}, false, nil
+	}
+	recs, err := s.ProcessedBetween(time.Time{}, time.Time{})
+	if err != nil {
+		return ReceiptRank{}, false, err
+	}
+	rank := ReceiptRank{Total: len(recs)}
+	found := false
+	for _, rec := range recs {
+		if rec.ID == id {
+			rank.Points, found = rec.Points, true
+		}
+	}
+	if !found {
+		return ReceiptRank{}, false, nil
+	}
+	for _, rec := range recs {
+		if rec.Points <= rank.Points {
+			rank.AtOrBelow++
+		}
+	}
+	rank.Rank = rank.Total - rank.AtOrBelow + 1
+	return rank, true, nil
+}
+
+func (s *tenantStore) ProcessedBetween(from, to time.Time) ([]StoredReceipt, error) {
+	recs, err := s.Store.ProcessedBetween(from, to)
+	if err != nil {
+		return nil, err
+	}
+	owned := recs[:0]
+	for _, rec := range recs {
+		if s.owns(rec.ID) {
+			owned = append(owned, s.local(rec))
+		}
+	}
+	return owned, nil
+}
+
+// ProcessedPage reads the store's pages until it has limit of the tenant's
+// receipts, or the store has no more.
+func (s *tenantStore) ProcessedPage(after time.Time, afterID string, to time.Time, limit int) ([]StoredReceipt, error) {
+	if afterID != "" {
+		afterID = s.prefix + afterID
+	}
+	var page []StoredReceipt
+	for len(page) < limit {
+		recs, err := s.Store.ProcessedPage(after, afterID, to, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range recs {
+			if s.owns(rec.ID) && len(page) < limit {
+				page = append(page, s.local(rec))
+			}
+		}
+		if len(recs) < limit {
+			break
+		}
+		last := recs[len(recs)-1]
+		after, afterID = last.ProcessedAt, last.ID
+	}
+	return page, nil
+}
+
+func (s *tenantStore) RetailerStats() ([]RetailerStats, error) {
+	recs, err := s.ProcessedBetween(time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return groupRetailerStats(recs, s.retailerKey), nil
+}
+
+func (s *tenantStore) AddLedgerEntry(entry LedgerEntry, checkBalance bool) (int64, bool, error) {
+	entry.ID, entry.UserID = s.prefix+entry.ID, s.scoped(entry.UserID)
+	return s.Store.AddLedgerEntry(entry, checkBalance)
+}
+
+func (s *tenantStore) Ledger(userID string) ([]LedgerEntry, error) {
+	entries, err := s.Store.Ledger(s.scoped(userID))
+	for i := range entries {
+		entries[i].ID, entries[i].UserID = strings.TrimPrefix(entries[i].ID, s.prefix), userID
+	}
+	return entries, err
+}
+
+func (s *tenantStore) UserBalance(userID string) (UserBalance, error) {
+	balance, err := s.Store.UserBalance(s.scoped(userID))
+	balance.UserID = userID
+	return balance, err
+}
+
+// Leaderboard reads the tenant's own leaderboards, which leaderboardBuckets
+// keeps apart by the tenant prefix of each credit's id.
+func (s *tenantStore) Leaderboard(bucket string, limit int) ([]LeaderboardEntry, error) {
+	entries, err := s.Store.Leaderboard(s.prefix+bucket, limit)
+	for i := range entries {
+		_, entries[i].UserID = splitTenant(entries[i].UserID)
+	}
+	return entries, err
+}
+
+func (s *tenantStore) ExpiringLedgerUsers(before time.Time) ([]string, error) {
+	users, err := s.Store.ExpiringLedgerUsers(before)
+	var owned []string
+	for _, userID := range users {
+		if tenant, local := splitTenant(userID); tenant == s.tenant {
+			owned = append(owned, local)
+		}
+	}
+	return owned, err
+}
+
+// TenantStats counts the receipts stored for one tenant.
+type TenantStats struct {
+	Receipts int   `json:"receipts"`
+	Points   int64 `json:"points"`
+}
+
+// tenantStats counts the receipts stored for each tenant, keyed by
+// tenantLabel.
+func tenantStats(store Store) (map[string]TenantStats, error) {
+	recs, err := store.ProcessedBetween(time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]TenantStats)
+	for _, rec := range recs {
+		tenant, _ := splitTenant(rec.ID)
+		s := stats[tenantLabel(tenant)]
+		s.Receipts++
+		s.Points += rec.Points
+		stats[tenantLabel(tenant)] = s
+	}
+	return stats, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OTLP protocols accepted in OTEL_EXPORTER_OTLP_PROTOCOL.
+const (
+	otlpHTTP = "http/protobuf"
+	otlpGRPC = "grpc"
+)
+
+// tracerName identifies the service's spans. Until setupTracing installs a
+// provider, the global tracer discards them.
+const tracerName = "receipt-processor-challenge"
+
+var tracer = otel.Tracer(tracerName)
+
+// setupTracing installs a tracer provider exporting spans over OTLP with
+// protocol. The exporter, resource, and sampler read the remaining standard
+// OTEL_* variables themselves. The returned function flushes and stops the
+// exporter.
+func setupTracing(ctx context.Context, protocol string) (func(context.Context) error, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch protocol {
+	case otlpGRPC:
+		exporter, err = otlptracegrpc.New(ctx)
+	default:
+		exporter, err = otlptracehttp.New(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", tracerName)))
+	if err != nil {
+		return nil, err
+	}
+	// Detected last, so OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win
+	if res, err = resource.Merge(res, resource.Environment()); err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware starts a server span for each request, continuing any
+// trace the caller propagated. Spans are named by the route pattern the
+// request matches, like the request metrics. Without tracing it returns next
+// unchanged.
+func tracingMiddleware(next http.Handler, enabled bool, route func(*http.Request) string) http.Handler {
+	if !enabled {
+		return next
+	}
+	labelled := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.route", route(r)))
+		next.ServeHTTP(w, r)
+	})
+	return otelhttp.NewHandler(labelled, "http", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return route(r)
+	}))
+}
+
+// endSpan ends span, marking it failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedScore scores data under rules in a span of its own, returning the
+// breakdown and its total.
+func tracedScore(ctx context.Context, data *ValidatedReceiptData, rules PointsConfig) ([]RuleResult, int64) {
+	_, span := tracer.Start(ctx, "receipt.score")
+	defer span.End()
+	breakdown := calculatePointsBreakdown(data, rules)
+	points := sumBreakdown(breakdown)
+	span.SetAttributes(attribute.Int64("receipt.points", points), attribute.Int("receipt.items", len(data.Items)))
+	return breakdown, points
+}
+
+// storeSpans is a StoreObserver recording each store call as a child span
+// of a request's span, so store latency shows up in its trace.
+type storeSpans struct{ ctx context.Context }
+
+func (s storeSpans) ObserveStoreOp(method string, latency time.Duration, err error) {
+	end := time.Now()
+	_, span := tracer.Start(s.ctx, "store."+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithTimestamp(end.Add(-latency)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// tracedStore returns store instrumented to record its calls in r's trace,
+// or store itself without tracing.
+func tracedStore(store Store, enabled bool, r *http.Request) Store {
+	if !enabled {
+		return store
+	}
+	return newObservableStore(store, storeSpans{ctx: r.Context()})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxRedemptionReferenceLength bounds a redemption's reference.
+const maxRedemptionReferenceLength = 128
+
+// validUserID reports whether id is a well-formed user id, held to the same
+// form as customer ids.
+func validUserID(id string) bool {
+	return len(id) <= maxCustomerIDLength && idPatternRegex.MatchString(id)
+}
+
+// creditReceipt adds rec's points to the ledger of the user it was
+// submitted with, if any, to expire as cfg says. A receipt is credited only
+// once, however often this is called for it. Points of a purchase so old
+// that they have already expired are expired at once.
+func creditReceipt(store Store, rec StoredReceipt, cfg *Config, at time.Time) error {
+	if rec.Receipt.UserID == "" {
+		return nil
+	}
+	credit := LedgerEntry{
+		ID:        rec.ID,
+		UserID:    rec.Receipt.UserID,
+		Kind:      ledgerReceipt,
+		Points:    rec.Points,
+		CreatedAt: at,
+		ExpiresAt: creditExpiry(cfg, rec.PurchaseDate),
+	}
+	if _, _, err := store.AddLedgerEntry(credit, false); err != nil {
+		return err
+	}
+	if !credit.ExpiresAt.IsZero() && !credit.ExpiresAt.After(at) {
+		_, err := expirePoints(store, credit.UserID, at)
+		return err
+	}
+	return nil
+}
+
+// adjustmentEntryID returns the id of the nth adjustment to the credit with
+// the given id. Adjustments worked out from the same ledger share an id, so
+// of two racing ones only the first is added.
+func adjustmentEntryID(creditID string, n int) string {
+	return "adjustment-" + creditID + "-" + strconv.Itoa(n)
+}
+
+// adjustCredit brings the credit of the receipt receiptID to points, if the
+// receipt was credited to userID: its new points after a rescore, or zero
+// once it is removed. The difference is added to the ledger as an adjustment
+// referencing the credit. Only what the ledger still lacks is added, so
+// calling it again, or for a receipt never credited, adds nothing.
+func adjustCredit(store Store, userID, receiptID string, points int64, at time.Time) error {
+	if userID == "" {
+		return nil
+	}
+	for {
+		entries, err := store.Ledger(userID)
+		if err != nil {
+			return err
+		}
+		var credit LedgerEntry
+		var credited int64
+		var found bool
+		var adjustments int
+		for _, entry := range entries {
+			switch {
+			case entry.Kind == ledgerReceipt && entry.ID == receiptID:
+				credit = entry
+				credited += entry.Points
+				found = true
+			case entry.Kind == ledgerAdjustment && entry.Reference == receiptID:
+				credited += entry.Points
+				adjustments++
+			}
+		}
+		if !found || credited == points {
+			return nil
+		}
+		_, added, err := store.AddLedgerEntry(LedgerEntry{
+			ID:         adjustmentEntryID(receiptID, adjustments),
+			UserID:     userID,
+			Kind:       ledgerAdjustment,
+			Points:     points - credited,
+			Reference:  receiptID,
+			CreatedAt:  at,
+			CreditedAt: credit.CreatedAt,
+		}, false)
+		if err != nil || added {
+			return err
+		}
+		// Another adjustment was added meanwhile; start over from the ledger it left
+	}
+}
+
+// LedgerEntryResponse describes a ledger entry.
+type LedgerEntryResponse struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Points    int64     `json:"points"`
+	Reference string    `json:"reference,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+}
+
+// userIDFromPath returns the {id} of r's path, answering 400 and reporting
+// false if it is malformed.
+func userIDFromPath(w http.ResponseWriter, r *http.Request, logger *slog.Logger) (string, bool) {
+	id := r.PathValue("id")
+	if !validUserID(id) {
+		logger.Warn("Invalid user ID requested", slog.String("user_id", id))
+		errorResponse(w, http.StatusBadRequest, invalidUserIDMsg, logger)
+		return "", false
+	}
+	return id, true
+}
+
+// Handles GET /users/{id}/points requests, reporting the user's points
+// balance from their ledger: the points earned by their receipts, as
+// adjusted when they are rescored or removed, less those redeemed or
+// expired. A user with no ledger entries has a balance of zero.
+func getUserPointsHandler(w http.ResponseWriter, r *http.Request, store Store, logger *slog.Logger) {
+	id, ok := userIDFromPath(w, r, logger)
+	if !ok {
+		return
+	}
+	balance, err := store.UserBalance(id)
+	if err != nil {
+		logger.Error("Failed to compute user balance", slog.String("user_id", id), slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	type UserPointsResponse struct {
+		UserID   string `json:"userId"`
+		Points   int64  `json:"points"`
+		Earned   int64  `json:"earned"`
+		Redeemed int64  `json:"redeemed"`
+		Expired  int64  `json:"expired"`
+		Receipts int    `json:"receipts"`
+	}
+	logger.Info("User balance retrieved", slog.String("user_id", id), slog.Int64("points", balance.Points))
+	jsonResponse(w, http.StatusOK, UserPointsResponse{
+		UserID:   id,
+		Points:   balance.Points,
+		Earned:   balance.Earned,
+		Redeemed: balance.Redeemed,
+		Expired:  balance.Expired,
+		Receipts: balance.Receipts,
+	}, logger)
+}
+
+// Handles GET /users/{id}/ledger requests, listing the user's credits and
+// debits, oldest first.
+func getUserLedgerHandler(w http.ResponseWriter, r *http.Request, store Store, logger *slog.Logger) {
+	id, ok := userIDFromPath(w, r, logger)
+	if !ok {
+		return
+	}
+	entries, err := store.Ledger(id)
+	if err != nil {
+		logger.Error("Failed to read user ledger", slog.String("user_id", id), slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	type LedgerResponse struct {
+		UserID  string                `json:"userId"`
+		Entries []LedgerEntryResponse `json:"entries"`
+	}
+	resp := LedgerResponse{UserID: id, Entries: make([]LedgerEntryResponse, len(entries))}
+	for i, entry := range entries {
+		resp.Entries[i] = LedgerEntryResponse{ID: entry.ID, Kind: entry.Kind, Points: entry.Points, Reference: entry.Reference, CreatedAt: entry.CreatedAt, ExpiresAt: entry.ExpiresAt}
+	}
+	jsonResponse(w, http.StatusOK, resp, logger)
+}
+
+// Handles GET /users/{id}/expirations requests, listing when the points the
+// user has left will expire, soonest first, by the receipt that earned them.
+// Points that never expire are not listed.
+func getUserExpirationsHandler(w http.ResponseWriter, r *http.Request, store Store, clock Clock, logger *slog.Logger) {
+	id, ok := userIDFromPath(w, r, logger)
+	if !ok {
+		return
+	}
+	entries, err := store.Ledger(id)
+	if err != nil {
+		logger.Error("Failed to read user ledger", slog.String("user_id", id), slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	type Expiration struct {
+		ReceiptID string    `json:"receiptId"`
+		Points    int64     `json:"points"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	type ExpirationsResponse struct {
+		UserID      string       `json:"userId"`
+		Points      int64        `json:"points"` // total of Expirations
+		Expirations []Expiration `json:"expirations"`
+	}
+	// Credits already past their expiry are left to the expiry job
+	now := clock.Now()
+	resp := ExpirationsResponse{UserID: id, Expirations: []Expiration{}}
+	for _, c := range unspentCredits(entries) {
+		if c.Credit.ExpiresAt.After(now) {
+			resp.Points += c.Remaining
+			resp.Expirations = append(resp.Expirations, Expiration{ReceiptID: c.Credit.ID, Points: c.Remaining, ExpiresAt: c.Credit.ExpiresAt})
+		}
+	}
+	jsonResponse(w, http.StatusOK, resp, logger)
+}
+
+// Handles POST /users/{id}/redeem requests, deducting points from the user's
+// balance if it covers them. The check and the deduction are one atomic
+// store operation, so concurrent redemptions never overdraw the balance.
+// Points that have expired are taken off first, so they cannot be redeemed
+// in the time before the expiry job gets to them.
+func redeemPointsHandler(w http.ResponseWriter, r *http.Request, cfg *Config, store Store, clock Clock, logger *slog.Logger) {
+	id, ok := userIDFromPath(w, r, logger)
+	if !ok {
+		return
+	}
+	type RedeemRequest struct {
+		Points    int64  `json:"points"`
+		Reference string `json:"reference"` // the caller's note, e.g. the order the points paid for
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+	var req RedeemRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		logger.Warn("Failed to decode redemption request", slog.Any("error", err))
+		errorResponse(w, http.StatusBadRequest, invalidRedemptionMsg, logger)
+		return
+	}
+	req.Reference = strings.TrimSpace(req.Reference)
+	if req.Points <= 0 || len(req.Reference) > maxRedemptionReferenceLength {
+		errorResponse(w, http.StatusBadRequest, invalidRedemptionMsg, logger)
+		return
+	}
+
+	now := clock.Now()
+	if cfg.PointsExpiryDays > 0 {
+		if _, err := expirePoints(store, id, now); err != nil {
+			logger.Error("Failed to expire points before redemption", slog.String("user_id", id), slog.Any("error", err))
+			errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+			return
+		}
+	}
+	entry := LedgerEntry{
+		ID:        uuid.NewString(),
+		UserID:    id,
+		Kind:      ledgerRedemption,
+		Points:    -req.Points,
+		Reference: req.Reference,
+		CreatedAt: now,
+	}
+	balance, added, err := store.AddLedgerEntry(entry, true)
+	if err != nil {
+		logger.Error("Failed to redeem points", slog.String("user_id", id), slog.Any("error", err))
+		errorResponse(w, http.StatusInternalServerError, internalErrorMsg, logger)
+		return
+	}
+	if !added {
+		logger.Warn("Redemption exceeds balance", slog.String("user_id", id), slog.Int64("points", req.Points), slog.Int64("balance", balance))
+		errorResponse(w, http.StatusConflict, insufficientPointsMsg, logger)
+		return
+	}
+
+	type RedeemResponse struct {
+		LedgerEntryResponse
+		Balance int64 `json:"balance"`
+	}
+	logger.Info("Points redeemed", slog.String("user_id", id), slog.String("entry_id", entry.ID), slog.Int64("points", req.Points), slog.Int64("balance", balance))
+	jsonResponse(w, http.StatusOK, RedeemResponse{
+		LedgerEntryResponse: LedgerEntryResponse{ID: entry.ID, Kind: entry.Kind, Points: entry.Points, Reference: entry.Reference, CreatedAt: entry.CreatedAt},
+		Balance:             balance,
+	}, logger)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAdjustCredit(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name            string
+		credit          bool    // whether the receipt was credited 28 points
+		userID          string  // who adjustCredit is told the receipt belongs to
+		targets         []int64 // points adjustCredit is called with, in turn
+		wantEarned      int64
+		wantAdjustments []int64 // points of the adjustment entries, in order
+	}{
+		{name: "rescored up", credit: true, userID: "alice", targets: []int64{40}, wantEarned: 40, wantAdjustments: []int64{12}},
+		{name: "removed", credit: true, userID: "alice", targets: []int64{0}, wantEarned: 0, wantAdjustments: []int64{-28}},
+		{name: "unchanged", credit: true, userID: "alice", targets: []int64{28}, wantEarned: 28},
+		{name: "repeated", credit: true, userID: "alice", targets: []int64{40, 40}, wantEarned: 40, wantAdjustments: []int64{12}},
+		{name: "rescored then removed", credit: true, userID: "alice", targets: []int64{40, 10, 0}, wantEarned: 0, wantAdjustments: []int64{12, -30, -10}},
+		{name: "never credited", userID: "alice", targets: []int64{40}},
+		{name: "no user", credit: true, targets: []int64{40}, wantEarned: 28},
+	}
+	for _, backend := range testBackends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				store := backend.open(t)
+				if tt.credit {
+					if _, _, err := store.AddLedgerEntry(LedgerEntry{ID: "receipt-1", UserID: "alice", Kind: ledgerReceipt, Points: 28, CreatedAt: at}, false); err != nil {
+						t.Fatalf("AddLedgerEntry: %v", err)
+					}
+				}
+				for _, points := range tt.targets {
+					if err := adjustCredit(store, tt.userID, "receipt-1", points, at); err != nil {
+						t.Fatalf("adjustCredit(%d): %v", points, err)
+					}
+				}
+
+				balance, err := store.UserBalance("alice")
+				if err != nil {
+					t.Fatalf("UserBalance: %v", err)
+				}
+				if balance.Earned != tt.wantEarned || balance.Points != tt.wantEarned {
+					t.Errorf("earned %d with a balance of %d, want %d", balance.Earned, balance.Points, tt.wantEarned)
+				}
+				entries, err := store.Ledger("alice")
+				if err != nil {
+					t.Fatalf("Ledger: %v", err)
+				}
+				var adjustments []int64
+				for _, entry := range entries {
+					if entry.Kind == ledgerAdjustment {
+						if entry.Reference != "receipt-1" {
+							t.Errorf("adjustment %s references %q, want receipt-1", entry.ID, entry.Reference)
+						}
+						adjustments = append(adjustments, entry.Points)
+					}
+				}
+				if !slices.Equal(adjustments, tt.wantAdjustments) {
+					t.Errorf("adjustments = %v, want %v", adjustments, tt.wantAdjustments)
+				}
+			})
+		}
+	}
+}
+
+func TestRemovedReceiptCredits(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string // empty for the removed receipt's own path
+		body   string
+		status int
+	}{
+		{name: "deleted", method: http.MethodDelete, status: http.StatusNoContent},
+		{name: "purged", method: http.MethodPost, path: "/admin/purge", body: `{"retailer":"Target"}`, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, routerDeps{Config: testConfig(t, map[string]string{"ADMIN_TOKEN": "secret"})})
+			removed := testReceipt()
+			removed.UserID = "alice"
+			id := processReceipt(t, srv, removed)
+			kept := testReceipt()
+			kept.UserID = "alice"
+			kept.Retailer = "Walgreens" // 3 more alphanumeric characters than Target
+			processReceipt(t, srv, kept)
+
+			path := cmp.Or(tt.path, "/receipts/"+id)
+			resp, body := send(t, srv, tt.method, path, tt.body, "Authorization", "Bearer secret")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("%s %s: status %d, body %s", tt.method, path, resp.StatusCode, body)
+			}
+
+			_, body = send(t, srv, http.MethodGet, "/users/alice/points", "")
+			var balance struct{ Points, Earned int64 }
+			decodeBody(t, body, &balance)
+			if want := int64(28 + 3); balance.Points != want || balance.Earned != want {
+				t.Errorf("balance = %+v, want %d points earned and left", balance, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Operations recorded in the write-ahead log.
+const (
+	walSave        = "save"         // Receipt was saved or updated
+	walDelete      = "delete"       // the receipt with ID was removed
+	walCustomer    = "customer"     // RecordCustomerPurchase(Key, At)
+	walRetailerDay = "retailer_day" // ClaimRetailerDay(Key, At) succeeded
+	walFingerprint = "fingerprint"  // ClaimFingerprint(Key, ID, At) succeeded
+
+	walFingerprintRelease = "fingerprint_release" // ReleaseFingerprint(Key, ID)
+
+	walIdempotencyReserve  = "idempotency_reserve"  // ReserveIdempotencyKey at At succeeded with Idempotency
+	walIdempotencyComplete = "idempotency_complete" // CompleteIdempotencyKey(Key, ID)
+	walIdempotencyRelease  = "idempotency_release"  // ReleaseIdempotencyKey(Key)
+
+	walAPIKey = "api_key" // APIKey was saved or updated
+	walLedger = "ledger"  // LedgerEntry was added
+)
+
+// walEntry is one line of the write-ahead log.
+type walEntry struct {
+	Seq     uint64         `json:"seq"`
+	Op      string         `json:"op"`
+	ID      string         `json:"id,omitempty"`
+	Receipt *StoredReceipt `json:"receipt,omitempty"`
+	Key     string         `json:"key,omitempty"`
+	At      time.Time      `json:"at,omitzero"`
+
+	Idempotency *IdempotencyRecord `json:"idempotency,omitempty"`
+	APIKey      *APIKey            `json:"apiKey,omitempty"`
+	LedgerEntry *LedgerEntry       `json:"ledgerEntry,omitempty"`
+}
+
+// walStore records every change to a memoryStore in an append-only log of
+// JSON lines, so changes made since the last snapshot survive a crash. Each
+// entry is numbered; a snapshot notes the last number it includes, and the
+// entries up to it are dropped from the log once the snapshot is on disk.
+//
+// Writes are applied to the memory store and then appended, both under mu,
+// so the log order is the order the changes were made in. Reads go straight
+// to the memory store.
+type walStore struct {
+	*memoryStore
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	fsync  bool   // sync the file after every append
+	seq    uint64 // number of the last entry written
+	logger *slog.Logger
+}
+
+// openWAL replays the log at path into mem, skipping the entries already
+// included in snap, and opens it for appending. The log is created if it
+// does not exist. A partially written last line, left by a crash during an
+// append, is discarded.
+func openWAL(mem *memoryStore, snap memorySnapshot, path string, fsync bool, logger *slog.Logger) (*walStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening write-ahead log: %w", err)
+	}
+	w := &walStore{memoryStore: mem, path: path, file: f, fsync: fsync, seq: snap.WALSeq, logger: logger}
+
+	replayed, good, err := w.replay(f, snap.WALSeq)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if good < end {
+		logger.Warn("Discarding incomplete write-ahead log entry", slog.String("path", path), slog.Int64("bytes", end-good))
+		if err := f.Truncate(good); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("truncating write-ahead log: %w", err)
+		}
+		if _, err := f.Seek(good, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if replayed > 0 {
+		logger.Info("Replayed write-ahead log", slog.String("path", path), slog.Int("entries", replayed))
+	}
+	return w, nil
+}
+
+// replay applies the entries in r numbered after since. It returns how many
+// were applied and the offset just past the last complete line.
+func (w *walStore) replay(r io.Reader, since uint64) (replayed int, good int64, err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return replayed, good, nil // anything in line is a torn write
+		}
+		if err != nil {
+			return replayed, good, fmt.Errorf("reading write-ahead log: %w", err)
+		}
+		var e walEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return replayed, good, fmt.Errorf("decoding write-ahead log entry at offset %d: %w", good, err)
+		}
+		good += int64(len(line))
+		w.seq = max(w.seq, e.Seq)
+		if e.Seq <= since {
+			continue
+		}
+		if err := w.apply(e); err != nil {
+			return replayed, good, fmt.Errorf("applying write-ahead log entry %d: %w", e.Seq, err)
+		}
+		replayed++
+	}
+}
+
+// apply makes the change recorded by e to the memory store.
+func (w *walStore) apply(e walEntry) error {
+	var err error
+	switch e.Op {
+	case walSave:
+		if e.Receipt == nil {
+			return fmt.Errorf("save entry has no receipt")
+		}
+		err = w.memoryStore.Save(*e.Receipt)
+	case walDelete:
+		_, err = w.memoryStore.Delete(e.ID)
+	case walCustomer:
+		_, _, err = w.memoryStore.RecordCustomerPurchase(e.Key, e.At)
+	case walRetailerDay:
+		_, err = w.memoryStore.ClaimRetailerDay(e.Key, e.At)
+	case walFingerprint:
+		// A zero window always succeeds, restoring the claim time
+		_, _, err = w.memoryStore.ClaimFingerprint(e.Key, e.ID, e.At, 0)
+	case walFingerprintRelease:
+		err = w.memoryStore.ReleaseFingerprint(e.Key, e.ID)
+	case walIdempotencyReserve:
+		if e.Idempotency == nil {
+			return fmt.Errorf("reservation entry has no record")
+		}
+		rec := e.Idempotency
+		_, _, err = w.memoryStore.ReserveIdempotencyKey(rec.Key, rec.RequestHash, e.At, rec.ExpiresAt.Sub(e.At))
+	case walIdempotencyComplete:
+		err = w.memoryStore.CompleteIdempotencyKey(e.Key, e.ID)
+	case walIdempotencyRelease:
+		err = w.memoryStore.ReleaseIdempotencyKey(e.Key)
+	case walAPIKey:
+		if e.APIKey == nil {
+			return fmt.Errorf("API key entry has no key")
+		}
+		err = w.memoryStore.SaveAPIKey(*e.APIKey)
+	case walLedger:
+		if e.LedgerEntry == nil {
+			return fmt.Errorf("ledger entry has no entry")
+		}
+		// The balance was checked when the entry was first added
+		_, _, err = w.memoryStore.AddLedgerEntry(*e.LedgerEntry, false)
+	default:
+		return fmt.Errorf("unknown operation %q", e.Op)
+	}
+	return err
+}
+
+// appendEntries numbers and writes entries. Callers must hold mu.
+func (w *walStore) appendEntries(entries ...walEntry) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	seq := w.seq
+	for _, e := range entries {
+		seq++
+		e.Seq = seq
+		if err := enc.Encode(e); err != nil {
+			return fmt.Errorf("encoding write-ahead log entry: %w", err)
+		}
+	}
+	if _, err := w.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("appending to write-ahead log: %w", err)
+	}
+	if w.fsync {
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("syncing write-ahead log: %w", err)
+		}
+	}
+	w.seq = seq
+	return nil
+}
+
+func (w *walStore) Save(rec StoredReceipt) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.memoryStore.Save(rec); err != nil {
+		return err
+	}
+	return w.appendEntries(walEntry{Op: walSave, Receipt: &rec})
+}
+
+func (w *walStore) Update(id string, fn func(*StoredReceipt) error) (StoredReceipt, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rec, found, err := w.memoryStore.Update(id, fn)
+	if err != nil || !found {
+		return rec, found, err
+	}
+	return rec, true, w.appendEntries(walEntry{Op: walSave, Receipt: &rec})
+}
+
+func (w *walStore) Delete(id string) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	found, err := w.memoryStore.Delete(id)
+	if err != nil || !found {
+		return found, err
+	}
+	return true, w.appendEntries(walEntry{Op: walDelete, ID: id})
+}
+
+func (w *walStore) DeleteWhere(pred func(StoredReceipt) bool) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var entries []walEntry
+	deleted, err := w.memoryStore.DeleteWhere(func(rec StoredReceipt) bool {
+		if !pred(rec) {
+			return false
+		}
+		entries = append(entries, walEntry{Op: walDelete, ID: rec.ID})
+		return true
+	})
+	if err != nil || deleted == 0 {
+		return deleted, err
+	}
+	return deleted, w.appendEntries(entries...)
+}
+
+func (w *walStore) RecordCustomerPurchase(customerID string, date time.Time) (time.Time, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	previous, found, err := w.memoryStore.RecordCustomerPurchase(customerID, date)
+	if err != nil {
+		return previous, found, err
+	}
+	return previous, found, w.appendEntries(walEntry{Op: walCustomer, Key: customerID, At: date})
+}
+
+func (w *walStore) ClaimRetailerDay(retailer string, date time.Time) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	claimed, err := w.memoryStore.ClaimRetailerDay(retailer, date)
+	if err != nil || !claimed {
+		return claimed, err
+	}
+	return true, w.appendEntries(walEntry{Op: walRetailerDay, Key: retailer, At: date})
+}
+
+func (w *walStore) ClaimFingerprint(fingerprint, id string, at time.Time, window time.Duration) (string, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	holder, claimed, err := w.memoryStore.ClaimFingerprint(fingerprint, id, at, window)
+	if err != nil || !claimed {
+		return holder, claimed, err
+	}
+	return "", true, w.appendEntries(walEntry{Op: walFingerprint, Key: fingerprint, ID: id, At: at})
+}
+
+func (w *walStore) ReleaseFingerprint(fingerprint, id string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.memoryStore.ReleaseFingerprint(fingerprint, id); err != nil {
+		return err
+	}
+	return w.appendEntries(walEntry{Op: walFingerprintRelease, Key: fingerprint, ID: id})
+}
+
+func (w *walStore) ReserveIdempotencyKey(key, requestHash string, at time.Time, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rec, reserved, err := w.memoryStore.ReserveIdempotencyKey(key, requestHash, at, ttl)
+	if err != nil || !reserved {
+		return rec, reserved, err
+	}
+	return rec, true, w.appendEntries(walEntry{Op: walIdempotencyReserve, At: at, Idempotency: &rec})
+}
+
+func (w *walStore) CompleteIdempotencyKey(key, receiptID string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.memoryStore.CompleteIdempotencyKey(key, receiptID); err != nil {
+		return err
+	}
+	return w.appendEntries(walEntry{Op: walIdempotencyComplete, Key: key, ID: receiptID})
+}
+
+func (w *walStore) ReleaseIdempotencyKey(key string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.memoryStore.ReleaseIdempotencyKey(key); err != nil {
+		return err
+	}
+	return w.appendEntries(walEntry{Op: walIdempotencyRelease, Key: key})
+}
+
+func (w *walStore) SaveAPIKey(key APIKey) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.memoryStore.SaveAPIKey(key); err != nil {
+		return err
+	}
+	return w.appendEntries(walEntry{Op: walAPIKey, APIKey: &key})
+}
+
+func (w *walStore) UpdateAPIKey(id string, fn func(*APIKey) error) (APIKey, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	key, found, err := w.memoryStore.UpdateAPIKey(id, fn)
+	if err != nil || !found {
+		return key, found, err
+	}
+	return key, true, w.appendEntries(walEntry{Op: walAPIKey, APIKey: &key})
+}
+
+func (w *walStore) AddLedgerEntry(entry LedgerEntry, checkBalance bool) (int64, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	balance, added, err := w.memoryStore.AddLedgerEntry(entry, checkBalance)
+	if err != nil || !added {
+		return balance, added, err
+	}
+	return balance, true, w.appendEntries(walEntry{Op: walLedger, LedgerEntry: &entry})
+}
+
+// snapshot copies the memory store while holding mu, so the copy includes
+// exactly the entries up to WALSeq.
+func (w *walStore) snapshot() memorySnapshot {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	snap := w.memoryStore.snapshot()
+	snap.WALSeq = w.seq
+	return snap
+}
+
+// snapshotWritten rewrites the log without the entries included in snap,
+// which is now on disk. Writers wait until the rewrite finishes; the log
+// only holds the changes made since snap was taken, so it is short.
+//
+// The log is read through a handle of its own, so w.file stays at its end
+// and, if the rewrite fails, appends carry on where they left off.
+func (w *walStore) snapshotWritten(snap memorySnapshot) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	src, err := os.Open(w.path)
+	if err != nil {
+		return fmt.Errorf("opening write-ahead log: %w", err)
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating write-ahead log: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	br := bufio.NewReader(src)
+	for {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("reading write-ahead log: %w", err)
+		}
+		var e walEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			tmp.Close()
+			return fmt.Errorf("decoding write-ahead log entry: %w", err)
+		}
+		if e.Seq <= snap.WALSeq {
+			continue
+		}
+		if _, err := tmp.Write(line); err != nil {
+			tmp.Close()
+			return fmt.Errorf("writing write-ahead log: %w", err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing write-ahead log: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		tmp.Close()
+		return fmt.Errorf("replacing write-ahead log: %w", err)
+	}
+	w.file.Close()
+	w.file = tmp // now at w.path, positioned at its end
+	return nil
+}
+
+// Close closes the log file.
+func (w *walStore) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// walSeqs returns the sequence numbers of the entries in the log at path.
+func walSeqs(t *testing.T, path string) []uint64 {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening log: %v", err)
+	}
+	defer f.Close()
+	var seqs []uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e walEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("decoding log line %q: %v", scanner.Text(), err)
+		}
+		seqs = append(seqs, e.Seq)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("reading log: %v", err)
+	}
+	return seqs
+}
+
+func TestWALSnapshotWritten(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     bool // the rewrite cannot create its temporary file
+		wantSeqs []uint64
+	}{
+		{name: "rewritten", wantSeqs: []uint64{3}},
+		// The log is left whole, and later entries still go at its end
+		{name: "rewrite fails", fail: true, wantSeqs: []uint64{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "data")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "receipts.wal")
+			logger := slog.New(slog.DiscardHandler)
+			w, err := openWAL(newMemoryStore(normalizeRetailer), memorySnapshot{}, path, false, logger)
+			if err != nil {
+				t.Fatalf("openWAL: %v", err)
+			}
+			saveAll(t, w, StoredReceipt{ID: "before-snapshot-1", Points: 1}, StoredReceipt{ID: "before-snapshot-2", Points: 2})
+
+			snap := w.snapshot()
+			if tt.fail {
+				// Without its directory the log cannot be rewritten
+				moved := dir + ".moved"
+				if err := os.Rename(dir, moved); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.snapshotWritten(snap); err == nil {
+					t.Error("snapshotWritten succeeded without the log's directory")
+				}
+				if err := os.Rename(moved, dir); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := w.snapshotWritten(snap); err != nil {
+				t.Fatalf("snapshotWritten: %v", err)
+			}
+			saveAll(t, w, StoredReceipt{ID: "after", Points: 3})
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if got := walSeqs(t, path); !slices.Equal(got, tt.wantSeqs) {
+				t.Errorf("log entries = %v, want %v", got, tt.wantSeqs)
+			}
+
+			// Restarting from the snapshot and the log restores every receipt
+			mem := newMemoryStore(normalizeRetailer)
+			mem.restore(snap)
+			reopened, err := openWAL(mem, snap, path, false, logger)
+			if err != nil {
+				t.Fatalf("reopening: %v", err)
+			}
+			defer reopened.Close()
+			ids := []string{"before-snapshot-1", "before-snapshot-2", "after"}
+			if got := storedIDs(t, reopened, ids...); !slices.Equal(got, ids) {
+				t.Errorf("receipts after restart = %v, want %v", got, ids)
+			}
+		})
+	}
+}